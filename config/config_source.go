@@ -15,10 +15,13 @@ import (
 // A ChangeListener is called when configuration changes.
 type ChangeListener = func(*Config)
 
-// A ChangeDispatcher manages listeners on config changes.
+// A ChangeDispatcher manages listeners on config changes. Listeners can report whether they applied a
+// change via the embedded ReloadTracker.
 type ChangeDispatcher struct {
 	sync.Mutex
 	onConfigChangeListeners []ChangeListener
+
+	ReloadTracker
 }
 
 // Trigger triggers a change.
@@ -49,6 +52,8 @@ type StaticSource struct {
 	mu  sync.Mutex
 	cfg *Config
 	lis []ChangeListener
+
+	ReloadTracker
 }
 
 // NewStaticSource creates a new StaticSource.
@@ -17,6 +17,8 @@ type MetricsManager struct {
 	serviceName string
 	addr        string
 	basicAuth   string
+	envoyURL    string
+	envoyPrefix string
 	handler     http.Handler
 }
 
@@ -71,12 +73,25 @@ func (mgr *MetricsManager) updateInfo(cfg *Config) {
 }
 
 func (mgr *MetricsManager) updateServer(cfg *Config) {
-	if cfg.Options.MetricsAddr == mgr.addr && cfg.Options.MetricsBasicAuth == mgr.basicAuth {
+	envoyURL := cfg.Options.GetEnvoyAdminURL()
+	if cfg.Options.EnvoyStatsDisabled {
+		envoyURL = nil
+	}
+	var envoyURLStr string
+	if envoyURL != nil {
+		envoyURLStr = envoyURL.String()
+	}
+	if cfg.Options.MetricsAddr == mgr.addr &&
+		cfg.Options.MetricsBasicAuth == mgr.basicAuth &&
+		envoyURLStr == mgr.envoyURL &&
+		cfg.Options.EnvoyStatsPrefix == mgr.envoyPrefix {
 		return
 	}
 
 	mgr.addr = cfg.Options.MetricsAddr
 	mgr.basicAuth = cfg.Options.MetricsBasicAuth
+	mgr.envoyURL = envoyURLStr
+	mgr.envoyPrefix = cfg.Options.EnvoyStatsPrefix
 	mgr.handler = nil
 
 	if mgr.addr == "" {
@@ -84,7 +99,13 @@ func (mgr *MetricsManager) updateServer(cfg *Config) {
 		return
 	}
 
-	handler, err := metrics.PrometheusHandler(EnvoyAdminURL)
+	if cfg.Options.EnvoyStatsDisabled {
+		log.Warn().Msg("metrics: envoy stats are disabled, envoy metrics will not be available")
+	} else if envoyURL == nil {
+		log.Warn().Msg("metrics: envoy admin interface is disabled, envoy metrics will not be available")
+	}
+
+	handler, err := metrics.PrometheusHandler(envoyURL, cfg.Options.EnvoyStatsPrefix)
 	if err != nil {
 		log.Error().Err(err).Msg("metrics: failed to create prometheus handler")
 		return
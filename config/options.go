@@ -2,15 +2,19 @@ package config
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"crypto/tls"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
+	"regexp"
 	"sort"
 	"strings"
 	"sync/atomic"
@@ -29,6 +33,7 @@ import (
 	"github.com/pomerium/pomerium/internal/log"
 	"github.com/pomerium/pomerium/internal/telemetry"
 	"github.com/pomerium/pomerium/internal/telemetry/metrics"
+	"github.com/pomerium/pomerium/internal/telemetry/trace"
 	"github.com/pomerium/pomerium/internal/urlutil"
 	"github.com/pomerium/pomerium/pkg/cryptutil"
 	"github.com/pomerium/pomerium/pkg/grpc/config"
@@ -202,6 +207,18 @@ type Options struct {
 
 	// Datadog tracing address
 	TracingDatadogAddress string `mapstructure:"tracing_datadog_address" yaml:"tracing_datadog_address,omitempty"`
+	// TracingDatadogConnectTimeout is the connect timeout for the envoy cluster of the Datadog agent. Defaults to 5s.
+	TracingDatadogConnectTimeout time.Duration `mapstructure:"tracing_datadog_connect_timeout" yaml:"tracing_datadog_connect_timeout,omitempty"`
+	// TracingDatadogDNSRefreshRate is how often envoy re-resolves the Datadog agent address when it is a hostname.
+	TracingDatadogDNSRefreshRate time.Duration `mapstructure:"tracing_datadog_dns_refresh_rate" yaml:"tracing_datadog_dns_refresh_rate,omitempty"`
+	// TracingDatadogMaxConnections and TracingDatadogMaxPendingRequests set circuit breaker thresholds for the Datadog agent.
+	TracingDatadogMaxConnections     uint32 `mapstructure:"tracing_datadog_max_connections" yaml:"tracing_datadog_max_connections,omitempty"`
+	TracingDatadogMaxPendingRequests uint32 `mapstructure:"tracing_datadog_max_pending_requests" yaml:"tracing_datadog_max_pending_requests,omitempty"`
+	// TracingDatadogLBPolicy is the load balancing policy for the Datadog agent cluster. Defaults to ROUND_ROBIN.
+	TracingDatadogLBPolicy string `mapstructure:"tracing_datadog_lb_policy" yaml:"tracing_datadog_lb_policy,omitempty"`
+	// TracingProxyAddress is the host:port of an HTTP CONNECT proxy envoy reaches the Datadog agent
+	// through. Only the Datadog agent cluster is proxied, other providers export spans directly.
+	TracingProxyAddress string `mapstructure:"tracing_proxy_address" yaml:"tracing_proxy_address,omitempty"`
 
 	//  Jaeger
 	//
@@ -218,6 +235,21 @@ type Options struct {
 	TracingJaegerAgentEndpoint string `mapstructure:"tracing_jaeger_agent_endpoint" yaml:"tracing_jaeger_agent_endpoint,omitempty"`
 	ZipkinEndpoint             string `mapstructure:"tracing_zipkin_endpoint" yaml:"tracing_zipkin_endpoint"`
 
+	// AWS X-Ray
+	//
+	// TracingXRayDaemonAddress is the host:port of the X-Ray daemon's UDP endpoint. Defaults to 127.0.0.1:2000.
+	// TracingXRaySegmentName is the name of the X-Ray segment. Defaults to the service name.
+	TracingXRayDaemonAddress string `mapstructure:"tracing_xray_daemon_address" yaml:"tracing_xray_daemon_address,omitempty"`
+	TracingXRaySegmentName   string `mapstructure:"tracing_xray_segment_name" yaml:"tracing_xray_segment_name,omitempty"`
+
+	// Lightstep
+	//
+	// TracingLightstepCollectorURL is the URL of the Lightstep collector. Defaults to https://ingest.lightstep.com:443.
+	// The access token is read from TracingLightstepAccessTokenFile, or TracingLightstepAccessToken if no file is set.
+	TracingLightstepCollectorURL    string `mapstructure:"tracing_lightstep_collector_url" yaml:"tracing_lightstep_collector_url,omitempty"`
+	TracingLightstepAccessToken     string `mapstructure:"tracing_lightstep_access_token" yaml:"tracing_lightstep_access_token,omitempty"`
+	TracingLightstepAccessTokenFile string `mapstructure:"tracing_lightstep_access_token_file" yaml:"tracing_lightstep_access_token_file,omitempty"`
+
 	// GRPC Service Settings
 
 	// GRPCAddr specifies the host and port on which the server should serve
@@ -284,6 +316,292 @@ type Options struct {
 	EnvoyAdminAccessLogPath string `mapstructure:"envoy_admin_access_log_path" yaml:"envoy_admin_access_log_path"`
 	EnvoyAdminProfilePath   string `mapstructure:"envoy_admin_profile_path" yaml:"envoy_admin_profile_path"`
 	EnvoyAdminAddress       string `mapstructure:"envoy_admin_address" yaml:"envoy_admin_address"`
+	// EnvoyAdminProfilingEnabled sets envoy's profile path to EnvoyAdminProfilePath. When disabled no
+	// profile path is configured.
+	EnvoyAdminProfilingEnabled bool `mapstructure:"envoy_admin_profiling_enabled" yaml:"envoy_admin_profiling_enabled,omitempty"`
+	// EnvoyAdminAccessLogReopenOnSignal makes pomerium forward SIGUSR1 to envoy so it re-opens its
+	// access logs, for use with external log rotation.
+	EnvoyAdminAccessLogReopenOnSignal bool `mapstructure:"envoy_admin_access_log_reopen_on_signal" yaml:"envoy_admin_access_log_reopen_on_signal,omitempty"`
+	// EnvoyAdminDisabled removes the envoy admin interface entirely. Envoy metrics will not be
+	// included on the metrics endpoint when the admin interface is disabled.
+	EnvoyAdminDisabled bool `mapstructure:"envoy_admin_disabled" yaml:"envoy_admin_disabled,omitempty"`
+
+	// EnvoyStatsDisabled turns off envoy's internal stats and the envoy process metrics to reduce memory
+	// usage. Envoy metrics will not be available.
+	EnvoyStatsDisabled bool `mapstructure:"envoy_stats_disabled" yaml:"envoy_stats_disabled,omitempty"`
+	// EnvoyStatsTags are fixed tags added to every envoy metric. The service and cluster_id tags are
+	// set by pomerium and cannot be overridden.
+	EnvoyStatsTags map[string]string `mapstructure:"envoy_stats_tags" yaml:"envoy_stats_tags,omitempty"`
+	// EnvoyStatsPrefix is prepended to the names of envoy metrics exposed on the metrics address, so the
+	// metrics of multiple instances sharing a namespace don't collide.
+	EnvoyStatsPrefix string `mapstructure:"envoy_stats_prefix" yaml:"envoy_stats_prefix,omitempty"`
+	// EnvoyStatsHistogramBuckets are the upper bounds of the buckets envoy records histogram values in,
+	// replacing envoy's default buckets for every histogram.
+	EnvoyStatsHistogramBuckets []float64 `mapstructure:"envoy_stats_histogram_buckets" yaml:"envoy_stats_histogram_buckets,omitempty"`
+	// EnvoyStatsTagExtractors extract tags from the names of envoy metrics with regular expressions, in
+	// addition to envoy's built-in tag extraction.
+	EnvoyStatsTagExtractors []EnvoyStatsTagExtractor `mapstructure:"envoy_stats_tag_extractors" yaml:"envoy_stats_tag_extractors,omitempty"`
+
+	// EnvoyListenerReusePort sets SO_REUSEPORT on the sockets of envoy's listeners, so each worker
+	// thread gets its own listening socket.
+	EnvoyListenerReusePort bool `mapstructure:"envoy_listener_reuse_port" yaml:"envoy_listener_reuse_port,omitempty"`
+	// EnvoyListenerSocketOptions are socket options set on the sockets of envoy's listeners. Envoy has
+	// no default socket options for listeners, so they're added to every listener pomerium configures.
+	EnvoyListenerSocketOptions []EnvoySocketOption `mapstructure:"envoy_listener_socket_options" yaml:"envoy_listener_socket_options,omitempty"`
+
+	// EnvoyXDSAPIType is the API type envoy uses to talk to the control plane's aggregated discovery service.
+	// Possible options are "DELTA_GRPC" and "GRPC". Defaults to "DELTA_GRPC".
+	EnvoyXDSAPIType string `mapstructure:"envoy_xds_api_type" yaml:"envoy_xds_api_type,omitempty"`
+	// EnvoyBootstrapFormat is the format envoy's bootstrap config file is written in, "json" or "yaml".
+	// Defaults to "json", which is faster to write.
+	EnvoyBootstrapFormat string `mapstructure:"envoy_bootstrap_format" yaml:"envoy_bootstrap_format,omitempty"`
+	// EnvoyXDSInitialFetchTimeout is how long envoy waits for the first listeners and clusters from the
+	// control plane before it finishes initializing without them. It defaults to envoy's default of 15s.
+	EnvoyXDSInitialFetchTimeout time.Duration `mapstructure:"envoy_xds_initial_fetch_timeout" yaml:"envoy_xds_initial_fetch_timeout,omitempty"`
+
+	// EnvoyNodeID and EnvoyNodeCluster identify this envoy instance to the control plane. Both default
+	// to "proxy". The {hostname} placeholder is replaced with the machine's hostname.
+	EnvoyNodeID      string `mapstructure:"envoy_node_id" yaml:"envoy_node_id,omitempty"`
+	EnvoyNodeCluster string `mapstructure:"envoy_node_cluster" yaml:"envoy_node_cluster,omitempty"`
+	// EnvoyNodeMetadata is additional metadata sent to the control plane with the envoy node.
+	EnvoyNodeMetadata map[string]string `mapstructure:"envoy_node_metadata" yaml:"envoy_node_metadata,omitempty"`
+	// EnvoyNodeLocalityRegion, EnvoyNodeLocalityZone and EnvoyNodeLocalitySubZone describe where the envoy node is running.
+	EnvoyNodeLocalityRegion  string `mapstructure:"envoy_node_locality_region" yaml:"envoy_node_locality_region,omitempty"`
+	EnvoyNodeLocalityZone    string `mapstructure:"envoy_node_locality_zone" yaml:"envoy_node_locality_zone,omitempty"`
+	EnvoyNodeLocalitySubZone string `mapstructure:"envoy_node_locality_sub_zone" yaml:"envoy_node_locality_sub_zone,omitempty"`
+
+	// EnvoyRuntime sets envoy runtime keys, such as envoy.reloadable_features flags, in a static
+	// runtime layer. Values must be booleans, numbers or strings.
+	EnvoyRuntime map[string]interface{} `mapstructure:"envoy_runtime" yaml:"envoy_runtime,omitempty"`
+
+	// EnvoyBootstrapClusters are extra clusters, in envoy's cluster format, to add to the static resources
+	// of envoy's bootstrap config, so envoy can reach them before it receives its config from the control
+	// plane.
+	EnvoyBootstrapClusters []map[string]interface{} `mapstructure:"envoy_bootstrap_clusters" yaml:"envoy_bootstrap_clusters,omitempty"`
+
+	// EnvoyAccessLogServiceAddress is the host:port of a gRPC access log service envoy streams access
+	// logs to instead of the control plane. EnvoyAccessLogServiceLogName defaults to "ingress-http".
+	EnvoyAccessLogServiceAddress string `mapstructure:"envoy_access_log_service_address" yaml:"envoy_access_log_service_address,omitempty"`
+	EnvoyAccessLogServiceLogName string `mapstructure:"envoy_access_log_service_log_name" yaml:"envoy_access_log_service_log_name,omitempty"`
+
+	// EnvoyControlPlaneTLS enables TLS for the connection from envoy to the control plane. When enabled
+	// the control plane gRPC listener serves EnvoyControlPlaneServerCertFile and
+	// EnvoyControlPlaneServerKeyFile, which envoy verifies against EnvoyControlPlaneCAFile.
+	// EnvoyControlPlaneCertFile and EnvoyControlPlaneKeyFile can be used to present a client certificate
+	// for mutual TLS, which the control plane then requires and verifies against the same CA.
+	EnvoyControlPlaneTLS            bool   `mapstructure:"envoy_control_plane_tls" yaml:"envoy_control_plane_tls,omitempty"`
+	EnvoyControlPlaneTLSServerName  string `mapstructure:"envoy_control_plane_tls_server_name" yaml:"envoy_control_plane_tls_server_name,omitempty"`
+	EnvoyControlPlaneCAFile         string `mapstructure:"envoy_control_plane_ca_file" yaml:"envoy_control_plane_ca_file,omitempty"`
+	EnvoyControlPlaneServerCertFile string `mapstructure:"envoy_control_plane_server_cert_file" yaml:"envoy_control_plane_server_cert_file,omitempty"`
+	EnvoyControlPlaneServerKeyFile  string `mapstructure:"envoy_control_plane_server_key_file" yaml:"envoy_control_plane_server_key_file,omitempty"`
+	EnvoyControlPlaneCertFile       string `mapstructure:"envoy_control_plane_cert_file" yaml:"envoy_control_plane_cert_file,omitempty"`
+	EnvoyControlPlaneKeyFile        string `mapstructure:"envoy_control_plane_key_file" yaml:"envoy_control_plane_key_file,omitempty"`
+
+	// EnvoyControlPlaneKeepaliveInterval and EnvoyControlPlaneKeepaliveTimeout configure HTTP/2 PING based
+	// keepalive on envoy's connection to the control plane, so that stalled connections are detected and
+	// re-established. They default to 30s and 5s respectively.
+	EnvoyControlPlaneKeepaliveInterval time.Duration `mapstructure:"envoy_control_plane_keepalive_interval" yaml:"envoy_control_plane_keepalive_interval,omitempty"` //nolint
+	EnvoyControlPlaneKeepaliveTimeout  time.Duration `mapstructure:"envoy_control_plane_keepalive_timeout" yaml:"envoy_control_plane_keepalive_timeout,omitempty"`
+	// EnvoyControlPlaneTCPKeepaliveProbes, EnvoyControlPlaneTCPKeepaliveTime and
+	// EnvoyControlPlaneTCPKeepaliveInterval enable TCP keepalive on envoy's connection to the control
+	// plane. Unset values use the operating system defaults. The durations have a resolution of 1s.
+	EnvoyControlPlaneTCPKeepaliveProbes   uint32        `mapstructure:"envoy_control_plane_tcp_keepalive_probes" yaml:"envoy_control_plane_tcp_keepalive_probes,omitempty"`     //nolint
+	EnvoyControlPlaneTCPKeepaliveTime     time.Duration `mapstructure:"envoy_control_plane_tcp_keepalive_time" yaml:"envoy_control_plane_tcp_keepalive_time,omitempty"`         //nolint
+	EnvoyControlPlaneTCPKeepaliveInterval time.Duration `mapstructure:"envoy_control_plane_tcp_keepalive_interval" yaml:"envoy_control_plane_tcp_keepalive_interval,omitempty"` //nolint
+
+	// EnvoyControlPlaneLBPolicy is the load balancing policy for envoy's control plane cluster. Defaults
+	// to ROUND_ROBIN.
+	EnvoyControlPlaneLBPolicy string `mapstructure:"envoy_control_plane_lb_policy" yaml:"envoy_control_plane_lb_policy,omitempty"`
+
+	// EnvoyControlPlaneMaxConnections, EnvoyControlPlaneMaxPendingRequests and EnvoyControlPlaneMaxRequests
+	// set circuit breaker thresholds for envoy's control plane cluster. Unset values use envoy's defaults.
+	EnvoyControlPlaneMaxConnections     uint32 `mapstructure:"envoy_control_plane_max_connections" yaml:"envoy_control_plane_max_connections,omitempty"`
+	EnvoyControlPlaneMaxPendingRequests uint32 `mapstructure:"envoy_control_plane_max_pending_requests" yaml:"envoy_control_plane_max_pending_requests,omitempty"`
+	EnvoyControlPlaneMaxRequests        uint32 `mapstructure:"envoy_control_plane_max_requests" yaml:"envoy_control_plane_max_requests,omitempty"`
+
+	// EnvoyEnvironment are additional environment variables set on the envoy process. They take
+	// precedence over any variables with the same name inherited from pomerium's environment.
+	EnvoyEnvironment map[string]string `mapstructure:"envoy_environment" yaml:"envoy_environment,omitempty"`
+
+	// EnvoyRunAsUID and EnvoyRunAsGID run the envoy process as a different user and group than
+	// pomerium. Both must be set, and pomerium must have the privilege to change credentials.
+	EnvoyRunAsUID uint32 `mapstructure:"envoy_run_as_uid" yaml:"envoy_run_as_uid,omitempty"`
+	EnvoyRunAsGID uint32 `mapstructure:"envoy_run_as_gid" yaml:"envoy_run_as_gid,omitempty"`
+
+	// EnvoyNiceness is the niceness envoy's CPU scheduling priority is set to, from -20 (highest
+	// priority) to 19 (lowest). When it's 0 envoy has pomerium's niceness. It's only supported on linux.
+	EnvoyNiceness int `mapstructure:"envoy_niceness" yaml:"envoy_niceness,omitempty"`
+
+	// EnvoyCPUSet restricts envoy to a set of cpus, in the kernel's list format such as 0-3,6. When
+	// it's empty envoy may run on any cpu pomerium may run on. It's only supported on linux.
+	EnvoyCPUSet string `mapstructure:"envoy_cpuset" yaml:"envoy_cpuset,omitempty"`
+
+	// EnvoyExtraArgs are additional command line arguments passed to envoy. Arguments managed by
+	// pomerium, such as the config path, base id and log level, cannot be overridden.
+	EnvoyExtraArgs []string `mapstructure:"envoy_extra_args" yaml:"envoy_extra_args,omitempty"`
+
+	// EnvoyDisableHotRestart makes config changes stop the running envoy process before starting a new
+	// one, rather than hot restarting envoy. This causes brief downtime on every reload.
+	EnvoyDisableHotRestart bool `mapstructure:"envoy_disable_hot_restart" yaml:"envoy_disable_hot_restart,omitempty"`
+	// EnvoyDrainStrategy and EnvoyDrainTime set envoy's --drain-strategy and --drain-time-s, which control
+	// how the previous envoy process drains its connections on a hot restart.
+	EnvoyDrainStrategy string        `mapstructure:"envoy_drain_strategy" yaml:"envoy_drain_strategy,omitempty"`
+	EnvoyDrainTime     time.Duration `mapstructure:"envoy_drain_time" yaml:"envoy_drain_time,omitempty"`
+	// EnvoyRestartEpochStart is the restart epoch of an envoy process started from scratch, and each hot
+	// restart has the next epoch. When EnvoyRestartEpochMax is set, a hot restart beyond it is replaced by
+	// a full restart, with a fresh base id unless EnvoyRestartEpochStart is set: envoy only accepts a
+	// non-zero restart epoch with an explicit base id, so the one persisted in the working directory is
+	// used.
+	EnvoyRestartEpochStart int `mapstructure:"envoy_restart_epoch_start" yaml:"envoy_restart_epoch_start,omitempty"`
+	EnvoyRestartEpochMax   int `mapstructure:"envoy_restart_epoch_max" yaml:"envoy_restart_epoch_max,omitempty"`
+	// EnvoyRestartOnBinaryChange makes pomerium check the envoy binary whenever it starts envoy. If the
+	// binary was replaced since the running envoy was started, envoy is fully restarted with the new
+	// binary rather than hot restarted.
+	EnvoyRestartOnBinaryChange bool `mapstructure:"envoy_restart_on_binary_change" yaml:"envoy_restart_on_binary_change,omitempty"`
+
+	// EnvoyShutdownTimeout is how long envoy has to drain its connections and exit when pomerium shuts
+	// down, before it's killed. The default is 30s.
+	EnvoyShutdownTimeout time.Duration `mapstructure:"envoy_shutdown_timeout" yaml:"envoy_shutdown_timeout,omitempty"`
+
+	// EnvoyDrainWatchInterval is how often the envoy server state is polled to detect envoy draining
+	// unexpectedly. The default is 10s.
+	EnvoyDrainWatchInterval time.Duration `mapstructure:"envoy_drain_watch_interval" yaml:"envoy_drain_watch_interval,omitempty"`
+
+	// EnvoyWarmUpPeriod is how long a new envoy process has to stay up before it replaces the previous
+	// one. The default is 1s.
+	EnvoyWarmUpPeriod time.Duration `mapstructure:"envoy_warm_up_period" yaml:"envoy_warm_up_period,omitempty"`
+
+	// EnvoyWarmUpTimeout is how long a new envoy process is waited for to become live after a
+	// hot-restart, before the previous process is released. Zero disables waiting.
+	EnvoyWarmUpTimeout time.Duration `mapstructure:"envoy_warm_up_timeout" yaml:"envoy_warm_up_timeout,omitempty"`
+
+	// EnvoyDNSResolvers are the addresses (ip or ip:port) of DNS servers used to resolve the hostnames
+	// of clusters in envoy's bootstrap configuration. If empty the system resolver is used.
+	EnvoyDNSResolvers []string `mapstructure:"envoy_dns_resolvers" yaml:"envoy_dns_resolvers,omitempty"`
+	// EnvoyDNSUseTCP makes envoy use TCP instead of UDP for DNS lookups.
+	EnvoyDNSUseTCP bool `mapstructure:"envoy_dns_use_tcp" yaml:"envoy_dns_use_tcp,omitempty"`
+
+	// EnvoyClusterBufferLimitBytes is the per-connection buffer limit of the clusters in envoy's bootstrap
+	// configuration. Clusters the control plane sends envoy aren't affected. If zero envoy's default is
+	// used.
+	EnvoyClusterBufferLimitBytes uint32 `mapstructure:"envoy_cluster_buffer_limit_bytes" yaml:"envoy_cluster_buffer_limit_bytes,omitempty"`
+
+	// EnvoyOverloadMaxHeapSizeBytes enables envoy's overload manager with a heap size resource monitor.
+	// Once heap usage reaches the stop accepting connections and stop accepting requests thresholds,
+	// expressed as a fraction of the max heap size, envoy starts shedding load.
+	EnvoyOverloadMaxHeapSizeBytes                  uint64  `mapstructure:"envoy_overload_max_heap_size_bytes" yaml:"envoy_overload_max_heap_size_bytes,omitempty"`
+	EnvoyOverloadStopAcceptingConnectionsThreshold float64 `mapstructure:"envoy_overload_stop_accepting_connections_threshold" yaml:"envoy_overload_stop_accepting_connections_threshold,omitempty"` //nolint
+	EnvoyOverloadStopAcceptingRequestsThreshold    float64 `mapstructure:"envoy_overload_stop_accepting_requests_threshold" yaml:"envoy_overload_stop_accepting_requests_threshold,omitempty"`       //nolint
+
+	// EnvoyGlobalDownstreamMaxConnections limits the total number of downstream connections envoy
+	// accepts across all listeners. Once the limit is reached new connections are rejected.
+	EnvoyGlobalDownstreamMaxConnections uint64 `mapstructure:"envoy_global_downstream_max_connections" yaml:"envoy_global_downstream_max_connections,omitempty"`
+
+	// EnvoyLogQueueSize enables writing envoy logs from a separate goroutine through a queue of
+	// this size. When the queue is full log lines are dropped rather than blocking envoy.
+	EnvoyLogQueueSize int `mapstructure:"envoy_log_queue_size" yaml:"envoy_log_queue_size,omitempty"`
+	// EnvoyLogReadBufferSize is the size in bytes of the buffer envoy's output is read into. It
+	// defaults to 4096.
+	EnvoyLogReadBufferSize int `mapstructure:"envoy_log_read_buffer_size" yaml:"envoy_log_read_buffer_size,omitempty"`
+	// EnvoyLogDeduplicate collapses consecutive identical envoy log lines into a single line, with
+	// the number of repeats logged every EnvoyLogDeduplicateInterval. The interval defaults to 5s.
+	EnvoyLogDeduplicate         bool          `mapstructure:"envoy_log_deduplicate" yaml:"envoy_log_deduplicate,omitempty"`
+	EnvoyLogDeduplicateInterval time.Duration `mapstructure:"envoy_log_deduplicate_interval" yaml:"envoy_log_deduplicate_interval,omitempty"`
+	// EnvoyLogRedactPatterns are regular expressions for sensitive values to redact from envoy logs, in
+	// addition to the built-in bearer token and cookie patterns. If a pattern has a capture group only
+	// the first group is redacted, otherwise the whole match is.
+	EnvoyLogRedactPatterns []string `mapstructure:"envoy_log_redact_patterns" yaml:"envoy_log_redact_patterns,omitempty"`
+	// EnvoyLogFormat overrides the format envoy writes its logs in. When set envoy log lines are
+	// written as-is rather than parsed into structured fields.
+	EnvoyLogFormat string `mapstructure:"envoy_log_format" yaml:"envoy_log_format,omitempty"`
+	// EnvoyLogFile is the path of a file to write envoy's log lines to as-is, before they're parsed or
+	// redacted. Once the file reaches EnvoyLogFileMaxSize bytes it's rotated, keeping
+	// EnvoyLogFileMaxBackups old files, or none when it's 0. They default to 100MiB and 3. When
+	// EnvoyLogFileOnly is set envoy log lines are only written to the file and not to pomerium's log.
+	EnvoyLogFile           string `mapstructure:"envoy_log_file" yaml:"envoy_log_file,omitempty"`
+	EnvoyLogFileMaxSize    int64  `mapstructure:"envoy_log_file_max_size" yaml:"envoy_log_file_max_size,omitempty"`
+	EnvoyLogFileMaxBackups int    `mapstructure:"envoy_log_file_max_backups" yaml:"envoy_log_file_max_backups"`
+	EnvoyLogFileOnly       bool   `mapstructure:"envoy_log_file_only" yaml:"envoy_log_file_only,omitempty"`
+	// EnvoyLogPath is the path of a file envoy writes its logs to itself, with --log-path, instead of
+	// them being read and written to pomerium's log.
+	EnvoyLogPath string `mapstructure:"envoy_log_path" yaml:"envoy_log_path,omitempty"`
+
+	// EnvoyFileFlushInterval sets envoy's --file-flush-interval-msec, how often envoy flushes the files it
+	// writes, such as access logs. If zero envoy's default is used.
+	EnvoyFileFlushInterval time.Duration `mapstructure:"envoy_file_flush_interval" yaml:"envoy_file_flush_interval,omitempty"`
+
+	// EnvoyPIDFile is the path of a file to write the envoy process id to.
+	EnvoyPIDFile string `mapstructure:"envoy_pid_file" yaml:"envoy_pid_file,omitempty"`
+
+	// EnvoyCleanupOnClose removes the generated envoy config file, and the base id file if pomerium
+	// created it, when envoy is stopped.
+	EnvoyCleanupOnClose bool `mapstructure:"envoy_cleanup_on_close" yaml:"envoy_cleanup_on_close,omitempty"`
+
+	// EnvoyWorkingDirectory is the directory envoy runs in, where its config and hot restart base id are
+	// written. It defaults to a directory in the system temporary directory.
+	EnvoyWorkingDirectory string `mapstructure:"envoy_working_directory" yaml:"envoy_working_directory,omitempty"`
+
+	// EnvoyConfigDumpPath is the path of a file to write a copy of the envoy bootstrap config to on
+	// every reload. It's only for debugging, envoy doesn't read it.
+	EnvoyConfigDumpPath string `mapstructure:"envoy_config_dump_path" yaml:"envoy_config_dump_path,omitempty"`
+
+	// EnvoyConfigHistory is the number of envoy bootstrap configs to keep. When it's set each config is
+	// written to its own timestamped subdirectory of the working directory, rather than replacing the
+	// previous config, and the oldest subdirectories are removed.
+	EnvoyConfigHistory int `mapstructure:"envoy_config_history" yaml:"envoy_config_history,omitempty"`
+
+	// EnvoyUnchangedReloadWarnThreshold is how many config reloads without changes to the envoy config
+	// there can be in a minute before a warning is logged. If zero it defaults to 10.
+	EnvoyUnchangedReloadWarnThreshold int `mapstructure:"envoy_unchanged_reload_warn_threshold" yaml:"envoy_unchanged_reload_warn_threshold,omitempty"`
+
+	// EnvoyHealthCheckAddress is the address of a listener which envoy answers health checks on directly,
+	// at EnvoyHealthCheckPath. The listener is disabled if the address is empty.
+	EnvoyHealthCheckAddress string `mapstructure:"envoy_health_check_address" yaml:"envoy_health_check_address,omitempty"`
+	EnvoyHealthCheckPath    string `mapstructure:"envoy_health_check_path" yaml:"envoy_health_check_path,omitempty"`
+
+	// EnvoyStatsAddress is the address of a listener which serves envoy's prometheus stats from the admin
+	// interface, without exposing the rest of it. The listener is disabled if the address is empty.
+	EnvoyStatsAddress string `mapstructure:"envoy_stats_address" yaml:"envoy_stats_address,omitempty"`
+
+	// EnvoyBinaryURL is a URL to download the envoy binary from when no embedded or system envoy
+	// binary is available. The downloaded binary must match the sha256 EnvoyBinaryChecksum.
+	EnvoyBinaryURL      string `mapstructure:"envoy_binary_url" yaml:"envoy_binary_url,omitempty"`
+	EnvoyBinaryChecksum string `mapstructure:"envoy_binary_checksum" yaml:"envoy_binary_checksum,omitempty"`
+	// EnvoyBinaryPath is the path to an envoy binary to use instead of the embedded or system one. If
+	// EnvoyBinaryChecksum is set the binary must match it.
+	EnvoyBinaryPath string `mapstructure:"envoy_binary_path" yaml:"envoy_binary_path,omitempty"`
+	// EnvoyEmbeddedBinaryDisabled skips extracting the embedded envoy binary, so a binary on the PATH is
+	// used. If EnvoyBinaryChecksum is set the binary must match it.
+	EnvoyEmbeddedBinaryDisabled bool `mapstructure:"envoy_embedded_binary_disabled" yaml:"envoy_embedded_binary_disabled,omitempty"`
+
+	// EnvoyAllowUnverifiedBinary silences the warning logged when pomerium was built without an
+	// envoy checksum, for development builds. EnvoyRequireVerifiedBinary makes it an error instead.
+	EnvoyAllowUnverifiedBinary bool `mapstructure:"envoy_allow_unverified_binary" yaml:"envoy_allow_unverified_binary,omitempty"`
+	EnvoyRequireVerifiedBinary bool `mapstructure:"envoy_require_verified_binary" yaml:"envoy_require_verified_binary,omitempty"`
+
+	// EnvoyAllowUnsupportedVersion allows envoy binaries older than the minimum supported version to be
+	// used, with a warning.
+	EnvoyAllowUnsupportedVersion bool `mapstructure:"envoy_allow_unsupported_version" yaml:"envoy_allow_unsupported_version,omitempty"`
+	// EnvoyStrictCompatibility fails config changes which generate a bootstrap config using features the
+	// envoy version doesn't support, instead of logging a warning.
+	EnvoyStrictCompatibility bool `mapstructure:"envoy_strict_compatibility" yaml:"envoy_strict_compatibility,omitempty"`
+}
+
+// An EnvoyStatsTagExtractor extracts a tag from the names of envoy metrics with a regular expression.
+type EnvoyStatsTagExtractor struct {
+	Name  string `mapstructure:"name" yaml:"name,omitempty"`
+	Regex string `mapstructure:"regex" yaml:"regex,omitempty"`
+}
+
+// An EnvoySocketOption is a socket option set with setsockopt. The level and name are the platform's
+// numeric values.
+type EnvoySocketOption struct {
+	Description string `mapstructure:"description" yaml:"description,omitempty"`
+	Level       int64  `mapstructure:"level" yaml:"level,omitempty"`
+	Name        int64  `mapstructure:"name" yaml:"name,omitempty"`
+	IntValue    int64  `mapstructure:"int_value" yaml:"int_value,omitempty"`
+	// State is the state of the socket the option is set in: prebind (the default), bound or listening.
+	State string `mapstructure:"state" yaml:"state,omitempty"`
 }
 
 type certificateFilePair struct {
@@ -331,6 +649,7 @@ var defaultOptions = Options{
 	EnvoyAdminAccessLogPath: os.DevNull,
 	EnvoyAdminProfilePath:   os.DevNull,
 	EnvoyAdminAddress:       "127.0.0.1:9901",
+	EnvoyLogFileMaxBackups:  3,
 }
 
 // NewDefaultOptions returns a copy the default options. It's the caller's
@@ -698,6 +1017,293 @@ func (o *Options) Validate() error {
 		return fmt.Errorf("config: %w", err)
 	}
 
+	if err := ValidateTracingProvider(o.TracingProvider); err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+
+	if o.EnvoyLogQueueSize < 0 {
+		return errors.New("config: envoy_log_queue_size must not be negative")
+	}
+	if o.EnvoyLogReadBufferSize < 0 {
+		return errors.New("config: envoy_log_read_buffer_size must not be negative")
+	}
+	if o.EnvoyLogDeduplicateInterval < 0 {
+		return errors.New("config: envoy_log_deduplicate_interval must not be negative")
+	}
+	for _, pattern := range o.EnvoyLogRedactPatterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("config: invalid envoy_log_redact_patterns entry %s: %w", pattern, err)
+		}
+	}
+	if o.EnvoyLogFileMaxSize < 0 {
+		return errors.New("config: envoy_log_file_max_size must not be negative")
+	}
+	if o.EnvoyLogFileMaxBackups < 0 {
+		return errors.New("config: envoy_log_file_max_backups must not be negative")
+	}
+	if o.EnvoyLogFileOnly && o.EnvoyLogFile == "" {
+		return errors.New("config: envoy_log_file_only requires envoy_log_file")
+	}
+	if o.EnvoyLogPath != "" && !filepath.IsAbs(o.EnvoyLogPath) {
+		return errors.New("config: envoy_log_path must be an absolute path")
+	}
+	if o.EnvoyLogPath != "" && o.EnvoyLogFile != "" {
+		return errors.New("config: envoy_log_path and envoy_log_file are mutually exclusive")
+	}
+	if o.EnvoyFileFlushInterval != 0 && o.EnvoyFileFlushInterval < time.Millisecond {
+		return errors.New("config: envoy_file_flush_interval must be at least 1ms")
+	}
+	if o.EnvoyFileFlushInterval != 0 && EnvoyExtraArgsContain(o.EnvoyExtraArgs, "--file-flush-interval-msec") {
+		return errors.New("config: envoy_file_flush_interval and --file-flush-interval-msec in envoy_extra_args are mutually exclusive")
+	}
+	if o.EnvoyConfigHistory < 0 {
+		return errors.New("config: envoy_config_history must not be negative")
+	}
+	if o.EnvoyUnchangedReloadWarnThreshold < 0 {
+		return errors.New("config: envoy_unchanged_reload_warn_threshold must not be negative")
+	}
+
+	if o.TracingDatadogConnectTimeout < 0 {
+		return errors.New("config: tracing_datadog_connect_timeout must not be negative")
+	}
+	if o.TracingDatadogDNSRefreshRate < 0 {
+		return errors.New("config: tracing_datadog_dns_refresh_rate must not be negative")
+	}
+	if o.TracingProxyAddress != "" {
+		if o.TracingProvider != trace.DatadogTracingProviderName {
+			return errors.New("config: tracing_proxy_address is only supported by the datadog tracing provider")
+		}
+		if _, _, err := net.SplitHostPort(o.TracingProxyAddress); err != nil {
+			return fmt.Errorf("config: invalid tracing_proxy_address %s: %w", o.TracingProxyAddress, err)
+		}
+	}
+
+	if o.TracingXRayDaemonAddress != "" {
+		if _, _, err := net.SplitHostPort(o.TracingXRayDaemonAddress); err != nil {
+			return fmt.Errorf("config: invalid tracing_xray_daemon_address %s: %w", o.TracingXRayDaemonAddress, err)
+		}
+	}
+
+	if err := ValidateXDSAPIType(o.EnvoyXDSAPIType); err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	if err := ValidateBootstrapFormat(o.EnvoyBootstrapFormat); err != nil {
+		return fmt.Errorf("config: envoy_bootstrap_format: %w", err)
+	}
+	if o.EnvoyXDSInitialFetchTimeout < 0 {
+		return errors.New("config: envoy_xds_initial_fetch_timeout must not be negative")
+	}
+
+	if o.EnvoyStatsPrefix != "" {
+		if err := ValidateEnvoyStatsPrefix(o.EnvoyStatsPrefix); err != nil {
+			return fmt.Errorf("config: envoy_stats_prefix: %w", err)
+		}
+	}
+	for name := range o.EnvoyStatsTags {
+		if err := ValidateEnvoyStatsTagName(name); err != nil {
+			return fmt.Errorf("config: envoy_stats_tags: %w", err)
+		}
+	}
+	if err := ValidateEnvoyHistogramBuckets(o.EnvoyStatsHistogramBuckets); err != nil {
+		return fmt.Errorf("config: envoy_stats_histogram_buckets: %w", err)
+	}
+	tagExtractorNames := make(map[string]bool, len(o.EnvoyStatsTagExtractors))
+	for _, extractor := range o.EnvoyStatsTagExtractors {
+		if err := ValidateEnvoyStatsTagName(extractor.Name); err != nil {
+			return fmt.Errorf("config: envoy_stats_tag_extractors: %w", err)
+		}
+		if _, ok := o.EnvoyStatsTags[extractor.Name]; ok || tagExtractorNames[extractor.Name] {
+			return fmt.Errorf("config: envoy_stats_tag_extractors: duplicate tag %s", extractor.Name)
+		}
+		tagExtractorNames[extractor.Name] = true
+		if err := ValidateEnvoyStatsTagRegex(extractor.Regex); err != nil {
+			return fmt.Errorf("config: envoy_stats_tag_extractors: %s: %w", extractor.Name, err)
+		}
+	}
+
+	for _, opt := range o.EnvoyListenerSocketOptions {
+		if err := ValidateEnvoySocketOption(opt); err != nil {
+			return fmt.Errorf("config: envoy_listener_socket_options: %w", err)
+		}
+	}
+
+	if err := ValidateLBPolicy(o.EnvoyControlPlaneLBPolicy); err != nil {
+		return fmt.Errorf("config: envoy_control_plane_lb_policy: %w", err)
+	}
+	if err := ValidateLBPolicy(o.TracingDatadogLBPolicy); err != nil {
+		return fmt.Errorf("config: tracing_datadog_lb_policy: %w", err)
+	}
+
+	if !o.EnvoyAdminDisabled {
+		if err := ValidateEnvoyAdminAddress(o.EnvoyAdminAddress); err != nil {
+			return fmt.Errorf("config: envoy_admin_address: %w", err)
+		}
+	}
+
+	if o.EnvoyControlPlaneTLS {
+		if o.EnvoyControlPlaneCAFile == "" {
+			return errors.New("config: envoy_control_plane_tls requires envoy_control_plane_ca_file")
+		}
+		if _, err := os.Stat(o.EnvoyControlPlaneCAFile); err != nil {
+			return fmt.Errorf("config: bad envoy control plane ca file: %w", err)
+		}
+		if o.EnvoyControlPlaneServerCertFile == "" || o.EnvoyControlPlaneServerKeyFile == "" {
+			return errors.New("config: envoy_control_plane_tls requires envoy_control_plane_server_cert_file and envoy_control_plane_server_key_file")
+		}
+		if _, err := cryptutil.CertificateFromFile(o.EnvoyControlPlaneServerCertFile, o.EnvoyControlPlaneServerKeyFile); err != nil {
+			return fmt.Errorf("config: bad envoy control plane server cert file: %w", err)
+		}
+		if (o.EnvoyControlPlaneCertFile == "") != (o.EnvoyControlPlaneKeyFile == "") {
+			return errors.New("config: envoy_control_plane_cert_file and envoy_control_plane_key_file must be set together")
+		}
+		if o.EnvoyControlPlaneCertFile != "" {
+			if _, err := cryptutil.CertificateFromFile(o.EnvoyControlPlaneCertFile, o.EnvoyControlPlaneKeyFile); err != nil {
+				return fmt.Errorf("config: bad envoy control plane cert file: %w", err)
+			}
+		}
+	}
+
+	if err := ValidateEnvoyExtraArgs(o.EnvoyExtraArgs); err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+
+	if err := ValidateDrainStrategy(o.EnvoyDrainStrategy); err != nil {
+		return fmt.Errorf("config: envoy_drain_strategy: %w", err)
+	}
+	if o.EnvoyDrainStrategy != "" && EnvoyExtraArgsContain(o.EnvoyExtraArgs, "--drain-strategy") {
+		return errors.New("config: envoy_drain_strategy and --drain-strategy in envoy_extra_args are mutually exclusive")
+	}
+	if o.EnvoyDrainTime != 0 && o.EnvoyDrainTime < time.Second {
+		return errors.New("config: envoy_drain_time must be at least 1s")
+	}
+	if o.EnvoyDrainTime != 0 && EnvoyExtraArgsContain(o.EnvoyExtraArgs, "--drain-time-s") {
+		return errors.New("config: envoy_drain_time and --drain-time-s in envoy_extra_args are mutually exclusive")
+	}
+
+	for _, resolver := range o.EnvoyDNSResolvers {
+		if err := ValidateDNSResolverAddress(resolver); err != nil {
+			return fmt.Errorf("config: invalid envoy_dns_resolvers entry %s: %w", resolver, err)
+		}
+	}
+
+	if o.EnvoyAccessLogServiceAddress != "" {
+		if _, _, err := net.SplitHostPort(o.EnvoyAccessLogServiceAddress); err != nil {
+			return fmt.Errorf("config: invalid envoy_access_log_service_address %s: %w", o.EnvoyAccessLogServiceAddress, err)
+		}
+	}
+
+	if _, err := ParseEnvoyBootstrapClusters(o.EnvoyBootstrapClusters); err != nil {
+		return fmt.Errorf("config: invalid envoy_bootstrap_clusters: %w", err)
+	}
+
+	for key, value := range o.EnvoyRuntime {
+		if err := ValidateEnvoyRuntimeValue(value); err != nil {
+			return fmt.Errorf("config: invalid envoy_runtime value for %s: %w", key, err)
+		}
+	}
+	if _, ok := o.EnvoyRuntime[EnvoyGlobalDownstreamMaxConnectionsRuntimeKey]; ok && o.EnvoyGlobalDownstreamMaxConnections > 0 {
+		return fmt.Errorf("config: envoy_global_downstream_max_connections and the %s envoy_runtime key are mutually exclusive",
+			EnvoyGlobalDownstreamMaxConnectionsRuntimeKey)
+	}
+
+	for name, threshold := range map[string]float64{
+		"envoy_overload_stop_accepting_connections_threshold": o.EnvoyOverloadStopAcceptingConnectionsThreshold,
+		"envoy_overload_stop_accepting_requests_threshold":    o.EnvoyOverloadStopAcceptingRequestsThreshold,
+	} {
+		if threshold < 0 || threshold > 1 {
+			return fmt.Errorf("config: %s must be between 0 and 1", name)
+		}
+	}
+
+	if o.EnvoyBinaryURL != "" {
+		if _, err := urlutil.ParseAndValidateURL(o.EnvoyBinaryURL); err != nil {
+			return fmt.Errorf("config: bad envoy_binary_url %s : %w", o.EnvoyBinaryURL, err)
+		}
+		if bs, err := hex.DecodeString(o.EnvoyBinaryChecksum); err != nil || len(bs) != sha256.Size {
+			return errors.New("config: envoy_binary_url requires a hex encoded sha256 envoy_binary_checksum")
+		}
+	}
+
+	if o.EnvoyBinaryPath != "" {
+		if o.EnvoyBinaryURL != "" {
+			return errors.New("config: envoy_binary_path and envoy_binary_url are mutually exclusive")
+		}
+	}
+	if (o.EnvoyBinaryPath != "" || o.EnvoyEmbeddedBinaryDisabled) && o.EnvoyBinaryChecksum != "" {
+		if bs, err := hex.DecodeString(o.EnvoyBinaryChecksum); err != nil || len(bs) != sha256.Size {
+			return errors.New("config: envoy_binary_checksum must be a hex encoded sha256 checksum")
+		}
+	}
+
+	if (o.EnvoyRunAsUID == 0) != (o.EnvoyRunAsGID == 0) {
+		return errors.New("config: envoy_run_as_uid and envoy_run_as_gid must be set together")
+	}
+
+	if o.EnvoyNiceness < -20 || o.EnvoyNiceness > 19 {
+		return errors.New("config: envoy_niceness must be between -20 and 19")
+	}
+
+	if o.EnvoyCPUSet != "" {
+		if _, err := ParseCPUSet(o.EnvoyCPUSet); err != nil {
+			return fmt.Errorf("config: invalid envoy_cpuset: %w", err)
+		}
+	}
+
+	if o.EnvoyAllowUnverifiedBinary && o.EnvoyRequireVerifiedBinary {
+		return errors.New("config: envoy_allow_unverified_binary and envoy_require_verified_binary are mutually exclusive")
+	}
+
+	if o.EnvoyControlPlaneKeepaliveInterval < 0 {
+		return errors.New("config: envoy_control_plane_keepalive_interval must not be negative")
+	}
+	if o.EnvoyControlPlaneKeepaliveTimeout < 0 {
+		return errors.New("config: envoy_control_plane_keepalive_timeout must not be negative")
+	}
+	if o.EnvoyControlPlaneTCPKeepaliveTime != 0 && o.EnvoyControlPlaneTCPKeepaliveTime < time.Second {
+		return errors.New("config: envoy_control_plane_tcp_keepalive_time must be at least 1s")
+	}
+	if o.EnvoyControlPlaneTCPKeepaliveInterval != 0 && o.EnvoyControlPlaneTCPKeepaliveInterval < time.Second {
+		return errors.New("config: envoy_control_plane_tcp_keepalive_interval must be at least 1s")
+	}
+	if o.EnvoyRestartEpochStart < 0 || o.EnvoyRestartEpochMax < 0 {
+		return errors.New("config: envoy_restart_epoch_start and envoy_restart_epoch_max must not be negative")
+	}
+	if o.EnvoyRestartEpochMax > 0 && o.EnvoyRestartEpochStart > o.EnvoyRestartEpochMax {
+		return errors.New("config: envoy_restart_epoch_start must not be greater than envoy_restart_epoch_max")
+	}
+	if o.EnvoyShutdownTimeout < 0 {
+		return errors.New("config: envoy_shutdown_timeout must not be negative")
+	}
+	if o.EnvoyDrainWatchInterval != 0 && o.EnvoyDrainWatchInterval < time.Second {
+		return errors.New("config: envoy_drain_watch_interval must be at least 1s")
+	}
+	if o.EnvoyWarmUpPeriod < 0 {
+		return errors.New("config: envoy_warm_up_period must not be negative")
+	}
+	if o.EnvoyWarmUpTimeout < 0 {
+		return errors.New("config: envoy_warm_up_timeout must not be negative")
+	}
+	if o.EnvoyWarmUpTimeout > 0 && o.EnvoyAdminDisabled {
+		return errors.New("config: envoy_warm_up_timeout requires the envoy admin interface")
+	}
+
+	if o.EnvoyHealthCheckAddress != "" {
+		if err := ValidateListenerAddress(o.EnvoyHealthCheckAddress); err != nil {
+			return fmt.Errorf("config: invalid envoy_health_check_address: %w", err)
+		}
+	}
+	if o.EnvoyHealthCheckPath != "" && !strings.HasPrefix(o.EnvoyHealthCheckPath, "/") {
+		return errors.New("config: envoy_health_check_path must start with /")
+	}
+	if o.EnvoyStatsAddress != "" {
+		if err := ValidateListenerAddress(o.EnvoyStatsAddress); err != nil {
+			return fmt.Errorf("config: invalid envoy_stats_address: %w", err)
+		}
+		if o.EnvoyAdminDisabled {
+			return errors.New("config: envoy_stats_address requires the envoy admin interface")
+		}
+	}
+
 	if o.MetricsAddr != "" {
 		if err := ValidateListenerAddress(o.MetricsAddr); err != nil {
 			return fmt.Errorf("config: invalid metrics_addr: %w", err)
@@ -842,6 +1448,31 @@ func (o *Options) GetMetricsBasicAuth() (username, password string, ok bool) {
 	return string(bs[:idx]), string(bs[idx+1:]), true
 }
 
+// GetEnvoyAdminURL returns the URL used to reach the envoy admin interface, or nil if the admin
+// interface is disabled. Unix socket addresses are returned with a unix scheme, and an admin interface
+// listening on all interfaces is reached over loopback.
+func (o *Options) GetEnvoyAdminURL() *url.URL {
+	if o.EnvoyAdminDisabled {
+		return nil
+	}
+	if path, ok := EnvoyAdminUnixSocketPath(o.EnvoyAdminAddress); ok {
+		return &url.URL{Scheme: "unix", Path: path}
+	}
+
+	host, port, err := net.SplitHostPort(o.EnvoyAdminAddress)
+	if err != nil {
+		return EnvoyAdminURL
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		if ip.To4() != nil {
+			host = "127.0.0.1"
+		} else {
+			host = "::1"
+		}
+	}
+	return &url.URL{Scheme: "http", Host: net.JoinHostPort(host, port)}
+}
+
 // Checksum returns the checksum of the current options struct
 func (o *Options) Checksum() uint64 {
 	return hashutil.MustHash(o)
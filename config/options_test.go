@@ -47,6 +47,207 @@ func Test_Validate(t *testing.T) {
 	missingStorageDSN.DataBrokerStorageType = "redis"
 	badSignoutRedirectURL := testOptions()
 	badSignoutRedirectURL.SignOutRedirectURLString = "--"
+	badXDSAPIType := testOptions()
+	badXDSAPIType.EnvoyXDSAPIType = "REST"
+	sotwXDSAPIType := testOptions()
+	sotwXDSAPIType.EnvoyXDSAPIType = "GRPC"
+	controlPlaneTLS := testOptions()
+	controlPlaneTLS.EnvoyControlPlaneTLS = true
+	controlPlaneTLS.EnvoyControlPlaneCAFile = "./testdata/ca.pem"
+	controlPlaneTLS.EnvoyControlPlaneServerCertFile = "./testdata/example-cert.pem"
+	controlPlaneTLS.EnvoyControlPlaneServerKeyFile = "./testdata/example-key.pem"
+	controlPlaneTLS.EnvoyControlPlaneCertFile = "./testdata/example-cert.pem"
+	controlPlaneTLS.EnvoyControlPlaneKeyFile = "./testdata/example-key.pem"
+	controlPlaneTLSMissingCA := testOptions()
+	controlPlaneTLSMissingCA.EnvoyControlPlaneTLS = true
+	controlPlaneTLSMissingServerCert := testOptions()
+	controlPlaneTLSMissingServerCert.EnvoyControlPlaneTLS = true
+	controlPlaneTLSMissingServerCert.EnvoyControlPlaneCAFile = "./testdata/ca.pem"
+	controlPlaneTLSMissingKey := testOptions()
+	controlPlaneTLSMissingKey.EnvoyControlPlaneTLS = true
+	controlPlaneTLSMissingKey.EnvoyControlPlaneCAFile = "./testdata/ca.pem"
+	controlPlaneTLSMissingKey.EnvoyControlPlaneServerCertFile = "./testdata/example-cert.pem"
+	controlPlaneTLSMissingKey.EnvoyControlPlaneServerKeyFile = "./testdata/example-key.pem"
+	controlPlaneTLSMissingKey.EnvoyControlPlaneCertFile = "./testdata/example-cert.pem"
+	envoyExtraArgs := testOptions()
+	envoyExtraArgs.EnvoyExtraArgs = []string{"--disable-hot-restart", "--drain-strategy", "immediate"}
+	badEnvoyExtraArgs := testOptions()
+	badEnvoyExtraArgs.EnvoyExtraArgs = []string{"--log-level=trace"}
+	envoyDNSResolvers := testOptions()
+	envoyDNSResolvers.EnvoyDNSResolvers = []string{"8.8.8.8", "[2001:4860:4860::8888]:53"}
+	badEnvoyDNSResolvers := testOptions()
+	badEnvoyDNSResolvers.EnvoyDNSResolvers = []string{"dns.example.com:53"}
+	badEnvoyOverloadThreshold := testOptions()
+	badEnvoyOverloadThreshold.EnvoyOverloadStopAcceptingRequestsThreshold = 1.5
+	envoyAdminUnixSocket := testOptions()
+	envoyAdminUnixSocket.EnvoyAdminAddress = "unix:///var/run/pomerium/envoy-admin.sock"
+	badEnvoyAdminUnixSocket := testOptions()
+	badEnvoyAdminUnixSocket.EnvoyAdminAddress = "unix://"
+	badEnvoyAdminAddressPort := testOptions()
+	badEnvoyAdminAddressPort.EnvoyAdminAddress = "127.0.0.1:99011"
+	badEnvoyAdminAddressHost := testOptions()
+	badEnvoyAdminAddressHost.EnvoyAdminAddress = "localhost:9901"
+	badEnvoyAdminAddressMissing := testOptions()
+	badEnvoyAdminAddressMissing.EnvoyAdminAddress = ""
+	envoyAdminDisabledWithoutAddress := testOptions()
+	envoyAdminDisabledWithoutAddress.EnvoyAdminAddress = ""
+	envoyAdminDisabledWithoutAddress.EnvoyAdminDisabled = true
+	envoyRuntime := testOptions()
+	envoyRuntime.EnvoyRuntime = map[string]interface{}{"envoy.reloadable_features.example": true, "example.percent": 50}
+	badEnvoyRuntime := testOptions()
+	badEnvoyRuntime.EnvoyRuntime = map[string]interface{}{"example": []interface{}{"a"}}
+	badEnvoyAccessLogServiceAddress := testOptions()
+	badEnvoyAccessLogServiceAddress.EnvoyAccessLogServiceAddress = "als.example.com"
+	badDatadogConnectTimeout := testOptions()
+	badDatadogConnectTimeout.TracingDatadogConnectTimeout = -time.Second
+	badEnvoyLogRedactPatterns := testOptions()
+	badEnvoyLogRedactPatterns.EnvoyLogRedactPatterns = []string{"("}
+	badTracingProvider := testOptions()
+	badTracingProvider.TracingProvider = "example"
+	badXRayDaemonAddress := testOptions()
+	badXRayDaemonAddress.TracingProvider = "xray"
+	badXRayDaemonAddress.TracingXRayDaemonAddress = "127.0.0.1"
+	badEnvoyControlPlaneTCPKeepaliveTime := testOptions()
+	badEnvoyControlPlaneTCPKeepaliveTime.EnvoyControlPlaneTCPKeepaliveTime = 500 * time.Millisecond
+	badEnvoyControlPlaneLBPolicy := testOptions()
+	badEnvoyControlPlaneLBPolicy.EnvoyControlPlaneLBPolicy = "least_request"
+	badEnvoyStatsTags := testOptions()
+	badEnvoyStatsTags.EnvoyStatsTags = map[string]string{"service": "example"}
+	badEnvoyRunAsUID := testOptions()
+	badEnvoyRunAsUID.EnvoyRunAsUID = 1000
+	badEnvoyDrainWatchInterval := testOptions()
+	badEnvoyDrainWatchInterval.EnvoyDrainWatchInterval = time.Millisecond
+	badEnvoyHealthCheckAddress := testOptions()
+	badEnvoyHealthCheckAddress.EnvoyHealthCheckAddress = "localhost:9902"
+	badEnvoyHealthCheckPath := testOptions()
+	badEnvoyHealthCheckPath.EnvoyHealthCheckAddress = ":9902"
+	badEnvoyHealthCheckPath.EnvoyHealthCheckPath = "healthz"
+	envoyStatsAddress := testOptions()
+	envoyStatsAddress.EnvoyStatsAddress = ":9903"
+	badEnvoyStatsAddress := testOptions()
+	badEnvoyStatsAddress.EnvoyStatsAddress = "localhost:9903"
+	envoyStatsAddressAdminDisabled := testOptions()
+	envoyStatsAddressAdminDisabled.EnvoyStatsAddress = ":9903"
+	envoyStatsAddressAdminDisabled.EnvoyAdminDisabled = true
+	badEnvoyStatsPrefix := testOptions()
+	badEnvoyStatsPrefix.EnvoyStatsPrefix = "edge.proxy"
+	badEnvoyShutdownTimeout := testOptions()
+	badEnvoyShutdownTimeout.EnvoyShutdownTimeout = -time.Second
+	envoyRestartEpochLimits := testOptions()
+	envoyRestartEpochLimits.EnvoyRestartEpochStart = 2
+	envoyRestartEpochLimits.EnvoyRestartEpochMax = 10
+	badEnvoyRestartEpochLimits := testOptions()
+	badEnvoyRestartEpochLimits.EnvoyRestartEpochStart = 10
+	badEnvoyRestartEpochLimits.EnvoyRestartEpochMax = 2
+	envoyDrain := testOptions()
+	envoyDrain.EnvoyDrainStrategy = DrainStrategyGradual
+	envoyDrain.EnvoyDrainTime = time.Minute
+	badEnvoyDrainStrategy := testOptions()
+	badEnvoyDrainStrategy.EnvoyDrainStrategy = "slow"
+	badEnvoyDrainTime := testOptions()
+	badEnvoyDrainTime.EnvoyDrainTime = -time.Second
+	badEnvoyDrainStrategyExtraArgs := testOptions()
+	badEnvoyDrainStrategyExtraArgs.EnvoyDrainStrategy = DrainStrategyImmediate
+	badEnvoyDrainStrategyExtraArgs.EnvoyExtraArgs = []string{"--drain-strategy=gradual"}
+	envoyLogReadBufferSize := testOptions()
+	envoyLogReadBufferSize.EnvoyLogReadBufferSize = -1
+	tracingProxyAddress := testOptions()
+	tracingProxyAddress.TracingProvider = "datadog"
+	tracingProxyAddress.TracingProxyAddress = "proxy.example.com:3128"
+	badTracingProxyAddress := testOptions()
+	badTracingProxyAddress.TracingProvider = "datadog"
+	badTracingProxyAddress.TracingProxyAddress = "proxy.example.com"
+	unsupportedTracingProxyAddress := testOptions()
+	unsupportedTracingProxyAddress.TracingProvider = "zipkin"
+	unsupportedTracingProxyAddress.TracingProxyAddress = "proxy.example.com:3128"
+	envoyHistogramBuckets := testOptions()
+	envoyHistogramBuckets.EnvoyStatsHistogramBuckets = []float64{0.5, 1, 5}
+	unorderedEnvoyHistogramBuckets := testOptions()
+	unorderedEnvoyHistogramBuckets.EnvoyStatsHistogramBuckets = []float64{1, 0.5}
+	zeroEnvoyHistogramBucket := testOptions()
+	zeroEnvoyHistogramBucket.EnvoyStatsHistogramBuckets = []float64{0, 1}
+	badEnvoyStatsTagExtractorRegex := testOptions()
+	badEnvoyStatsTagExtractorRegex.EnvoyStatsTagExtractors = []EnvoyStatsTagExtractor{{Name: "route", Regex: `^cluster\.route\.`}}
+	duplicateEnvoyStatsTagExtractor := testOptions()
+	duplicateEnvoyStatsTagExtractor.EnvoyStatsTags = map[string]string{"route": "example"}
+	duplicateEnvoyStatsTagExtractor.EnvoyStatsTagExtractors = []EnvoyStatsTagExtractor{{Name: "route", Regex: `^cluster\.(route-(.+?)\.)`}}
+	envoyStatsTagExtractor := testOptions()
+	envoyStatsTagExtractor.EnvoyStatsTagExtractors = []EnvoyStatsTagExtractor{{Name: "route", Regex: `^cluster\.(route-(.+?)\.)`}}
+	badEnvoyWarmUpPeriod := testOptions()
+	badEnvoyWarmUpPeriod.EnvoyWarmUpPeriod = -time.Second
+	badEnvoyWarmUpTimeout := testOptions()
+	badEnvoyWarmUpTimeout.EnvoyWarmUpTimeout = -time.Second
+	envoyWarmUpTimeoutWithoutAdmin := testOptions()
+	envoyWarmUpTimeoutWithoutAdmin.EnvoyWarmUpTimeout = time.Minute
+	envoyWarmUpTimeoutWithoutAdmin.EnvoyAdminDisabled = true
+	badEnvoyEmbeddedBinaryDisabledChecksum := testOptions()
+	badEnvoyEmbeddedBinaryDisabledChecksum.EnvoyEmbeddedBinaryDisabled = true
+	badEnvoyEmbeddedBinaryDisabledChecksum.EnvoyBinaryChecksum = "not-a-checksum"
+	badEnvoyListenerSocketOptionState := testOptions()
+	badEnvoyListenerSocketOptionState.EnvoyListenerSocketOptions = []EnvoySocketOption{{Level: 1, Name: 8, IntValue: 1024, State: "connected"}}
+	envoyLogFileOnly := testOptions()
+	envoyLogFileOnly.EnvoyLogFileOnly = true
+	envoyLogFileOnlyWithFile := testOptions()
+	envoyLogFileOnlyWithFile.EnvoyLogFile = "/var/log/envoy.log"
+	envoyLogFileOnlyWithFile.EnvoyLogFileOnly = true
+	badEnvoyLogFileMaxSize := testOptions()
+	badEnvoyLogFileMaxSize.EnvoyLogFileMaxSize = -1
+	badEnvoyNiceness := testOptions()
+	badEnvoyNiceness.EnvoyNiceness = 20
+	envoyCPUSet := testOptions()
+	envoyCPUSet.EnvoyCPUSet = "0-1,3"
+	badEnvoyCPUSet := testOptions()
+	badEnvoyCPUSet.EnvoyCPUSet = "3-1"
+	envoyLogPathAndFile := testOptions()
+	envoyLogPathAndFile.EnvoyLogPath = "/var/log/envoy.log"
+	envoyLogPathAndFile.EnvoyLogFile = "/var/log/envoy-raw.log"
+	relativeEnvoyLogPath := testOptions()
+	relativeEnvoyLogPath.EnvoyLogPath = "envoy.log"
+	envoyDownstreamMaxConnectionsConflict := testOptions()
+	envoyDownstreamMaxConnectionsConflict.EnvoyGlobalDownstreamMaxConnections = 1000
+	envoyDownstreamMaxConnectionsConflict.EnvoyRuntime = map[string]interface{}{"overload.global_downstream_max_connections": 2000}
+	badEnvoyXDSInitialFetchTimeout := testOptions()
+	badEnvoyXDSInitialFetchTimeout.EnvoyXDSInitialFetchTimeout = -time.Second
+	badEnvoyBootstrapFormat := testOptions()
+	badEnvoyBootstrapFormat.EnvoyBootstrapFormat = "toml"
+	badEnvoyConfigHistory := testOptions()
+	badEnvoyConfigHistory.EnvoyConfigHistory = -1
+	badEnvoyUnchangedReloadWarnThreshold := testOptions()
+	badEnvoyUnchangedReloadWarnThreshold.EnvoyUnchangedReloadWarnThreshold = -1
+	badEnvoyFileFlushInterval := testOptions()
+	badEnvoyFileFlushInterval.EnvoyFileFlushInterval = time.Microsecond
+	envoyFileFlushIntervalExtraArg := testOptions()
+	envoyFileFlushIntervalExtraArg.EnvoyFileFlushInterval = time.Second
+	envoyFileFlushIntervalExtraArg.EnvoyExtraArgs = []string{"--file-flush-interval-msec", "100"}
+	envoyBootstrapCluster := func(name string) map[string]interface{} {
+		return map[string]interface{}{
+			"name":            name,
+			"connect_timeout": "1s",
+			"load_assignment": map[interface{}]interface{}{"cluster_name": name},
+		}
+	}
+	envoyBootstrapClusters := testOptions()
+	envoyBootstrapClusters.EnvoyBootstrapClusters = []map[string]interface{}{envoyBootstrapCluster("ext-authz")}
+	envoyBootstrapClustersReserved := testOptions()
+	envoyBootstrapClustersReserved.EnvoyBootstrapClusters = []map[string]interface{}{envoyBootstrapCluster("pomerium-control-plane-grpc")}
+	envoyBootstrapClustersReservedAdmin := testOptions()
+	envoyBootstrapClustersReservedAdmin.EnvoyBootstrapClusters = []map[string]interface{}{envoyBootstrapCluster(EnvoyAdminClusterName)}
+	envoyBootstrapClustersReservedDatadog := testOptions()
+	envoyBootstrapClustersReservedDatadog.EnvoyBootstrapClusters = []map[string]interface{}{envoyBootstrapCluster(EnvoyDatadogClusterName)}
+	envoyBootstrapClustersDuplicate := testOptions()
+	envoyBootstrapClustersDuplicate.EnvoyBootstrapClusters = []map[string]interface{}{envoyBootstrapCluster("ext-authz"), envoyBootstrapCluster("ext-authz")}
+	envoyBootstrapClustersUnknownField := testOptions()
+	envoyBootstrapClustersUnknownField.EnvoyBootstrapClusters = []map[string]interface{}{{"name": "ext-authz", "bogus": true}}
+	envoyBootstrapClustersInvalid := testOptions()
+	envoyBootstrapClustersInvalid.EnvoyBootstrapClusters = []map[string]interface{}{{"name": ""}}
+	envoyBinaryPath := testOptions()
+	envoyBinaryPath.EnvoyBinaryPath = "/usr/local/bin/envoy"
+	badEnvoyBinaryPath := testOptions()
+	badEnvoyBinaryPath.EnvoyBinaryPath = "/usr/local/bin/envoy"
+	badEnvoyBinaryPath.EnvoyBinaryChecksum = "not-a-checksum"
+	badEnvoyUnverifiedBinary := testOptions()
+	badEnvoyUnverifiedBinary.EnvoyAllowUnverifiedBinary = true
+	badEnvoyUnverifiedBinary.EnvoyRequireVerifiedBinary = true
 
 	missingSharedSecretWithPersistence := testOptions()
 	missingSharedSecretWithPersistence.SharedKey = ""
@@ -67,6 +268,88 @@ func Test_Validate(t *testing.T) {
 		{"missing databroker storage dsn", missingStorageDSN, true},
 		{"invalid signout redirect url", badSignoutRedirectURL, true},
 		{"no shared key with databroker persistence", missingSharedSecretWithPersistence, true},
+		{"invalid envoy xds api type", badXDSAPIType, true},
+		{"state-of-the-world envoy xds api type", sotwXDSAPIType, false},
+		{"envoy control plane tls", controlPlaneTLS, false},
+		{"envoy control plane tls missing ca", controlPlaneTLSMissingCA, true},
+		{"envoy control plane tls missing server cert", controlPlaneTLSMissingServerCert, true},
+		{"envoy control plane tls missing key", controlPlaneTLSMissingKey, true},
+		{"envoy extra args", envoyExtraArgs, false},
+		{"envoy extra args managed by pomerium", badEnvoyExtraArgs, true},
+		{"envoy dns resolvers", envoyDNSResolvers, false},
+		{"envoy dns resolver hostname", badEnvoyDNSResolvers, true},
+		{"invalid envoy overload threshold", badEnvoyOverloadThreshold, true},
+		{"envoy admin unix socket", envoyAdminUnixSocket, false},
+		{"envoy admin unix socket missing path", badEnvoyAdminUnixSocket, true},
+		{"envoy admin address port out of range", badEnvoyAdminAddressPort, true},
+		{"envoy admin address hostname", badEnvoyAdminAddressHost, true},
+		{"envoy admin address missing", badEnvoyAdminAddressMissing, true},
+		{"envoy admin disabled without address", envoyAdminDisabledWithoutAddress, false},
+		{"envoy runtime", envoyRuntime, false},
+		{"envoy runtime with non-scalar value", badEnvoyRuntime, true},
+		{"envoy access log service address without port", badEnvoyAccessLogServiceAddress, true},
+		{"unknown tracing provider", badTracingProvider, true},
+		{"invalid envoy log redact pattern", badEnvoyLogRedactPatterns, true},
+		{"negative datadog connect timeout", badDatadogConnectTimeout, true},
+		{"xray daemon address without port", badXRayDaemonAddress, true},
+		{"envoy allow and require verified binary", badEnvoyUnverifiedBinary, true},
+		{"envoy binary path", envoyBinaryPath, false},
+		{"envoy bootstrap clusters", envoyBootstrapClusters, false},
+		{"envoy bootstrap cluster with reserved name", envoyBootstrapClustersReserved, true},
+		{"envoy bootstrap cluster with envoy admin cluster name", envoyBootstrapClustersReservedAdmin, true},
+		{"envoy bootstrap cluster with datadog cluster name", envoyBootstrapClustersReservedDatadog, true},
+		{"envoy bootstrap clusters with duplicate names", envoyBootstrapClustersDuplicate, true},
+		{"envoy bootstrap cluster with unknown field", envoyBootstrapClustersUnknownField, true},
+		{"envoy bootstrap cluster without name", envoyBootstrapClustersInvalid, true},
+		{"envoy file flush interval under 1ms", badEnvoyFileFlushInterval, true},
+		{"envoy file flush interval and extra arg", envoyFileFlushIntervalExtraArg, true},
+		{"negative envoy config history", badEnvoyConfigHistory, true},
+		{"negative envoy unchanged reload warn threshold", badEnvoyUnchangedReloadWarnThreshold, true},
+		{"unknown envoy bootstrap format", badEnvoyBootstrapFormat, true},
+		{"negative envoy xds initial fetch timeout", badEnvoyXDSInitialFetchTimeout, true},
+		{"envoy global downstream max connections conflict", envoyDownstreamMaxConnectionsConflict, true},
+		{"envoy log path and file", envoyLogPathAndFile, true},
+		{"relative envoy log path", relativeEnvoyLogPath, true},
+		{"envoy niceness out of range", badEnvoyNiceness, true},
+		{"envoy cpuset", envoyCPUSet, false},
+		{"invalid envoy cpuset", badEnvoyCPUSet, true},
+		{"envoy log file only without a file", envoyLogFileOnly, true},
+		{"envoy log file only", envoyLogFileOnlyWithFile, false},
+		{"negative envoy log file max size", badEnvoyLogFileMaxSize, true},
+		{"unknown envoy listener socket option state", badEnvoyListenerSocketOptionState, true},
+		{"invalid envoy binary checksum without embedded binary", badEnvoyEmbeddedBinaryDisabledChecksum, true},
+		{"negative envoy warm up period", badEnvoyWarmUpPeriod, true},
+		{"negative envoy warm up timeout", badEnvoyWarmUpTimeout, true},
+		{"envoy warm up timeout without admin", envoyWarmUpTimeoutWithoutAdmin, true},
+		{"envoy stats tag extractor without a sub-expression", badEnvoyStatsTagExtractorRegex, true},
+		{"envoy stats tag extractor duplicating a fixed tag", duplicateEnvoyStatsTagExtractor, true},
+		{"envoy stats tag extractor", envoyStatsTagExtractor, false},
+		{"envoy histogram buckets", envoyHistogramBuckets, false},
+		{"unordered envoy histogram buckets", unorderedEnvoyHistogramBuckets, true},
+		{"zero envoy histogram bucket", zeroEnvoyHistogramBucket, true},
+		{"tracing proxy address", tracingProxyAddress, false},
+		{"invalid tracing proxy address", badTracingProxyAddress, true},
+		{"tracing proxy address with unsupported provider", unsupportedTracingProxyAddress, true},
+		{"negative envoy log read buffer size", envoyLogReadBufferSize, true},
+		{"envoy drain strategy and time", envoyDrain, false},
+		{"unknown envoy drain strategy", badEnvoyDrainStrategy, true},
+		{"negative envoy drain time", badEnvoyDrainTime, true},
+		{"envoy drain strategy also in extra args", badEnvoyDrainStrategyExtraArgs, true},
+		{"envoy restart epoch limits", envoyRestartEpochLimits, false},
+		{"envoy restart epoch start beyond max", badEnvoyRestartEpochLimits, true},
+		{"negative envoy shutdown timeout", badEnvoyShutdownTimeout, true},
+		{"envoy stats prefix with a dot", badEnvoyStatsPrefix, true},
+		{"envoy health check address hostname", badEnvoyHealthCheckAddress, true},
+		{"envoy health check path without leading slash", badEnvoyHealthCheckPath, true},
+		{"envoy stats address", envoyStatsAddress, false},
+		{"envoy stats address hostname", badEnvoyStatsAddress, true},
+		{"envoy stats address without admin", envoyStatsAddressAdminDisabled, true},
+		{"envoy drain watch interval under a second", badEnvoyDrainWatchInterval, true},
+		{"envoy binary path with invalid checksum", badEnvoyBinaryPath, true},
+		{"envoy uid without gid", badEnvoyRunAsUID, true},
+		{"envoy stats tag reserved by pomerium", badEnvoyStatsTags, true},
+		{"unknown envoy control plane lb policy", badEnvoyControlPlaneLBPolicy, true},
+		{"envoy control plane tcp keepalive time under a second", badEnvoyControlPlaneTCPKeepaliveTime, true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -79,6 +362,34 @@ func Test_Validate(t *testing.T) {
 	}
 }
 
+func TestParseCPUSet(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		value   string
+		want    []int
+		wantErr bool
+	}{
+		{"0", []int{0}, false},
+		{"0-3,6", []int{0, 1, 2, 3, 6}, false},
+		{"6,1-2,2", []int{1, 2, 6}, false},
+		{"", nil, true},
+		{"a", nil, true},
+		{"3-1", nil, true},
+		{"-1", nil, true},
+		{"0,", nil, true},
+		{"1024", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseCPUSet(tt.value)
+		if tt.wantErr {
+			assert.Error(t, err, tt.value)
+			continue
+		}
+		assert.NoError(t, err, tt.value)
+		assert.Equal(t, tt.want, got, tt.value)
+	}
+}
+
 func Test_bindEnvs(t *testing.T) {
 	o := new(Options)
 	o.viper = viper.New()
@@ -271,6 +582,7 @@ func TestOptionsFromViper(t *testing.T) {
 				EnvoyAdminAccessLogPath:  os.DevNull,
 				EnvoyAdminProfilePath:    os.DevNull,
 				EnvoyAdminAddress:        "127.0.0.1:9901",
+				EnvoyLogFileMaxBackups:   3,
 			},
 			false,
 		},
@@ -294,6 +606,7 @@ func TestOptionsFromViper(t *testing.T) {
 				EnvoyAdminAccessLogPath:         os.DevNull,
 				EnvoyAdminProfilePath:           os.DevNull,
 				EnvoyAdminAddress:               "127.0.0.1:9901",
+				EnvoyLogFileMaxBackups:          3,
 			},
 			false,
 		},
@@ -569,3 +882,18 @@ func mustParseWeightedURLs(t *testing.T, urls ...string) []WeightedURL {
 	require.NoError(t, err)
 	return wu
 }
+
+func TestOptions_GetEnvoyAdminURL(t *testing.T) {
+	assert.Equal(t, EnvoyAdminURL, (&Options{EnvoyAdminAddress: "127.0.0.1:9901"}).GetEnvoyAdminURL())
+	assert.Equal(t, &url.URL{Scheme: "unix", Path: "/tmp/envoy-admin.sock"},
+		(&Options{EnvoyAdminAddress: "unix:///tmp/envoy-admin.sock"}).GetEnvoyAdminURL())
+	assert.Nil(t, (&Options{EnvoyAdminAddress: "127.0.0.1:9901", EnvoyAdminDisabled: true}).GetEnvoyAdminURL())
+	assert.Equal(t, &url.URL{Scheme: "http", Host: "127.0.0.1:19901"},
+		(&Options{EnvoyAdminAddress: "127.0.0.1:19901"}).GetEnvoyAdminURL())
+	assert.Equal(t, &url.URL{Scheme: "http", Host: "127.0.0.1:19901"},
+		(&Options{EnvoyAdminAddress: "0.0.0.0:19901"}).GetEnvoyAdminURL())
+	assert.Equal(t, &url.URL{Scheme: "http", Host: "[::1]:19901"},
+		(&Options{EnvoyAdminAddress: "[::]:19901"}).GetEnvoyAdminURL())
+	assert.Equal(t, &url.URL{Scheme: "http", Host: "10.0.0.5:19901"},
+		(&Options{EnvoyAdminAddress: "10.0.0.5:19901"}).GetEnvoyAdminURL())
+}
@@ -0,0 +1,80 @@
+package config
+
+import (
+	"sync"
+	"time"
+)
+
+// A ReloadStatus is the outcome of a consumer applying a config change.
+type ReloadStatus struct {
+	// Version is the checksum of the config the consumer applied.
+	Version uint64
+	Err     error
+	Time    time.Time
+}
+
+// A ReloadListener is called when a consumer reports the outcome of applying a config change.
+type ReloadListener = func(consumer string, status ReloadStatus)
+
+// A ReloadReporter is implemented by config sources which track whether config changes took effect.
+type ReloadReporter interface {
+	ReportReload(consumer string, version uint64, err error)
+}
+
+// A ReloadTracker tracks the config version each consumer has applied.
+type ReloadTracker struct {
+	reloadMu        sync.Mutex
+	reloadStatuses  map[string]ReloadStatus
+	reloadListeners []ReloadListener
+}
+
+// ReportReload records the outcome of a consumer applying the config with the given version.
+func (tracker *ReloadTracker) ReportReload(consumer string, version uint64, err error) {
+	status := ReloadStatus{Version: version, Err: err, Time: time.Now()}
+
+	tracker.reloadMu.Lock()
+	if err == nil {
+		if tracker.reloadStatuses == nil {
+			tracker.reloadStatuses = make(map[string]ReloadStatus)
+		}
+		tracker.reloadStatuses[consumer] = status
+	}
+	listeners := tracker.reloadListeners
+	tracker.reloadMu.Unlock()
+
+	for _, li := range listeners {
+		li(consumer, status)
+	}
+}
+
+// OnReload adds a listener which is called whenever a consumer reports the outcome of a config change.
+func (tracker *ReloadTracker) OnReload(li ReloadListener) {
+	tracker.reloadMu.Lock()
+	defer tracker.reloadMu.Unlock()
+
+	tracker.reloadListeners = append(tracker.reloadListeners, li)
+}
+
+// AppliedVersion returns the version of the config the consumer last applied successfully. Failed
+// reloads leave the previously applied version in place.
+func (tracker *ReloadTracker) AppliedVersion(consumer string) (uint64, bool) {
+	tracker.reloadMu.Lock()
+	defer tracker.reloadMu.Unlock()
+
+	status, ok := tracker.reloadStatuses[consumer]
+	return status.Version, ok
+}
+
+// Committed returns true if all of the consumers have applied the config with the given version.
+func (tracker *ReloadTracker) Committed(version uint64, consumers ...string) bool {
+	tracker.reloadMu.Lock()
+	defer tracker.reloadMu.Unlock()
+
+	for _, consumer := range consumers {
+		status, ok := tracker.reloadStatuses[consumer]
+		if !ok || status.Version != version {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,34 @@
+package config
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReloadTracker(t *testing.T) {
+	var tracker ReloadTracker
+
+	var reported []string
+	tracker.OnReload(func(consumer string, status ReloadStatus) {
+		reported = append(reported, consumer)
+		assert.False(t, status.Time.IsZero())
+	})
+
+	_, ok := tracker.AppliedVersion("envoy")
+	assert.False(t, ok)
+	assert.False(t, tracker.Committed(1, "envoy"))
+
+	tracker.ReportReload("envoy", 1, nil)
+	tracker.ReportReload("envoy", 2, errors.New("error"))
+	version, ok := tracker.AppliedVersion("envoy")
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1), version, "failed reloads should not change the applied version")
+	assert.True(t, tracker.Committed(1, "envoy"))
+	assert.False(t, tracker.Committed(1, "envoy", "other"))
+
+	tracker.ReportReload("other", 1, nil)
+	assert.True(t, tracker.Committed(1, "envoy", "other"))
+	assert.Equal(t, []string{"envoy", "envoy", "other"}, reported)
+}
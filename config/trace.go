@@ -13,6 +13,8 @@ import (
 	"github.com/pomerium/pomerium/internal/urlutil"
 )
 
+const defaultLightstepCollectorURL = "https://ingest.lightstep.com:443"
+
 // TracingOptions are the options for tracing.
 type TracingOptions = trace.TracingOptions
 
@@ -37,6 +39,19 @@ func NewTracingOptions(o *Options) (*TracingOptions, error) {
 			tracingOpts.JaegerCollectorEndpoint = jaegerCollectorEndpoint
 			tracingOpts.JaegerAgentEndpoint = o.TracingJaegerAgentEndpoint
 		}
+	case trace.LightstepTracingProviderName:
+		rawLightstepCollectorURL := o.TracingLightstepCollectorURL
+		if rawLightstepCollectorURL == "" {
+			rawLightstepCollectorURL = defaultLightstepCollectorURL
+		}
+		lightstepCollectorURL, err := urlutil.ParseAndValidateURL(rawLightstepCollectorURL)
+		if err != nil {
+			return nil, fmt.Errorf("config: invalid lightstep collector url: %w", err)
+		}
+		tracingOpts.LightstepCollectorURL = lightstepCollectorURL
+	case trace.XRayTracingProviderName:
+		tracingOpts.XRayDaemonAddress = o.TracingXRayDaemonAddress
+		tracingOpts.XRaySegmentName = o.TracingXRaySegmentName
 	case trace.ZipkinTracingProviderName:
 		zipkinEndpoint, err := urlutil.ParseAndValidateURL(o.ZipkinEndpoint)
 		if err != nil {
@@ -52,6 +52,24 @@ func Test_NewTracingOptions(t *testing.T) {
 			nil,
 			true,
 		},
+		{
+			"lightstep_default_collector",
+			&Options{TracingProvider: "lightstep", TracingLightstepAccessToken: "ACCESS_TOKEN"},
+			&TracingOptions{Provider: "lightstep", LightstepCollectorURL: &url.URL{Scheme: "https", Host: "ingest.lightstep.com:443"}, Service: "pomerium"},
+			false,
+		},
+		{
+			"lightstep_bad",
+			&Options{TracingProvider: "lightstep", TracingLightstepCollectorURL: "notaurl"},
+			nil,
+			true,
+		},
+		{
+			"xray_good",
+			&Options{TracingProvider: "xray", TracingXRayDaemonAddress: "127.0.0.1:2000", TracingXRaySegmentName: "example"},
+			&TracingOptions{Provider: "xray", XRayDaemonAddress: "127.0.0.1:2000", XRaySegmentName: "example", Service: "pomerium"},
+			false,
+		},
 		{
 			"noprovider",
 			&Options{},
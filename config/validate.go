@@ -3,9 +3,16 @@ package config
 import (
 	"fmt"
 	"net"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
 	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"github.com/pomerium/pomerium/internal/telemetry/trace"
 )
 
 // DNSLookupFamily values.
@@ -39,6 +46,372 @@ func GetEnvoyDNSLookupFamily(value string) envoy_config_cluster_v3.Cluster_DnsLo
 	return envoy_config_cluster_v3.Cluster_AUTO
 }
 
+// LBPolicy values.
+const (
+	LBPolicyRoundRobin   = "ROUND_ROBIN"
+	LBPolicyLeastRequest = "LEAST_REQUEST"
+	LBPolicyRandom       = "RANDOM"
+	LBPolicyRingHash     = "RING_HASH"
+	LBPolicyMaglev       = "MAGLEV"
+)
+
+// AllLBPolicies are all the available LBPolicy values.
+var AllLBPolicies = []string{LBPolicyRoundRobin, LBPolicyLeastRequest, LBPolicyRandom, LBPolicyRingHash, LBPolicyMaglev}
+
+// ValidateLBPolicy validates the value to confirm its one of the available load balancing policies.
+func ValidateLBPolicy(value string) error {
+	switch value {
+	case "", LBPolicyRoundRobin, LBPolicyLeastRequest, LBPolicyRandom, LBPolicyRingHash, LBPolicyMaglev:
+		return nil
+	}
+
+	return fmt.Errorf("unknown lb policy: %s, known policies are: %s", value, strings.Join(AllLBPolicies, ", "))
+}
+
+// GetEnvoyLBPolicy gets the envoy load balancing policy.
+func GetEnvoyLBPolicy(value string) envoy_config_cluster_v3.Cluster_LbPolicy {
+	switch value {
+	case LBPolicyLeastRequest:
+		return envoy_config_cluster_v3.Cluster_LEAST_REQUEST
+	case LBPolicyRandom:
+		return envoy_config_cluster_v3.Cluster_RANDOM
+	case LBPolicyRingHash:
+		return envoy_config_cluster_v3.Cluster_RING_HASH
+	case LBPolicyMaglev:
+		return envoy_config_cluster_v3.Cluster_MAGLEV
+	}
+	return envoy_config_cluster_v3.Cluster_ROUND_ROBIN
+}
+
+// DrainStrategy values.
+const (
+	DrainStrategyGradual   = "gradual"
+	DrainStrategyImmediate = "immediate"
+)
+
+// AllDrainStrategies are all the available DrainStrategy values.
+var AllDrainStrategies = []string{DrainStrategyGradual, DrainStrategyImmediate}
+
+// ValidateDrainStrategy validates the value to confirm its one of the available envoy drain strategies.
+func ValidateDrainStrategy(value string) error {
+	switch value {
+	case "", DrainStrategyGradual, DrainStrategyImmediate:
+		return nil
+	}
+
+	return fmt.Errorf("unknown drain strategy: %s, known strategies are: %s", value, strings.Join(AllDrainStrategies, ", "))
+}
+
+// BootstrapFormat values.
+const (
+	BootstrapFormatJSON = "json"
+	BootstrapFormatYAML = "yaml"
+)
+
+// AllBootstrapFormats are all the available BootstrapFormat values.
+var AllBootstrapFormats = []string{BootstrapFormatJSON, BootstrapFormatYAML}
+
+// ValidateBootstrapFormat validates the value to confirm its one of the available envoy bootstrap formats.
+func ValidateBootstrapFormat(value string) error {
+	switch value {
+	case "", BootstrapFormatJSON, BootstrapFormatYAML:
+		return nil
+	}
+
+	return fmt.Errorf("unknown bootstrap format: %s, known formats are: %s", value, strings.Join(AllBootstrapFormats, ", "))
+}
+
+// XDSAPIType values.
+const (
+	XDSAPITypeDeltaGRPC = "DELTA_GRPC"
+	XDSAPITypeGRPC      = "GRPC"
+)
+
+// AllXDSAPITypes are all the available XDSAPIType values.
+var AllXDSAPITypes = []string{XDSAPITypeDeltaGRPC, XDSAPITypeGRPC}
+
+// ValidateXDSAPIType validates the value to confirm its one of the available xDS API types.
+func ValidateXDSAPIType(value string) error {
+	switch value {
+	case "", XDSAPITypeDeltaGRPC, XDSAPITypeGRPC:
+		return nil
+	}
+
+	return fmt.Errorf("unknown envoy_xds_api_type: %s, known types are: %s", value, strings.Join(AllXDSAPITypes, ", "))
+}
+
+// GetEnvoyXDSAPIType gets the envoy xDS API type.
+func GetEnvoyXDSAPIType(value string) envoy_config_core_v3.ApiConfigSource_ApiType {
+	switch value {
+	case XDSAPITypeGRPC:
+		return envoy_config_core_v3.ApiConfigSource_GRPC
+	}
+	return envoy_config_core_v3.ApiConfigSource_DELTA_GRPC
+}
+
+// Envoy socket option states.
+const (
+	EnvoySocketStatePrebind   = "prebind"
+	EnvoySocketStateBound     = "bound"
+	EnvoySocketStateListening = "listening"
+)
+
+// ValidateEnvoySocketOption validates that a socket option has a known state and non-negative level
+// and name.
+func ValidateEnvoySocketOption(opt EnvoySocketOption) error {
+	switch opt.State {
+	case "", EnvoySocketStatePrebind, EnvoySocketStateBound, EnvoySocketStateListening:
+	default:
+		return fmt.Errorf("unknown socket option state: %s, known states are: %s", opt.State,
+			strings.Join([]string{EnvoySocketStatePrebind, EnvoySocketStateBound, EnvoySocketStateListening}, ", "))
+	}
+	if opt.Level < 0 || opt.Name < 0 {
+		return fmt.Errorf("invalid socket option level %d and name %d, they must not be negative", opt.Level, opt.Name)
+	}
+	return nil
+}
+
+// GetEnvoySocketOptions gets the envoy socket options for the configured options.
+func GetEnvoySocketOptions(opts []EnvoySocketOption) []*envoy_config_core_v3.SocketOption {
+	if len(opts) == 0 {
+		return nil
+	}
+
+	socketOptions := make([]*envoy_config_core_v3.SocketOption, 0, len(opts))
+	for _, opt := range opts {
+		state := envoy_config_core_v3.SocketOption_STATE_PREBIND
+		switch opt.State {
+		case EnvoySocketStateBound:
+			state = envoy_config_core_v3.SocketOption_STATE_BOUND
+		case EnvoySocketStateListening:
+			state = envoy_config_core_v3.SocketOption_STATE_LISTENING
+		}
+		socketOptions = append(socketOptions, &envoy_config_core_v3.SocketOption{
+			Description: opt.Description,
+			Level:       opt.Level,
+			Name:        opt.Name,
+			Value:       &envoy_config_core_v3.SocketOption_IntValue{IntValue: opt.IntValue},
+			State:       state,
+		})
+	}
+	return socketOptions
+}
+
+// reservedEnvoyArgs are the envoy command line arguments managed by pomerium.
+var reservedEnvoyArgs = []string{
+	"-c", "--config-path",
+	"-l", "--log-level",
+	"--log-format",
+	"--log-format-escaped",
+	"--log-path",
+	"--base-id",
+	"--base-id-path",
+	"--use-dynamic-base-id",
+	"--restart-epoch",
+}
+
+// Names of the clusters pomerium configures envoy with, either in the bootstrap config or via the control
+// plane.
+const (
+	EnvoyAccessLogServiceClusterName   = "pomerium-access-log-service"
+	EnvoyAdminClusterName              = "pomerium-envoy-admin"
+	EnvoyAuthorizeClusterName          = "pomerium-authorize"
+	EnvoyControlPlaneGRPCClusterName   = "pomerium-control-plane-grpc"
+	EnvoyControlPlaneHTTPClusterName   = "pomerium-control-plane-http"
+	EnvoyDatadogClusterName            = "datadog-apm"
+	EnvoyLightstepCollectorClusterName = "lightstep-collector"
+	EnvoyTracingProxyClusterName       = "pomerium-tracing-proxy"
+)
+
+// reservedEnvoyClusterNames are the names of the clusters pomerium configures envoy with, which extra
+// bootstrap clusters can't use.
+var reservedEnvoyClusterNames = []string{
+	EnvoyAccessLogServiceClusterName,
+	EnvoyAdminClusterName,
+	EnvoyAuthorizeClusterName,
+	EnvoyControlPlaneGRPCClusterName,
+	EnvoyControlPlaneHTTPClusterName,
+	EnvoyDatadogClusterName,
+	EnvoyLightstepCollectorClusterName,
+	EnvoyTracingProxyClusterName,
+}
+
+// ParseEnvoyBootstrapClusters parses extra envoy bootstrap clusters from their definitions in envoy's
+// cluster format. Each cluster must be valid and have a unique name, which can't be the name of one of
+// pomerium's clusters.
+func ParseEnvoyBootstrapClusters(raw []map[string]interface{}) ([]*envoy_config_cluster_v3.Cluster, error) {
+	clusters := make([]*envoy_config_cluster_v3.Cluster, 0, len(raw))
+	names := map[string]bool{}
+	for i, src := range raw {
+		// nested maps decoded from yaml have interface keys, which can't be marshaled to JSON
+		m := make(map[string]interface{}, len(src))
+		for k, v := range src {
+			var err error
+			if m[k], err = serializable(v); err != nil {
+				return nil, fmt.Errorf("cluster %d: %w", i, err)
+			}
+		}
+
+		cluster := new(envoy_config_cluster_v3.Cluster)
+		if err := parseJSONPB(m, cluster, protojson.UnmarshalOptions{}); err != nil {
+			return nil, fmt.Errorf("cluster %d: %w", i, err)
+		}
+		if err := cluster.Validate(); err != nil {
+			return nil, fmt.Errorf("cluster %d: %w", i, err)
+		}
+
+		name := cluster.GetName()
+		for _, reserved := range reservedEnvoyClusterNames {
+			if name == reserved {
+				return nil, fmt.Errorf("cluster %d: %s is a reserved cluster name", i, name)
+			}
+		}
+		if names[name] {
+			return nil, fmt.Errorf("cluster %d: duplicate cluster name %s", i, name)
+		}
+		names[name] = true
+
+		clusters = append(clusters, cluster)
+	}
+	return clusters, nil
+}
+
+// Envoy stats tag names set by pomerium.
+const (
+	EnvoyStatsTagService   = "service"
+	EnvoyStatsTagClusterID = "cluster_id"
+)
+
+// ValidateEnvoyStatsTagName validates that a user-defined stats tag name is not empty and isn't one of the
+// tags set by pomerium.
+func ValidateEnvoyStatsTagName(name string) error {
+	switch name {
+	case "":
+		return fmt.Errorf("tag name is required")
+	case EnvoyStatsTagService, EnvoyStatsTagClusterID:
+		return fmt.Errorf("%s is set by pomerium and cannot be overridden", name)
+	}
+	return nil
+}
+
+// ValidateEnvoyStatsTagRegex validates a stats tag extraction regex. Envoy removes the first
+// sub-expression from the stat name and uses the second, or the first if there's only one, as the tag
+// value, so the regex must have one or two sub-expressions.
+func ValidateEnvoyStatsTagRegex(expr string) error {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return fmt.Errorf("invalid regex %q: %w", expr, err)
+	}
+	if n := re.NumSubexp(); n < 1 || n > 2 {
+		return fmt.Errorf("invalid regex %q, expected one or two sub-expressions, got %d", expr, n)
+	}
+	return nil
+}
+
+var envoyStatsPrefixRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// ValidateEnvoyStatsPrefix validates that the envoy stats prefix is a valid prometheus metric name prefix.
+// Dots are not allowed since envoy uses them to separate the elements of a stat name.
+func ValidateEnvoyStatsPrefix(prefix string) error {
+	if !envoyStatsPrefixRE.MatchString(prefix) {
+		return fmt.Errorf("invalid prefix %q, expected letters, digits and underscores, not starting with a digit", prefix)
+	}
+	return nil
+}
+
+// ValidateEnvoyHistogramBuckets validates that histogram bucket upper bounds are positive and in
+// increasing order.
+func ValidateEnvoyHistogramBuckets(buckets []float64) error {
+	for i, bucket := range buckets {
+		if bucket <= 0 {
+			return fmt.Errorf("invalid bucket %v, buckets must be greater than zero", bucket)
+		}
+		if i > 0 && bucket <= buckets[i-1] {
+			return fmt.Errorf("invalid bucket %v, buckets must be in increasing order", bucket)
+		}
+	}
+	return nil
+}
+
+// maxCPUSetCPU is the highest cpu number a cpuset can contain, the size of the kernel's cpu mask.
+const maxCPUSetCPU = 1023
+
+// ParseCPUSet parses a cpuset in the kernel's list format, a comma-separated list of cpu numbers and
+// inclusive ranges such as 0-3,6. It returns the cpus in increasing order without duplicates.
+func ParseCPUSet(value string) ([]int, error) {
+	seen := make(map[int]bool)
+	for _, part := range strings.Split(value, ",") {
+		first, last := part, part
+		if idx := strings.IndexByte(part, '-'); idx >= 0 {
+			first, last = part[:idx], part[idx+1:]
+		}
+		lo, err := strconv.Atoi(strings.TrimSpace(first))
+		if err != nil || lo < 0 {
+			return nil, fmt.Errorf("invalid cpu range %q", part)
+		}
+		hi, err := strconv.Atoi(strings.TrimSpace(last))
+		if err != nil || hi < lo {
+			return nil, fmt.Errorf("invalid cpu range %q", part)
+		}
+		if hi > maxCPUSetCPU {
+			return nil, fmt.Errorf("invalid cpu %d, cpus must be at most %d", hi, maxCPUSetCPU)
+		}
+		for cpu := lo; cpu <= hi; cpu++ {
+			seen[cpu] = true
+		}
+	}
+
+	cpus := make([]int, 0, len(seen))
+	for cpu := range seen {
+		cpus = append(cpus, cpu)
+	}
+	sort.Ints(cpus)
+	return cpus, nil
+}
+
+// envoyAdminUnixSocketPrefix is the prefix used to bind the envoy admin interface to a unix socket.
+const envoyAdminUnixSocketPrefix = "unix://"
+
+// EnvoyAdminUnixSocketPath returns the unix socket path for an envoy admin address, if the address
+// refers to a unix socket.
+func EnvoyAdminUnixSocketPath(addr string) (path string, ok bool) {
+	if !strings.HasPrefix(addr, envoyAdminUnixSocketPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(addr, envoyAdminUnixSocketPrefix), true
+}
+
+// envoyArgName returns the name of an envoy argument, which may be given as --name=value.
+func envoyArgName(arg string) string {
+	if idx := strings.IndexByte(arg, '='); idx >= 0 {
+		return arg[:idx]
+	}
+	return arg
+}
+
+// EnvoyExtraArgsContain returns true if the extra envoy arguments set the argument with the given name.
+func EnvoyExtraArgsContain(args []string, name string) bool {
+	for _, arg := range args {
+		if envoyArgName(arg) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateEnvoyExtraArgs validates that the extra envoy arguments do not conflict with the ones managed by pomerium.
+func ValidateEnvoyExtraArgs(args []string) error {
+	for _, arg := range args {
+		name := envoyArgName(arg)
+		for _, reserved := range reservedEnvoyArgs {
+			if name == reserved {
+				return fmt.Errorf("envoy_extra_args: %s is managed by pomerium and cannot be set", name)
+			}
+		}
+	}
+	return nil
+}
+
 // ValidateListenerAddress validates that a listener address is ip:port, not host:port.
 func ValidateListenerAddress(addr string) error {
 	host, _, err := net.SplitHostPort(addr)
@@ -52,3 +425,74 @@ func ValidateListenerAddress(addr string) error {
 
 	return nil
 }
+
+// ValidateEnvoyAdminAddress validates that the envoy admin address is an ip:port or a unix socket
+// (unix:///path).
+func ValidateEnvoyAdminAddress(addr string) error {
+	if path, ok := EnvoyAdminUnixSocketPath(addr); ok {
+		if path == "" {
+			return fmt.Errorf("unix socket path is required")
+		}
+		return nil
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid address %q, expected ip:port or unix:///path: %w", addr, err)
+	}
+	if net.ParseIP(host) == nil {
+		return fmt.Errorf("invalid address %q, expected an ip address for the host, envoy doesn't resolve hostnames here", addr)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("invalid address %q, expected a port number between 0 and 65535", addr)
+	}
+	return nil
+}
+
+// ValidateTracingProvider validates that the tracing provider is empty or one of the supported providers.
+func ValidateTracingProvider(provider string) error {
+	switch provider {
+	case "",
+		trace.DatadogTracingProviderName,
+		trace.JaegerTracingProviderName,
+		trace.LightstepTracingProviderName,
+		trace.XRayTracingProviderName,
+		trace.ZipkinTracingProviderName:
+		return nil
+	}
+	return fmt.Errorf("unknown tracing provider: %s", provider)
+}
+
+// EnvoyGlobalDownstreamMaxConnectionsRuntimeKey is the envoy runtime key which limits the total number of
+// downstream connections.
+const EnvoyGlobalDownstreamMaxConnectionsRuntimeKey = "overload.global_downstream_max_connections"
+
+// ValidateEnvoyRuntimeValue validates that an envoy runtime value is a scalar type envoy supports.
+func ValidateEnvoyRuntimeValue(value interface{}) error {
+	switch value.(type) {
+	case bool, string,
+		int, int8, int16, int32, int64,
+		uint, uint8, uint16, uint32, uint64,
+		float32, float64:
+		return nil
+	}
+	return fmt.Errorf("unsupported type %T, expected a boolean, number or string", value)
+}
+
+// ValidateDNSResolverAddress validates that a DNS resolver address is either an ip or ip:port.
+func ValidateDNSResolverAddress(addr string) error {
+	if net.ParseIP(addr) != nil {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid address, expected ip or ip:port")
+	}
+
+	if net.ParseIP(host) == nil {
+		return fmt.Errorf("invalid address, expected ip for host")
+	}
+
+	return nil
+}
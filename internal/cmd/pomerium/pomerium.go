@@ -83,11 +83,12 @@ func Run(ctx context.Context, configFile string) error {
 	log.Info().Str("port", httpPort).Msg("HTTP server started")
 
 	// create envoy server
-	envoyServer, err := envoy.NewServer(src, grpcPort, httpPort)
+	envoyServer, err := envoy.NewServerWithContext(ctx, src, grpcPort, httpPort)
 	if err != nil {
 		return fmt.Errorf("error creating envoy server: %w", err)
 	}
-	defer envoyServer.Close()
+	defer func() { _ = envoyServer.Shutdown(context.Background()) }()
+	setupEnvoyDebug(controlPlane, envoyServer)
 
 	// add services
 	if err := setupAuthenticate(src, controlPlane); err != nil {
@@ -223,6 +224,19 @@ func setupRegistryReporter(src config.Source) error {
 	return nil
 }
 
+// setupEnvoyDebug exposes the bootstrap config envoy was started with alongside the pprof handlers.
+func setupEnvoyDebug(controlPlane *controlplane.Server, envoyServer *envoy.Server) {
+	controlPlane.HTTPRouter.Path("/debug/envoy/bootstrap").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bs, err := envoyServer.Bootstrap()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(bs)
+	})
+}
+
 func setupProxy(src config.Source, controlPlane *controlplane.Server) error {
 	if !config.IsProxy(src.GetConfig().Options.Services) {
 		return nil
@@ -0,0 +1,81 @@
+package controlplane
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+
+	"github.com/pomerium/pomerium/config"
+)
+
+// A grpcTLSListener serves TLS on the control plane gRPC listener once envoy_control_plane_tls is
+// enabled. Until then, or after it's disabled again, connections are accepted as plaintext. The TLS
+// config is only applied to new connections, envoy reconnects when it's restarted with the new bootstrap
+// config.
+type grpcTLSListener struct {
+	net.Listener
+	tlsConfig atomic.Value // *tls.Config
+}
+
+func newGRPCTLSListener(li net.Listener) *grpcTLSListener {
+	gli := &grpcTLSListener{Listener: li}
+	gli.tlsConfig.Store((*tls.Config)(nil))
+	return gli
+}
+
+// Accept accepts the next connection, wrapping it in TLS if it's enabled.
+func (li *grpcTLSListener) Accept() (net.Conn, error) {
+	conn, err := li.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if cfg := li.tlsConfig.Load().(*tls.Config); cfg != nil {
+		return tls.Server(conn, cfg), nil
+	}
+	return conn, nil
+}
+
+// update applies the control plane TLS options from the config.
+func (li *grpcTLSListener) update(options *config.Options) error {
+	cfg, err := buildGRPCTLSConfig(options)
+	if err != nil {
+		return err
+	}
+	li.tlsConfig.Store(cfg)
+	return nil
+}
+
+// buildGRPCTLSConfig builds the TLS config the control plane gRPC listener serves to envoy, or nil if
+// envoy connects to it over plaintext. Client certificates are required when envoy presents one.
+func buildGRPCTLSConfig(options *config.Options) (*tls.Config, error) {
+	if !options.EnvoyControlPlaneTLS {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(options.EnvoyControlPlaneServerCertFile, options.EnvoyControlPlaneServerKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading control plane server certificate: %w", err)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"h2"},
+	}
+
+	if options.EnvoyControlPlaneCertFile != "" {
+		bs, err := ioutil.ReadFile(options.EnvoyControlPlaneCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading control plane ca file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bs) {
+			return nil, fmt.Errorf("no certificates found in control plane ca file %s", options.EnvoyControlPlaneCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
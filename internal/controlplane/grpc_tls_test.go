@@ -0,0 +1,94 @@
+package controlplane
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+
+	"github.com/pomerium/pomerium/config"
+)
+
+func TestServer_grpcTLS(t *testing.T) {
+	const (
+		caFile   = "../testutil/testdata/tls/ca.crt"
+		certFile = "../testutil/testdata/tls/redis.crt"
+		keyFile  = "../testutil/testdata/tls/redis.key"
+	)
+
+	srv, err := NewServer("test", nil)
+	require.NoError(t, err)
+	go func() { _ = srv.GRPCServer.Serve(srv.GRPCListener) }()
+	defer srv.GRPCServer.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	call := func(opt grpc.DialOption) error {
+		ctx, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+
+		cc, err := grpc.DialContext(ctx, srv.GRPCListener.Addr().String(), opt, grpc.WithBlock())
+		if err != nil {
+			return err
+		}
+		defer cc.Close()
+
+		stream, err := grpc_reflection_v1alpha.NewServerReflectionClient(cc).ServerReflectionInfo(ctx)
+		if err != nil {
+			return err
+		}
+		err = stream.Send(&grpc_reflection_v1alpha.ServerReflectionRequest{
+			MessageRequest: &grpc_reflection_v1alpha.ServerReflectionRequest_ListServices{},
+		})
+		if err != nil {
+			return err
+		}
+		_, err = stream.Recv()
+		return err
+	}
+
+	bs, err := ioutil.ReadFile(caFile)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	require.True(t, pool.AppendCertsFromPEM(bs))
+	clientCert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	require.NoError(t, err)
+
+	// plaintext until tls is enabled
+	assert.NoError(t, call(grpc.WithInsecure()))
+
+	opts := config.NewDefaultOptions()
+	opts.EnvoyControlPlaneTLS = true
+	opts.EnvoyControlPlaneCAFile = caFile
+	opts.EnvoyControlPlaneServerCertFile = certFile
+	opts.EnvoyControlPlaneServerKeyFile = keyFile
+	require.NoError(t, srv.grpcTLSListener.update(opts))
+	assert.Error(t, call(grpc.WithInsecure()), "plaintext connections should be rejected")
+	assert.NoError(t, call(grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
+		RootCAs:    pool,
+		ServerName: "localhost",
+	}))))
+
+	// mutual tls requires the client certificate
+	opts.EnvoyControlPlaneCertFile = certFile
+	opts.EnvoyControlPlaneKeyFile = keyFile
+	require.NoError(t, srv.grpcTLSListener.update(opts))
+	assert.Error(t, call(grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
+		RootCAs:    pool,
+		ServerName: "localhost",
+	}))), "connections without a client certificate should be rejected")
+	assert.NoError(t, call(grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
+		RootCAs:      pool,
+		ServerName:   "localhost",
+		Certificates: []tls.Certificate{clientCert},
+	}))))
+}
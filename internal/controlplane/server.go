@@ -48,6 +48,8 @@ type Server struct {
 	HTTPListener net.Listener
 	HTTPRouter   *mux.Router
 
+	grpcTLSListener *grpcTLSListener
+
 	currentConfig atomicVersionedConfig
 	name          string
 	xdsmgr        *xdsmgr.Manager
@@ -67,10 +69,12 @@ func NewServer(name string, metricsMgr *config.MetricsManager) (*Server, error)
 	var err error
 
 	// setup gRPC
-	srv.GRPCListener, err = net.Listen("tcp4", "127.0.0.1:0")
+	li, err := net.Listen("tcp4", "127.0.0.1:0")
 	if err != nil {
 		return nil, err
 	}
+	srv.grpcTLSListener = newGRPCTLSListener(li)
+	srv.GRPCListener = srv.grpcTLSListener
 	ui, si := grpcutil.AttachMetadataInterceptors(
 		metadata.Pairs(grpcutil.MetadataKeyPomeriumVersion, version.FullVersion()),
 	)
@@ -167,6 +171,10 @@ func (srv *Server) Run(ctx context.Context) error {
 
 // OnConfigChange updates the pomerium config options.
 func (srv *Server) OnConfigChange(cfg *config.Config) error {
+	if err := srv.grpcTLSListener.update(cfg.Options); err != nil {
+		return err
+	}
+
 	prev := srv.currentConfig.Load()
 	srv.currentConfig.Store(versionedConfig{
 		Config:  cfg,
@@ -79,13 +79,22 @@ func buildAccessLogs(options *config.Options) []*envoy_config_accesslog_v3.Acces
 		return nil
 	}
 
+	// access logs are sent to the control plane unless a separate access log service is configured
+	clusterName, logName := config.EnvoyControlPlaneGRPCClusterName, "ingress-http"
+	if options.EnvoyAccessLogServiceAddress != "" {
+		clusterName = config.EnvoyAccessLogServiceClusterName
+		if options.EnvoyAccessLogServiceLogName != "" {
+			logName = options.EnvoyAccessLogServiceLogName
+		}
+	}
+
 	tc := marshalAny(&envoy_extensions_access_loggers_grpc_v3.HttpGrpcAccessLogConfig{
 		CommonConfig: &envoy_extensions_access_loggers_grpc_v3.CommonGrpcAccessLogConfig{
-			LogName: "ingress-http",
+			LogName: logName,
 			GrpcService: &envoy_config_core_v3.GrpcService{
 				TargetSpecifier: &envoy_config_core_v3.GrpcService_EnvoyGrpc_{
 					EnvoyGrpc: &envoy_config_core_v3.GrpcService_EnvoyGrpc{
-						ClusterName: "pomerium-control-plane-grpc",
+						ClusterName: clusterName,
 					},
 				},
 			},
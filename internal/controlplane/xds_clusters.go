@@ -62,15 +62,15 @@ func (srv *Server) buildClusters(options *config.Options) ([]*envoy_config_clust
 		return nil, err
 	}
 
-	controlGRPC, err := srv.buildInternalCluster(options, "pomerium-control-plane-grpc", []*url.URL{grpcURL}, true)
+	controlGRPC, err := srv.buildInternalCluster(options, config.EnvoyControlPlaneGRPCClusterName, []*url.URL{grpcURL}, true)
 	if err != nil {
 		return nil, err
 	}
-	controlHTTP, err := srv.buildInternalCluster(options, "pomerium-control-plane-http", []*url.URL{httpURL}, false)
+	controlHTTP, err := srv.buildInternalCluster(options, config.EnvoyControlPlaneHTTPClusterName, []*url.URL{httpURL}, false)
 	if err != nil {
 		return nil, err
 	}
-	authZ, err := srv.buildInternalCluster(options, "pomerium-authorize", authzURLs, true)
+	authZ, err := srv.buildInternalCluster(options, config.EnvoyAuthorizeClusterName, authzURLs, true)
 	if err != nil {
 		return nil, err
 	}
@@ -81,6 +81,12 @@ func (srv *Server) buildClusters(options *config.Options) ([]*envoy_config_clust
 		authZ,
 	}
 
+	tracingClusters, err := srv.buildTracingClusters(options)
+	if err != nil {
+		return nil, err
+	}
+	clusters = append(clusters, tracingClusters...)
+
 	if config.IsProxy(options.Services) {
 		for i, p := range options.GetAllPolicies() {
 			policy := p
@@ -80,6 +80,12 @@ func (srv *Server) buildListeners(cfg *config.Config) ([]*envoy_config_listener_
 		listeners = append(listeners, li)
 	}
 
+	// envoy has no default socket options for listeners, so socket tuning is applied to each of them
+	for _, li := range listeners {
+		li.ReusePort = cfg.Options.EnvoyListenerReusePort
+		li.SocketOptions = config.GetEnvoySocketOptions(cfg.Options.EnvoyListenerSocketOptions)
+	}
+
 	return listeners, nil
 }
 
@@ -356,7 +362,7 @@ func (srv *Server) buildMainHTTPConnectionManagerFilter(
 				Timeout: grpcClientTimeout,
 				TargetSpecifier: &envoy_config_core_v3.GrpcService_EnvoyGrpc_{
 					EnvoyGrpc: &envoy_config_core_v3.GrpcService_EnvoyGrpc{
-						ClusterName: "pomerium-authorize",
+						ClusterName: config.EnvoyAuthorizeClusterName,
 					},
 				},
 			},
@@ -480,7 +486,7 @@ func (srv *Server) buildMetricsHTTPConnectionManagerFilter() (*envoy_config_list
 			Action: &envoy_config_route_v3.Route_Route{
 				Route: &envoy_config_route_v3.RouteAction{
 					ClusterSpecifier: &envoy_config_route_v3.RouteAction_Cluster{
-						Cluster: "pomerium-control-plane-http",
+						Cluster: config.EnvoyControlPlaneHTTPClusterName,
 					},
 				},
 			},
@@ -581,7 +587,7 @@ func (srv *Server) buildGRPCHTTPConnectionManagerFilter() (*envoy_config_listene
 			Action: &envoy_config_route_v3.Route_Route{
 				Route: &envoy_config_route_v3.RouteAction{
 					ClusterSpecifier: &envoy_config_route_v3.RouteAction_Cluster{
-						Cluster: "pomerium-control-plane-grpc",
+						Cluster: config.EnvoyControlPlaneGRPCClusterName,
 					},
 					// disable the timeout to support grpc streaming
 					Timeout: &durationpb.Duration{
@@ -701,3 +701,48 @@ func Test_requireProxyProtocol(t *testing.T) {
 		assert.Len(t, li.GetListenerFilters(), 0)
 	})
 }
+
+func Test_buildAccessLogs(t *testing.T) {
+	options := config.NewDefaultOptions()
+	options.EnvoyAccessLogServiceAddress = "als.example.com:9000"
+	options.EnvoyAccessLogServiceLogName = "pomerium"
+	testutil.AssertProtoJSONEqual(t, `[{
+		"name": "envoy.access_loggers.http_grpc",
+		"typedConfig": {
+			"@type": "type.googleapis.com/envoy.extensions.access_loggers.grpc.v3.HttpGrpcAccessLogConfig",
+			"commonConfig": {
+				"grpcService": {
+					"envoyGrpc": {
+						"clusterName": "pomerium-access-log-service"
+					}
+				},
+				"logName": "pomerium",
+				"transportApiVersion": "V3"
+			}
+		}
+	}]`, buildAccessLogs(options))
+}
+
+func Test_buildListenersSocketOptions(t *testing.T) {
+	srv, _ := NewServer("TEST", nil)
+	listeners, err := srv.buildListeners(&config.Config{Options: &config.Options{
+		Services:               config.ServiceDataBroker,
+		GRPCInsecure:           true,
+		MetricsAddr:            "127.0.0.1:9902",
+		EnvoyListenerReusePort: true,
+		EnvoyListenerSocketOptions: []config.EnvoySocketOption{
+			{Description: "SO_RCVBUF", Level: 1, Name: 8, IntValue: 1 << 20},
+		},
+	}})
+	require.NoError(t, err)
+	require.Len(t, listeners, 2)
+	for _, li := range listeners {
+		assert.True(t, li.GetReusePort(), li.GetName())
+		testutil.AssertProtoJSONEqual(t, `[{
+			"description": "SO_RCVBUF",
+			"level": "1",
+			"name": "8",
+			"intValue": "1048576"
+		}]`, li.GetSocketOptions(), li.GetName())
+	}
+}
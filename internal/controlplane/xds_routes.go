@@ -22,14 +22,14 @@ import (
 )
 
 const (
-	httpCluster = "pomerium-control-plane-http"
+	httpCluster = config.EnvoyControlPlaneHTTPClusterName
 )
 
 func (srv *Server) buildGRPCRoutes() ([]*envoy_config_route_v3.Route, error) {
 	action := &envoy_config_route_v3.Route_Route{
 		Route: &envoy_config_route_v3.RouteAction{
 			ClusterSpecifier: &envoy_config_route_v3.RouteAction_Cluster{
-				Cluster: "pomerium-control-plane-grpc",
+				Cluster: config.EnvoyControlPlaneGRPCClusterName,
 			},
 		},
 	}
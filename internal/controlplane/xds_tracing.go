@@ -2,14 +2,49 @@ package controlplane
 
 import (
 	"fmt"
+	"net"
+	"strconv"
 
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	envoy_config_trace_v3 "github.com/envoyproxy/go-control-plane/envoy/config/trace/v3"
 	"google.golang.org/protobuf/types/known/anypb"
 
 	"github.com/pomerium/pomerium/config"
+	"github.com/pomerium/pomerium/internal/log"
+	"github.com/pomerium/pomerium/internal/telemetry"
 	"github.com/pomerium/pomerium/internal/telemetry/trace"
 )
 
+const lightstepCollectorClusterName = config.EnvoyLightstepCollectorClusterName
+
+// buildTracingClusters builds any clusters needed by the tracing provider.
+func (srv *Server) buildTracingClusters(options *config.Options) ([]*envoy_config_cluster_v3.Cluster, error) {
+	tracingOptions, err := config.NewTracingOptions(options)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tracing config: %w", err)
+	}
+
+	switch tracingOptions.Provider {
+	case trace.LightstepTracingProviderName:
+		// the collector is not a pomerium service, so verify it against the system root CAs
+		ts, err := srv.buildInternalTransportSocket(new(config.Options), tracingOptions.LightstepCollectorURL)
+		if err != nil {
+			return nil, err
+		}
+
+		cluster := newDefaultEnvoyClusterConfig()
+		cluster.DnsLookupFamily = config.GetEnvoyDNSLookupFamily(options.DNSLookupFamily)
+		endpoints := []Endpoint{NewEndpoint(tracingOptions.LightstepCollectorURL, ts, 1)}
+		if err := srv.buildCluster(cluster, lightstepCollectorClusterName, endpoints, true); err != nil {
+			return nil, err
+		}
+		return []*envoy_config_cluster_v3.Cluster{cluster}, nil
+	default:
+		return nil, nil
+	}
+}
+
 func (srv *Server) buildTracingProvider(options *config.Options) (*envoy_config_trace_v3.Tracing_Http, error) {
 	tracingOptions, err := config.NewTracingOptions(options)
 	if err != nil {
@@ -19,7 +54,7 @@ func (srv *Server) buildTracingProvider(options *config.Options) (*envoy_config_
 	switch tracingOptions.Provider {
 	case trace.DatadogTracingProviderName:
 		tracingTC, _ := anypb.New(&envoy_config_trace_v3.DatadogConfig{
-			CollectorCluster: "datadog-apm",
+			CollectorCluster: config.EnvoyDatadogClusterName,
 			ServiceName:      tracingOptions.Service,
 		})
 		return &envoy_config_trace_v3.Tracing_Http{
@@ -28,6 +63,64 @@ func (srv *Server) buildTracingProvider(options *config.Options) (*envoy_config_
 				TypedConfig: tracingTC,
 			},
 		}, nil
+	case trace.LightstepTracingProviderName:
+		accessTokenFile := options.TracingLightstepAccessTokenFile
+		if accessTokenFile == "" && options.TracingLightstepAccessToken != "" {
+			accessTokenFile = srv.filemgr.BytesDataSource("lightstep-access-token", []byte(options.TracingLightstepAccessToken)).GetFilename()
+		}
+		if accessTokenFile == "" {
+			log.Warn().Msg("lightstep tracing is disabled because no access token is configured")
+			return nil, nil
+		}
+
+		tracingTC, _ := anypb.New(&envoy_config_trace_v3.LightstepConfig{
+			CollectorCluster: lightstepCollectorClusterName,
+			AccessTokenFile:  accessTokenFile,
+			PropagationModes: []envoy_config_trace_v3.LightstepConfig_PropagationMode{
+				envoy_config_trace_v3.LightstepConfig_ENVOY,
+				envoy_config_trace_v3.LightstepConfig_LIGHTSTEP,
+				envoy_config_trace_v3.LightstepConfig_B3,
+				envoy_config_trace_v3.LightstepConfig_TRACE_CONTEXT,
+			},
+		})
+		return &envoy_config_trace_v3.Tracing_Http{
+			Name: "envoy.tracers.lightstep",
+			ConfigType: &envoy_config_trace_v3.Tracing_Http_TypedConfig{
+				TypedConfig: tracingTC,
+			},
+		}, nil
+	case trace.XRayTracingProviderName:
+		xrayConfig := &envoy_config_trace_v3.XRayConfig{
+			SegmentName: tracingOptions.XRaySegmentName,
+		}
+		if xrayConfig.SegmentName == "" {
+			xrayConfig.SegmentName = telemetry.ServiceName(options.Services)
+		}
+		if tracingOptions.XRayDaemonAddress != "" {
+			host, port, err := net.SplitHostPort(tracingOptions.XRayDaemonAddress)
+			if err != nil {
+				return nil, fmt.Errorf("invalid xray daemon address: %w", err)
+			}
+			portValue, err := strconv.ParseUint(port, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid xray daemon port: %w", err)
+			}
+			xrayConfig.DaemonEndpoint = &envoy_config_core_v3.SocketAddress{
+				Protocol: envoy_config_core_v3.SocketAddress_UDP,
+				Address:  host,
+				PortSpecifier: &envoy_config_core_v3.SocketAddress_PortValue{
+					PortValue: uint32(portValue),
+				},
+			}
+		}
+
+		tracingTC, _ := anypb.New(xrayConfig)
+		return &envoy_config_trace_v3.Tracing_Http{
+			Name: "envoy.tracers.xray",
+			ConfigType: &envoy_config_trace_v3.Tracing_Http_TypedConfig{
+				TypedConfig: tracingTC,
+			},
+		}, nil
 	case trace.ZipkinTracingProviderName:
 		if tracingOptions.ZipkinEndpoint.String() == "" {
 			return nil, fmt.Errorf("missing zipkin url")
@@ -0,0 +1,105 @@
+package controlplane
+
+import (
+	"io/ioutil"
+	"testing"
+
+	envoy_config_trace_v3 "github.com/envoyproxy/go-control-plane/envoy/config/trace/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pomerium/pomerium/config"
+	"github.com/pomerium/pomerium/internal/testutil"
+)
+
+func Test_buildTracingProvider(t *testing.T) {
+	srv, _ := NewServer("TEST", nil)
+
+	t.Run("lightstep", func(t *testing.T) {
+		options := config.NewDefaultOptions()
+		options.TracingProvider = "lightstep"
+		options.TracingLightstepAccessTokenFile = "/var/run/secrets/lightstep-access-token"
+		provider, err := srv.buildTracingProvider(options)
+		require.NoError(t, err)
+		testutil.AssertProtoJSONEqual(t, `{
+			"name": "envoy.tracers.lightstep",
+			"typedConfig": {
+				"@type": "type.googleapis.com/envoy.config.trace.v3.LightstepConfig",
+				"collectorCluster": "lightstep-collector",
+				"accessTokenFile": "/var/run/secrets/lightstep-access-token",
+				"propagationModes": ["ENVOY", "LIGHTSTEP", "B3", "TRACE_CONTEXT"]
+			}
+		}`, provider)
+	})
+	t.Run("lightstep inline access token", func(t *testing.T) {
+		options := config.NewDefaultOptions()
+		options.TracingProvider = "lightstep"
+		options.TracingLightstepAccessToken = "ACCESS_TOKEN"
+		provider, err := srv.buildTracingProvider(options)
+		require.NoError(t, err)
+
+		var cfg envoy_config_trace_v3.LightstepConfig
+		require.NoError(t, provider.GetTypedConfig().UnmarshalTo(&cfg))
+		bs, err := ioutil.ReadFile(cfg.GetAccessTokenFile())
+		require.NoError(t, err)
+		assert.Equal(t, "ACCESS_TOKEN", string(bs))
+	})
+	t.Run("lightstep missing access token", func(t *testing.T) {
+		options := config.NewDefaultOptions()
+		options.TracingProvider = "lightstep"
+		provider, err := srv.buildTracingProvider(options)
+		require.NoError(t, err)
+		assert.Nil(t, provider)
+	})
+	t.Run("xray", func(t *testing.T) {
+		options := config.NewDefaultOptions()
+		options.TracingProvider = "xray"
+		options.TracingXRayDaemonAddress = "127.0.0.1:3000"
+		provider, err := srv.buildTracingProvider(options)
+		require.NoError(t, err)
+		testutil.AssertProtoJSONEqual(t, `{
+			"name": "envoy.tracers.xray",
+			"typedConfig": {
+				"@type": "type.googleapis.com/envoy.config.trace.v3.XRayConfig",
+				"daemonEndpoint": { "protocol": "UDP", "address": "127.0.0.1", "portValue": 3000 },
+				"segmentName": "pomerium"
+			}
+		}`, provider)
+	})
+	t.Run("xray segment name", func(t *testing.T) {
+		options := config.NewDefaultOptions()
+		options.TracingProvider = "xray"
+
+		var cfg envoy_config_trace_v3.XRayConfig
+		options.Services = "proxy"
+		provider, err := srv.buildTracingProvider(options)
+		require.NoError(t, err)
+		require.NoError(t, provider.GetTypedConfig().UnmarshalTo(&cfg))
+		assert.Equal(t, "pomerium-proxy", cfg.GetSegmentName(), "the segment should be named after the service")
+
+		options.TracingXRaySegmentName = "example"
+		provider, err = srv.buildTracingProvider(options)
+		require.NoError(t, err)
+		require.NoError(t, provider.GetTypedConfig().UnmarshalTo(&cfg))
+		assert.Equal(t, "example", cfg.GetSegmentName())
+	})
+}
+
+func Test_buildTracingClusters(t *testing.T) {
+	srv, _ := NewServer("TEST", nil)
+
+	options := config.NewDefaultOptions()
+	clusters, err := srv.buildTracingClusters(options)
+	require.NoError(t, err)
+	assert.Empty(t, clusters)
+
+	options.TracingProvider = "lightstep"
+	options.TracingLightstepCollectorURL = "http://lightstep-satellite:8360"
+	clusters, err = srv.buildTracingClusters(options)
+	require.NoError(t, err)
+	if assert.Len(t, clusters, 1) {
+		assert.Equal(t, "lightstep-collector", clusters[0].GetName())
+		assert.Equal(t, "STRICT_DNS", clusters[0].GetType().String())
+		assert.NotNil(t, clusters[0].GetHttp2ProtocolOptions())
+	}
+}
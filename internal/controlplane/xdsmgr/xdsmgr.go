@@ -9,8 +9,6 @@ import (
 	envoy_service_discovery_v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
 	"github.com/google/uuid"
 	"golang.org/x/sync/errgroup"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
 
 	"github.com/pomerium/pomerium/internal/log"
 	"github.com/pomerium/pomerium/internal/signal"
@@ -24,6 +22,29 @@ type streamState struct {
 
 var onHandleDeltaRequest = func(state *streamState) {}
 
+type sotwStreamState struct {
+	// resourceNames are the subscribed resources, empty for a wildcard subscription
+	resourceNames []string
+	// sentVersion is the version of the resources last sent to the client
+	sentVersion string
+	// pending is set when the client is owed a response even if the resources haven't changed
+	pending bool
+}
+
+func (state *sotwStreamState) subscribed(name string) bool {
+	if len(state.resourceNames) == 0 {
+		return true
+	}
+	for _, n := range state.resourceNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+var onHandleStreamRequest = func(state *sotwStreamState) {}
+
 // A Manager manages xDS resources.
 type Manager struct {
 	signal *signal.Signal
@@ -210,11 +231,138 @@ func (mgr *Manager) DeltaAggregatedResources(
 	return eg.Wait()
 }
 
-// StreamAggregatedResources is not implemented.
+// StreamAggregatedResources implements the state-of-the-world xDS server. Each response contains every
+// resource of its type the client subscribed to, or all of them for wildcard subscriptions.
 func (mgr *Manager) StreamAggregatedResources(
 	stream envoy_service_discovery_v3.AggregatedDiscoveryService_StreamAggregatedResourcesServer,
 ) error {
-	return status.Errorf(codes.Unimplemented, "method StreamAggregatedResources not implemented")
+	ch := mgr.signal.Bind()
+	defer mgr.signal.Unbind(ch)
+
+	stateByTypeURL := map[string]*sotwStreamState{}
+
+	getResponse := func(typeURL string) *envoy_service_discovery_v3.DiscoveryResponse {
+		mgr.mu.Lock()
+		defer mgr.mu.Unlock()
+
+		state, ok := stateByTypeURL[typeURL]
+		if !ok || !state.pending && state.sentVersion == mgr.nonce {
+			return nil
+		}
+		state.pending = false
+		state.sentVersion = mgr.nonce
+
+		res := &envoy_service_discovery_v3.DiscoveryResponse{
+			VersionInfo: mgr.nonce,
+			TypeUrl:     typeURL,
+			Nonce:       mgr.nonce,
+		}
+		for _, resource := range mgr.resources[typeURL] {
+			if state.subscribed(resource.Name) {
+				res.Resources = append(res.Resources, resource.Resource)
+			}
+		}
+		return res
+	}
+
+	handleRequest := func(req *envoy_service_discovery_v3.DiscoveryRequest) {
+		mgr.mu.Lock()
+		defer mgr.mu.Unlock()
+
+		state, ok := stateByTypeURL[req.GetTypeUrl()]
+		if !ok {
+			// first time we've seen a message for this type URL.
+			state = &sotwStreamState{pending: true}
+			stateByTypeURL[req.GetTypeUrl()] = state
+		}
+
+		switch {
+		case req.GetResponseNonce() == "":
+			// a new subscription, which always gets a response
+			state.pending = true
+		case req.GetErrorDetail() != nil:
+			// a NACK, the rejected resources aren't sent again until they're updated
+			bs, _ := json.Marshal(req.ErrorDetail.Details)
+			log.Error().
+				Err(errors.New(req.ErrorDetail.Message)).
+				Int32("code", req.ErrorDetail.Code).
+				RawJSON("details", bs).Msg("error applying configuration")
+		}
+
+		// a change to the subscribed resources is answered with the new set
+		if !stringSlicesEqual(state.resourceNames, req.GetResourceNames()) {
+			state.resourceNames = req.GetResourceNames()
+			state.pending = true
+		}
+
+		onHandleStreamRequest(state)
+	}
+
+	incoming := make(chan *envoy_service_discovery_v3.DiscoveryRequest)
+	outgoing := make(chan *envoy_service_discovery_v3.DiscoveryResponse)
+	eg, ctx := errgroup.WithContext(stream.Context())
+	// 1. receive all incoming messages
+	eg.Go(func() error {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				return err
+			}
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case incoming <- req:
+			}
+		}
+	})
+	// 2. handle incoming requests or resource changes
+	eg.Go(func() error {
+		for {
+			var typeURLs []string
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case req := <-incoming:
+				handleRequest(req)
+				typeURLs = []string{req.GetTypeUrl()}
+			case <-ch:
+				mgr.mu.Lock()
+				for typeURL := range stateByTypeURL {
+					typeURLs = append(typeURLs, typeURL)
+				}
+				mgr.mu.Unlock()
+			}
+
+			for _, typeURL := range typeURLs {
+				res := getResponse(typeURL)
+				if res == nil {
+					continue
+				}
+
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case outgoing <- res:
+				}
+			}
+		}
+	})
+	// 3. send all outgoing messages
+	eg.Go(func() error {
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case res := <-outgoing:
+				err := stream.Send(res)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	})
+	return eg.Wait()
 }
 
 // Update updates the state of resources. If any changes are made they will be pushed to any listening
@@ -227,3 +375,15 @@ func (mgr *Manager) Update(resources map[string][]*envoy_service_discovery_v3.Re
 
 	mgr.signal.Broadcast()
 }
+
+func stringSlicesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -10,8 +10,9 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 
 	"github.com/pomerium/pomerium/internal/signal"
 )
@@ -53,16 +54,6 @@ func TestManager(t *testing.T) {
 	defer func() { _ = cc.Close() }()
 
 	client := envoy_service_discovery_v3.NewAggregatedDiscoveryServiceClient(cc)
-	t.Run("stream is disabled", func(t *testing.T) {
-		stream, err := client.StreamAggregatedResources(ctx)
-		if !assert.NoError(t, err) {
-			return
-		}
-		_, err = stream.Recv()
-		assert.Error(t, err, "only delta should be implemented")
-		assert.Equal(t, codes.Unimplemented, grpc.Code(err))
-	})
-
 	t.Run("updates", func(t *testing.T) {
 		stream, err := client.DeltaAggregatedResources(ctx)
 		if !assert.NoError(t, err) {
@@ -117,3 +108,84 @@ func TestManager(t *testing.T) {
 		}, time.Second*5, time.Millisecond)
 	})
 }
+
+func TestManager_StreamAggregatedResources(t *testing.T) {
+	ctx, clearTimeout := context.WithTimeout(context.Background(), time.Second*10)
+	defer clearTimeout()
+
+	typeURL := "example.com/example"
+	resource := func(name, value string) *envoy_service_discovery_v3.Resource {
+		a, err := anypb.New(wrapperspb.String(value))
+		require.NoError(t, err)
+		return &envoy_service_discovery_v3.Resource{Name: name, Version: value, Resource: a}
+	}
+
+	srv := grpc.NewServer()
+	mgr := NewManager(map[string][]*envoy_service_discovery_v3.Resource{
+		typeURL: {resource("r1", "1"), resource("r2", "1")},
+	})
+	envoy_service_discovery_v3.RegisterAggregatedDiscoveryServiceServer(srv, mgr)
+
+	li := bufconn.Listen(bufSize)
+	go func() { _ = srv.Serve(li) }()
+	defer srv.Stop()
+
+	cc, err := grpc.Dial("test",
+		grpc.WithInsecure(),
+		grpc.WithContextDialer(func(ctx context.Context, target string) (net.Conn, error) {
+			return li.Dial()
+		}))
+	require.NoError(t, err)
+	defer func() { _ = cc.Close() }()
+
+	client := envoy_service_discovery_v3.NewAggregatedDiscoveryServiceClient(cc)
+	stream, err := client.StreamAggregatedResources(ctx)
+	require.NoError(t, err)
+
+	values := func(res *envoy_service_discovery_v3.DiscoveryResponse) []string {
+		var vs []string
+		for _, a := range res.GetResources() {
+			v := new(wrapperspb.StringValue)
+			require.NoError(t, a.UnmarshalTo(v))
+			vs = append(vs, v.GetValue())
+		}
+		return vs
+	}
+
+	// a wildcard subscription gets every resource
+	require.NoError(t, stream.Send(&envoy_service_discovery_v3.DiscoveryRequest{TypeUrl: typeURL}))
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	assert.NotEmpty(t, res.GetNonce(), "nonce should not be empty")
+	assert.Equal(t, []string{"1", "1"}, values(res))
+
+	// an ACK gets no response, so the next response is the update
+	require.NoError(t, stream.Send(&envoy_service_discovery_v3.DiscoveryRequest{
+		TypeUrl:       typeURL,
+		VersionInfo:   res.GetVersionInfo(),
+		ResponseNonce: res.GetNonce(),
+	}))
+	mgr.Update(map[string][]*envoy_service_discovery_v3.Resource{
+		typeURL: {resource("r1", "2")},
+	})
+	res, err = stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2"}, values(res), "the whole state should be sent")
+
+	// subscribing to named resources only sends those
+	mgr.Update(map[string][]*envoy_service_discovery_v3.Resource{
+		typeURL: {resource("r1", "3"), resource("r2", "3")},
+	})
+	res, err = stream.Recv()
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&envoy_service_discovery_v3.DiscoveryRequest{
+		TypeUrl:       typeURL,
+		ResourceNames: []string{"r2"},
+		VersionInfo:   res.GetVersionInfo(),
+		ResponseNonce: res.GetNonce(),
+	}))
+	res, err = stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"3"}, values(res))
+	assert.Len(t, res.GetResources(), 1)
+}
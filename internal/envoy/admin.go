@@ -0,0 +1,432 @@
+package envoy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pomerium/pomerium/internal/log"
+	"github.com/pomerium/pomerium/internal/telemetry/metrics"
+	"github.com/pomerium/pomerium/internal/tripper"
+)
+
+// envoy server states, as reported by the admin /server_info endpoint
+const (
+	ServerStateLive         = "LIVE"
+	ServerStateDraining     = "DRAINING"
+	ServerStatePreInit      = "PRE_INITIALIZING"
+	ServerStateInitializing = "INITIALIZING"
+)
+
+const adminRequestTimeout = 5 * time.Second
+
+// serverStatePollInterval is how often the server state is polled while waiting for envoy to become live.
+const serverStatePollInterval = 100 * time.Millisecond
+
+var (
+	errAdminDisabled = errors.New("envoy admin interface is disabled")
+	errEnvoyExited   = errors.New("envoy exited")
+)
+
+// An adminClient sends requests to the envoy admin interface at an admin url. Its connections are reused,
+// so clients are cached on the Server rather than built per request.
+type adminClient struct {
+	adminURL string
+	baseURL  *url.URL
+	client   *http.Client
+}
+
+// newAdminClient returns a client for the envoy admin interface. Admin urls with a unix
+// scheme are reached over the unix socket.
+func newAdminClient(adminURL string) (*adminClient, error) {
+	u, err := url.Parse(adminURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid envoy admin url: %w", err)
+	}
+
+	c := &adminClient{adminURL: adminURL, baseURL: u}
+	if u.Scheme == "unix" {
+		c.baseURL = &url.URL{Scheme: "http", Host: "envoy"}
+		c.client = &http.Client{Timeout: adminRequestTimeout, Transport: tripper.NewUnixSocketTransport(u.Path)}
+	} else {
+		c.client = &http.Client{Timeout: adminRequestTimeout, Transport: http.DefaultTransport.(*http.Transport).Clone()}
+	}
+	return c, nil
+}
+
+// close closes the client's idle connections.
+func (c *adminClient) close() {
+	c.client.CloseIdleConnections()
+}
+
+// getAdminClient returns the cached client for the envoy admin interface. The cached client
+// is replaced when the admin url changes.
+func (srv *Server) getAdminClient(adminURL string) (*adminClient, error) {
+	srv.adminClientMu.Lock()
+	defer srv.adminClientMu.Unlock()
+
+	if srv.adminClient != nil && srv.adminClient.adminURL == adminURL {
+		return srv.adminClient, nil
+	}
+
+	c, err := newAdminClient(adminURL)
+	if err != nil {
+		return nil, err
+	}
+	if srv.adminClient != nil {
+		srv.adminClient.close()
+	}
+	srv.adminClient = c
+	return c, nil
+}
+
+// closeAdminClient closes the cached admin client, if there is one.
+func (srv *Server) closeAdminClient() {
+	srv.adminClientMu.Lock()
+	defer srv.adminClientMu.Unlock()
+
+	if srv.adminClient != nil {
+		srv.adminClient.close()
+		srv.adminClient = nil
+	}
+}
+
+// adminRequest sends a request to the envoy admin interface.
+func adminRequest(ctx context.Context, client *adminClient, method, pathAndQuery string) (*http.Response, error) {
+	ref, err := url.Parse(pathAndQuery)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, client.baseURL.ResolveReference(ref).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return client.client.Do(req)
+}
+
+// adminPost sends a POST request to the envoy admin interface and returns an error if it doesn't succeed.
+func adminPost(ctx context.Context, client *adminClient, pathAndQuery string) error {
+	res, err := adminRequest(ctx, client, http.MethodPost, pathAndQuery)
+	if err != nil {
+		return err
+	}
+	_ = res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status from envoy admin %s: %s", pathAndQuery, res.Status)
+	}
+	return nil
+}
+
+// setLogLevel sets the level of all of envoy's loggers via the admin interface.
+func setLogLevel(ctx context.Context, client *adminClient, level string) error {
+	// the admin interface only accepts envoy's own name for the warning level
+	if level == "warn" {
+		level = "warning"
+	}
+	query := url.Values{"level": {level}}
+	if err := adminPost(ctx, client, "/logging?"+query.Encode()); err != nil {
+		return fmt.Errorf("error setting envoy log level: %w", err)
+	}
+	return nil
+}
+
+// ServerState returns the state of the running envoy process, as reported by the admin /server_info
+// endpoint. It returns an error if the admin interface is disabled or envoy can't be reached.
+func (srv *Server) ServerState(ctx context.Context) (string, error) {
+	srv.mu.Lock()
+	adminURL := srv.options.adminURL
+	srv.mu.Unlock()
+
+	if adminURL == "" {
+		return "", errAdminDisabled
+	}
+	client, err := srv.getAdminClient(adminURL)
+	if err != nil {
+		return "", err
+	}
+	return serverState(ctx, client)
+}
+
+// serverInfo is the part of the admin /server_info response pomerium uses.
+type serverInfo struct {
+	State              string `json:"state"`
+	CommandLineOptions struct {
+		RestartEpoch int `json:"restart_epoch"`
+	} `json:"command_line_options"`
+}
+
+// getServerInfo returns the server info reported by the envoy admin interface.
+func getServerInfo(ctx context.Context, client *adminClient) (*serverInfo, error) {
+	res, err := adminRequest(ctx, client, http.MethodGet, "/server_info")
+	if err != nil {
+		return nil, fmt.Errorf("error querying envoy server info: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status querying envoy server info: %s", res.Status)
+	}
+
+	var info serverInfo
+	if err := json.NewDecoder(res.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("error decoding envoy server info: %w", err)
+	}
+	return &info, nil
+}
+
+// serverState returns the state reported by the envoy admin interface.
+func serverState(ctx context.Context, client *adminClient) (string, error) {
+	info, err := getServerInfo(ctx, client)
+	if err != nil {
+		return "", err
+	}
+	return info.State, nil
+}
+
+// waitForLive polls the envoy admin interface until the envoy process with the given restart
+// epoch reports that it's live. During a hot restart the previous process keeps answering on the shared
+// admin address until the new one takes it over, so its answers are ignored. It returns errEnvoyExited
+// if exited is closed first, or the context's error if it's done first.
+func waitForLive(ctx context.Context, client *adminClient, epoch int, exited <-chan struct{}) error {
+	for {
+		// the admin interface is only available once envoy has started, so errors are retried
+		info, err := getServerInfo(ctx, client)
+		if err == nil && info.State == ServerStateLive && info.CommandLineOptions.RestartEpoch == epoch {
+			return nil
+		}
+
+		select {
+		case <-exited:
+			return errEnvoyExited
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(serverStatePollInterval):
+		}
+	}
+}
+
+// Drain starts gracefully draining envoy's listeners. Envoy's health checks start failing, so load
+// balancers stop sending it traffic, and listeners stop accepting new connections once they've drained.
+func (srv *Server) Drain(ctx context.Context) error {
+	srv.mu.Lock()
+	adminURL := srv.options.adminURL
+	srv.mu.Unlock()
+
+	if adminURL == "" {
+		return errAdminDisabled
+	}
+
+	client, err := srv.getAdminClient(adminURL)
+	if err != nil {
+		return err
+	}
+
+	srv.setDrainInitiated(true)
+	if err := adminPost(ctx, client, "/healthcheck/fail"); err != nil {
+		return fmt.Errorf("error failing envoy health checks: %w", err)
+	}
+	if err := adminPost(ctx, client, "/drain_listeners?graceful"); err != nil {
+		return fmt.Errorf("error draining envoy listeners: %w", err)
+	}
+	return nil
+}
+
+// activeConnections returns the number of connections envoy is handling, from the
+// server.total_connections stat. It returns false if the stat isn't available.
+func activeConnections(ctx context.Context, client *adminClient) (int, bool) {
+	query := url.Values{"filter": {`^server\.total_connections$`}}
+	res, err := adminRequest(ctx, client, http.MethodGet, "/stats?"+query.Encode())
+	if err != nil {
+		return 0, false
+	}
+	defer res.Body.Close()
+
+	bs, err := ioutil.ReadAll(res.Body)
+	if err != nil || res.StatusCode != http.StatusOK {
+		return 0, false
+	}
+	for _, line := range strings.Split(string(bs), "\n") {
+		if !strings.HasPrefix(line, "server.total_connections: ") {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(line, "server.total_connections: "))
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// Stat returns the value of a single envoy counter or gauge from the admin /stats endpoint. It returns an
+// error if the admin interface is disabled, envoy can't be reached or envoy has no such stat.
+func (srv *Server) Stat(ctx context.Context, name string) (float64, error) {
+	srv.mu.Lock()
+	adminURL := srv.options.adminURL
+	srv.mu.Unlock()
+
+	if adminURL == "" {
+		return 0, errAdminDisabled
+	}
+	client, err := srv.getAdminClient(adminURL)
+	if err != nil {
+		return 0, err
+	}
+	return stat(ctx, client, name)
+}
+
+// stat returns the value of the named counter or gauge reported by the envoy admin interface.
+func stat(ctx context.Context, client *adminClient, name string) (float64, error) {
+	query := url.Values{"filter": {"^" + regexp.QuoteMeta(name) + "$"}, "format": {"json"}}
+	res, err := adminRequest(ctx, client, http.MethodGet, "/stats?"+query.Encode())
+	if err != nil {
+		return 0, fmt.Errorf("error querying envoy stats: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status querying envoy stats: %s", res.Status)
+	}
+
+	// histograms are reported in the same list without a name, so they're skipped
+	var stats struct {
+		Stats []struct {
+			Name  string   `json:"name"`
+			Value *float64 `json:"value"`
+		} `json:"stats"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&stats); err != nil {
+		return 0, fmt.Errorf("error decoding envoy stats: %w", err)
+	}
+	for _, s := range stats.Stats {
+		if s.Name == name && s.Value != nil {
+			return *s.Value, nil
+		}
+	}
+	return 0, fmt.Errorf("envoy stat %s not found", name)
+}
+
+// memoryStats is envoy's memory usage, as reported by the admin /memory endpoint.
+type memoryStats struct {
+	Allocated        int64 `json:"allocated,string"`
+	HeapSize         int64 `json:"heap_size,string"`
+	TotalThreadCache int64 `json:"total_thread_cache,string"`
+}
+
+// memory returns the memory usage reported by the envoy admin interface.
+func memory(ctx context.Context, client *adminClient) (*memoryStats, error) {
+	res, err := adminRequest(ctx, client, http.MethodGet, "/memory")
+	if err != nil {
+		return nil, fmt.Errorf("error querying envoy memory: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status querying envoy memory: %s", res.Status)
+	}
+
+	var m memoryStats
+	if err := json.NewDecoder(res.Body).Decode(&m); err != nil {
+		return nil, fmt.Errorf("error decoding envoy memory: %w", err)
+	}
+	return &m, nil
+}
+
+// measureMemory records envoy's memory usage from the admin interface. Envoy may be restarting, so
+// errors are only logged at debug level.
+func (srv *Server) measureMemory(ctx context.Context) {
+	srv.mu.Lock()
+	adminURL := srv.options.adminURL
+	var services string
+	if srv.appliedConfig != nil {
+		services = srv.appliedConfig.Options.Services
+	}
+	srv.mu.Unlock()
+
+	if adminURL == "" {
+		return
+	}
+	client, err := srv.getAdminClient(adminURL)
+	if err != nil {
+		log.Debug().Err(err).Str("service", "envoy").Msg("envoy: failed to measure envoy memory")
+		return
+	}
+	m, err := memory(ctx, client)
+	if err != nil {
+		log.Debug().Err(err).Str("service", "envoy").Msg("envoy: failed to measure envoy memory")
+		return
+	}
+	metrics.RecordEnvoyMemory(services, m.Allocated, m.HeapSize, m.TotalThreadCache)
+}
+
+// waitForDrain waits until envoy has no active connections or the context is done.
+func waitForDrain(ctx context.Context, client *adminClient) {
+	const pollInterval = 500 * time.Millisecond
+	for {
+		n, ok := activeConnections(ctx, client)
+		if !ok || n == 0 {
+			return
+		}
+		log.Debug().Str("service", "envoy").Int("connections", n).Msg("envoy: waiting for connections to drain")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// setDrainInitiated records whether pomerium has asked envoy to drain, so the drain watcher doesn't
+// report it.
+func (srv *Server) setDrainInitiated(initiated bool) {
+	var v int32
+	if initiated {
+		v = 1
+	}
+	atomic.StoreInt32(&srv.drainInitiated, v)
+}
+
+// watchDraining polls the envoy server state and reports when envoy starts draining without pomerium
+// having initiated it, e.g. because envoy was sent a signal.
+func (srv *Server) watchDraining(ctx context.Context) {
+	var lastState string
+	for {
+		srv.mu.Lock()
+		interval := firstNonZeroDuration(srv.options.drainWatchInterval, defaultDrainWatchInterval)
+		srv.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		state, err := srv.ServerState(ctx)
+		if errors.Is(err, errAdminDisabled) {
+			continue
+		} else if err != nil {
+			// envoy may be restarting
+			log.Debug().Err(err).Str("service", "envoy").Msg("envoy: failed to query server state")
+			lastState = ""
+			continue
+		}
+
+		if state == ServerStateDraining && lastState != ServerStateDraining && atomic.LoadInt32(&srv.drainInitiated) == 0 {
+			srv.mu.Lock()
+			epoch := srv.epoch
+			srv.mu.Unlock()
+
+			log.Warn().Str("service", "envoy").Int("restart_epoch", epoch).Msg("envoy: envoy is draining unexpectedly")
+			srv.notifyEvents(newEvent(EventDraining, epoch, nil))
+		}
+		lastState = state
+	}
+}
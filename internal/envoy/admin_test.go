@@ -0,0 +1,249 @@
+package envoy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/stats/view"
+
+	"github.com/pomerium/pomerium/config"
+	"github.com/pomerium/pomerium/internal/telemetry/metrics"
+)
+
+// newFakeAdmin starts a fake envoy admin interface. It returns the server, a function to set the
+// reported server state and a function returning the paths of the requests it received.
+func newFakeAdmin(t *testing.T) (srv *httptest.Server, setState func(string), requests func() []string) {
+	srv = httptest.NewUnstartedServer(nil)
+	setState, requests = startFakeAdmin(t, srv)
+	return srv, setState, requests
+}
+
+// startFakeAdmin starts srv as a fake envoy admin interface.
+func startFakeAdmin(t *testing.T, srv *httptest.Server) (setState func(string), requests func() []string) {
+	var mu sync.Mutex
+	state := ServerStateLive
+	var paths []string
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		paths = append(paths, r.Method+" "+r.URL.Path)
+
+		switch r.URL.Path {
+		case "/server_info":
+			_, _ = w.Write([]byte(`{"version":"test","state":"` + state + `","uptime_current_epoch":"1s"}`))
+		case "/healthcheck/fail", "/drain_listeners":
+			state = ServerStateDraining
+			_, _ = w.Write([]byte("OK\n"))
+		case "/memory":
+			_, _ = w.Write([]byte(`{"allocated":"1000","heap_size":"4000","pageheap_unmapped":"0","pageheap_free":"0","total_thread_cache":"200"}`))
+		case "/logging":
+			_, _ = w.Write([]byte("active loggers:\n"))
+		case "/stats":
+			if r.URL.Query().Get("format") == "json" {
+				_, _ = w.Write([]byte(`{"stats":[{"name":"server.live","value":1},{"histograms":{"supported_quantiles":[50]}}]}`))
+				return
+			}
+			_, _ = w.Write([]byte("server.total_connections: 0\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return func(s string) {
+			mu.Lock()
+			state = s
+			mu.Unlock()
+		}, func() []string {
+			mu.Lock()
+			defer mu.Unlock()
+			return append([]string(nil), paths...)
+		}
+}
+
+func TestServer_ServerState(t *testing.T) {
+	admin, setState, _ := newFakeAdmin(t)
+
+	srv := &Server{options: serverOptions{adminURL: admin.URL}}
+	state, err := srv.ServerState(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, ServerStateLive, state)
+
+	setState(ServerStateDraining)
+	state, err = srv.ServerState(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, ServerStateDraining, state)
+
+	srv.options.adminURL = ""
+	_, err = srv.ServerState(context.Background())
+	assert.ErrorIs(t, err, errAdminDisabled)
+}
+
+// newTestAdminClient returns a client for the admin interface at adminURL, closed when the test ends.
+func newTestAdminClient(t *testing.T, adminURL string) *adminClient {
+	client, err := newAdminClient(adminURL)
+	require.NoError(t, err)
+	t.Cleanup(client.close)
+	return client
+}
+
+func TestServer_getAdminClient(t *testing.T) {
+	srv := &Server{}
+	defer srv.closeAdminClient()
+
+	client, err := srv.getAdminClient("http://127.0.0.1:9901")
+	require.NoError(t, err)
+	same, err := srv.getAdminClient("http://127.0.0.1:9901")
+	require.NoError(t, err)
+	assert.Same(t, client, same, "the client should be reused for the same admin url")
+
+	other, err := srv.getAdminClient("unix:///tmp/envoy-admin.sock")
+	require.NoError(t, err)
+	assert.NotSame(t, client, other, "the client should be replaced when the admin url changes")
+	assert.Equal(t, &url.URL{Scheme: "http", Host: "envoy"}, other.baseURL)
+
+	_, err = srv.getAdminClient("://invalid")
+	assert.Error(t, err)
+}
+
+func Test_waitForLive(t *testing.T) {
+	// the previous process answers on the shared admin address until the new one takes it over
+	var epoch int32 = 1
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, `{"state":"LIVE","command_line_options":{"restart_epoch":%d}}`, atomic.LoadInt32(&epoch))
+	}))
+	defer admin.Close()
+	client := newTestAdminClient(t, admin.URL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, waitForLive(ctx, client, 2, nil), context.DeadlineExceeded,
+		"a live parent process should not end the wait")
+
+	time.AfterFunc(100*time.Millisecond, func() { atomic.StoreInt32(&epoch, 2) })
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, waitForLive(ctx, client, 2, nil))
+}
+
+func TestServer_watchDraining(t *testing.T) {
+	admin, setState, _ := newFakeAdmin(t)
+
+	srv := &Server{options: serverOptions{adminURL: admin.URL, drainWatchInterval: 10 * time.Millisecond}}
+	var mu sync.Mutex
+	var events []Event
+	srv.OnEvent(func(evt Event) {
+		mu.Lock()
+		events = append(events, evt)
+		mu.Unlock()
+	})
+	eventCount := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(events)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go srv.watchDraining(ctx)
+
+	// drains initiated by pomerium aren't reported
+	srv.setDrainInitiated(true)
+	setState(ServerStateDraining)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 0, eventCount())
+
+	setState(ServerStateLive)
+	srv.setDrainInitiated(false)
+	time.Sleep(50 * time.Millisecond)
+	setState(ServerStateDraining)
+	require.Eventually(t, func() bool {
+		return eventCount() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the transition is only reported once
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 1, eventCount())
+	mu.Lock()
+	assert.Equal(t, EventDraining, events[0].Type)
+	mu.Unlock()
+}
+
+func TestServer_Drain(t *testing.T) {
+	admin, _, requests := newFakeAdmin(t)
+
+	srv := &Server{options: serverOptions{adminURL: admin.URL}}
+	require.NoError(t, srv.Drain(context.Background()))
+	assert.Equal(t, []string{"POST /healthcheck/fail", "POST /drain_listeners"}, requests())
+	assert.Equal(t, int32(1), srv.drainInitiated, "drains initiated by pomerium should not be reported")
+
+	n, ok := activeConnections(context.Background(), newTestAdminClient(t, admin.URL))
+	assert.True(t, ok)
+	assert.Equal(t, 0, n)
+
+	srv.options.adminURL = ""
+	assert.ErrorIs(t, srv.Drain(context.Background()), errAdminDisabled)
+}
+
+func TestServer_Stat(t *testing.T) {
+	admin, _, _ := newFakeAdmin(t)
+
+	srv := &Server{options: serverOptions{adminURL: admin.URL}}
+	v, err := srv.Stat(context.Background(), "server.live")
+	require.NoError(t, err)
+	assert.Equal(t, float64(1), v)
+
+	_, err = srv.Stat(context.Background(), "server.missing")
+	assert.Error(t, err)
+
+	srv.options.adminURL = ""
+	_, err = srv.Stat(context.Background(), "server.live")
+	assert.ErrorIs(t, err, errAdminDisabled)
+}
+
+func TestServer_measureMemory(t *testing.T) {
+	views := []*view.View{metrics.EnvoyMemoryAllocatedView, metrics.EnvoyMemoryHeapSizeView, metrics.EnvoyMemoryTotalThreadCacheView}
+	require.NoError(t, view.Register(views...))
+	defer view.Unregister(views...)
+
+	admin, _, _ := newFakeAdmin(t)
+	srv := &Server{
+		options:       serverOptions{adminURL: admin.URL},
+		appliedConfig: &config.Config{Options: &config.Options{Services: "proxy"}},
+	}
+	srv.measureMemory(context.Background())
+
+	for name, expected := range map[string]float64{
+		metrics.EnvoyMemoryAllocatedView.Name:        1000,
+		metrics.EnvoyMemoryHeapSizeView.Name:         4000,
+		metrics.EnvoyMemoryTotalThreadCacheView.Name: 200,
+	} {
+		rows, err := view.RetrieveData(name)
+		require.NoError(t, err)
+		require.Len(t, rows, 1, name)
+		assert.Equal(t, "proxy", rows[0].Tags[0].Value)
+		assert.Equal(t, expected, rows[0].Data.(*view.LastValueData).Value, name)
+	}
+}
+
+func Test_setLogLevel(t *testing.T) {
+	var levels []string
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		levels = append(levels, r.URL.Query().Get("level"))
+	}))
+	defer admin.Close()
+	client := newTestAdminClient(t, admin.URL)
+
+	require.NoError(t, setLogLevel(context.Background(), client, "debug"))
+	require.NoError(t, setLogLevel(context.Background(), client, "warn"))
+	assert.Equal(t, []string{"debug", "warning"}, levels)
+}
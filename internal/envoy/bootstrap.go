@@ -0,0 +1,634 @@
+package envoy
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	envoy_config_bootstrap_v3 "github.com/envoyproxy/go-control-plane/envoy/config/bootstrap/v3"
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_config_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	envoy_config_listener_v3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	envoy_config_overload_v3 "github.com/envoyproxy/go-control-plane/envoy/config/overload/v3"
+	envoy_config_route_v3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	envoy_extensions_filters_http_health_check_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/health_check/v3"
+	envoy_http_connection_manager "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	envoy_extensions_filters_network_tcp_proxy_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/tcp_proxy/v3"
+	envoy_extensions_resource_monitors_fixed_heap_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/resource_monitors/fixed_heap/v3"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/pomerium/pomerium/config"
+)
+
+const (
+	accessLogServiceClusterName = config.EnvoyAccessLogServiceClusterName
+	datadogClusterName          = config.EnvoyDatadogClusterName
+	healthCheckListenerName     = "pomerium-health-check"
+	statsAdminClusterName       = config.EnvoyAdminClusterName
+	statsListenerName           = "pomerium-envoy-stats"
+	tracingProxyClusterName     = config.EnvoyTracingProxyClusterName
+	tracingProxyListenerName    = "pomerium-tracing-proxy-tunnel"
+)
+
+// tracingProxySocketName is the name of the unix socket in the working directory which tracing clusters
+// connect to when their traffic is tunneled through a proxy.
+const tracingProxySocketName = "tracing-proxy.sock"
+
+const defaultHealthCheckPath = "/healthz"
+
+const (
+	// statsPath is the admin endpoint which the stats listener exposes.
+	statsPath = "/stats/prometheus"
+	// statsAdminConnectTimeout is the connect timeout of the cluster which the stats listener reaches the
+	// admin interface through.
+	statsAdminConnectTimeout = time.Second
+)
+
+const (
+	defaultOverloadStopAcceptingConnectionsThreshold = 0.95
+	defaultOverloadStopAcceptingRequestsThreshold    = 0.98
+)
+
+// buildNode builds the node config which identifies this envoy instance to the control plane.
+func (srv *Server) buildNode() (*envoy_config_core_v3.Node, error) {
+	node := &envoy_config_core_v3.Node{
+		Id:      srv.options.nodeID,
+		Cluster: srv.options.nodeCluster,
+	}
+
+	if len(srv.options.nodeMetadata) > 0 {
+		fields := make(map[string]interface{}, len(srv.options.nodeMetadata))
+		for k, v := range srv.options.nodeMetadata {
+			fields[k] = v
+		}
+		md, err := structpb.NewStruct(fields)
+		if err != nil {
+			return nil, fmt.Errorf("invalid envoy node metadata: %w", err)
+		}
+		node.Metadata = md
+	}
+
+	if srv.options.nodeLocalityRegion != "" || srv.options.nodeLocalityZone != "" || srv.options.nodeLocalitySubZone != "" {
+		node.Locality = &envoy_config_core_v3.Locality{
+			Region:  srv.options.nodeLocalityRegion,
+			Zone:    srv.options.nodeLocalityZone,
+			SubZone: srv.options.nodeLocalitySubZone,
+		}
+	}
+
+	return node, nil
+}
+
+// datadogAddress returns the address of the Datadog APM agent.
+func (srv *Server) datadogAddress() *envoy_config_core_v3.SocketAddress {
+	addr := &envoy_config_core_v3.SocketAddress{
+		Address: "127.0.0.1",
+		PortSpecifier: &envoy_config_core_v3.SocketAddress_PortValue{
+			PortValue: 8126,
+		},
+	}
+	if srv.options.tracingOptions.DatadogAddress != "" {
+		a, p, err := net.SplitHostPort(srv.options.tracingOptions.DatadogAddress)
+		if err == nil {
+			addr.Address = a
+			if pv, err := strconv.ParseUint(p, 10, 32); err == nil {
+				addr.PortSpecifier = &envoy_config_core_v3.SocketAddress_PortValue{
+					PortValue: uint32(pv),
+				}
+			}
+		}
+	}
+	return addr
+}
+
+// buildDatadogCluster builds the cluster for the Datadog APM agent. When a tracing proxy is configured
+// the cluster connects to the tracing proxy tunnel instead of the agent.
+func (srv *Server) buildDatadogCluster() *envoy_config_cluster_v3.Cluster {
+	addr := &envoy_config_core_v3.Address{
+		Address: &envoy_config_core_v3.Address_SocketAddress{
+			SocketAddress: srv.datadogAddress(),
+		},
+	}
+
+	// for IPs we use a static discovery type, otherwise we use DNS
+	discoveryType := envoy_config_cluster_v3.Cluster_STATIC
+	if srv.options.tracingProxyAddress != "" {
+		addr = srv.tracingProxyTunnelAddress()
+	} else if net.ParseIP(addr.GetSocketAddress().GetAddress()) == nil {
+		discoveryType = envoy_config_cluster_v3.Cluster_STRICT_DNS
+	}
+
+	cluster := &envoy_config_cluster_v3.Cluster{
+		Name:           datadogClusterName,
+		ConnectTimeout: durationpb.New(srv.options.datadogConnectTimeout),
+		ClusterDiscoveryType: &envoy_config_cluster_v3.Cluster_Type{
+			Type: discoveryType,
+		},
+		LbPolicy: config.GetEnvoyLBPolicy(srv.options.datadogLBPolicy),
+		LoadAssignment: &envoy_config_endpoint_v3.ClusterLoadAssignment{
+			ClusterName: datadogClusterName,
+			Endpoints: []*envoy_config_endpoint_v3.LocalityLbEndpoints{{
+				LbEndpoints: []*envoy_config_endpoint_v3.LbEndpoint{{
+					HostIdentifier: &envoy_config_endpoint_v3.LbEndpoint_Endpoint{
+						Endpoint: &envoy_config_endpoint_v3.Endpoint{
+							Address: addr,
+						},
+					},
+				}},
+			}},
+		},
+	}
+
+	if discoveryType == envoy_config_cluster_v3.Cluster_STRICT_DNS && srv.options.datadogDNSRefreshRate > 0 {
+		cluster.DnsRefreshRate = durationpb.New(srv.options.datadogDNSRefreshRate)
+	}
+
+	cluster.CircuitBreakers = buildCircuitBreakers(srv.options.datadogMaxConnections, srv.options.datadogMaxPendingRequests, 0)
+
+	return cluster
+}
+
+// buildCircuitBreakers builds circuit breakers for a cluster with the given thresholds. Thresholds which
+// are zero are left at envoy's defaults, and when all of them are zero nil is returned.
+func buildCircuitBreakers(maxConnections, maxPendingRequests, maxRequests uint32) *envoy_config_cluster_v3.CircuitBreakers {
+	if maxConnections == 0 && maxPendingRequests == 0 && maxRequests == 0 {
+		return nil
+	}
+
+	thresholds := &envoy_config_cluster_v3.CircuitBreakers_Thresholds{}
+	if maxConnections > 0 {
+		thresholds.MaxConnections = wrapperspb.UInt32(maxConnections)
+	}
+	if maxPendingRequests > 0 {
+		thresholds.MaxPendingRequests = wrapperspb.UInt32(maxPendingRequests)
+	}
+	if maxRequests > 0 {
+		thresholds.MaxRequests = wrapperspb.UInt32(maxRequests)
+	}
+	return &envoy_config_cluster_v3.CircuitBreakers{
+		Thresholds: []*envoy_config_cluster_v3.CircuitBreakers_Thresholds{thresholds},
+	}
+}
+
+// tracingProxyTunnelAddress returns the address of the listener which tunnels tracing traffic through
+// the tracing proxy.
+func (srv *Server) tracingProxyTunnelAddress() *envoy_config_core_v3.Address {
+	return &envoy_config_core_v3.Address{
+		Address: &envoy_config_core_v3.Address_Pipe{
+			Pipe: &envoy_config_core_v3.Pipe{
+				Path: filepath.Join(srv.wd, tracingProxySocketName),
+			},
+		},
+	}
+}
+
+// buildTracingProxy builds the listener and cluster which tunnel connections to the Datadog agent at
+// target through the tracing proxy using HTTP CONNECT. The datadog cluster connects to the listener in
+// place of the agent. It's the only tracing cluster envoy owns, the Zipkin exporter posts to its URL
+// directly, so no other provider is proxied.
+func (srv *Server) buildTracingProxy(target *envoy_config_core_v3.SocketAddress) (*envoy_config_listener_v3.Listener, *envoy_config_cluster_v3.Cluster, error) {
+	proxyAddr, err := ParseAddress(srv.options.tracingProxyAddress)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid tracing proxy address: %w", err)
+	}
+
+	discoveryType := envoy_config_cluster_v3.Cluster_STATIC
+	if net.ParseIP(proxyAddr.GetSocketAddress().GetAddress()) == nil {
+		discoveryType = envoy_config_cluster_v3.Cluster_STRICT_DNS
+	}
+
+	cluster := &envoy_config_cluster_v3.Cluster{
+		Name:           tracingProxyClusterName,
+		ConnectTimeout: durationpb.New(srv.options.datadogConnectTimeout),
+		ClusterDiscoveryType: &envoy_config_cluster_v3.Cluster_Type{
+			Type: discoveryType,
+		},
+		LoadAssignment: &envoy_config_endpoint_v3.ClusterLoadAssignment{
+			ClusterName: tracingProxyClusterName,
+			Endpoints: []*envoy_config_endpoint_v3.LocalityLbEndpoints{{
+				LbEndpoints: []*envoy_config_endpoint_v3.LbEndpoint{{
+					HostIdentifier: &envoy_config_endpoint_v3.LbEndpoint_Endpoint{
+						Endpoint: &envoy_config_endpoint_v3.Endpoint{
+							Address: proxyAddr,
+						},
+					},
+				}},
+			}},
+		},
+	}
+
+	tcpProxyConfig, err := anypb.New(&envoy_extensions_filters_network_tcp_proxy_v3.TcpProxy{
+		StatPrefix: "tracing_proxy",
+		ClusterSpecifier: &envoy_extensions_filters_network_tcp_proxy_v3.TcpProxy_Cluster{
+			Cluster: tracingProxyClusterName,
+		},
+		TunnelingConfig: &envoy_extensions_filters_network_tcp_proxy_v3.TcpProxy_TunnelingConfig{
+			Hostname: net.JoinHostPort(target.GetAddress(), strconv.FormatUint(uint64(target.GetPortValue()), 10)),
+		},
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("error marshaling tracing proxy config: %w", err)
+	}
+
+	listener := &envoy_config_listener_v3.Listener{
+		Name:    tracingProxyListenerName,
+		Address: srv.tracingProxyTunnelAddress(),
+		FilterChains: []*envoy_config_listener_v3.FilterChain{{
+			Filters: []*envoy_config_listener_v3.Filter{{
+				Name: "envoy.filters.network.tcp_proxy",
+				ConfigType: &envoy_config_listener_v3.Filter_TypedConfig{
+					TypedConfig: tcpProxyConfig,
+				},
+			}},
+		}},
+	}
+
+	return listener, cluster, nil
+}
+
+// buildAccessLogServiceCluster builds the cluster for the gRPC access log service. When no access
+// log service is configured nil is returned.
+func (srv *Server) buildAccessLogServiceCluster() (*envoy_config_cluster_v3.Cluster, error) {
+	if srv.options.accessLogServiceAddress == "" {
+		return nil, nil
+	}
+
+	addr, err := ParseAddress(srv.options.accessLogServiceAddress)
+	if err != nil {
+		return nil, fmt.Errorf("invalid access log service address: %w", err)
+	}
+
+	discoveryType := envoy_config_cluster_v3.Cluster_STATIC
+	if net.ParseIP(addr.GetSocketAddress().GetAddress()) == nil {
+		discoveryType = envoy_config_cluster_v3.Cluster_STRICT_DNS
+	}
+
+	return &envoy_config_cluster_v3.Cluster{
+		Name:           accessLogServiceClusterName,
+		ConnectTimeout: durationpb.New(5 * time.Second),
+		ClusterDiscoveryType: &envoy_config_cluster_v3.Cluster_Type{
+			Type: discoveryType,
+		},
+		LbPolicy: envoy_config_cluster_v3.Cluster_ROUND_ROBIN,
+		LoadAssignment: &envoy_config_endpoint_v3.ClusterLoadAssignment{
+			ClusterName: accessLogServiceClusterName,
+			Endpoints: []*envoy_config_endpoint_v3.LocalityLbEndpoints{{
+				LbEndpoints: []*envoy_config_endpoint_v3.LbEndpoint{{
+					HostIdentifier: &envoy_config_endpoint_v3.LbEndpoint_Endpoint{
+						Endpoint: &envoy_config_endpoint_v3.Endpoint{
+							Address: addr,
+						},
+					},
+				}},
+			}},
+		},
+		Http2ProtocolOptions: &envoy_config_core_v3.Http2ProtocolOptions{},
+	}, nil
+}
+
+// buildHealthCheckListener builds a static listener which answers health checks directly from envoy, without
+// going through the data plane. It responds with a 200 while envoy is live and a 503 once it starts
+// draining. When no health check address is configured nil is returned.
+func (srv *Server) buildHealthCheckListener() (*envoy_config_listener_v3.Listener, error) {
+	if srv.options.healthCheckAddress == "" {
+		return nil, nil
+	}
+
+	addr, err := ParseAddress(srv.options.healthCheckAddress)
+	if err != nil {
+		return nil, fmt.Errorf("invalid health check address: %w", err)
+	}
+	if addr.GetSocketAddress().GetAddress() == "" {
+		addr.GetSocketAddress().Address = "0.0.0.0"
+	}
+
+	healthCheckConfig, err := anypb.New(&envoy_extensions_filters_http_health_check_v3.HealthCheck{
+		PassThroughMode: wrapperspb.Bool(false),
+		Headers: []*envoy_config_route_v3.HeaderMatcher{{
+			Name: ":path",
+			HeaderMatchSpecifier: &envoy_config_route_v3.HeaderMatcher_ExactMatch{
+				ExactMatch: firstNonEmpty(srv.options.healthCheckPath, defaultHealthCheckPath),
+			},
+		}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling health check config: %w", err)
+	}
+
+	hcmConfig, err := anypb.New(&envoy_http_connection_manager.HttpConnectionManager{
+		CodecType:  envoy_http_connection_manager.HttpConnectionManager_AUTO,
+		StatPrefix: "health_check",
+		RouteSpecifier: &envoy_http_connection_manager.HttpConnectionManager_RouteConfig{
+			RouteConfig: &envoy_config_route_v3.RouteConfiguration{
+				Name: healthCheckListenerName,
+				VirtualHosts: []*envoy_config_route_v3.VirtualHost{{
+					Name:    healthCheckListenerName,
+					Domains: []string{"*"},
+				}},
+			},
+		},
+		HttpFilters: []*envoy_http_connection_manager.HttpFilter{
+			{
+				Name: "envoy.filters.http.health_check",
+				ConfigType: &envoy_http_connection_manager.HttpFilter_TypedConfig{
+					TypedConfig: healthCheckConfig,
+				},
+			},
+			{
+				Name: "envoy.filters.http.router",
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling health check http connection manager config: %w", err)
+	}
+
+	return &envoy_config_listener_v3.Listener{
+		Name:          healthCheckListenerName,
+		Address:       addr,
+		ReusePort:     srv.options.listenerReusePort,
+		SocketOptions: config.GetEnvoySocketOptions(srv.options.listenerSocketOptions),
+		FilterChains: []*envoy_config_listener_v3.FilterChain{{
+			Filters: []*envoy_config_listener_v3.Filter{{
+				Name: "envoy.filters.network.http_connection_manager",
+				ConfigType: &envoy_config_listener_v3.Filter_TypedConfig{
+					TypedConfig: hcmConfig,
+				},
+			}},
+		}},
+	}, nil
+}
+
+// buildStatsListener builds a static listener which serves envoy's prometheus stats, and the cluster it
+// proxies them from the admin interface at adminAddr through, so metrics can be scraped without exposing
+// the rest of the admin interface. Requests for any other path get a 404. When no stats address is
+// configured nil is returned.
+func (srv *Server) buildStatsListener(adminAddr *envoy_config_core_v3.Address) (*envoy_config_listener_v3.Listener, *envoy_config_cluster_v3.Cluster, error) {
+	if srv.options.statsAddress == "" {
+		return nil, nil, nil
+	}
+	if adminAddr == nil {
+		return nil, nil, fmt.Errorf("the envoy stats listener requires the envoy admin interface")
+	}
+
+	addr, err := ParseAddress(srv.options.statsAddress)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid stats address: %w", err)
+	}
+	if addr.GetSocketAddress().GetAddress() == "" {
+		addr.GetSocketAddress().Address = "0.0.0.0"
+	}
+
+	// the admin interface may listen on a wildcard address, which can't be connected to
+	adminAddr = proto.Clone(adminAddr).(*envoy_config_core_v3.Address)
+	if sa := adminAddr.GetSocketAddress(); sa != nil {
+		switch sa.GetAddress() {
+		case "", "0.0.0.0":
+			sa.Address = "127.0.0.1"
+		case "::":
+			sa.Address = "::1"
+		}
+	}
+
+	cluster := &envoy_config_cluster_v3.Cluster{
+		Name:           statsAdminClusterName,
+		ConnectTimeout: durationpb.New(statsAdminConnectTimeout),
+		ClusterDiscoveryType: &envoy_config_cluster_v3.Cluster_Type{
+			Type: envoy_config_cluster_v3.Cluster_STATIC,
+		},
+		LoadAssignment: &envoy_config_endpoint_v3.ClusterLoadAssignment{
+			ClusterName: statsAdminClusterName,
+			Endpoints: []*envoy_config_endpoint_v3.LocalityLbEndpoints{{
+				LbEndpoints: []*envoy_config_endpoint_v3.LbEndpoint{{
+					HostIdentifier: &envoy_config_endpoint_v3.LbEndpoint_Endpoint{
+						Endpoint: &envoy_config_endpoint_v3.Endpoint{
+							Address: adminAddr,
+						},
+					},
+				}},
+			}},
+		},
+	}
+
+	hcmConfig, err := anypb.New(&envoy_http_connection_manager.HttpConnectionManager{
+		CodecType:  envoy_http_connection_manager.HttpConnectionManager_AUTO,
+		StatPrefix: "envoy_stats",
+		RouteSpecifier: &envoy_http_connection_manager.HttpConnectionManager_RouteConfig{
+			RouteConfig: &envoy_config_route_v3.RouteConfiguration{
+				Name: statsListenerName,
+				VirtualHosts: []*envoy_config_route_v3.VirtualHost{{
+					Name:    statsListenerName,
+					Domains: []string{"*"},
+					Routes: []*envoy_config_route_v3.Route{{
+						Match: &envoy_config_route_v3.RouteMatch{
+							PathSpecifier: &envoy_config_route_v3.RouteMatch_Path{Path: statsPath},
+						},
+						Action: &envoy_config_route_v3.Route_Route{
+							Route: &envoy_config_route_v3.RouteAction{
+								ClusterSpecifier: &envoy_config_route_v3.RouteAction_Cluster{
+									Cluster: statsAdminClusterName,
+								},
+							},
+						},
+					}},
+				}},
+			},
+		},
+		HttpFilters: []*envoy_http_connection_manager.HttpFilter{{
+			Name: "envoy.filters.http.router",
+		}},
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("error marshaling stats http connection manager config: %w", err)
+	}
+
+	listener := &envoy_config_listener_v3.Listener{
+		Name:          statsListenerName,
+		Address:       addr,
+		ReusePort:     srv.options.listenerReusePort,
+		SocketOptions: config.GetEnvoySocketOptions(srv.options.listenerSocketOptions),
+		FilterChains: []*envoy_config_listener_v3.FilterChain{{
+			Filters: []*envoy_config_listener_v3.Filter{{
+				Name: "envoy.filters.network.http_connection_manager",
+				ConfigType: &envoy_config_listener_v3.Filter_TypedConfig{
+					TypedConfig: hcmConfig,
+				},
+			}},
+		}},
+	}
+
+	return listener, cluster, nil
+}
+
+// buildControlPlaneConnectionOptions builds the TCP keepalive options for the control plane cluster. It
+// returns nil if TCP keepalive isn't configured.
+func (srv *Server) buildControlPlaneConnectionOptions() *envoy_config_cluster_v3.UpstreamConnectionOptions {
+	probes := srv.options.controlPlaneTCPKeepaliveProbes
+	keepaliveTime := srv.options.controlPlaneTCPKeepaliveTime
+	interval := srv.options.controlPlaneTCPKeepaliveInterval
+	if probes == 0 && keepaliveTime == 0 && interval == 0 {
+		return nil
+	}
+
+	keepalive := new(envoy_config_core_v3.TcpKeepalive)
+	if probes > 0 {
+		keepalive.KeepaliveProbes = wrapperspb.UInt32(probes)
+	}
+	if keepaliveTime > 0 {
+		keepalive.KeepaliveTime = wrapperspb.UInt32(uint32(keepaliveTime / time.Second))
+	}
+	if interval > 0 {
+		keepalive.KeepaliveInterval = wrapperspb.UInt32(uint32(interval / time.Second))
+	}
+	return &envoy_config_cluster_v3.UpstreamConnectionOptions{
+		TcpKeepalive: keepalive,
+	}
+}
+
+// checkPortConflicts returns an error if any of the control plane gRPC port, the control plane HTTP port
+// and the port of the admin address are the same, which envoy would otherwise only report once it fails
+// to start. Only ports are compared, as the addresses may be wildcards. Unix socket admin addresses and
+// ephemeral ports can't conflict.
+func (srv *Server) checkPortConflicts(adminAddr *envoy_config_core_v3.Address) error {
+	type namedPort struct{ name, port string }
+	ports := []namedPort{
+		{"control plane grpc", srv.grpcPort},
+		{"control plane http", srv.httpPort},
+	}
+	if sa := adminAddr.GetSocketAddress(); sa != nil {
+		ports = append(ports, namedPort{"envoy admin", strconv.FormatUint(uint64(sa.GetPortValue()), 10)})
+	}
+
+	seen := map[string]string{}
+	for _, p := range ports {
+		if p.port == "" || p.port == "0" {
+			continue
+		}
+		if other, ok := seen[p.port]; ok {
+			return fmt.Errorf("port conflict: the %s port and the %s port are both %s", other, p.name, p.port)
+		}
+		seen[p.port] = p.name
+	}
+	return nil
+}
+
+// buildAdminConfig builds the admin interface config. When the admin interface is disabled nil
+// is returned.
+func (srv *Server) buildAdminConfig(cfg *config.Config) (*envoy_config_bootstrap_v3.Admin, error) {
+	if cfg.Options.EnvoyAdminDisabled {
+		return nil, nil
+	}
+
+	adminAddr, err := parseAdminAddress(cfg.Options.EnvoyAdminAddress)
+	if err != nil {
+		return nil, err
+	}
+	if err := srv.checkPortConflicts(adminAddr); err != nil {
+		return nil, err
+	}
+	paths := []string{cfg.Options.EnvoyAdminAccessLogPath}
+	if cfg.Options.EnvoyAdminProfilingEnabled {
+		paths = append(paths, cfg.Options.EnvoyAdminProfilePath)
+	}
+	for _, p := range paths {
+		if err := validateWritablePath(p); err != nil {
+			return nil, err
+		}
+	}
+
+	adminCfg := &envoy_config_bootstrap_v3.Admin{
+		AccessLogPath: cfg.Options.EnvoyAdminAccessLogPath,
+		Address:       adminAddr,
+	}
+	// profiling is off unless it's enabled, so the profile path is omitted
+	if cfg.Options.EnvoyAdminProfilingEnabled {
+		adminCfg.ProfilePath = cfg.Options.EnvoyAdminProfilePath
+	}
+	return adminCfg, nil
+}
+
+// buildLayeredRuntime builds a static runtime layer from the configured runtime keys and the global
+// downstream connection limit. When neither is configured nil is returned.
+func (srv *Server) buildLayeredRuntime() (*envoy_config_bootstrap_v3.LayeredRuntime, error) {
+	keys := make(map[string]interface{}, len(srv.options.runtime)+1)
+	for k, v := range srv.options.runtime {
+		keys[k] = v
+	}
+	if srv.options.globalDownstreamMaxConnections > 0 {
+		keys[config.EnvoyGlobalDownstreamMaxConnectionsRuntimeKey] = srv.options.globalDownstreamMaxConnections
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	layer, err := structpb.NewStruct(keys)
+	if err != nil {
+		return nil, fmt.Errorf("invalid envoy runtime: %w", err)
+	}
+
+	return &envoy_config_bootstrap_v3.LayeredRuntime{
+		Layers: []*envoy_config_bootstrap_v3.RuntimeLayer{{
+			Name: "static_layer_0",
+			LayerSpecifier: &envoy_config_bootstrap_v3.RuntimeLayer_StaticLayer{
+				StaticLayer: layer,
+			},
+		}},
+	}, nil
+}
+
+// buildOverloadManager builds the overload manager config. When no max heap size is configured
+// the overload manager is disabled and nil is returned.
+func (srv *Server) buildOverloadManager() (*envoy_config_overload_v3.OverloadManager, error) {
+	if srv.options.overloadMaxHeapSizeBytes == 0 {
+		return nil, nil
+	}
+
+	fixedHeapConfig, err := anypb.New(&envoy_extensions_resource_monitors_fixed_heap_v3.FixedHeapConfig{
+		MaxHeapSizeBytes: srv.options.overloadMaxHeapSizeBytes,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling fixed heap config: %w", err)
+	}
+
+	const fixedHeapMonitorName = "envoy.resource_monitors.fixed_heap"
+	thresholdTrigger := func(value float64) []*envoy_config_overload_v3.Trigger {
+		return []*envoy_config_overload_v3.Trigger{{
+			Name: fixedHeapMonitorName,
+			TriggerOneof: &envoy_config_overload_v3.Trigger_Threshold{
+				Threshold: &envoy_config_overload_v3.ThresholdTrigger{
+					Value: value,
+				},
+			},
+		}}
+	}
+
+	return &envoy_config_overload_v3.OverloadManager{
+		ResourceMonitors: []*envoy_config_overload_v3.ResourceMonitor{{
+			Name: fixedHeapMonitorName,
+			ConfigType: &envoy_config_overload_v3.ResourceMonitor_TypedConfig{
+				TypedConfig: fixedHeapConfig,
+			},
+		}},
+		Actions: []*envoy_config_overload_v3.OverloadAction{
+			{
+				Name: "envoy.overload_actions.stop_accepting_connections",
+				Triggers: thresholdTrigger(firstNonZeroFloat(
+					srv.options.overloadStopAcceptingConnectionsThreshold,
+					defaultOverloadStopAcceptingConnectionsThreshold)),
+			},
+			{
+				Name: "envoy.overload_actions.stop_accepting_requests",
+				Triggers: thresholdTrigger(firstNonZeroFloat(
+					srv.options.overloadStopAcceptingRequestsThreshold,
+					defaultOverloadStopAcceptingRequestsThreshold)),
+			},
+		},
+	}, nil
+}
@@ -0,0 +1,511 @@
+package envoy
+
+import (
+	"testing"
+	"time"
+
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pomerium/pomerium/config"
+	"github.com/pomerium/pomerium/internal/telemetry/trace"
+	"github.com/pomerium/pomerium/internal/testutil"
+)
+
+func TestServer_buildNode(t *testing.T) {
+	t.Run("default", func(t *testing.T) {
+		srv := &Server{options: serverOptions{nodeID: "proxy", nodeCluster: "proxy"}}
+		node, err := srv.buildNode()
+		require.NoError(t, err)
+		testutil.AssertProtoJSONEqual(t, `{ "id": "proxy", "cluster": "proxy" }`, node)
+	})
+	t.Run("metadata and locality", func(t *testing.T) {
+		srv := &Server{options: serverOptions{
+			nodeID:             "proxy",
+			nodeCluster:        "proxy",
+			nodeMetadata:       map[string]string{"tenant": "example"},
+			nodeLocalityRegion: "us-east-1",
+			nodeLocalityZone:   "us-east-1a",
+		}}
+		node, err := srv.buildNode()
+		require.NoError(t, err)
+		testutil.AssertProtoJSONEqual(t, `{
+			"id": "proxy",
+			"cluster": "proxy",
+			"metadata": { "tenant": "example" },
+			"locality": { "region": "us-east-1", "zone": "us-east-1a" }
+		}`, node)
+	})
+}
+
+func TestServer_buildDatadogCluster(t *testing.T) {
+	t.Run("default", func(t *testing.T) {
+		srv := &Server{options: serverOptions{datadogConnectTimeout: 5 * time.Second}}
+		testutil.AssertProtoJSONEqual(t, `{
+			"name": "datadog-apm",
+			"type": "STATIC",
+			"connectTimeout": "5s",
+			"loadAssignment": {
+				"clusterName": "datadog-apm",
+				"endpoints": [{
+					"lbEndpoints": [{
+						"endpoint": {
+							"address": { "socketAddress": { "address": "127.0.0.1", "portValue": 8126 } }
+						}
+					}]
+				}]
+			}
+		}`, srv.buildDatadogCluster())
+	})
+	t.Run("resilience", func(t *testing.T) {
+		srv := &Server{options: serverOptions{
+			tracingOptions:            trace.TracingOptions{DatadogAddress: "datadog-agent.monitoring.svc:8126"},
+			datadogConnectTimeout:     time.Second,
+			datadogDNSRefreshRate:     10 * time.Second,
+			datadogMaxConnections:     10,
+			datadogMaxPendingRequests: 100,
+			datadogLBPolicy:           "LEAST_REQUEST",
+		}}
+		testutil.AssertProtoJSONEqual(t, `{
+			"name": "datadog-apm",
+			"type": "STRICT_DNS",
+			"connectTimeout": "1s",
+			"lbPolicy": "LEAST_REQUEST",
+			"dnsRefreshRate": "10s",
+			"circuitBreakers": {
+				"thresholds": [{ "maxConnections": 10, "maxPendingRequests": 100 }]
+			},
+			"loadAssignment": {
+				"clusterName": "datadog-apm",
+				"endpoints": [{
+					"lbEndpoints": [{
+						"endpoint": {
+							"address": { "socketAddress": { "address": "datadog-agent.monitoring.svc", "portValue": 8126 } }
+						}
+					}]
+				}]
+			}
+		}`, srv.buildDatadogCluster())
+	})
+	t.Run("proxy", func(t *testing.T) {
+		srv := &Server{wd: "/tmp/envoy", options: serverOptions{
+			tracingOptions:        trace.TracingOptions{DatadogAddress: "datadog-agent.monitoring.svc:8126"},
+			datadogConnectTimeout: time.Second,
+			datadogDNSRefreshRate: 10 * time.Second,
+			tracingProxyAddress:   "proxy.corp.example.com:3128",
+		}}
+		testutil.AssertProtoJSONEqual(t, `{
+			"name": "datadog-apm",
+			"type": "STATIC",
+			"connectTimeout": "1s",
+			"loadAssignment": {
+				"clusterName": "datadog-apm",
+				"endpoints": [{
+					"lbEndpoints": [{
+						"endpoint": {
+							"address": { "pipe": { "path": "/tmp/envoy/tracing-proxy.sock" } }
+						}
+					}]
+				}]
+			}
+		}`, srv.buildDatadogCluster())
+	})
+}
+
+func TestServer_buildTracingProxy(t *testing.T) {
+	srv := &Server{wd: "/tmp/envoy", options: serverOptions{
+		datadogConnectTimeout: time.Second,
+		tracingProxyAddress:   "proxy.corp.example.com:3128",
+	}}
+	listener, cluster, err := srv.buildTracingProxy(&envoy_config_core_v3.SocketAddress{
+		Address:       "datadog-agent.monitoring.svc",
+		PortSpecifier: &envoy_config_core_v3.SocketAddress_PortValue{PortValue: 8126},
+	})
+	require.NoError(t, err)
+	testutil.AssertProtoJSONEqual(t, `{
+		"name": "pomerium-tracing-proxy-tunnel",
+		"address": { "pipe": { "path": "/tmp/envoy/tracing-proxy.sock" } },
+		"filterChains": [{
+			"filters": [{
+				"name": "envoy.filters.network.tcp_proxy",
+				"typedConfig": {
+					"@type": "type.googleapis.com/envoy.extensions.filters.network.tcp_proxy.v3.TcpProxy",
+					"statPrefix": "tracing_proxy",
+					"cluster": "pomerium-tracing-proxy",
+					"tunnelingConfig": { "hostname": "datadog-agent.monitoring.svc:8126" }
+				}
+			}]
+		}]
+	}`, listener)
+	testutil.AssertProtoJSONEqual(t, `{
+		"name": "pomerium-tracing-proxy",
+		"type": "STRICT_DNS",
+		"connectTimeout": "1s",
+		"loadAssignment": {
+			"clusterName": "pomerium-tracing-proxy",
+			"endpoints": [{
+				"lbEndpoints": [{
+					"endpoint": {
+						"address": { "socketAddress": { "address": "proxy.corp.example.com", "portValue": 3128 } }
+					}
+				}]
+			}]
+		}
+	}`, cluster)
+
+	srv.options.tracingProxyAddress = "proxy.corp.example.com"
+	_, _, err = srv.buildTracingProxy(srv.datadogAddress())
+	assert.Error(t, err)
+}
+
+func TestServer_buildAccessLogServiceCluster(t *testing.T) {
+	t.Run("disabled", func(t *testing.T) {
+		srv := &Server{}
+		cluster, err := srv.buildAccessLogServiceCluster()
+		require.NoError(t, err)
+		assert.Nil(t, cluster)
+	})
+	t.Run("enabled", func(t *testing.T) {
+		srv := &Server{options: serverOptions{accessLogServiceAddress: "als.example.com:9000"}}
+		cluster, err := srv.buildAccessLogServiceCluster()
+		require.NoError(t, err)
+		testutil.AssertProtoJSONEqual(t, `{
+			"name": "pomerium-access-log-service",
+			"type": "STRICT_DNS",
+			"connectTimeout": "5s",
+			"loadAssignment": {
+				"clusterName": "pomerium-access-log-service",
+				"endpoints": [{
+					"lbEndpoints": [{
+						"endpoint": {
+							"address": { "socketAddress": { "address": "als.example.com", "portValue": 9000 } }
+						}
+					}]
+				}]
+			},
+			"http2ProtocolOptions": {}
+		}`, cluster)
+	})
+}
+
+func TestServer_buildHealthCheckListener(t *testing.T) {
+	t.Run("disabled", func(t *testing.T) {
+		srv := &Server{}
+		listener, err := srv.buildHealthCheckListener()
+		require.NoError(t, err)
+		assert.Nil(t, listener)
+	})
+	t.Run("enabled", func(t *testing.T) {
+		srv := &Server{options: serverOptions{healthCheckAddress: ":9902"}}
+		listener, err := srv.buildHealthCheckListener()
+		require.NoError(t, err)
+		testutil.AssertProtoJSONEqual(t, `{
+			"name": "pomerium-health-check",
+			"address": { "socketAddress": { "address": "0.0.0.0", "portValue": 9902 } },
+			"filterChains": [{
+				"filters": [{
+					"name": "envoy.filters.network.http_connection_manager",
+					"typedConfig": {
+						"@type": "type.googleapis.com/envoy.extensions.filters.network.http_connection_manager.v3.HttpConnectionManager",
+						"statPrefix": "health_check",
+						"routeConfig": {
+							"name": "pomerium-health-check",
+							"virtualHosts": [{ "name": "pomerium-health-check", "domains": ["*"] }]
+						},
+						"httpFilters": [
+							{
+								"name": "envoy.filters.http.health_check",
+								"typedConfig": {
+									"@type": "type.googleapis.com/envoy.extensions.filters.http.health_check.v3.HealthCheck",
+									"passThroughMode": false,
+									"headers": [{ "name": ":path", "exactMatch": "/healthz" }]
+								}
+							},
+							{ "name": "envoy.filters.http.router" }
+						]
+					}
+				}]
+			}]
+		}`, listener)
+	})
+	t.Run("socket options", func(t *testing.T) {
+		srv := &Server{options: serverOptions{
+			healthCheckAddress:    ":9902",
+			listenerReusePort:     true,
+			listenerSocketOptions: []config.EnvoySocketOption{{Level: 1, Name: 8, IntValue: 1 << 20, State: config.EnvoySocketStateListening}},
+		}}
+		listener, err := srv.buildHealthCheckListener()
+		require.NoError(t, err)
+		assert.True(t, listener.GetReusePort())
+		testutil.AssertProtoJSONEqual(t, `[{"level": "1", "name": "8", "intValue": "1048576", "state": "STATE_LISTENING"}]`,
+			listener.GetSocketOptions())
+	})
+	t.Run("invalid address", func(t *testing.T) {
+		srv := &Server{options: serverOptions{healthCheckAddress: "9902"}}
+		_, err := srv.buildHealthCheckListener()
+		assert.Error(t, err)
+	})
+}
+
+func TestServer_buildStatsListener(t *testing.T) {
+	adminAddr, err := ParseAddress("0.0.0.0:9901")
+	require.NoError(t, err)
+
+	t.Run("disabled", func(t *testing.T) {
+		srv := &Server{}
+		listener, cluster, err := srv.buildStatsListener(adminAddr)
+		require.NoError(t, err)
+		assert.Nil(t, listener)
+		assert.Nil(t, cluster)
+	})
+	t.Run("enabled", func(t *testing.T) {
+		srv := &Server{options: serverOptions{statsAddress: ":9903"}}
+		listener, cluster, err := srv.buildStatsListener(adminAddr)
+		require.NoError(t, err)
+		testutil.AssertProtoJSONEqual(t, `{
+			"name": "pomerium-envoy-stats",
+			"address": { "socketAddress": { "address": "0.0.0.0", "portValue": 9903 } },
+			"filterChains": [{
+				"filters": [{
+					"name": "envoy.filters.network.http_connection_manager",
+					"typedConfig": {
+						"@type": "type.googleapis.com/envoy.extensions.filters.network.http_connection_manager.v3.HttpConnectionManager",
+						"statPrefix": "envoy_stats",
+						"routeConfig": {
+							"name": "pomerium-envoy-stats",
+							"virtualHosts": [{
+								"name": "pomerium-envoy-stats",
+								"domains": ["*"],
+								"routes": [{
+									"match": { "path": "/stats/prometheus" },
+									"route": { "cluster": "pomerium-envoy-admin" }
+								}]
+							}]
+						},
+						"httpFilters": [{ "name": "envoy.filters.http.router" }]
+					}
+				}]
+			}]
+		}`, listener)
+		testutil.AssertProtoJSONEqual(t, `{
+			"name": "pomerium-envoy-admin",
+			"type": "STATIC",
+			"connectTimeout": "1s",
+			"loadAssignment": {
+				"clusterName": "pomerium-envoy-admin",
+				"endpoints": [{
+					"lbEndpoints": [{
+						"endpoint": {
+							"address": { "socketAddress": { "address": "127.0.0.1", "portValue": 9901 } }
+						}
+					}]
+				}]
+			}
+		}`, cluster)
+		assert.Equal(t, "0.0.0.0", adminAddr.GetSocketAddress().GetAddress(), "the admin address should not be changed")
+	})
+	t.Run("admin disabled", func(t *testing.T) {
+		srv := &Server{options: serverOptions{statsAddress: ":9903"}}
+		_, _, err := srv.buildStatsListener(nil)
+		assert.Error(t, err)
+	})
+	t.Run("invalid address", func(t *testing.T) {
+		srv := &Server{options: serverOptions{statsAddress: "9903"}}
+		_, _, err := srv.buildStatsListener(adminAddr)
+		assert.Error(t, err)
+	})
+}
+
+func TestServer_buildAdminConfig(t *testing.T) {
+	srv := &Server{}
+	t.Run("disabled", func(t *testing.T) {
+		admin, err := srv.buildAdminConfig(&config.Config{Options: &config.Options{
+			EnvoyAdminDisabled: true,
+		}})
+		require.NoError(t, err)
+		assert.Nil(t, admin)
+	})
+	t.Run("enabled", func(t *testing.T) {
+		admin, err := srv.buildAdminConfig(&config.Config{Options: &config.Options{
+			EnvoyAdminAddress:       "127.0.0.1:9901",
+			EnvoyAdminAccessLogPath: "/dev/null",
+			EnvoyAdminProfilePath:   "/dev/null",
+		}})
+		require.NoError(t, err)
+		testutil.AssertProtoJSONEqual(t, `{
+			"accessLogPath": "/dev/null",
+			"address": { "socketAddress": { "address": "127.0.0.1", "portValue": 9901 } }
+		}`, admin)
+	})
+	t.Run("profiling", func(t *testing.T) {
+		admin, err := srv.buildAdminConfig(&config.Config{Options: &config.Options{
+			EnvoyAdminAddress:          "127.0.0.1:9901",
+			EnvoyAdminAccessLogPath:    "/dev/null",
+			EnvoyAdminProfilePath:      "/dev/null",
+			EnvoyAdminProfilingEnabled: true,
+		}})
+		require.NoError(t, err)
+		testutil.AssertProtoJSONEqual(t, `{
+			"accessLogPath": "/dev/null",
+			"profilePath": "/dev/null",
+			"address": { "socketAddress": { "address": "127.0.0.1", "portValue": 9901 } }
+		}`, admin)
+
+		_, err = srv.buildAdminConfig(&config.Config{Options: &config.Options{
+			EnvoyAdminAddress:          "127.0.0.1:9901",
+			EnvoyAdminAccessLogPath:    "/dev/null",
+			EnvoyAdminProfilePath:      "/nonexistent/envoy.prof",
+			EnvoyAdminProfilingEnabled: true,
+		}})
+		assert.Error(t, err, "the profile path should be validated when profiling is enabled")
+	})
+	t.Run("unix socket", func(t *testing.T) {
+		admin, err := srv.buildAdminConfig(&config.Config{Options: &config.Options{
+			EnvoyAdminAddress:       "unix:///var/run/pomerium/envoy-admin.sock",
+			EnvoyAdminAccessLogPath: "/dev/null",
+			EnvoyAdminProfilePath:   "/dev/null",
+		}})
+		require.NoError(t, err)
+		testutil.AssertProtoJSONEqual(t, `{
+			"accessLogPath": "/dev/null",
+			"address": { "pipe": { "path": "/var/run/pomerium/envoy-admin.sock" } }
+		}`, admin)
+	})
+	t.Run("port conflict", func(t *testing.T) {
+		srv := &Server{grpcPort: "9901", httpPort: "9902"}
+		_, err := srv.buildAdminConfig(&config.Config{Options: &config.Options{
+			EnvoyAdminAddress:       "127.0.0.1:9901",
+			EnvoyAdminAccessLogPath: "/dev/null",
+		}})
+		assert.EqualError(t, err, "port conflict: the control plane grpc port and the envoy admin port are both 9901")
+
+		_, err = srv.buildAdminConfig(&config.Config{Options: &config.Options{
+			EnvoyAdminAddress:       "unix:///var/run/pomerium/envoy-admin.sock",
+			EnvoyAdminAccessLogPath: "/dev/null",
+		}})
+		assert.NoError(t, err, "unix sockets should not conflict with ports")
+	})
+}
+
+func TestServer_checkPortConflicts(t *testing.T) {
+	addr := func(port uint32) *envoy_config_core_v3.Address {
+		return &envoy_config_core_v3.Address{Address: &envoy_config_core_v3.Address_SocketAddress{
+			SocketAddress: &envoy_config_core_v3.SocketAddress{
+				Address:       "0.0.0.0",
+				PortSpecifier: &envoy_config_core_v3.SocketAddress_PortValue{PortValue: port},
+			},
+		}}
+	}
+
+	srv := &Server{grpcPort: "5443", httpPort: "5444"}
+	assert.NoError(t, srv.checkPortConflicts(addr(9901)))
+	assert.NoError(t, srv.checkPortConflicts(addr(0)), "ephemeral ports should not conflict")
+	assert.NoError(t, srv.checkPortConflicts(nil))
+	assert.EqualError(t, srv.checkPortConflicts(addr(5444)),
+		"port conflict: the control plane http port and the envoy admin port are both 5444")
+
+	srv = &Server{grpcPort: "5443", httpPort: "5443"}
+	assert.EqualError(t, srv.checkPortConflicts(nil),
+		"port conflict: the control plane grpc port and the control plane http port are both 5443")
+}
+
+func TestServer_buildControlPlaneConnectionOptions(t *testing.T) {
+	t.Run("disabled", func(t *testing.T) {
+		srv := &Server{}
+		assert.Nil(t, srv.buildControlPlaneConnectionOptions())
+	})
+	t.Run("enabled", func(t *testing.T) {
+		srv := &Server{options: serverOptions{
+			controlPlaneTCPKeepaliveProbes: 3,
+			controlPlaneTCPKeepaliveTime:   5 * time.Minute,
+		}}
+		testutil.AssertProtoJSONEqual(t, `{
+			"tcpKeepalive": {
+				"keepaliveProbes": 3,
+				"keepaliveTime": 300
+			}
+		}`, srv.buildControlPlaneConnectionOptions())
+	})
+}
+
+func TestServer_buildLayeredRuntime(t *testing.T) {
+	t.Run("disabled", func(t *testing.T) {
+		srv := &Server{}
+		rt, err := srv.buildLayeredRuntime()
+		require.NoError(t, err)
+		assert.Nil(t, rt)
+	})
+	t.Run("enabled", func(t *testing.T) {
+		srv := &Server{options: serverOptions{runtime: map[string]interface{}{
+			"envoy.reloadable_features.example":          false,
+			"overload.global_downstream_max_connections": 50000,
+		}}}
+		rt, err := srv.buildLayeredRuntime()
+		require.NoError(t, err)
+		testutil.AssertProtoJSONEqual(t, `{
+			"layers": [{
+				"name": "static_layer_0",
+				"staticLayer": {
+					"envoy.reloadable_features.example": false,
+					"overload.global_downstream_max_connections": 50000
+				}
+			}]
+		}`, rt)
+	})
+	t.Run("global downstream max connections", func(t *testing.T) {
+		srv := &Server{options: serverOptions{
+			runtime:                        map[string]interface{}{"envoy.reloadable_features.example": false},
+			globalDownstreamMaxConnections: 10000,
+		}}
+		rt, err := srv.buildLayeredRuntime()
+		require.NoError(t, err)
+		testutil.AssertProtoJSONEqual(t, `{
+			"layers": [{
+				"name": "static_layer_0",
+				"staticLayer": {
+					"envoy.reloadable_features.example": false,
+					"overload.global_downstream_max_connections": 10000
+				}
+			}]
+		}`, rt)
+		assert.NotContains(t, srv.options.runtime, "overload.global_downstream_max_connections",
+			"the configured runtime keys should not be modified")
+	})
+}
+
+func TestServer_buildOverloadManager(t *testing.T) {
+	t.Run("disabled", func(t *testing.T) {
+		srv := &Server{}
+		om, err := srv.buildOverloadManager()
+		require.NoError(t, err)
+		assert.Nil(t, om)
+	})
+	t.Run("enabled", func(t *testing.T) {
+		srv := &Server{options: serverOptions{
+			overloadMaxHeapSizeBytes:               1073741824,
+			overloadStopAcceptingRequestsThreshold: 0.9,
+		}}
+		om, err := srv.buildOverloadManager()
+		require.NoError(t, err)
+		testutil.AssertProtoJSONEqual(t, `{
+			"resourceMonitors": [{
+				"name": "envoy.resource_monitors.fixed_heap",
+				"typedConfig": {
+					"@type": "type.googleapis.com/envoy.extensions.resource_monitors.fixed_heap.v3.FixedHeapConfig",
+					"maxHeapSizeBytes": "1073741824"
+				}
+			}],
+			"actions": [
+				{
+					"name": "envoy.overload_actions.stop_accepting_connections",
+					"triggers": [{ "name": "envoy.resource_monitors.fixed_heap", "threshold": { "value": 0.95 } }]
+				},
+				{
+					"name": "envoy.overload_actions.stop_accepting_requests",
+					"triggers": [{ "name": "envoy.resource_monitors.fixed_heap", "threshold": { "value": 0.9 } }]
+				}
+			]
+		}`, om)
+	})
+}
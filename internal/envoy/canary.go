@@ -0,0 +1,223 @@
+package envoy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	envoy_config_bootstrap_v3 "github.com/envoyproxy/go-control-plane/envoy/config/bootstrap/v3"
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/golang/protobuf/proto"
+	"github.com/natefinch/atomic"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"github.com/pomerium/pomerium/config"
+	"github.com/pomerium/pomerium/internal/log"
+)
+
+const (
+	canaryDirectoryPrefix = "canary-"
+	canaryAdminSocketName = "admin.sock"
+
+	// defaultCanaryTimeout is how long a canary has to become live when the context has no deadline.
+	defaultCanaryTimeout = 30 * time.Second
+)
+
+// Canary starts a short-lived envoy process with the bootstrap config built from cfg, waits for it to
+// become live and stops it. It returns an error if envoy fails to start, exits or doesn't become live
+// before the context is done. The running envoy process isn't affected, so a risky config can be
+// checked before it's applied with ReloadConfig.
+//
+// The canary runs in its own working directory with its own base id. So that it doesn't conflict with
+// the running envoy its admin interface listens on a unix socket in that directory, and it neither
+// binds static listeners nor fetches dynamic resources from the control plane. Extra args aren't
+// passed to the canary.
+func (srv *Server) Canary(ctx context.Context, cfg *config.Config) error {
+	options, err := newServerOptions(cfg)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultCanaryTimeout)
+		defer cancel()
+	}
+
+	dir, err := ioutil.TempDir(srv.wd, canaryDirectoryPrefix)
+	if err != nil {
+		return fmt.Errorf("error creating working directory for envoy canary: %w", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			log.Warn().Err(err).Str("service", "envoy").Str("path", dir).Msg("envoy: failed to remove canary working directory")
+		}
+	}()
+
+	canary := &Server{
+		wd:        dir,
+		grpcPort:  srv.grpcPort,
+		httpPort:  srv.httpPort,
+		envoyPath: srv.envoyPath,
+		version:   srv.version,
+		options:   options,
+	}
+	if err := canary.writeCanaryConfig(cfg); err != nil {
+		return err
+	}
+
+	cmd, exited, err := canary.startCanary()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		select {
+		case <-exited:
+			return
+		default:
+		}
+		if err := killProcess(cmd.Process); err != nil {
+			log.Warn().Err(err).Str("service", "envoy").Msg("envoy: failed to kill canary process")
+		}
+		<-exited
+	}()
+
+	client, err := newAdminClient("unix://" + filepath.Join(dir, canaryAdminSocketName))
+	if err != nil {
+		return err
+	}
+	defer client.close()
+
+	err = waitForLive(ctx, client, 0, exited)
+	if errors.Is(err, errEnvoyExited) {
+		return fmt.Errorf("envoy canary exited before becoming live: %s", cmd.ProcessState)
+	} else if err != nil {
+		return fmt.Errorf("envoy canary did not become live: %w", err)
+	}
+	log.Info().Str("service", "envoy").Msg("envoy: canary is live")
+	return nil
+}
+
+// canaryBootstrap adjusts a bootstrap config so that it can run alongside the running envoy.
+func (srv *Server) canaryBootstrap(bcfg *envoy_config_bootstrap_v3.Bootstrap) {
+	bcfg.Admin = &envoy_config_bootstrap_v3.Admin{
+		AccessLogPath: os.DevNull,
+		Address: &envoy_config_core_v3.Address{
+			Address: &envoy_config_core_v3.Address_Pipe{
+				Pipe: &envoy_config_core_v3.Pipe{
+					Path: filepath.Join(srv.wd, canaryAdminSocketName),
+				},
+			},
+		},
+	}
+	bcfg.DynamicResources = nil
+	if bcfg.StaticResources != nil {
+		bcfg.StaticResources.Listeners = nil
+	}
+}
+
+// writeCanaryConfig writes the canary's bootstrap config to its working directory.
+func (srv *Server) writeCanaryConfig(cfg *config.Config) error {
+	bcfg, err := srv.buildBootstrap(cfg)
+	if err != nil {
+		return err
+	}
+	srv.canaryBootstrap(bcfg)
+
+	confBytes, err := protojson.Marshal(proto.MessageV2(bcfg))
+	if err != nil {
+		return err
+	}
+
+	cfgPath := filepath.Join(srv.wd, configFileName)
+	if err := atomic.WriteFile(cfgPath, bytes.NewReader(confBytes)); err != nil {
+		return fmt.Errorf("error writing envoy canary config: %w", err)
+	}
+	if err := os.Chmod(cfgPath, configFileMode); err != nil {
+		return fmt.Errorf("error setting envoy canary config file permissions: %w", err)
+	}
+
+	// envoy has to be able to read its config and create its admin socket when it runs as a different user
+	if srv.options.uid != 0 {
+		for _, p := range []string{srv.wd, cfgPath} {
+			if err := os.Chown(p, int(srv.options.uid), int(srv.options.gid)); err != nil {
+				return fmt.Errorf("error changing owner of %s for envoy canary: %w", p, err)
+			}
+		}
+	}
+	return nil
+}
+
+// startCanary starts the canary envoy process. The returned channel is closed once it has exited.
+func (srv *Server) startCanary() (*exec.Cmd, <-chan struct{}, error) {
+	args := []string{
+		"-c", configFileName,
+		"--log-level", srv.options.logLevel,
+		"--log-format", defaultLogFormat,
+		"--log-format-escaped",
+		"--use-dynamic-base-id", "--base-id-path", srv.baseIDPath(),
+	}
+
+	log.Debug().Str("service", "envoy").Str("path", srv.envoyPath).Strs("args", args).Msg("envoy: canary command line")
+	cmd := exec.Command(srv.envoyPath, args...) // #nosec
+	cmd.Dir = srv.wd
+	cmd.Env = buildEnvironment(os.Environ(), srv.options.environment)
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating stderr pipe for envoy canary: %w", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating stdout pipe for envoy canary: %w", err)
+	}
+
+	// canary log messages are prefixed so they aren't mistaken for the running envoy's
+	write := func(entry logEntry) {
+		entry.msg = "canary: " + entry.msg
+		writeLogEntry(entry)
+	}
+	var logsWG sync.WaitGroup
+	logsWG.Add(2)
+	go func() {
+		defer logsWG.Done()
+		if err := srv.handleLogs(stderr, logStreamStderr, defaultLogReadBufferSize, false, nil, write); err != nil {
+			log.Warn().Err(err).Str("service", "envoy").Msg("envoy: failed to read canary logs")
+		}
+	}()
+	go func() {
+		defer logsWG.Done()
+		if err := srv.handleLogs(stdout, logStreamStdout, defaultLogReadBufferSize, false, nil, write); err != nil {
+			log.Warn().Err(err).Str("service", "envoy").Msg("envoy: failed to read canary logs")
+		}
+	}()
+
+	cmd.SysProcAttr, err = buildSysProcAttr(srv.options.uid, srv.options.gid)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, fmt.Errorf("error starting envoy canary: %w", err)
+	}
+	if err := setupProcess(cmd.Process); err != nil {
+		log.Warn().Err(err).Str("service", "envoy").Msg("envoy: failed to set up canary process, it may outlive pomerium")
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		logsWG.Wait()
+		err := cmd.Wait()
+		releaseProcess(cmd.Process)
+		close(exited)
+		log.Debug().Err(err).Str("service", "envoy").Msg("envoy: canary process exited")
+	}()
+
+	return cmd, exited, nil
+}
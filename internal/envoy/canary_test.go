@@ -0,0 +1,103 @@
+package envoy
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	envoy_config_bootstrap_v3 "github.com/envoyproxy/go-control-plane/envoy/config/bootstrap/v3"
+	envoy_config_listener_v3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pomerium/pomerium/config"
+	"github.com/pomerium/pomerium/internal/testutil"
+)
+
+func TestServer_canaryBootstrap(t *testing.T) {
+	srv := &Server{wd: "/tmp/envoy/canary-1"}
+	bcfg := &envoy_config_bootstrap_v3.Bootstrap{
+		Admin:            &envoy_config_bootstrap_v3.Admin{AccessLogPath: "/var/log/envoy-admin.log"},
+		DynamicResources: &envoy_config_bootstrap_v3.Bootstrap_DynamicResources{},
+		StaticResources: &envoy_config_bootstrap_v3.Bootstrap_StaticResources{
+			Listeners: []*envoy_config_listener_v3.Listener{{Name: healthCheckListenerName}},
+		},
+	}
+	srv.canaryBootstrap(bcfg)
+	testutil.AssertProtoJSONEqual(t, `{
+		"admin": {
+			"accessLogPath": "/dev/null",
+			"address": { "pipe": { "path": "/tmp/envoy/canary-1/admin.sock" } }
+		},
+		"staticResources": {}
+	}`, bcfg)
+}
+
+func TestServer_Canary(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test requires a posix shell")
+	}
+
+	newServer := func(t *testing.T, script string) *Server {
+		dir := t.TempDir()
+		srv := &Server{
+			wd:        dir,
+			grpcPort:  "1234",
+			httpPort:  "1235",
+			envoyPath: writeFakeEnvoy(t, dir, script),
+		}
+		return srv
+	}
+	canaries := func(t *testing.T, srv *Server) []string {
+		matches, err := filepath.Glob(filepath.Join(srv.wd, canaryDirectoryPrefix+"*"))
+		require.NoError(t, err)
+		return matches
+	}
+
+	t.Run("live", func(t *testing.T) {
+		// the fake envoy links its admin socket to a fake admin interface
+		sockPath := filepath.Join(t.TempDir(), "admin.sock")
+		li, err := net.Listen("unix", sockPath)
+		require.NoError(t, err)
+		admin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`{"state":"` + ServerStateLive + `"}`))
+		}))
+		admin.Listener = li
+		admin.Start()
+		defer admin.Close()
+
+		srv := newServer(t, "ln -s "+sockPath+" "+canaryAdminSocketName+"\nexec sleep 10")
+		err = srv.Canary(context.Background(), &config.Config{Options: config.NewDefaultOptions()})
+		assert.NoError(t, err)
+		assert.Nil(t, srv.cmd, "the running envoy process should not be changed")
+		assert.Empty(t, canaries(t, srv), "the canary working directory should be removed")
+	})
+	t.Run("exited", func(t *testing.T) {
+		srv := newServer(t, "exit 1")
+		err := srv.Canary(context.Background(), &config.Config{Options: config.NewDefaultOptions()})
+		assert.Error(t, err)
+		assert.Empty(t, canaries(t, srv))
+	})
+	t.Run("timeout", func(t *testing.T) {
+		srv := newServer(t, "exec sleep 10")
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		err := srv.Canary(ctx, &config.Config{Options: config.NewDefaultOptions()})
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Empty(t, canaries(t, srv))
+	})
+	t.Run("config", func(t *testing.T) {
+		srv := newServer(t, "cp "+configFileName+" ../canary-config.json\nexit 1")
+		_ = srv.Canary(context.Background(), &config.Config{Options: config.NewDefaultOptions()})
+		bs, err := ioutil.ReadFile(filepath.Join(srv.wd, "canary-config.json"))
+		require.NoError(t, err)
+		assert.Contains(t, string(bs), canaryAdminSocketName)
+		assert.NotContains(t, string(bs), "dynamicResources")
+	})
+}
@@ -0,0 +1,93 @@
+package envoy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pomerium/pomerium/internal/log"
+)
+
+// downloadTimeout bounds the whole envoy binary download, including reading the body, so a stalled
+// server can't block startup forever.
+const downloadTimeout = 10 * time.Minute
+
+var downloadClient = &http.Client{Timeout: downloadTimeout}
+
+// downloadEnvoy downloads the envoy binary from rawURL to dst, verifying it against the expected
+// sha256 checksum. If dst already contains a binary with the expected checksum the download is skipped.
+func downloadEnvoy(ctx context.Context, rawURL, checksum, dst string) error {
+	if s, err := fileChecksum(dst); err == nil && s == checksum {
+		return nil
+	}
+
+	log.Info().Str("url", rawURL).Str("path", dst).Msg("envoy: downloading envoy binary")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return fmt.Errorf("error creating envoy binary download request: %w", err)
+	}
+	res, err := downloadClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error downloading envoy binary: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("error downloading envoy binary: unexpected status code %d", res.StatusCode)
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(dst), filepath.Base(dst))
+	if err != nil {
+		return fmt.Errorf("error creating temporary file for envoy binary: %w", err)
+	}
+	tmpPath := f.Name()
+	defer func() { _ = os.Remove(tmpPath) }()
+
+	h := sha256.New()
+	_, err = io.Copy(f, io.TeeReader(res.Body, h))
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return fmt.Errorf("error writing envoy binary: %w", err)
+	}
+
+	if s := hex.EncodeToString(h.Sum(nil)); s != checksum {
+		return fmt.Errorf("invalid downloaded envoy binary, expected %s but got %s", checksum, s)
+	}
+
+	err = os.Chmod(tmpPath, 0o755)
+	if err != nil {
+		return fmt.Errorf("error chmoding downloaded envoy binary: %w", err)
+	}
+
+	err = os.Rename(tmpPath, dst)
+	if err != nil {
+		return fmt.Errorf("error moving downloaded envoy binary into place: %w", err)
+	}
+
+	return nil
+}
+
+// fileChecksum returns the hex encoded sha256 checksum of the file at path.
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
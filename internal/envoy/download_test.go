@@ -0,0 +1,65 @@
+package envoy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_downloadEnvoy(t *testing.T) {
+	binary := []byte("#!/bin/sh\necho envoy\n")
+	sum := sha256.Sum256(binary)
+	checksum := hex.EncodeToString(sum[:])
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(binary)
+	}))
+	defer srv.Close()
+
+	t.Run("valid", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "envoy")
+		require.NoError(t, downloadEnvoy(context.Background(), srv.URL, checksum, dst))
+
+		bs, err := ioutil.ReadFile(dst)
+		require.NoError(t, err)
+		assert.Equal(t, binary, bs)
+
+		fi, err := os.Stat(dst)
+		require.NoError(t, err)
+		assert.NotZero(t, fi.Mode()&0o100, "binary should be executable")
+	})
+	t.Run("checksum mismatch", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "envoy")
+		err := downloadEnvoy(context.Background(), srv.URL, "0000", dst)
+		assert.Error(t, err)
+
+		_, err = os.Stat(dst)
+		assert.True(t, os.IsNotExist(err), "invalid binary should not be written")
+	})
+	t.Run("timeout", func(t *testing.T) {
+		stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		}))
+		defer stalled.Close()
+
+		orig := downloadClient
+		downloadClient = &http.Client{Timeout: 100 * time.Millisecond}
+		defer func() { downloadClient = orig }()
+
+		dst := filepath.Join(t.TempDir(), "envoy")
+		err := downloadEnvoy(context.Background(), stalled.URL, checksum, dst)
+		assert.Error(t, err)
+	})
+}
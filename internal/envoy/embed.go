@@ -1,64 +1,165 @@
 package envoy
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/natefinch/atomic"
 	resources "gopkg.in/cookieo9/resources-go.v2"
 )
 
 var embeddedFilesDirectory = filepath.Join(os.TempDir(), "pomerium-embedded-files")
 
-func extractEmbeddedEnvoy() (outPath string, err error) {
+// extractEmbeddedEnvoy extracts the embedded envoy binary. When the binary is extracted its sha256
+// checksum is computed while it's written, so it doesn't have to be read again to verify it. The
+// checksum is empty if a previously extracted binary is reused.
+func extractEmbeddedEnvoy() (outPath, checksum string, err error) {
 	exePath, err := resources.ExecutablePath()
 	if err != nil {
-		return "", fmt.Errorf("error finding executable path: %w", err)
+		return "", "", fmt.Errorf("error finding executable path: %w", err)
 	}
 	bundle, err := resources.OpenZip(exePath)
 	if err != nil {
-		return "", fmt.Errorf("error opening binary zip file: %w", err)
+		return "", "", fmt.Errorf("error opening binary zip file: %w", err)
 	}
 	defer bundle.Close()
 
 	rc, err := bundle.Open("envoy")
 	if err != nil {
-		return "", fmt.Errorf("error opening embedded envoy binary: %w", err)
+		return "", "", fmt.Errorf("error opening embedded envoy binary: %w", err)
 	}
 	defer rc.Close()
 
 	err = os.MkdirAll(embeddedFilesDirectory, 0o755)
 	if err != nil {
-		return "", fmt.Errorf("error creating embedded file directory: (directory=%s): %w", embeddedFilesDirectory, err)
+		return "", "", fmt.Errorf("error creating embedded file directory: (directory=%s): %w", embeddedFilesDirectory, err)
 	}
 
 	outPath = filepath.Join(embeddedFilesDirectory, "envoy")
 
-	// skip extraction if we already have it
+	br := bufio.NewReader(rc)
+	compression := detectCompression(br)
+
+	// skip extraction if we already have it. The size of a compressed binary will not match, so only the
+	// modification time is compared.
 	var zfi os.FileInfo
 	if zf, ok := rc.(interface{ FileInfo() os.FileInfo }); ok {
 		zfi = zf.FileInfo()
 		if fi, e := os.Stat(outPath); e == nil {
-			if fi.Size() == zfi.Size() && fi.ModTime() == zfi.ModTime() {
-				return outPath, nil
+			if (compression != compressionNone || fi.Size() == zfi.Size()) && fi.ModTime() == zfi.ModTime() {
+				return outPath, "", ensureExecutable(outPath)
 			}
 		}
 	}
 
-	err = atomic.WriteFile(outPath, rc)
+	checksum, err = extractEnvoy(br, compression, outPath)
 	if err != nil {
-		return "", fmt.Errorf("error extracting embedded envoy binary to temporary directory (path=%s): %w", outPath, err)
+		return "", "", err
 	}
 
-	err = os.Chmod(outPath, 0o755)
+	err = ensureExecutable(outPath)
 	if err != nil {
-		return "", fmt.Errorf("error chmoding embedded envoy binary: %w", err)
+		return "", "", err
 	}
 
 	if zfi != nil {
 		_ = os.Chtimes(outPath, zfi.ModTime(), zfi.ModTime())
 	}
 
-	return outPath, nil
+	return outPath, checksum, nil
+}
+
+// extractEnvoy decompresses the envoy binary from r and writes it to outPath. It returns the hex
+// encoded sha256 checksum of the decompressed binary, which is computed as it's written.
+func extractEnvoy(r io.Reader, c compression, outPath string) (checksum string, err error) {
+	dr, err := decompress(r, c)
+	if err != nil {
+		return "", fmt.Errorf("error decompressing embedded envoy binary: %w", err)
+	}
+	defer dr.Close()
+
+	h := sha256.New()
+	err = atomic.WriteFile(outPath, io.TeeReader(dr, h))
+	if err != nil {
+		return "", fmt.Errorf("error extracting embedded envoy binary to temporary directory (path=%s): %w", outPath, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ensureExecutable makes sure the file at path is an executable regular file, fixing its permissions
+// if necessary.
+func ensureExecutable(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("error checking envoy binary (path=%s): %w", path, err)
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("envoy binary is not a regular file (path=%s, mode=%s)", path, fi.Mode())
+	}
+	if fi.Mode().Perm()&0o100 != 0 {
+		return nil
+	}
+
+	err = os.Chmod(path, 0o755)
+	if err != nil {
+		return fmt.Errorf("error chmoding envoy binary (path=%s): %w", path, err)
+	}
+
+	fi, err = os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("error checking envoy binary (path=%s): %w", path, err)
+	}
+	if fi.Mode().Perm()&0o100 == 0 {
+		return fmt.Errorf("envoy binary is not executable after chmod, the filesystem may not support executable files (path=%s, mode=%s)",
+			path, fi.Mode())
+	}
+	return nil
+}
+
+type compression int
+
+const (
+	compressionNone compression = iota
+	compressionGzip
+	compressionZstd
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// detectCompression detects whether the data in the reader is compressed by looking at its magic bytes.
+func detectCompression(br *bufio.Reader) compression {
+	hdr, _ := br.Peek(len(zstdMagic))
+	switch {
+	case bytes.HasPrefix(hdr, gzipMagic):
+		return compressionGzip
+	case bytes.HasPrefix(hdr, zstdMagic):
+		return compressionZstd
+	}
+	return compressionNone
+}
+
+func decompress(r io.Reader, c compression) (io.ReadCloser, error) {
+	switch c {
+	case compressionGzip:
+		return gzip.NewReader(r)
+	case compressionZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return ioutil.NopCloser(r), nil
 }
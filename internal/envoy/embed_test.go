@@ -0,0 +1,101 @@
+package envoy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_decompress(t *testing.T) {
+	binary := []byte("\x7fELF envoy binary contents")
+
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	_, err := gw.Write(binary)
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+
+	zw, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+	zs := zw.EncodeAll(binary, nil)
+
+	for _, tc := range []struct {
+		name        string
+		data        []byte
+		compression compression
+	}{
+		{"none", binary, compressionNone},
+		{"gzip", gz.Bytes(), compressionGzip},
+		{"zstd", zs, compressionZstd},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			br := bufio.NewReader(bytes.NewReader(tc.data))
+			c := detectCompression(br)
+			assert.Equal(t, tc.compression, c)
+
+			r, err := decompress(br, c)
+			require.NoError(t, err)
+			defer r.Close()
+
+			bs, err := ioutil.ReadAll(r)
+			require.NoError(t, err)
+			assert.Equal(t, binary, bs)
+		})
+	}
+}
+
+func Test_extractEnvoy(t *testing.T) {
+	binary := []byte("\x7fELF envoy binary contents")
+	sum := sha256.Sum256(binary)
+	expected := hex.EncodeToString(sum[:])
+
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	_, err := gw.Write(binary)
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+
+	outPath := filepath.Join(t.TempDir(), "envoy")
+	checksum, err := extractEnvoy(&gz, compressionGzip, outPath)
+	require.NoError(t, err)
+	assert.Equal(t, expected, checksum, "the checksum should be of the decompressed binary")
+
+	bs, err := ioutil.ReadFile(outPath)
+	require.NoError(t, err)
+	assert.Equal(t, binary, bs)
+
+	// the extracted checksum is used instead of reading the binary
+	assert.NoError(t, verifyEnvoyChecksum(outPath, checksum, expected))
+	assert.Error(t, verifyEnvoyChecksum(outPath, checksum, strings.Repeat("0", 64)))
+	assert.NoError(t, verifyEnvoyChecksum(outPath, "", expected))
+}
+
+func Test_ensureExecutable(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes are not supported on windows")
+	}
+
+	dir := t.TempDir()
+
+	p := filepath.Join(dir, "envoy")
+	require.NoError(t, ioutil.WriteFile(p, []byte("envoy"), 0o600))
+	require.NoError(t, ensureExecutable(p))
+	fi, err := os.Stat(p)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o755), fi.Mode().Perm())
+
+	assert.Error(t, ensureExecutable(dir), "directories should be rejected")
+	assert.Error(t, ensureExecutable(filepath.Join(dir, "missing")))
+}
@@ -5,18 +5,19 @@ import (
 	"bufio"
 	"bytes"
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"net"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -28,13 +29,17 @@ import (
 	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	envoy_config_endpoint_v3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
 	envoy_config_metrics_v3 "github.com/envoyproxy/go-control-plane/envoy/config/metrics/v3"
+	envoy_extensions_transport_sockets_tls_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	envoy_type_matcher_v3 "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
 	"github.com/golang/protobuf/proto"
 	"github.com/google/go-cmp/cmp"
 	"github.com/natefinch/atomic"
 	"github.com/rs/zerolog"
 	"go.opencensus.io/stats/view"
 	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/anypb"
 	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 
 	"github.com/pomerium/pomerium/config"
 	"github.com/pomerium/pomerium/internal/log"
@@ -46,8 +51,37 @@ import (
 const (
 	workingDirectoryName = ".pomerium-envoy"
 	configFileName       = "envoy-config.yaml"
+
+	workingDirectoryMode = 0o700
+	configFileMode       = 0o600
+
+	// configHistoryDirectoryPrefix is the prefix of the working directory subdirectories each config is
+	// written to when a config history is kept. The rest of the name is the time the config was written,
+	// formatted so that the names sort chronologically.
+	configHistoryDirectoryPrefix = "config-"
+	configHistoryTimeFormat      = "20060102T150405.000000000Z"
+
+	defaultLogDeduplicateInterval        = 5 * time.Second
+	defaultLogReadBufferSize             = 4096
+	defaultLogFileMaxSize                = 100 << 20
+	defaultDatadogConnectTimeout         = 5 * time.Second
+	defaultNodeID                        = "proxy"
+	defaultNodeCluster                   = "proxy"
+	defaultControlPlaneKeepaliveInterval = 30 * time.Second
+	defaultControlPlaneKeepaliveTimeout  = 5 * time.Second
+	defaultWarmUpPeriod                  = time.Second
+	defaultDrainWatchInterval            = 10 * time.Second
+	defaultShutdownTimeout               = 30 * time.Second
+	defaultUnchangedReloadWarnThreshold  = 10
 )
 
+// unchangedReloadWindow is the window reloads without config changes are counted in, to warn when the
+// config source sends the same config repeatedly.
+const unchangedReloadWindow = time.Minute
+
+// ReloadConsumerName is the consumer name envoy reports config reloads to the config source with.
+const ReloadConsumerName = "envoy"
+
 // Checksum is the embedded envoy binary checksum. This value is populated by `make build`.
 var Checksum string
 
@@ -55,218 +89,1486 @@ type serverOptions struct {
 	services       string
 	logLevel       string
 	tracingOptions trace.TracingOptions
+	xdsAPIType     string
+	statsDisabled  bool
+	statsTags      map[string]string
+	statsBuckets   []float64
+	tagExtractors  []config.EnvoyStatsTagExtractor
+
+	xdsInitialFetchTimeout time.Duration
+	bootstrapFormat        string
+
+	datadogConnectTimeout     time.Duration
+	datadogDNSRefreshRate     time.Duration
+	datadogMaxConnections     uint32
+	datadogMaxPendingRequests uint32
+	datadogLBPolicy           string
+	tracingProxyAddress       string
+
+	nodeID              string
+	nodeCluster         string
+	nodeMetadata        map[string]string
+	nodeLocalityRegion  string
+	nodeLocalityZone    string
+	nodeLocalitySubZone string
+
+	runtime map[string]interface{}
+
+	bootstrapClusters []map[string]interface{}
+
+	globalDownstreamMaxConnections uint64
+
+	accessLogServiceAddress string
+
+	controlPlaneTLS           bool
+	controlPlaneTLSServerName string
+	controlPlaneCAFile        string
+	controlPlaneCertFile      string
+	controlPlaneKeyFile       string
+
+	controlPlaneKeepaliveInterval time.Duration
+	controlPlaneKeepaliveTimeout  time.Duration
+
+	controlPlaneTCPKeepaliveProbes   uint32
+	controlPlaneTCPKeepaliveTime     time.Duration
+	controlPlaneTCPKeepaliveInterval time.Duration
+	controlPlaneLBPolicy             string
+
+	controlPlaneMaxConnections     uint32
+	controlPlaneMaxPendingRequests uint32
+	controlPlaneMaxRequests        uint32
+
+	environment       map[string]string
+	uid, gid          uint32
+	niceness          int
+	cpus              []int
+	extraArgs         []string
+	disableHotRestart bool
+	restartEpochStart int
+	restartEpochMax   int
+	drainStrategy     string
+	drainTime         time.Duration
+
+	restartOnBinaryChange bool
+
+	dnsResolvers []string
+	dnsUseTCP    bool
+
+	clusterBufferLimitBytes uint32
+
+	overloadMaxHeapSizeBytes                  uint64
+	overloadStopAcceptingConnectionsThreshold float64
+	overloadStopAcceptingRequestsThreshold    float64
+
+	pidFile        string
+	configDumpPath string
+	configHistory  int
+	cleanupOnClose bool
+
+	logQueueSize           int
+	logReadBufferSize      int
+	logDeduplicate         bool
+	logDeduplicateInterval time.Duration
+	logRedactPatterns      []string
+	logFormat              string
+	logFile                string
+	logFileMaxSize         int64
+	logFileMaxBackups      int
+	logFileOnly            bool
+	logPath                string
+	fileFlushInterval      time.Duration
+
+	adminURL           string
+	drainWatchInterval time.Duration
+
+	healthCheckAddress string
+	healthCheckPath    string
+	statsAddress       string
+
+	listenerReusePort     bool
+	listenerSocketOptions []config.EnvoySocketOption
+
+	shutdownTimeout time.Duration
+	warmUpPeriod    time.Duration
+	warmUpTimeout   time.Duration
+
+	unchangedReloadWarnThreshold int
+
+	strictCompatibility bool
+}
+
+// redacted returns a copy of the options with any sensitive values removed, so they can be safely logged.
+func (opts serverOptions) redacted() serverOptions {
+	if opts.environment != nil {
+		env := make(map[string]string, len(opts.environment))
+		for k := range opts.environment {
+			env[k] = "<redacted>"
+		}
+		opts.environment = env
+	}
+	return opts
+}
+
+func newServerOptions(cfg *config.Config) (serverOptions, error) {
+	tracingOptions, err := config.NewTracingOptions(cfg.Options)
+	if err != nil {
+		return serverOptions{}, fmt.Errorf("invalid tracing config: %w", err)
+	}
+
+	nodeID, err := expandNodeTemplate(firstNonEmpty(cfg.Options.EnvoyNodeID, defaultNodeID))
+	if err != nil {
+		return serverOptions{}, fmt.Errorf("invalid envoy node id: %w", err)
+	}
+	nodeCluster, err := expandNodeTemplate(firstNonEmpty(cfg.Options.EnvoyNodeCluster, defaultNodeCluster))
+	if err != nil {
+		return serverOptions{}, fmt.Errorf("invalid envoy node cluster: %w", err)
+	}
+
+	var cpus []int
+	if cfg.Options.EnvoyCPUSet != "" {
+		cpus, err = config.ParseCPUSet(cfg.Options.EnvoyCPUSet)
+		if err != nil {
+			return serverOptions{}, fmt.Errorf("invalid envoy cpuset: %w", err)
+		}
+	}
+
+	var adminURL string
+	if u := cfg.Options.GetEnvoyAdminURL(); u != nil {
+		adminURL = u.String()
+	}
+
+	return serverOptions{
+		services:       cfg.Options.Services,
+		logLevel:       firstNonEmpty(cfg.Options.ProxyLogLevel, cfg.Options.LogLevel, "debug"),
+		tracingOptions: *tracingOptions,
+		xdsAPIType:     cfg.Options.EnvoyXDSAPIType,
+		statsDisabled:  cfg.Options.EnvoyStatsDisabled,
+		statsTags:      cfg.Options.EnvoyStatsTags,
+		statsBuckets:   cfg.Options.EnvoyStatsHistogramBuckets,
+		tagExtractors:  cfg.Options.EnvoyStatsTagExtractors,
+
+		xdsInitialFetchTimeout: cfg.Options.EnvoyXDSInitialFetchTimeout,
+		bootstrapFormat:        cfg.Options.EnvoyBootstrapFormat,
+
+		datadogConnectTimeout:     firstNonZeroDuration(cfg.Options.TracingDatadogConnectTimeout, defaultDatadogConnectTimeout),
+		datadogDNSRefreshRate:     cfg.Options.TracingDatadogDNSRefreshRate,
+		datadogMaxConnections:     cfg.Options.TracingDatadogMaxConnections,
+		datadogMaxPendingRequests: cfg.Options.TracingDatadogMaxPendingRequests,
+		datadogLBPolicy:           cfg.Options.TracingDatadogLBPolicy,
+		tracingProxyAddress:       cfg.Options.TracingProxyAddress,
+
+		nodeID:              nodeID,
+		nodeCluster:         nodeCluster,
+		nodeMetadata:        cfg.Options.EnvoyNodeMetadata,
+		nodeLocalityRegion:  cfg.Options.EnvoyNodeLocalityRegion,
+		nodeLocalityZone:    cfg.Options.EnvoyNodeLocalityZone,
+		nodeLocalitySubZone: cfg.Options.EnvoyNodeLocalitySubZone,
+
+		runtime: cfg.Options.EnvoyRuntime,
+
+		bootstrapClusters: cfg.Options.EnvoyBootstrapClusters,
+
+		globalDownstreamMaxConnections: cfg.Options.EnvoyGlobalDownstreamMaxConnections,
+
+		accessLogServiceAddress: cfg.Options.EnvoyAccessLogServiceAddress,
+
+		controlPlaneTLS:           cfg.Options.EnvoyControlPlaneTLS,
+		controlPlaneTLSServerName: cfg.Options.EnvoyControlPlaneTLSServerName,
+		controlPlaneCAFile:        cfg.Options.EnvoyControlPlaneCAFile,
+		controlPlaneCertFile:      cfg.Options.EnvoyControlPlaneCertFile,
+		controlPlaneKeyFile:       cfg.Options.EnvoyControlPlaneKeyFile,
+
+		controlPlaneKeepaliveInterval: firstNonZeroDuration(cfg.Options.EnvoyControlPlaneKeepaliveInterval, defaultControlPlaneKeepaliveInterval),
+		controlPlaneKeepaliveTimeout:  firstNonZeroDuration(cfg.Options.EnvoyControlPlaneKeepaliveTimeout, defaultControlPlaneKeepaliveTimeout),
+
+		controlPlaneTCPKeepaliveProbes:   cfg.Options.EnvoyControlPlaneTCPKeepaliveProbes,
+		controlPlaneTCPKeepaliveTime:     cfg.Options.EnvoyControlPlaneTCPKeepaliveTime,
+		controlPlaneTCPKeepaliveInterval: cfg.Options.EnvoyControlPlaneTCPKeepaliveInterval,
+		controlPlaneLBPolicy:             cfg.Options.EnvoyControlPlaneLBPolicy,
+
+		controlPlaneMaxConnections:     cfg.Options.EnvoyControlPlaneMaxConnections,
+		controlPlaneMaxPendingRequests: cfg.Options.EnvoyControlPlaneMaxPendingRequests,
+		controlPlaneMaxRequests:        cfg.Options.EnvoyControlPlaneMaxRequests,
+
+		environment:       cfg.Options.EnvoyEnvironment,
+		uid:               cfg.Options.EnvoyRunAsUID,
+		gid:               cfg.Options.EnvoyRunAsGID,
+		niceness:          cfg.Options.EnvoyNiceness,
+		cpus:              cpus,
+		extraArgs:         cfg.Options.EnvoyExtraArgs,
+		disableHotRestart: cfg.Options.EnvoyDisableHotRestart,
+		restartEpochStart: cfg.Options.EnvoyRestartEpochStart,
+		restartEpochMax:   cfg.Options.EnvoyRestartEpochMax,
+		drainStrategy:     cfg.Options.EnvoyDrainStrategy,
+		drainTime:         cfg.Options.EnvoyDrainTime,
+
+		restartOnBinaryChange: cfg.Options.EnvoyRestartOnBinaryChange,
+
+		dnsResolvers: cfg.Options.EnvoyDNSResolvers,
+		dnsUseTCP:    cfg.Options.EnvoyDNSUseTCP,
+
+		clusterBufferLimitBytes: cfg.Options.EnvoyClusterBufferLimitBytes,
+
+		overloadMaxHeapSizeBytes:                  cfg.Options.EnvoyOverloadMaxHeapSizeBytes,
+		overloadStopAcceptingConnectionsThreshold: cfg.Options.EnvoyOverloadStopAcceptingConnectionsThreshold,
+		overloadStopAcceptingRequestsThreshold:    cfg.Options.EnvoyOverloadStopAcceptingRequestsThreshold,
+
+		pidFile:        cfg.Options.EnvoyPIDFile,
+		configDumpPath: cfg.Options.EnvoyConfigDumpPath,
+		configHistory:  cfg.Options.EnvoyConfigHistory,
+		cleanupOnClose: cfg.Options.EnvoyCleanupOnClose,
+
+		logQueueSize:           cfg.Options.EnvoyLogQueueSize,
+		logReadBufferSize:      cfg.Options.EnvoyLogReadBufferSize,
+		logDeduplicate:         cfg.Options.EnvoyLogDeduplicate,
+		logDeduplicateInterval: firstNonZeroDuration(cfg.Options.EnvoyLogDeduplicateInterval, defaultLogDeduplicateInterval),
+		logRedactPatterns:      cfg.Options.EnvoyLogRedactPatterns,
+		logFormat:              cfg.Options.EnvoyLogFormat,
+		logFile:                cfg.Options.EnvoyLogFile,
+		logFileMaxSize:         firstNonZeroInt64(cfg.Options.EnvoyLogFileMaxSize, defaultLogFileMaxSize),
+		logFileMaxBackups:      cfg.Options.EnvoyLogFileMaxBackups,
+		logFileOnly:            cfg.Options.EnvoyLogFileOnly,
+		logPath:                cfg.Options.EnvoyLogPath,
+		fileFlushInterval:      cfg.Options.EnvoyFileFlushInterval,
+
+		adminURL:           adminURL,
+		drainWatchInterval: firstNonZeroDuration(cfg.Options.EnvoyDrainWatchInterval, defaultDrainWatchInterval),
+
+		healthCheckAddress: cfg.Options.EnvoyHealthCheckAddress,
+		healthCheckPath:    cfg.Options.EnvoyHealthCheckPath,
+		statsAddress:       cfg.Options.EnvoyStatsAddress,
+
+		listenerReusePort:     cfg.Options.EnvoyListenerReusePort,
+		listenerSocketOptions: cfg.Options.EnvoyListenerSocketOptions,
+
+		shutdownTimeout: firstNonZeroDuration(cfg.Options.EnvoyShutdownTimeout, defaultShutdownTimeout),
+		warmUpPeriod:    cfg.Options.EnvoyWarmUpPeriod,
+		warmUpTimeout:   cfg.Options.EnvoyWarmUpTimeout,
+
+		unchangedReloadWarnThreshold: firstNonZeroInt(cfg.Options.EnvoyUnchangedReloadWarnThreshold, defaultUnchangedReloadWarnThreshold),
+
+		strictCompatibility: cfg.Options.EnvoyStrictCompatibility,
+	}, nil
+}
+
+// An ErrorListener is called when envoy fails to apply a config change.
+type ErrorListener = func(error)
+
+// A BeforeReloadListener is called before envoy is restarted to apply a config change, with the config
+// being applied.
+type BeforeReloadListener = func(*config.Config)
+
+// An AfterReloadListener is called after envoy was restarted to apply a config change, with the config
+// and the error restarting it, if any.
+type AfterReloadListener = func(*config.Config, error)
+
+// verifyEnvoyChecksum returns an error if the sha256 checksum of the envoy binary doesn't match checksum.
+// If the binary's checksum was computed when it was extracted, extractedChecksum is compared rather than
+// reading the binary again.
+func verifyEnvoyChecksum(envoyPath, extractedChecksum, checksum string) error {
+	s := extractedChecksum
+	if s == "" {
+		var err error
+		s, err = fileChecksum(envoyPath)
+		if err != nil {
+			return fmt.Errorf("error reading envoy binary for checksum verification: %w", err)
+		}
+	}
+	if s != checksum {
+		return fmt.Errorf("invalid envoy binary, expected %s but got %s", checksum, s)
+	}
+	return nil
+}
+
+var warnUnverifiedEnvoyOnce sync.Once
+
+// checkUnverifiedEnvoy is called when there's no checksum to verify the envoy binary with. It returns an
+// error if a verified binary is required, and otherwise warns once unless unverified binaries are allowed.
+func checkUnverifiedEnvoy(options *config.Options) error {
+	switch {
+	case options.EnvoyRequireVerifiedBinary:
+		return errors.New("no checksum defined, envoy binary cannot be verified")
+	case options.EnvoyAllowUnverifiedBinary:
+		return nil
+	}
+	warnUnverifiedEnvoyOnce.Do(func() {
+		log.Warn().Msg("no checksum defined, envoy binary will not be verified!")
+	})
+	return nil
 }
 
 // A Server is a pomerium proxy implemented via envoy.
 type Server struct {
 	wd  string
 	cmd *exec.Cmd
+	// exited is closed when the cmd process exits
+	exited chan struct{}
 
 	grpcPort, httpPort string
 	envoyPath          string
-	restartEpoch       int
+	version            string
+	// restartEpoch is the number of hot restarts since envoy was last started from scratch
+	restartEpoch int
+	// fullEnvoyPath is the resolved path of the envoy binary, and binaryChecksum the checksum it was
+	// verified against, if any
+	fullEnvoyPath  string
+	binaryChecksum string
+	// startedChecksum is the checksum of the binary the running envoy was started from, when envoy is
+	// restarted on binary changes
+	startedChecksum string
+	// releaseVersion is the parsed envoy release version, or zero if it couldn't be determined
+	releaseVersion envoyVersion
+	// configFile is the path of the config file last written for envoy, relative to the working directory
+	configFile string
+	// ownsBaseID is set when envoy created the base id file for this server
+	ownsBaseID bool
+	// warmUpPeriod is how long a new envoy process has to stay up before it replaces the previous one,
+	// unless the options set a different period
+	warmUpPeriod time.Duration
+	// epoch is the restart epoch of the most recently started envoy process
+	epoch int
+	// drainInitiated is set (atomically) while pomerium is draining envoy
+	drainInitiated int32
+	// closes counts the calls to Close, so a process which was warming up while the server was closed
+	// isn't kept
+	closes int
+
+	// updateMu serializes config updates and restarts
+	updateMu sync.Mutex
 
 	mu      sync.Mutex
 	options serverOptions
+	// appliedConfig is the config envoy is running with
+	appliedConfig *config.Config
+	// unchangedReloads is the number of reloads without config changes since unchangedReloadsSince, and
+	// unchangedReloadsWarned is set once they've been warned about in that window
+	unchangedReloads       int
+	unchangedReloadsSince  time.Time
+	unchangedReloadsWarned bool
+
+	// shutdownMu is held while envoy is being shut down, so concurrent shutdowns wait for the first
+	shutdownMu sync.Mutex
+
+	// pendingConfig is the latest config change waiting for the in-flight reload to finish
+	pendingMu     sync.Mutex
+	pendingConfig *config.Config
+	reloading     bool
+
+	listenersMu    sync.Mutex
+	errorListeners []ErrorListener
+	eventListeners []EventListener
+
+	// reload listeners are also guarded by listenersMu
+	beforeReloadListeners []BeforeReloadListener
+	afterReloadListeners  []AfterReloadListener
+
+	// reloadReporter is the config source, if it tracks whether config changes took effect
+	reloadReporter config.ReloadReporter
+
+	// bootstrap is the redacted bootstrap config last written for envoy
+	bootstrapMu sync.Mutex
+	bootstrap   []byte
+
+	// logFile is the log file every envoy process writes its lines to, if there is one
+	logFile *logFile
+
+	// adminClient is the client for the envoy admin interface, reused while the admin url stays the same
+	adminClientMu sync.Mutex
+	adminClient   *adminClient
+}
+
+// A NoEnvoyBinaryError is returned when no envoy binary could be found. It records why each of the
+// places envoy is looked for failed.
+type NoEnvoyBinaryError struct {
+	// ConfiguredErr is why the configured envoy binary path couldn't be used. If a path is configured
+	// nothing else is tried.
+	ConfiguredErr error
+	// EmbeddedErr is why the embedded envoy binary couldn't be extracted.
+	EmbeddedErr error
+	// LookPathErr is why no envoy binary was found on the PATH.
+	LookPathErr error
+	// DownloadErr is why the envoy binary couldn't be downloaded, if a download URL is configured.
+	DownloadErr error
+}
+
+func (e *NoEnvoyBinaryError) Error() string {
+	var reasons []string
+	for _, r := range []struct {
+		name string
+		err  error
+	}{
+		{"configured binary", e.ConfiguredErr},
+		{"embedded binary", e.EmbeddedErr},
+		{"PATH lookup", e.LookPathErr},
+		{"download", e.DownloadErr},
+	} {
+		if r.err != nil {
+			reasons = append(reasons, r.name+": "+r.err.Error())
+		}
+	}
+	return "no envoy binary found (" + strings.Join(reasons, "; ") + ")"
+}
+
+// findEnvoyBinary finds the envoy binary to run. A configured binary path is used as-is, otherwise the
+// embedded binary is used, unless it's disabled, falling back to one on the PATH and then to downloading
+// it. If no binary is found a *NoEnvoyBinaryError is returned. The checksum of the embedded binary is
+// returned if it was computed while extracting it.
+func findEnvoyBinary(ctx context.Context, options *config.Options, wd string) (envoyPath, fullEnvoyPath, extractedChecksum string, downloaded bool, err error) {
+	if options.EnvoyBinaryPath != "" {
+		fullEnvoyPath, err = exec.LookPath(options.EnvoyBinaryPath)
+		if err != nil {
+			return "", "", "", false, &NoEnvoyBinaryError{ConfiguredErr: err}
+		}
+		return options.EnvoyBinaryPath, fullEnvoyPath, "", false, nil
+	}
+
+	var noBinaryErr NoEnvoyBinaryError
+	if options.EnvoyEmbeddedBinaryDisabled {
+		log.Debug().Str("service", "envoy").Msg("envoy: embedded envoy binary is disabled")
+		envoyPath = "envoy"
+	} else {
+		envoyPath, extractedChecksum, noBinaryErr.EmbeddedErr = extractEmbeddedEnvoy()
+		if noBinaryErr.EmbeddedErr != nil {
+			log.Debug().Err(noBinaryErr.EmbeddedErr).Str("service", "envoy").Msg("envoy: embedded envoy binary is not available")
+			envoyPath = "envoy"
+		}
+	}
+
+	fullEnvoyPath, noBinaryErr.LookPathErr = exec.LookPath(envoyPath)
+	if noBinaryErr.LookPathErr == nil {
+		return envoyPath, fullEnvoyPath, extractedChecksum, false, nil
+	}
+
+	if options.EnvoyBinaryURL != "" {
+		fullEnvoyPath = filepath.Join(wd, "envoy")
+		noBinaryErr.DownloadErr = downloadEnvoy(ctx, options.EnvoyBinaryURL, strings.ToLower(options.EnvoyBinaryChecksum), fullEnvoyPath)
+		if noBinaryErr.DownloadErr == nil {
+			return fullEnvoyPath, fullEnvoyPath, "", true, nil
+		}
+	}
+
+	return "", "", "", false, &noBinaryErr
+}
+
+// NewServer creates a new server with traffic routed by envoy.
+func NewServer(src config.Source, grpcPort, httpPort string) (*Server, error) {
+	return NewServerWithContext(context.Background(), src, grpcPort, httpPort)
+}
+
+// NewServerWithContext creates a new server with traffic routed by envoy. When the context is
+// cancelled the server stops listening for config changes and the envoy process is stopped.
+func NewServerWithContext(ctx context.Context, src config.Source, grpcPort, httpPort string) (*Server, error) {
+	options := src.GetConfig().Options
+
+	// each server has its own working directory, which also holds its hot restart base id
+	wd := firstNonEmpty(options.EnvoyWorkingDirectory, filepath.Join(os.TempDir(), workingDirectoryName))
+	err := ensureWorkingDirectory(wd)
+	if err != nil {
+		return nil, fmt.Errorf("error creating temporary working directory for envoy: %w", err)
+	}
+
+	envoyPath, fullEnvoyPath, extractedChecksum, downloaded, err := findEnvoyBinary(ctx, options, wd)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkNoExec(fullEnvoyPath); err != nil {
+		return nil, err
+	}
+
+	// Checksum is written at build time, if it's not empty we verify the binary. Downloaded binaries
+	// have already been verified against envoy_binary_checksum, which configured binaries, and system
+	// binaries when the embedded binary is disabled, are verified against instead of Checksum.
+	var binaryChecksum string
+	switch {
+	case downloaded:
+		binaryChecksum = strings.ToLower(options.EnvoyBinaryChecksum)
+	case (options.EnvoyBinaryPath != "" || options.EnvoyEmbeddedBinaryDisabled) && options.EnvoyBinaryChecksum != "":
+		binaryChecksum = strings.ToLower(options.EnvoyBinaryChecksum)
+		if err := verifyEnvoyChecksum(fullEnvoyPath, "", binaryChecksum); err != nil {
+			return nil, err
+		}
+	case options.EnvoyBinaryPath == "" && !options.EnvoyEmbeddedBinaryDisabled && Checksum != "":
+		binaryChecksum = Checksum
+		if err := verifyEnvoyChecksum(fullEnvoyPath, extractedChecksum, Checksum); err != nil {
+			return nil, err
+		}
+	default:
+		if err := checkUnverifiedEnvoy(options); err != nil {
+			return nil, err
+		}
+	}
+
+	// custom builds may not report a version we understand, so they're allowed with a warning
+	version, v, err := readEnvoyVersion(ctx, fullEnvoyPath)
+	if err != nil {
+		log.Warn().Err(err).Str("service", "envoy").Msg("envoy: failed to determine envoy version")
+	} else if err := checkEnvoyVersion(version, v, options.EnvoyAllowUnsupportedVersion); err != nil {
+		return nil, err
+	}
+
+	srv := &Server{
+		wd:             wd,
+		grpcPort:       grpcPort,
+		httpPort:       httpPort,
+		envoyPath:      envoyPath,
+		version:        version,
+		releaseVersion: v,
+		fullEnvoyPath:  fullEnvoyPath,
+		binaryChecksum: binaryChecksum,
+
+		warmUpPeriod: defaultWarmUpPeriod,
+	}
+	if r, ok := src.(config.ReloadReporter); ok {
+		srv.reloadReporter = r
+	}
+	// a port conflict would otherwise only show up as envoy failing to start
+	if !options.EnvoyAdminDisabled {
+		adminAddr, err := parseAdminAddress(options.EnvoyAdminAddress)
+		if err != nil {
+			return nil, fmt.Errorf("invalid envoy admin address: %w", err)
+		}
+		if err := srv.checkPortConflicts(adminAddr); err != nil {
+			return nil, err
+		}
+	}
+	if options.EnvoyStatsDisabled {
+		log.Info().Str("service", "envoy").Msg("envoy: stats are disabled, not collecting envoy process metrics")
+	} else {
+		go srv.runProcessCollector(ctx)
+	}
+
+	src.OnConfigChange(func(cfg *config.Config) {
+		// the config source has no way to remove a listener, so ignore changes once we're done
+		if ctx.Err() != nil {
+			return
+		}
+		srv.onConfigChange(cfg)
+	})
+	srv.onConfigChange(src.GetConfig())
+
+	if ctx.Done() != nil {
+		go func() {
+			<-ctx.Done()
+			_ = srv.Shutdown(context.Background())
+		}()
+	}
+
+	if src.GetConfig().Options.EnvoyAdminAccessLogReopenOnSignal {
+		go srv.forwardReopenLogsSignal(ctx)
+	}
+	go srv.watchDraining(ctx)
+
+	// the checksum the binary was verified against, or the one computed when it was extracted
+	log.Info().
+		Str("path", envoyPath).
+		Str("checksum", firstNonEmpty(binaryChecksum, extractedChecksum)).
+		Str("version", version).
+		Msg("running envoy")
+
+	return srv, nil
+}
+
+// Shutdown gracefully stops envoy. Envoy is drained, asked to exit once it has no active connections,
+// and killed if it hasn't exited when the context is done or the shutdown timeout has passed. Then the
+// server is closed.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.shutdownMu.Lock()
+	defer srv.shutdownMu.Unlock()
+
+	srv.mu.Lock()
+	adminURL := srv.options.adminURL
+	timeout := firstNonZeroDuration(srv.options.shutdownTimeout, defaultShutdownTimeout)
+	cmd, exited := srv.cmd, srv.exited
+	srv.mu.Unlock()
+
+	if cmd == nil || cmd.Process == nil || exited == nil {
+		return srv.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	log.Info().Str("service", "envoy").Dur("timeout", timeout).Msg("envoy: draining envoy before stopping it")
+	if err := srv.Drain(ctx); err != nil {
+		log.Warn().Err(err).Str("service", "envoy").Msg("envoy: failed to drain envoy")
+	} else if client, err := srv.getAdminClient(adminURL); err == nil {
+		waitForDrain(ctx, client)
+	}
+
+	if err := terminateProcess(cmd.Process); err != nil {
+		log.Warn().Err(err).Str("service", "envoy").Msg("envoy: failed to terminate process")
+	}
+	select {
+	case <-exited:
+	case <-ctx.Done():
+		log.Warn().Str("service", "envoy").Msg("envoy: timed out waiting for envoy to exit, killing it")
+	}
+
+	return srv.Close()
+}
+
+// Close kills any underlying envoy process.
+func (srv *Server) Close() error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	srv.closes++
+
+	var err error
+	if srv.cmd != nil && srv.cmd.Process != nil {
+		select {
+		case <-srv.exited:
+			// the process has already exited, so there's nothing to kill
+		default:
+			err = killProcess(srv.cmd.Process)
+			if err != nil {
+				log.Error().Err(err).Str("service", "envoy").Msg("envoy: failed to kill process on close")
+			}
+		}
+		srv.cmd = nil
+	}
+
+	if srv.options.pidFile != "" {
+		if e := os.Remove(srv.options.pidFile); e != nil && !os.IsNotExist(e) {
+			log.Warn().Err(e).Str("service", "envoy").Str("path", srv.options.pidFile).Msg("envoy: failed to remove pid file")
+		}
+	}
+
+	if srv.logFile != nil {
+		srv.logFile.close()
+		srv.logFile = nil
+	}
+
+	srv.closeAdminClient()
+
+	if srv.options.cleanupOnClose {
+		srv.cleanup()
+	}
+
+	return err
+}
+
+// cleanup removes the files generated for envoy. Only files pomerium created are removed, so the rest of
+// the working directory is left as-is.
+func (srv *Server) cleanup() {
+	paths := []string{filepath.Join(srv.wd, configFileName)}
+	if srv.ownsBaseID {
+		paths = append(paths, srv.baseIDPath())
+		srv.ownsBaseID = false
+	}
+
+	for _, p := range paths {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			log.Warn().Err(err).Str("service", "envoy").Str("path", p).Msg("envoy: failed to remove file")
+		}
+	}
+}
+
+// baseIDPath returns the path of the file envoy writes its hot restart base id to. It's in the working
+// directory so that servers with different working directories don't share a base id.
+func (srv *Server) baseIDPath() string {
+	return filepath.Join(srv.wd, baseIDFileName)
+}
+
+// stop kills the running envoy process and waits for it to exit. srv.mu must be held.
+func (srv *Server) stop() {
+	if srv.cmd == nil || srv.cmd.Process == nil {
+		return
+	}
+
+	log.Info().Str("service", "envoy").Msg("envoy: stopping envoy process")
+	if err := killProcess(srv.cmd.Process); err != nil {
+		log.Warn().Err(err).Str("service", "envoy").Msg("envoy: failed to kill process")
+	}
+	if srv.exited != nil {
+		<-srv.exited
+	}
+	srv.cmd = nil
+}
+
+// PID returns the process id of the running envoy process. It returns false if envoy is not running.
+func (srv *Server) PID() (int, bool) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if !srv.running() {
+		return 0, false
+	}
+	return srv.cmd.Process.Pid, true
+}
+
+// ReopenLogs signals envoy to re-open its access logs. This is used with external log rotation.
+func (srv *Server) ReopenLogs() error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.cmd == nil || srv.cmd.Process == nil {
+		return errors.New("envoy is not running")
+	}
+	return srv.cmd.Process.Signal(reopenLogsSignal)
+}
+
+func (srv *Server) forwardReopenLogsSignal(ctx context.Context) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, reopenLogsSignal)
+	defer signal.Stop(ch)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ch:
+		}
+
+		log.Info().Str("service", "envoy").Msg("envoy: re-opening access logs")
+		if err := srv.ReopenLogs(); err != nil {
+			log.Error().Err(err).Str("service", "envoy").Msg("envoy: failed to re-open access logs")
+		}
+	}
+}
+
+// onConfigChange applies config changes from the config source. Changes which arrive while a reload is
+// in flight are coalesced, so only the latest is applied once the reload finishes.
+func (srv *Server) onConfigChange(cfg *config.Config) {
+	srv.pendingMu.Lock()
+	srv.pendingConfig = cfg
+	if srv.reloading {
+		srv.pendingMu.Unlock()
+		log.Debug().Str("service", "envoy").Msg("envoy: reload in progress, queued config change")
+		return
+	}
+	srv.reloading = true
+	srv.pendingMu.Unlock()
+
+	for {
+		srv.pendingMu.Lock()
+		cfg := srv.pendingConfig
+		srv.pendingConfig = nil
+		if cfg == nil {
+			srv.reloading = false
+			srv.pendingMu.Unlock()
+			return
+		}
+		srv.pendingMu.Unlock()
+
+		if err := srv.update(cfg); err != nil {
+			log.Error().Err(err).Str("service", "envoy").Msg("envoy: failed to apply config change")
+		}
+	}
+}
+
+// ReloadConfig synchronously applies the given config to envoy, restarting envoy if the config changed.
+// Unlike config changes delivered via the config source, any error is returned to the caller.
+func (srv *Server) ReloadConfig(cfg *config.Config) error {
+	return srv.update(cfg)
+}
+
+// Restart restarts envoy with the config it's running with, for example to pick up a replaced binary or
+// to clear its state. Envoy is hot-restarted with the next restart epoch unless hot restart is disabled,
+// in which case the running process is stopped first. If the binary was verified against a checksum when
+// the server was created it's verified again, so a binary which was swapped out isn't started.
+func (srv *Server) Restart() error {
+	events, err := srv.restart()
+	srv.notifyEvents(events...)
+	return err
+}
+
+func (srv *Server) restart() ([]Event, error) {
+	srv.updateMu.Lock()
+	defer srv.updateMu.Unlock()
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.appliedConfig == nil {
+		return nil, errors.New("envoy has not been started")
+	}
+	if srv.binaryChecksum != "" {
+		if err := verifyEnvoyChecksum(srv.fullEnvoyPath, "", srv.binaryChecksum); err != nil {
+			return nil, err
+		}
+	}
+
+	// the config is written again in case a failed reload left a different one behind
+	if err := srv.writeConfig(srv.appliedConfig); err != nil {
+		return nil, fmt.Errorf("error writing envoy config: %w", err)
+	}
+	events := []Event{newEvent(EventConfigWritten, srv.epoch, nil)}
+
+	log.Info().Str("service", "envoy").Msg("envoy: restarting envoy process")
+	if err := srv.run(); err != nil {
+		return events, fmt.Errorf("error running envoy process: %w", err)
+	}
+	return append(events, newEvent(EventProcessStarted, srv.epoch, nil)), nil
+}
+
+// OnError adds a listener which is called whenever applying a config change to envoy fails.
+func (srv *Server) OnError(li ErrorListener) {
+	srv.listenersMu.Lock()
+	defer srv.listenersMu.Unlock()
+
+	srv.errorListeners = append(srv.errorListeners, li)
+}
+
+func (srv *Server) notifyError(err error) {
+	srv.listenersMu.Lock()
+	listeners := srv.errorListeners
+	srv.listenersMu.Unlock()
+
+	for _, li := range listeners {
+		li(err)
+	}
+}
+
+// OnBeforeReload adds a listener which is called before envoy is restarted to apply a config change.
+// Changes applied to the running envoy, or which don't change anything, don't restart it. Listeners are
+// called synchronously without srv.mu held, so they may call back into the server, but config updates
+// are serialized, so they mustn't reload the config themselves.
+func (srv *Server) OnBeforeReload(li BeforeReloadListener) {
+	srv.listenersMu.Lock()
+	defer srv.listenersMu.Unlock()
+
+	srv.beforeReloadListeners = append(srv.beforeReloadListeners, li)
+}
+
+// OnAfterReload adds a listener which is called once envoy has been restarted to apply a config change,
+// with the error if it failed to start. It's called exactly once for each call of the before reload
+// listeners.
+func (srv *Server) OnAfterReload(li AfterReloadListener) {
+	srv.listenersMu.Lock()
+	defer srv.listenersMu.Unlock()
+
+	srv.afterReloadListeners = append(srv.afterReloadListeners, li)
+}
+
+func (srv *Server) notifyBeforeReload(cfg *config.Config) {
+	srv.listenersMu.Lock()
+	listeners := srv.beforeReloadListeners
+	srv.listenersMu.Unlock()
+
+	for _, li := range listeners {
+		li(cfg)
+	}
+}
+
+func (srv *Server) notifyAfterReload(cfg *config.Config, err error) {
+	srv.listenersMu.Lock()
+	listeners := srv.afterReloadListeners
+	srv.listenersMu.Unlock()
+
+	for _, li := range listeners {
+		li(cfg, err)
+	}
+}
+
+func (srv *Server) update(cfg *config.Config) error {
+	// updates are serialized, so a restart decided by applyConfig can't be overtaken by another update
+	// while the reload listeners are called
+	srv.updateMu.Lock()
+	defer srv.updateMu.Unlock()
+
+	events, restart, err := srv.applyConfig(cfg)
+	if restart != nil {
+		srv.notifyBeforeReload(cfg)
+		events, err = srv.restartWithOptions(cfg, *restart)
+		srv.notifyAfterReload(cfg, err)
+	}
+
+	srv.mu.Lock()
+	epoch := srv.epoch
+	srv.mu.Unlock()
+	if err != nil {
+		events = append(events, newEvent(EventReloadFailed, epoch, err))
+	} else if len(events) > 0 {
+		events = append(events, newEvent(EventReloadCompleted, epoch, nil))
+	}
+	srv.notifyEvents(events...)
+
+	if srv.reloadReporter != nil {
+		srv.reloadReporter.ReportReload(ReloadConsumerName, cfg.Checksum(), err)
+	}
+
+	if err != nil {
+		srv.notifyError(err)
+	}
+	return err
+}
+
+// applyConfig applies the config to the running envoy if the change doesn't require a restart. If it
+// does, the new options are returned instead, so the reload listeners can be called without srv.mu held
+// before restartWithOptions restarts envoy. It returns the lifecycle events that occurred so they can be
+// sent to listeners once the lock is released.
+func (srv *Server) applyConfig(cfg *config.Config) ([]Event, *serverOptions, error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	options, err := newServerOptions(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if cmp.Equal(srv.options, options, cmp.AllowUnexported(serverOptions{})) {
+		log.Debug().Str("service", "envoy").Msg("envoy: no config changes detected")
+		srv.recordUnchangedReload(time.Now())
+		return nil, nil, nil
+	}
+	log.Debug().
+		Str("service", "envoy").
+		Str("diff", cmp.Diff(srv.options.redacted(), options.redacted(), cmp.AllowUnexported(serverOptions{}))).
+		Msg("envoy: config changes detected")
+
+	if srv.running() && !restartRequired(srv.options, options) {
+		err := srv.applyLive(srv.options, options)
+		if err == nil {
+			srv.options = options
+			srv.appliedConfig = cfg
+			return []Event{newEvent(EventAppliedLive, srv.epoch, nil)}, nil, nil
+		}
+		log.Warn().Err(err).Str("service", "envoy").Msg("envoy: failed to apply config change to the running envoy, restarting it")
+	}
+	return nil, &options, nil
+}
+
+// restartWithOptions writes the config and restarts envoy with the given options. It returns the
+// lifecycle events that occurred so they can be sent to listeners once the lock is released.
+func (srv *Server) restartWithOptions(cfg *config.Config, options serverOptions) ([]Event, error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	previous := srv.options
+	srv.options = options
+
+	if err := srv.writeConfig(cfg); err != nil {
+		// restore the previous options so the change is retried on the next update
+		srv.options = previous
+		return nil, fmt.Errorf("error writing envoy config: %w", err)
+	}
+	events := []Event{newEvent(EventConfigWritten, srv.epoch, nil)}
+
+	log.Info().Msg("envoy: starting envoy process")
+	if err := srv.run(); err != nil {
+		srv.options = previous
+		return events, fmt.Errorf("error running envoy process: %w", err)
+	}
+	events = append(events, newEvent(EventProcessStarted, srv.epoch, nil))
+	srv.appliedConfig = cfg
+
+	return events, nil
+}
+
+// recordUnchangedReload counts a reload without config changes. Frequent reloads which don't change
+// anything indicate that the config source is churning needlessly, so once there are more than the
+// threshold in a window a warning is logged. srv.mu must be held.
+func (srv *Server) recordUnchangedReload(now time.Time) {
+	metrics.RecordEnvoyUnchangedReload()
+
+	if now.Sub(srv.unchangedReloadsSince) >= unchangedReloadWindow {
+		srv.unchangedReloads = 0
+		srv.unchangedReloadsSince = now
+		srv.unchangedReloadsWarned = false
+	}
+	srv.unchangedReloads++
+
+	if srv.unchangedReloads > srv.options.unchangedReloadWarnThreshold && !srv.unchangedReloadsWarned {
+		srv.unchangedReloadsWarned = true
+		log.Warn().
+			Str("service", "envoy").
+			Int("reloads", srv.unchangedReloads).
+			Dur("window", unchangedReloadWindow).
+			Msg("envoy: config source sent unchanged config repeatedly")
+	}
+}
+
+// running returns true if the envoy process is running. srv.mu must be held.
+func (srv *Server) running() bool {
+	if srv.cmd == nil || srv.cmd.Process == nil {
+		return false
+	}
+	select {
+	case <-srv.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+// restartRequired returns true if envoy has to be restarted to apply a change from the previous options.
+//
+// Changes to the log level are applied to the running envoy via the admin interface, changes to the
+// niceness and cpuset are applied to the running process, and changes to the drain watch interval,
+// shutdown timeout, warm-up period and timeout, cleanup on close and unchanged reload warning threshold only
+// affect pomerium. Every other option is part of envoy's bootstrap config or command line, or of the
+// log pipeline set up when envoy starts, so changing it restarts envoy.
+func restartRequired(previous, options serverOptions) bool {
+	for _, opts := range []*serverOptions{&previous, &options} {
+		opts.logLevel = ""
+		opts.drainWatchInterval = 0
+		opts.shutdownTimeout = 0
+		opts.warmUpPeriod = 0
+		opts.warmUpTimeout = 0
+		opts.cleanupOnClose = false
+		opts.niceness = 0
+		opts.cpus = nil
+		opts.unchangedReloadWarnThreshold = 0
+	}
+	return !cmp.Equal(previous, options, cmp.AllowUnexported(serverOptions{}))
+}
+
+// applyLive applies changes which don't require a restart to the running envoy. srv.mu must be held.
+func (srv *Server) applyLive(previous, options serverOptions) error {
+	if options.logLevel != previous.logLevel {
+		if options.adminURL == "" {
+			return errAdminDisabled
+		}
+		client, err := srv.getAdminClient(options.adminURL)
+		if err != nil {
+			return err
+		}
+		if err := setLogLevel(context.Background(), client, options.logLevel); err != nil {
+			return err
+		}
+		log.Info().Str("service", "envoy").Str("level", options.logLevel).Msg("envoy: changed log level")
+	}
+	// restarting envoy wouldn't help if its niceness can't be set, so failures are only logged
+	if options.niceness != previous.niceness {
+		if err := setPriority(srv.cmd.Process, options.niceness); err != nil {
+			log.Warn().Err(err).Str("service", "envoy").Msg("envoy: failed to change niceness")
+		} else {
+			log.Info().Str("service", "envoy").Int("niceness", options.niceness).Msg("envoy: changed niceness")
+		}
+	}
+	if !cmp.Equal(options.cpus, previous.cpus) {
+		srv.applyAffinity(srv.cmd.Process, options.cpus)
+	}
+	return nil
+}
+
+// applyAffinity restricts the envoy process to the given cpus, or lets it run on every cpu pomerium may
+// run on when there are none. Restarting envoy wouldn't help if its affinity can't be set, so failures
+// are only logged.
+func (srv *Server) applyAffinity(p *os.Process, cpus []int) {
+	if err := setAffinity(p, cpus); err != nil {
+		log.Warn().Err(err).Str("service", "envoy").Msg("envoy: failed to set cpu affinity")
+	} else if len(cpus) == 0 {
+		log.Info().Str("service", "envoy").Msg("envoy: reset cpu affinity")
+	} else {
+		log.Info().Str("service", "envoy").Ints("cpus", cpus).Msg("envoy: set cpu affinity")
+	}
+}
+
+// run starts a new envoy process and, once it has warmed up, replaces the running one with it. srv.mu
+// must be held. It's released while the new process warms up, so the running envoy can still be
+// queried and closed in the meantime, and runs are serialized by srv.updateMu instead.
+func (srv *Server) run() error {
+	args := []string{
+		"-c", firstNonEmpty(srv.configFile, configFileName),
+		"--log-level", srv.options.logLevel,
+		"--log-format", firstNonEmpty(srv.options.logFormat, defaultLogFormat),
+		"--log-format-escaped",
+	}
+
+	// envoy requires each hot restart to have the epoch after the one of the process it replaces
+	epoch := 0
+	restartEpoch := srv.restartEpoch + 1
+	baseID, haveBaseID := readBaseID(srv.baseIDPath())
+	// only a running envoy can be hot restarted, the first process is started from scratch even if
+	// there is a base id
+	hotRestart := haveBaseID && srv.cmd != nil
+	if hotRestart && !srv.options.disableHotRestart && srv.options.restartEpochMax > 0 &&
+		srv.options.restartEpochStart+restartEpoch > srv.options.restartEpochMax {
+		// a new base id can't take over the previous process's sockets, so it has to be stopped first
+		log.Info().
+			Str("service", "envoy").
+			Int("max_restart_epoch", srv.options.restartEpochMax).
+			Msg("envoy: maximum restart epoch reached, performing a full restart")
+		hotRestart = false
+		srv.stop()
+	}
+	var binaryChecksum string
+	if srv.options.restartOnBinaryChange {
+		changed, sum, err := srv.checkBinaryChanged()
+		if err != nil {
+			return err
+		}
+		binaryChecksum = sum
+		// the new binary may not be able to take over from the old one, so it's started from scratch
+		if changed && hotRestart && !srv.options.disableHotRestart {
+			log.Info().
+				Str("service", "envoy").
+				Str("path", firstNonEmpty(srv.fullEnvoyPath, srv.envoyPath)).
+				Str("checksum", sum).
+				Msg("envoy: envoy binary changed, performing a full restart")
+			hotRestart = false
+			srv.stop()
+		}
+	}
+	switch {
+	case srv.options.disableHotRestart:
+		hotRestart = false
+		srv.stop()
+		if !containsString(srv.options.extraArgs, "--disable-hot-restart") {
+			args = append(args, "--disable-hot-restart")
+		}
+	case hotRestart:
+		epoch = srv.options.restartEpochStart + restartEpoch
+		args = append(args, "--base-id", strconv.Itoa(baseID), "--restart-epoch", strconv.Itoa(epoch))
+	default:
+		// a process started from scratch has the first epoch, and the hot restarts count on from it
+		restartEpoch = 0
+		epoch = srv.options.restartEpochStart
+		if epoch > 0 {
+			// envoy refuses to start with a non-zero restart epoch and a dynamic base id, so the persisted
+			// base id is used
+			if !haveBaseID {
+				return fmt.Errorf("envoy restart epoch start %d requires an existing base id in %s", epoch, srv.baseIDPath())
+			}
+			args = append(args, "--base-id", strconv.Itoa(baseID), "--restart-epoch", strconv.Itoa(epoch))
+			break
+		}
+		args = append(args, "--use-dynamic-base-id", "--base-id-path", srv.baseIDPath())
+		srv.ownsBaseID = true
+	}
+	if srv.options.drainStrategy != "" {
+		args = append(args, "--drain-strategy", srv.options.drainStrategy)
+	}
+	if srv.options.drainTime > 0 {
+		// envoy only takes whole seconds, so round up
+		args = append(args, "--drain-time-s", strconv.Itoa(int(math.Ceil(srv.options.drainTime.Seconds()))))
+	}
+	if srv.options.logPath != "" {
+		args = append(args, "--log-path", srv.options.logPath)
+	}
+	if srv.options.fileFlushInterval > 0 {
+		// envoy only takes whole milliseconds, so round up
+		args = append(args, "--file-flush-interval-msec",
+			strconv.FormatInt(int64(math.Ceil(float64(srv.options.fileFlushInterval)/float64(time.Millisecond))), 10))
+	}
+	args = append(args, srv.options.extraArgs...)
+
+	log.Debug().Str("service", "envoy").Str("path", srv.envoyPath).Strs("args", args).Msg("envoy: command line")
+	cmd := exec.Command(srv.envoyPath, args...) // #nosec
+	cmd.Dir = srv.wd
+	cmd.Env = buildEnvironment(os.Environ(), srv.options.environment)
+
+	// when envoy writes its logs to a file its output isn't parsed, so anything it writes before it
+	// opens the file is passed through as-is
+	var logsWG sync.WaitGroup
+	if srv.options.logPath != "" {
+		if err := validateWritablePath(srv.options.logPath); err != nil {
+			return err
+		}
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+	} else if err := srv.handleProcessLogs(cmd, epoch, &logsWG); err != nil {
+		return err
+	}
+
+	// make sure envoy is killed if we're killed
+	var err error
+	cmd.SysProcAttr, err = buildSysProcAttr(srv.options.uid, srv.options.gid)
+	if err != nil {
+		return err
+	}
+
+	err = cmd.Start()
+	if errors.Is(err, os.ErrPermission) && srv.options.uid != 0 {
+		return fmt.Errorf("error starting envoy as uid %d gid %d, pomerium may not have the privilege to change credentials: %w",
+			srv.options.uid, srv.options.gid, err)
+	} else if err != nil {
+		return fmt.Errorf("error starting envoy: %w", err)
+	}
+	if err := setupProcess(cmd.Process); err != nil {
+		log.Warn().Err(err).Str("service", "envoy").Msg("envoy: failed to set up process, it may outlive pomerium")
+	}
+	if srv.options.niceness != 0 {
+		if err := setPriority(cmd.Process, srv.options.niceness); err != nil {
+			log.Warn().Err(err).Str("service", "envoy").Msg("envoy: failed to set niceness")
+		}
+	}
+	if len(srv.options.cpus) > 0 {
+		srv.applyAffinity(cmd.Process, srv.options.cpus)
+	}
+
+	exited := make(chan struct{})
+	go srv.wait(cmd, &logsWG, epoch, exited)
+
+	warmUpPeriod := firstNonZeroDuration(srv.options.warmUpPeriod, srv.warmUpPeriod)
+	warmUpTimeout, adminURL := srv.options.warmUpTimeout, srv.options.adminURL
+	if warmUpPeriod > 0 || (warmUpTimeout > 0 && adminURL != "") {
+		closes := srv.closes
+		srv.mu.Unlock()
+		err := srv.warmUp(cmd, epoch, exited, warmUpPeriod, warmUpTimeout, adminURL)
+		srv.mu.Lock()
+		if err != nil {
+			return err
+		}
+		if srv.closes != closes {
+			if err := killProcess(cmd.Process); err != nil {
+				log.Warn().Err(err).Str("service", "envoy").Msg("envoy: failed to kill process started during close")
+			}
+			return errors.New("envoy server was closed while envoy was warming up")
+		}
+	}
+
+	if !srv.options.disableHotRestart {
+		srv.restartEpoch = restartEpoch
+	}
+
+	// the previous process is left to drain for the hot-reload, it's reaped by its wait goroutine
+	if srv.cmd != nil && srv.cmd.Process != nil {
+		log.Info().Msg("envoy: releasing envoy process for hot-reload")
+	}
+	srv.cmd = cmd
+	srv.exited = exited
+	srv.epoch = epoch
+	srv.startedChecksum = binaryChecksum
+
+	if srv.options.pidFile != "" {
+		err = atomic.WriteFile(srv.options.pidFile, strings.NewReader(strconv.Itoa(cmd.Process.Pid)+"\n"))
+		if err != nil {
+			log.Warn().Err(err).Str("service", "envoy").Str("path", srv.options.pidFile).Msg("envoy: failed to write pid file")
+		}
+	}
+
+	return nil
+}
+
+// warmUp waits for a new envoy process to warm up. If the new process dies during the warm-up period the
+// previous one keeps serving, and if the admin interface is enabled the previous one keeps serving until
+// the new one has received its config from the control plane and is live, or the warm-up timeout passes.
+func (srv *Server) warmUp(cmd *exec.Cmd, epoch int, exited <-chan struct{}, period, timeout time.Duration, adminURL string) error {
+	if period > 0 {
+		select {
+		case <-exited:
+			return fmt.Errorf("envoy exited during warm-up: %s", cmd.ProcessState)
+		case <-time.After(period):
+		}
+	}
+
+	if timeout <= 0 || adminURL == "" {
+		return nil
+	}
+	client, err := srv.getAdminClient(adminURL)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	err = waitForLive(ctx, client, epoch, exited)
+	cancel()
+	if errors.Is(err, errEnvoyExited) {
+		return fmt.Errorf("envoy exited during warm-up: %s", cmd.ProcessState)
+	} else if err != nil {
+		log.Warn().Err(err).
+			Str("service", "envoy").
+			Dur("timeout", timeout).
+			Msg("envoy: envoy did not become live before the warm-up timeout")
+	}
+	return nil
 }
 
-// NewServer creates a new server with traffic routed by envoy.
-func NewServer(src config.Source, grpcPort, httpPort string) (*Server, error) {
-	wd := filepath.Join(os.TempDir(), workingDirectoryName)
-	err := os.MkdirAll(wd, 0o755)
+// checkBinaryChanged returns the checksum of the envoy binary and whether it's different from the one the
+// running envoy was started from. If the binary was verified against a checksum when the server was
+// created it's verified again, so a binary which doesn't match isn't started.
+func (srv *Server) checkBinaryChanged() (changed bool, checksum string, err error) {
+	checksum, err = fileChecksum(firstNonEmpty(srv.fullEnvoyPath, srv.envoyPath))
 	if err != nil {
-		return nil, fmt.Errorf("error creating temporary working directory for envoy: %w", err)
+		return false, "", fmt.Errorf("error reading envoy binary for checksum verification: %w", err)
 	}
-
-	envoyPath, err := extractEmbeddedEnvoy()
-	if err != nil {
-		log.Warn().Err(err).Send()
-		envoyPath = "envoy"
+	if srv.binaryChecksum != "" {
+		if err := verifyEnvoyChecksum(srv.fullEnvoyPath, checksum, srv.binaryChecksum); err != nil {
+			return false, "", err
+		}
 	}
+	return srv.startedChecksum != "" && checksum != srv.startedChecksum, checksum, nil
+}
 
-	fullEnvoyPath, err := exec.LookPath(envoyPath)
+func (srv *Server) writeConfig(cfg *config.Config) (err error) {
+	confBytes, redactedBytes, err := srv.buildBootstrapConfig(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("no envoy binary found: %w", err)
+		return err
 	}
 
-	// Checksum is written at build time, if it's not empty we verify the binary
-	if Checksum != "" {
-		bs, err := ioutil.ReadFile(fullEnvoyPath)
-		if err != nil {
-			return nil, fmt.Errorf("error reading envoy binary for checksum verification: %w", err)
-		}
-		h := sha256.New()
-		h.Write(bs)
-		s := hex.EncodeToString(h.Sum(nil))
-		if Checksum != s {
-			return nil, fmt.Errorf("invalid envoy binary, expected %s but got %s", Checksum, s)
+	// with a config history each config is written to its own directory, so earlier ones are kept
+	configFile := configFileName
+	ownedPaths := []string{srv.wd}
+	if srv.options.configHistory > 0 {
+		dir := filepath.Join(srv.wd, configHistoryDirectoryPrefix+time.Now().UTC().Format(configHistoryTimeFormat))
+		if err := os.Mkdir(dir, workingDirectoryMode); err != nil {
+			return fmt.Errorf("error creating envoy config history directory: %w", err)
 		}
-	} else {
-		log.Info().Msg("no checksum defined, envoy binary will not be verified!")
+		defer func() {
+			if err != nil {
+				_ = os.RemoveAll(dir)
+			}
+		}()
+		configFile = filepath.Join(filepath.Base(dir), configFileName)
+		ownedPaths = append(ownedPaths, dir)
 	}
+	cfgPath := filepath.Join(srv.wd, configFile)
 
-	srv := &Server{
-		wd:        wd,
-		grpcPort:  grpcPort,
-		httpPort:  httpPort,
-		envoyPath: envoyPath,
+	// envoy has to be able to read its config when it runs as a different user
+	if srv.options.uid != 0 {
+		for _, p := range ownedPaths {
+			if err = os.Chown(p, int(srv.options.uid), int(srv.options.gid)); err != nil {
+				return fmt.Errorf("error changing owner of %s for envoy: %w", p, err)
+			}
+		}
 	}
-	go srv.runProcessCollector()
-
-	src.OnConfigChange(srv.onConfigChange)
-	srv.onConfigChange(src.GetConfig())
-
-	log.Info().
-		Str("path", envoyPath).
-		Str("checksum", Checksum).
-		Msg("running envoy")
 
-	return srv, nil
-}
+	if err = srv.writeConfigFile(cfgPath, confBytes); err != nil {
+		return err
+	}
+	log.Debug().Str("service", "envoy").Str("location", cfgPath).Msg("wrote config file to location")
 
-// Close kills any underlying envoy process.
-func (srv *Server) Close() error {
-	srv.mu.Lock()
-	defer srv.mu.Unlock()
+	srv.configFile = configFile
+	if srv.options.configHistory > 0 {
+		srv.pruneConfigHistory()
+	}
 
-	var err error
-	if srv.cmd != nil && srv.cmd.Process != nil {
-		err = srv.cmd.Process.Kill()
-		if err != nil {
-			log.Error().Err(err).Str("service", "envoy").Msg("envoy: failed to kill process on close")
-		}
-		srv.cmd = nil
+	if srv.options.configDumpPath != "" {
+		srv.writeConfigDump(confBytes)
 	}
 
-	return err
-}
+	srv.bootstrapMu.Lock()
+	srv.bootstrap = redactedBytes
+	srv.bootstrapMu.Unlock()
 
-func (srv *Server) onConfigChange(cfg *config.Config) {
-	srv.update(cfg)
+	return nil
 }
 
-func (srv *Server) update(cfg *config.Config) {
-	srv.mu.Lock()
-	defer srv.mu.Unlock()
+// writeConfigFile writes envoy's config to cfgPath. The config is written to a temporary file and read
+// back before it replaces cfgPath, so a failed or incomplete write leaves the previous config in place
+// for the running envoy to be restarted with.
+func (srv *Server) writeConfigFile(cfgPath string, confBytes []byte) error {
+	tmpPath := cfgPath + ".tmp"
+	// writing keeps the mode of an existing file, so a leftover temporary file is removed first
+	if err := os.Remove(tmpPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing temporary envoy config file: %w", err)
+	}
+	defer func() { _ = os.Remove(tmpPath) }()
 
-	tracingOptions, err := config.NewTracingOptions(cfg.Options)
+	if err := writeFile(tmpPath, confBytes, configFileMode); err != nil {
+		return fmt.Errorf("error writing envoy config file: %w", err)
+	}
+	written, err := ioutil.ReadFile(tmpPath)
 	if err != nil {
-		log.Error().Err(err).Str("service", "envoy").Msg("invalid tracing config")
-		return
+		return fmt.Errorf("error reading back envoy config file: %w", err)
+	}
+	if !bytes.Equal(written, confBytes) {
+		return fmt.Errorf("envoy config file was not written correctly, read back %d of %d bytes", len(written), len(confBytes))
 	}
 
-	options := serverOptions{
-		services:       cfg.Options.Services,
-		logLevel:       firstNonEmpty(cfg.Options.ProxyLogLevel, cfg.Options.LogLevel, "debug"),
-		tracingOptions: *tracingOptions,
+	if srv.options.uid != 0 {
+		if err := os.Chown(tmpPath, int(srv.options.uid), int(srv.options.gid)); err != nil {
+			return fmt.Errorf("error changing owner of %s for envoy: %w", cfgPath, err)
+		}
 	}
 
-	if cmp.Equal(srv.options, options, cmp.AllowUnexported(serverOptions{})) {
-		log.Debug().Str("service", "envoy").Msg("envoy: no config changes detected")
-		return
+	if err := atomic.ReplaceFile(tmpPath, cfgPath); err != nil {
+		return fmt.Errorf("error replacing envoy config file: %w", err)
 	}
-	srv.options = options
+	return nil
+}
 
-	if err := srv.writeConfig(cfg); err != nil {
-		log.Error().Err(err).Str("service", "envoy").Msg("envoy: failed to write envoy config")
+// pruneConfigHistory removes the oldest config history directories, keeping the configured number of
+// them. Errors are only logged, since envoy doesn't depend on the history.
+func (srv *Server) pruneConfigHistory() {
+	dirs, err := filepath.Glob(filepath.Join(srv.wd, configHistoryDirectoryPrefix+"*"))
+	if err != nil {
+		log.Warn().Err(err).Str("service", "envoy").Msg("envoy: failed to list config history")
 		return
 	}
+	sort.Strings(dirs)
 
-	log.Info().Msg("envoy: starting envoy process")
-	if err := srv.run(); err != nil {
-		log.Error().Err(err).Str("service", "envoy").Msg("envoy: failed to run envoy process")
-		return
+	for len(dirs) > srv.options.configHistory {
+		if err := os.RemoveAll(dirs[0]); err != nil {
+			log.Warn().Err(err).Str("service", "envoy").Str("path", dirs[0]).Msg("envoy: failed to remove config history")
+		}
+		dirs = dirs[1:]
 	}
 }
 
-func (srv *Server) run() error {
-	args := []string{
-		"-c", configFileName,
-		"--log-level", srv.options.logLevel,
-		"--log-format", "[LOG_FORMAT]%l--%n--%v",
-		"--log-format-escaped",
-	}
+// Bootstrap returns the bootstrap config last written for envoy, so it can be exposed for debugging.
+// Secrets are redacted. It returns an error if no config has been written yet.
+func (srv *Server) Bootstrap() ([]byte, error) {
+	srv.bootstrapMu.Lock()
+	defer srv.bootstrapMu.Unlock()
 
-	if baseID, ok := readBaseID(); ok {
-		args = append(args, "--base-id", strconv.Itoa(baseID), "--restart-epoch", strconv.Itoa(srv.restartEpoch))
-		srv.restartEpoch++ // start with epoch zero when we're a fresh pomerium process
-	} else {
-		args = append(args, "--use-dynamic-base-id", "--base-id-path", baseIDPath)
+	if srv.bootstrap == nil {
+		return nil, errors.New("envoy bootstrap config has not been written yet")
 	}
+	return append([]byte(nil), srv.bootstrap...), nil
+}
 
-	cmd := exec.Command(srv.envoyPath, args...) // #nosec
-	cmd.Dir = srv.wd
-
-	stderr, err := cmd.StderrPipe()
+// writeConfigDump writes a copy of the envoy config for debugging. Errors are only logged, since envoy
+// doesn't depend on the copy.
+func (srv *Server) writeConfigDump(confBytes []byte) {
+	dumpPath := srv.options.configDumpPath
+	err := os.Chmod(dumpPath, configFileMode)
+	if err == nil || os.IsNotExist(err) {
+		err = atomic.WriteFile(dumpPath, bytes.NewReader(confBytes))
+	}
 	if err != nil {
-		return fmt.Errorf("error creating stderr pipe for envoy: %w", err)
+		log.Warn().Err(err).Str("service", "envoy").Str("location", dumpPath).Msg("envoy: failed to write config dump")
+		return
 	}
-	go srv.handleLogs(stderr)
+	log.Debug().Str("service", "envoy").Str("location", dumpPath).Msg("wrote config dump to location")
+}
 
-	stdout, err := cmd.StdoutPipe()
+// buildBootstrapConfig returns the marshaled bootstrap config, in the configured format, and a JSON copy
+// with secrets redacted.
+func (srv *Server) buildBootstrapConfig(cfg *config.Config) (confBytes, redactedBytes []byte, err error) {
+	bcfg, err := srv.buildBootstrap(cfg)
 	if err != nil {
-		return fmt.Errorf("error creating stderr pipe for envoy: %w", err)
+		return nil, nil, err
+	}
+	if err := srv.checkBootstrapCompatibility(bcfg); err != nil {
+		return nil, nil, err
 	}
-	go srv.handleLogs(stdout)
-
-	// make sure envoy is killed if we're killed
-	cmd.SysProcAttr = sysProcAttr
 
-	err = cmd.Start()
+	confBytes, err = protojson.Marshal(proto.MessageV2(bcfg))
 	if err != nil {
-		return fmt.Errorf("error starting envoy: %w", err)
+		return nil, nil, err
 	}
-
-	// release the previous process so we can hot-reload
-	if srv.cmd != nil && srv.cmd.Process != nil {
-		log.Info().Msg("envoy: releasing envoy process for hot-reload")
-		err := srv.cmd.Process.Release()
+	if srv.options.bootstrapFormat == config.BootstrapFormatYAML {
+		confBytes, err = jsonToYAML(confBytes)
 		if err != nil {
-			log.Warn().Err(err).Str("service", "envoy").Msg("envoy: failed to release envoy process for hot-reload")
+			return nil, nil, fmt.Errorf("error converting envoy bootstrap config to yaml: %w", err)
 		}
 	}
-	srv.cmd = cmd
 
-	return nil
-}
-
-func (srv *Server) writeConfig(cfg *config.Config) error {
-	confBytes, err := srv.buildBootstrapConfig(cfg)
+	redacted := proto.Clone(bcfg)
+	if err := redactConfig(proto.MessageV2(redacted)); err != nil {
+		return nil, nil, fmt.Errorf("error redacting envoy bootstrap config: %w", err)
+	}
+	redactedBytes, err = protojson.Marshal(proto.MessageV2(redacted))
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-
-	cfgPath := filepath.Join(srv.wd, configFileName)
-	log.Debug().Str("service", "envoy").Str("location", cfgPath).Msg("wrote config file to location")
-
-	return atomic.WriteFile(cfgPath, bytes.NewReader(confBytes))
+	return confBytes, redactedBytes, nil
 }
 
-func (srv *Server) buildBootstrapConfig(cfg *config.Config) ([]byte, error) {
-	nodeCfg := &envoy_config_core_v3.Node{
-		Id:      "proxy",
-		Cluster: "proxy",
+// buildBootstrap builds the envoy bootstrap config.
+func (srv *Server) buildBootstrap(cfg *config.Config) (*envoy_config_bootstrap_v3.Bootstrap, error) {
+	nodeCfg, err := srv.buildNode()
+	if err != nil {
+		return nil, err
 	}
 
-	adminAddr, err := ParseAddress(cfg.Options.EnvoyAdminAddress)
+	adminCfg, err := srv.buildAdminConfig(cfg)
 	if err != nil {
 		return nil, err
 	}
-	adminCfg := &envoy_config_bootstrap_v3.Admin{
-		AccessLogPath: cfg.Options.EnvoyAdminAccessLogPath,
-		ProfilePath:   cfg.Options.EnvoyAdminProfilePath,
-		Address:       adminAddr,
-	}
 
 	dynamicCfg := &envoy_config_bootstrap_v3.Bootstrap_DynamicResources{
 		AdsConfig: &envoy_config_core_v3.ApiConfigSource{
-			ApiType:             envoy_config_core_v3.ApiConfigSource_ApiType(envoy_config_core_v3.ApiConfigSource_ApiType_value["DELTA_GRPC"]),
+			ApiType:             config.GetEnvoyXDSAPIType(srv.options.xdsAPIType),
 			TransportApiVersion: envoy_config_core_v3.ApiVersion_V3,
 			GrpcServices: []*envoy_config_core_v3.GrpcService{
 				{
 					TargetSpecifier: &envoy_config_core_v3.GrpcService_EnvoyGrpc_{
 						EnvoyGrpc: &envoy_config_core_v3.GrpcService_EnvoyGrpc{
-							ClusterName: "pomerium-control-plane-grpc",
+							ClusterName: config.EnvoyControlPlaneGRPCClusterName,
 						},
 					},
 				},
@@ -281,6 +1583,11 @@ func (srv *Server) buildBootstrapConfig(cfg *config.Config) ([]byte, error) {
 			ConfigSourceSpecifier: &envoy_config_core_v3.ConfigSource_Ads{},
 		},
 	}
+	// envoy waits 15s for the first responses unless a timeout is set
+	if srv.options.xdsInitialFetchTimeout > 0 {
+		dynamicCfg.LdsConfig.InitialFetchTimeout = durationpb.New(srv.options.xdsInitialFetchTimeout)
+		dynamicCfg.CdsConfig.InitialFetchTimeout = durationpb.New(srv.options.xdsInitialFetchTimeout)
+	}
 
 	controlPlanePort, err := strconv.Atoi(srv.grpcPort)
 	if err != nil {
@@ -303,16 +1610,16 @@ func (srv *Server) buildBootstrapConfig(cfg *config.Config) ([]byte, error) {
 	}
 
 	controlPlaneCluster := &envoy_config_cluster_v3.Cluster{
-		Name: "pomerium-control-plane-grpc",
+		Name: config.EnvoyControlPlaneGRPCClusterName,
 		ConnectTimeout: &durationpb.Duration{
 			Seconds: 5,
 		},
 		ClusterDiscoveryType: &envoy_config_cluster_v3.Cluster_Type{
 			Type: envoy_config_cluster_v3.Cluster_STATIC,
 		},
-		LbPolicy: envoy_config_cluster_v3.Cluster_ROUND_ROBIN,
+		LbPolicy: config.GetEnvoyLBPolicy(srv.options.controlPlaneLBPolicy),
 		LoadAssignment: &envoy_config_endpoint_v3.ClusterLoadAssignment{
-			ClusterName: "pomerium-control-plane-grpc",
+			ClusterName: config.EnvoyControlPlaneGRPCClusterName,
 			Endpoints: []*envoy_config_endpoint_v3.LocalityLbEndpoints{
 				{
 					LbEndpoints: []*envoy_config_endpoint_v3.LbEndpoint{
@@ -323,7 +1630,21 @@ func (srv *Server) buildBootstrapConfig(cfg *config.Config) ([]byte, error) {
 				},
 			},
 		},
-		Http2ProtocolOptions: &envoy_config_core_v3.Http2ProtocolOptions{},
+		Http2ProtocolOptions: &envoy_config_core_v3.Http2ProtocolOptions{
+			ConnectionKeepalive: &envoy_config_core_v3.KeepaliveSettings{
+				Interval: durationpb.New(srv.options.controlPlaneKeepaliveInterval),
+				Timeout:  durationpb.New(srv.options.controlPlaneKeepaliveTimeout),
+			},
+		},
+		UpstreamConnectionOptions: srv.buildControlPlaneConnectionOptions(),
+		CircuitBreakers: buildCircuitBreakers(srv.options.controlPlaneMaxConnections,
+			srv.options.controlPlaneMaxPendingRequests, srv.options.controlPlaneMaxRequests),
+	}
+	if srv.options.controlPlaneTLS {
+		controlPlaneCluster.TransportSocket, err = srv.buildControlPlaneTransportSocket()
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	staticCfg := &envoy_config_bootstrap_v3.Bootstrap_StaticResources{
@@ -333,86 +1654,251 @@ func (srv *Server) buildBootstrapConfig(cfg *config.Config) ([]byte, error) {
 	}
 
 	if srv.options.tracingOptions.Provider == trace.DatadogTracingProviderName {
-		addr := &envoy_config_core_v3.SocketAddress{
-			Address: "127.0.0.1",
-			PortSpecifier: &envoy_config_core_v3.SocketAddress_PortValue{
-				PortValue: 8126,
-			},
+		staticCfg.Clusters = append(staticCfg.Clusters, srv.buildDatadogCluster())
+
+		if srv.options.tracingProxyAddress != "" {
+			proxyListener, proxyCluster, err := srv.buildTracingProxy(srv.datadogAddress())
+			if err != nil {
+				return nil, err
+			}
+			staticCfg.Listeners = append(staticCfg.Listeners, proxyListener)
+			staticCfg.Clusters = append(staticCfg.Clusters, proxyCluster)
+		}
+	}
+
+	if alsCluster, err := srv.buildAccessLogServiceCluster(); err != nil {
+		return nil, err
+	} else if alsCluster != nil {
+		staticCfg.Clusters = append(staticCfg.Clusters, alsCluster)
+	}
+
+	if healthCheckListener, err := srv.buildHealthCheckListener(); err != nil {
+		return nil, err
+	} else if healthCheckListener != nil {
+		staticCfg.Listeners = append(staticCfg.Listeners, healthCheckListener)
+	}
+
+	if statsListener, statsCluster, err := srv.buildStatsListener(adminCfg.GetAddress()); err != nil {
+		return nil, err
+	} else if statsListener != nil {
+		staticCfg.Listeners = append(staticCfg.Listeners, statsListener)
+		staticCfg.Clusters = append(staticCfg.Clusters, statsCluster)
+	}
+
+	for _, cluster := range staticCfg.Clusters {
+		if err := srv.applyDNSResolvers(cluster); err != nil {
+			return nil, err
+		}
+		if srv.options.clusterBufferLimitBytes > 0 {
+			cluster.PerConnectionBufferLimitBytes = wrapperspb.UInt32(srv.options.clusterBufferLimitBytes)
 		}
-		if srv.options.tracingOptions.DatadogAddress != "" {
-			a, p, err := net.SplitHostPort(srv.options.tracingOptions.DatadogAddress)
-			if err == nil {
-				addr.Address = a
-				if pv, err := strconv.ParseUint(p, 10, 32); err == nil {
-					addr.PortSpecifier = &envoy_config_core_v3.SocketAddress_PortValue{
-						PortValue: uint32(pv),
-					}
-				}
+	}
+
+	// extra clusters are added as-is, so they set their own dns resolvers and buffer limits
+	bootstrapClusters, err := config.ParseEnvoyBootstrapClusters(srv.options.bootstrapClusters)
+	if err != nil {
+		return nil, fmt.Errorf("invalid envoy bootstrap clusters: %w", err)
+	}
+	for _, cluster := range bootstrapClusters {
+		for _, existing := range staticCfg.Clusters {
+			if cluster.GetName() == existing.GetName() {
+				return nil, fmt.Errorf("envoy bootstrap cluster %s conflicts with a cluster configured by pomerium", cluster.GetName())
 			}
 		}
+	}
+	staticCfg.Clusters = append(staticCfg.Clusters, bootstrapClusters...)
 
-		staticCfg.Clusters = append(staticCfg.Clusters, &envoy_config_cluster_v3.Cluster{
-			Name: "datadog-apm",
-			ConnectTimeout: &durationpb.Duration{
-				Seconds: 5,
-			},
-			ClusterDiscoveryType: &envoy_config_cluster_v3.Cluster_Type{
-				Type: envoy_config_cluster_v3.Cluster_STATIC,
+	bcfg := &envoy_config_bootstrap_v3.Bootstrap{
+		Node:                nodeCfg,
+		Admin:               adminCfg,
+		DynamicResources:    dynamicCfg,
+		StaticResources:     staticCfg,
+		StatsConfig:         srv.buildStatsConfig(),
+		UseTcpForDnsLookups: srv.options.dnsUseTCP,
+	}
+
+	bcfg.OverloadManager, err = srv.buildOverloadManager()
+	if err != nil {
+		return nil, err
+	}
+
+	bcfg.LayeredRuntime, err = srv.buildLayeredRuntime()
+	if err != nil {
+		return nil, err
+	}
+
+	return bcfg, nil
+}
+
+// applyDNSResolvers sets the configured DNS resolvers on clusters which resolve their endpoints via DNS.
+func (srv *Server) applyDNSResolvers(cluster *envoy_config_cluster_v3.Cluster) error {
+	switch cluster.GetType() {
+	case envoy_config_cluster_v3.Cluster_STRICT_DNS, envoy_config_cluster_v3.Cluster_LOGICAL_DNS:
+	default:
+		return nil
+	}
+
+	for _, resolver := range srv.options.dnsResolvers {
+		if net.ParseIP(resolver) != nil {
+			resolver = net.JoinHostPort(resolver, "53")
+		}
+		addr, err := ParseAddress(resolver)
+		if err != nil {
+			return fmt.Errorf("invalid dns resolver: %w", err)
+		}
+		cluster.DnsResolvers = append(cluster.DnsResolvers, addr)
+	}
+	cluster.UseTcpForDnsLookups = srv.options.dnsUseTCP
+	return nil
+}
+
+func (srv *Server) buildControlPlaneTransportSocket() (*envoy_config_core_v3.TransportSocket, error) {
+	validationContext := &envoy_extensions_transport_sockets_tls_v3.CertificateValidationContext{
+		TrustedCa: &envoy_config_core_v3.DataSource{
+			Specifier: &envoy_config_core_v3.DataSource_Filename{
+				Filename: srv.options.controlPlaneCAFile,
 			},
-			LbPolicy: envoy_config_cluster_v3.Cluster_ROUND_ROBIN,
-			LoadAssignment: &envoy_config_endpoint_v3.ClusterLoadAssignment{
-				ClusterName: "datadog-apm",
-				Endpoints: []*envoy_config_endpoint_v3.LocalityLbEndpoints{
-					{
-						LbEndpoints: []*envoy_config_endpoint_v3.LbEndpoint{
-							{
-								HostIdentifier: &envoy_config_endpoint_v3.LbEndpoint_Endpoint{
-									Endpoint: &envoy_config_endpoint_v3.Endpoint{
-										Address: &envoy_config_core_v3.Address{
-											Address: &envoy_config_core_v3.Address_SocketAddress{
-												SocketAddress: addr,
-											},
-										},
-									},
-								},
-							},
-						},
-					},
-				},
+		},
+	}
+	if srv.options.controlPlaneTLSServerName != "" {
+		validationContext.MatchSubjectAltNames = []*envoy_type_matcher_v3.StringMatcher{{
+			MatchPattern: &envoy_type_matcher_v3.StringMatcher_Exact{
+				Exact: srv.options.controlPlaneTLSServerName,
 			},
-		})
+		}}
 	}
 
-	bcfg := &envoy_config_bootstrap_v3.Bootstrap{
-		Node:             nodeCfg,
-		Admin:            adminCfg,
-		DynamicResources: dynamicCfg,
-		StaticResources:  staticCfg,
-		StatsConfig:      srv.buildStatsConfig(),
+	tlsContext := &envoy_extensions_transport_sockets_tls_v3.UpstreamTlsContext{
+		CommonTlsContext: &envoy_extensions_transport_sockets_tls_v3.CommonTlsContext{
+			AlpnProtocols: []string{"h2"},
+			ValidationContextType: &envoy_extensions_transport_sockets_tls_v3.CommonTlsContext_ValidationContext{
+				ValidationContext: validationContext,
+			},
+		},
+		Sni: srv.options.controlPlaneTLSServerName,
+	}
+	if srv.options.controlPlaneCertFile != "" {
+		tlsContext.CommonTlsContext.TlsCertificates = []*envoy_extensions_transport_sockets_tls_v3.TlsCertificate{{
+			CertificateChain: &envoy_config_core_v3.DataSource{
+				Specifier: &envoy_config_core_v3.DataSource_Filename{
+					Filename: srv.options.controlPlaneCertFile,
+				},
+			},
+			PrivateKey: &envoy_config_core_v3.DataSource{
+				Specifier: &envoy_config_core_v3.DataSource_Filename{
+					Filename: srv.options.controlPlaneKeyFile,
+				},
+			},
+		}}
 	}
 
-	jsonBytes, err := protojson.Marshal(proto.MessageV2(bcfg))
+	tlsConfig, err := anypb.New(tlsContext)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("error marshaling control plane tls context: %w", err)
 	}
-	return jsonBytes, nil
+	return &envoy_config_core_v3.TransportSocket{
+		Name: "tls",
+		ConfigType: &envoy_config_core_v3.TransportSocket_TypedConfig{
+			TypedConfig: tlsConfig,
+		},
+	}, nil
 }
 
+// buildStatsConfig builds envoy's stats config. There is no limit on the length of stat names to
+// configure: since envoy 1.11 names are kept in a symbol table rather than fixed-size shared memory
+// slots, so they aren't truncated and --max-obj-name-len is ignored.
 func (srv *Server) buildStatsConfig() *envoy_config_metrics_v3.StatsConfig {
+	// a minimal config which rejects every stat, so envoy doesn't allocate memory for them
+	if srv.options.statsDisabled {
+		return &envoy_config_metrics_v3.StatsConfig{
+			StatsMatcher: &envoy_config_metrics_v3.StatsMatcher{
+				StatsMatcher: &envoy_config_metrics_v3.StatsMatcher_RejectAll{RejectAll: true},
+			},
+		}
+	}
+
 	cfg := &envoy_config_metrics_v3.StatsConfig{}
 
 	cfg.StatsTags = []*envoy_config_metrics_v3.TagSpecifier{
 		{
-			TagName: "service",
+			TagName: config.EnvoyStatsTagService,
 			TagValue: &envoy_config_metrics_v3.TagSpecifier_FixedValue{
 				FixedValue: telemetry.ServiceName(srv.options.services),
 			},
 		},
 	}
+	// cluster_id distinguishes the metrics of multiple pomerium clusters sharing a metrics backend
+	if srv.options.nodeCluster != "" {
+		cfg.StatsTags = append(cfg.StatsTags, &envoy_config_metrics_v3.TagSpecifier{
+			TagName: config.EnvoyStatsTagClusterID,
+			TagValue: &envoy_config_metrics_v3.TagSpecifier_FixedValue{
+				FixedValue: srv.options.nodeCluster,
+			},
+		})
+	}
+
+	// user-defined tags are sorted so the config is stable
+	names := make([]string, 0, len(srv.options.statsTags))
+	for name := range srv.options.statsTags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cfg.StatsTags = append(cfg.StatsTags, &envoy_config_metrics_v3.TagSpecifier{
+			TagName: name,
+			TagValue: &envoy_config_metrics_v3.TagSpecifier_FixedValue{
+				FixedValue: srv.options.statsTags[name],
+			},
+		})
+	}
+
+	// user-defined extractors are kept in order, since envoy applies them in order and each one removes
+	// its match from the stat name. Envoy's default extractors still apply.
+	for _, extractor := range srv.options.tagExtractors {
+		cfg.StatsTags = append(cfg.StatsTags, &envoy_config_metrics_v3.TagSpecifier{
+			TagName: extractor.Name,
+			TagValue: &envoy_config_metrics_v3.TagSpecifier_Regex{
+				Regex: extractor.Regex,
+			},
+		})
+	}
+
+	if len(srv.options.statsBuckets) > 0 {
+		cfg.HistogramBucketSettings = []*envoy_config_metrics_v3.HistogramBucketSettings{{
+			Match: &envoy_type_matcher_v3.StringMatcher{
+				MatchPattern: &envoy_type_matcher_v3.StringMatcher_SafeRegex{
+					SafeRegex: &envoy_type_matcher_v3.RegexMatcher{
+						EngineType: &envoy_type_matcher_v3.RegexMatcher_GoogleRe2{
+							GoogleRe2: &envoy_type_matcher_v3.RegexMatcher_GoogleRE2{},
+						},
+						Regex: ".*",
+					},
+				},
+			},
+			Buckets: srv.options.statsBuckets,
+		}}
+	}
 	return cfg
 }
 
-var fileNameAndNumberRE = regexp.MustCompile(`^(\[[a-zA-Z0-9/-_.]+:[0-9]+])\s(.*)$`)
+// defaultLogFormat is the log format parseLog expects. Messages are c-escaped with --log-format-escaped.
+const defaultLogFormat = "[LOG_FORMAT]%l--%n--%v"
+
+var fileNameAndNumberRE = regexp.MustCompile(`^\[([a-zA-Z0-9/-_.]+):([0-9]+)]\s(.*)$`)
+
+// parseSourceLocation splits the [file:line] prefix envoy adds to messages from the rest of the
+// message. If there's no prefix, msg is returned unchanged.
+func parseSourceLocation(msg string) (file string, line int, rest string) {
+	parts := fileNameAndNumberRE.FindStringSubmatch(msg)
+	if len(parts) != 4 {
+		return "", 0, msg
+	}
+	line, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return "", 0, msg
+	}
+	return parts[1], line, parts[3]
+}
 
 func (srv *Server) parseLog(line string) (name string, logLevel string, msg string) {
 	// format: [LOG_FORMAT]level--name--message
@@ -426,24 +1912,65 @@ func (srv *Server) parseLog(line string) (name string, logLevel string, msg stri
 	return
 }
 
-func (srv *Server) handleLogs(rc io.ReadCloser) {
+// handleLogs reads envoy log lines from rc, the named output stream, through a buffer of bufferSize
+// bytes and writes them. Unless raw is set, lines are expected to be in the default log format and are
+// parsed into their level, logger name, source location and message. If tee is set lines are first
+// written to it as-is, and if write is nil that's all that's done with them.
+//
+// While a line is being written envoy's output isn't read, so once the pipe fills up envoy blocks.
+// Lines which hold up reading for longer than logReadDelayThreshold are counted by a metric.
+//
+// Read errors are retried. After maxLogReadErrors consecutive errors handleLogs gives up and returns
+// an error. rc is closed, so envoy's writes to the stream fail rather than block.
+func (srv *Server) handleLogs(rc io.ReadCloser, stream string, bufferSize int, raw bool, tee *logFile, write func(logEntry)) error {
 	defer rc.Close()
 
 	bo := backoff.NewExponentialBackOff()
-
-	s := bufio.NewReader(rc)
+	bo.InitialInterval = logReadRetryInitialInterval
+	bo.MaxInterval = logReadRetryMaxInterval
+	// retries are limited by count, and a backoff which stops would make the retries spin
+	bo.MaxElapsedTime = 0
+	bo.Reset()
+	errorCount := 0
+
+	s := bufio.NewReaderSize(rc, bufferSize)
+	var readAt time.Time
 	for {
+		if !readAt.IsZero() && time.Since(readAt) >= logReadDelayThreshold {
+			metrics.RecordEnvoyLogReadDelayed(1)
+		}
 		ln, err := s.ReadString('\n')
+		readAt = time.Now()
 		if err != nil {
 			if errors.Is(err, io.EOF) || errors.Is(err, os.ErrClosed) {
-				break
+				return nil
 			}
-			log.Error().Err(err).Msg("failed to read log")
+			errorCount++
+			if errorCount >= maxLogReadErrors {
+				return fmt.Errorf("giving up reading envoy %s after %d consecutive errors: %w", stream, errorCount, err)
+			}
+			log.Error().Err(err).Str("service", "envoy").Str("stream", stream).Msg("failed to read log")
 			time.Sleep(bo.NextBackOff())
 			continue
 		}
 		ln = strings.TrimRight(ln, "\r\n")
 		bo.Reset()
+		errorCount = 0
+
+		if tee != nil && ln != "" {
+			tee.writeLine(ln)
+		}
+		if write == nil {
+			continue
+		}
+
+		if raw {
+			if ln != "" {
+				recordLogLevel("")
+				write(logEntry{level: zerolog.NoLevel, name: "envoy", msg: ln, stream: stream})
+			}
+			continue
+		}
 
 		name, logLevel, msg := srv.parseLog(ln)
 		if name == "" {
@@ -457,7 +1984,10 @@ func (srv *Server) handleLogs(rc io.ReadCloser) {
 			msg = ln
 		}
 
-		msg = fileNameAndNumberRE.ReplaceAllString(msg, "\"$2\"")
+		file, line, msg := parseSourceLocation(msg)
+		if file != "" {
+			msg = "\"" + msg + "\""
+		}
 		if s, err := strconv.Unquote(msg); err == nil {
 			msg = s
 		}
@@ -467,41 +1997,141 @@ func (srv *Server) handleLogs(rc io.ReadCloser) {
 			continue
 		}
 
-		log.WithLevel(lvl).
-			Str("service", "envoy").
-			Str("name", name).
-			Msg(msg)
+		recordLogLevel(logLevel)
+		write(logEntry{level: lvl, name: name, file: file, line: line, msg: msg, stream: stream})
 	}
 }
 
-func (srv *Server) runProcessCollector() {
-	// macos is not supported
-	if runtime.GOOS != "linux" {
-		return
+// sharedLogFile returns the log file every envoy process writes to, opening it or applying changed
+// settings to it. srv.mu must be held.
+func (srv *Server) sharedLogFile() (*logFile, error) {
+	if srv.logFile == nil {
+		lf, err := openLogFile(srv.options.logFile, srv.options.logFileMaxSize, srv.options.logFileMaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		srv.logFile = lf
+		return lf, nil
+	}
+	if err := srv.logFile.reconfigure(srv.options.logFile, srv.options.logFileMaxSize, srv.options.logFileMaxBackups); err != nil {
+		return nil, err
+	}
+	return srv.logFile, nil
+}
+
+// handleProcessLogs reads the envoy process's output and writes it to pomerium's log. logsWG is done once
+// both output streams have been read.
+func (srv *Server) handleProcessLogs(cmd *exec.Cmd, epoch int, logsWG *sync.WaitGroup) error {
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return fmt.Errorf("error creating stderr pipe for envoy: %w", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("error creating stderr pipe for envoy: %w", err)
+	}
+
+	redactor, err := newLogRedactor(srv.options.logRedactPatterns)
+	if err != nil {
+		return err
+	}
+
+	// lines are written unmodified to the log file, before any parsing or redaction
+	var tee *logFile
+	if srv.options.logFile != "" {
+		tee, err = srv.sharedLogFile()
+		if err != nil {
+			return err
+		}
+	}
+
+	// log entries pass through the trace id parser, the redactor, the deduplicator and then the queue
+	// before being written
+	write := writeLogEntry
+	var closeLogs []func()
+	if srv.options.logQueueSize > 0 {
+		queue := newLogQueue(srv.options.logQueueSize, write)
+		write = queue.write
+		closeLogs = append([]func(){queue.close}, closeLogs...)
+	}
+	if srv.options.logDeduplicate {
+		dedup := newLogDeduplicator(srv.options.logDeduplicateInterval, write)
+		write = dedup.write
+		closeLogs = append([]func(){dedup.close}, closeLogs...)
+	}
+	write = redactor.wrap(write)
+	// trace ids are only logged for traced requests, so skip looking for them otherwise
+	if srv.options.tracingOptions.Enabled() {
+		write = withTraceIDs(write)
 	}
 
-	pc := metrics.NewProcessCollector("envoy")
-	if err := view.Register(pc.Views()...); err != nil {
-		log.Error().Err(err).Msg("failed to register envoy process metric views")
+	// custom log formats can't be parsed, so their lines are written as-is
+	rawLogs := srv.options.logFormat != ""
+	readBufferSize := srv.options.logReadBufferSize
+	if readBufferSize == 0 {
+		readBufferSize = defaultLogReadBufferSize
+	}
+
+	if tee != nil && srv.options.logFileOnly {
+		write = nil
+	}
+
+	logsWG.Add(2)
+	go func() {
+		defer logsWG.Done()
+		if err := srv.handleLogs(stderr, logStreamStderr, readBufferSize, rawLogs, tee, write); err != nil {
+			srv.logsFailed(epoch, err)
+		}
+	}()
+	go func() {
+		defer logsWG.Done()
+		if err := srv.handleLogs(stdout, logStreamStdout, readBufferSize, rawLogs, tee, write); err != nil {
+			srv.logsFailed(epoch, err)
+		}
+	}()
+	go func() {
+		logsWG.Wait()
+		for _, closeLog := range closeLogs {
+			closeLog()
+		}
+	}()
+	return nil
+}
+
+// logsFailed reports that envoy's output can no longer be read, so whatever supervises envoy can restart it.
+func (srv *Server) logsFailed(restartEpoch int, err error) {
+	log.Error().Err(err).Str("service", "envoy").Int("restart_epoch", restartEpoch).Msg("envoy: failed to read logs")
+	srv.notifyEvents(newEvent(EventLogsFailed, restartEpoch, err))
+}
+
+// runProcessCollector periodically measures envoy's process and memory metrics until the context is done.
+func (srv *Server) runProcessCollector(ctx context.Context) {
+	// process metrics are only supported on linux, memory metrics come from the admin interface
+	var pc *metrics.ProcessCollector
+	if runtime.GOOS == "linux" {
+		pc = metrics.NewProcessCollector("envoy")
+		if err := view.Register(pc.Views()...); err != nil {
+			log.Error().Err(err).Msg("failed to register envoy process metric views")
+		}
 	}
 
 	const collectInterval = time.Second * 10
 	ticker := time.NewTicker(collectInterval)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		var pid int
-		srv.mu.Lock()
-		if srv.cmd != nil && srv.cmd.Process != nil {
-			pid = srv.cmd.Process.Pid
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
 		}
-		srv.mu.Unlock()
 
-		if pid > 0 {
-			err := pc.Measure(context.Background(), pid)
+		if pid, ok := srv.PID(); ok && pc != nil {
+			err := pc.Measure(ctx, pid)
 			if err != nil {
 				log.Error().Err(err).Msg("failed to measure envoy process metrics")
 			}
 		}
+		srv.measureMemory(ctx)
 	}
 }
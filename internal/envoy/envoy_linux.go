@@ -2,9 +2,129 @@
 
 package envoy
 
-import "syscall"
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
 
 var sysProcAttr = &syscall.SysProcAttr{
 	Setpgid:   true,
 	Pdeathsig: syscall.SIGTERM,
 }
+
+// reopenLogsSignal is the signal which makes envoy re-open its access logs.
+var reopenLogsSignal = syscall.SIGUSR1
+
+// setupProcess is called once the envoy process has started.
+func setupProcess(p *os.Process) error {
+	return nil
+}
+
+// setPriority sets the niceness of every thread of the envoy process. Threads inherit the niceness of the
+// thread that creates them, so threads started afterwards have it too.
+func setPriority(p *os.Process, niceness int) error {
+	tids, err := processThreads(p)
+	if err != nil {
+		return err
+	}
+	for _, tid := range tids {
+		err = unix.Setpriority(unix.PRIO_PROCESS, tid, niceness)
+		switch {
+		case errors.Is(err, unix.ESRCH):
+			// the thread has exited
+		case errors.Is(err, unix.EACCES), errors.Is(err, unix.EPERM):
+			return fmt.Errorf("error setting envoy niceness to %d, pomerium may not have the privilege to raise its priority: %w", niceness, err)
+		case err != nil:
+			return fmt.Errorf("error setting envoy niceness to %d: %w", niceness, err)
+		}
+	}
+	return nil
+}
+
+// setAffinity restricts every thread of the envoy process to the given cpus, which must be ones pomerium
+// itself may run on. When there are none envoy may run on all of them. Threads inherit the affinity of
+// the thread that creates them, so threads started afterwards are restricted too.
+func setAffinity(p *os.Process, cpus []int) error {
+	var available, set unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &available); err != nil {
+		return fmt.Errorf("error getting available cpus: %w", err)
+	}
+	if len(cpus) == 0 {
+		set = available
+	}
+	for _, cpu := range cpus {
+		if !available.IsSet(cpu) {
+			return fmt.Errorf("error setting envoy cpu affinity, cpu %d is not available, %d cpus are available", cpu, available.Count())
+		}
+		set.Set(cpu)
+	}
+
+	tids, err := processThreads(p)
+	if err != nil {
+		return err
+	}
+	for _, tid := range tids {
+		err = unix.SchedSetaffinity(tid, &set)
+		switch {
+		case errors.Is(err, unix.ESRCH):
+			// the thread has exited
+		case err != nil:
+			return fmt.Errorf("error setting envoy cpu affinity: %w", err)
+		}
+	}
+	return nil
+}
+
+// processThreads returns the thread ids of a process.
+func processThreads(p *os.Process) ([]int, error) {
+	tasks, err := ioutil.ReadDir("/proc/" + strconv.Itoa(p.Pid) + "/task")
+	if err != nil {
+		return nil, fmt.Errorf("error listing envoy threads: %w", err)
+	}
+	tids := make([]int, 0, len(tasks))
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		tids = append(tids, tid)
+	}
+	return tids, nil
+}
+
+// killProcess kills the envoy process.
+func killProcess(p *os.Process) error {
+	return p.Kill()
+}
+
+// terminateProcess asks the envoy process to exit.
+func terminateProcess(p *os.Process) error {
+	return p.Signal(syscall.SIGTERM)
+}
+
+// releaseProcess is called once the envoy process has exited.
+func releaseProcess(p *os.Process) {}
+
+// isNoExec returns true if path is on a filesystem mounted noexec.
+func isNoExec(path string) (bool, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return false, err
+	}
+	return st.Flags&unix.ST_NOEXEC != 0, nil
+}
+
+// buildSysProcAttr returns the process attributes for envoy, running it as uid and gid if they're set.
+func buildSysProcAttr(uid, gid uint32) (*syscall.SysProcAttr, error) {
+	attr := *sysProcAttr
+	if uid != 0 {
+		attr.Credential = &syscall.Credential{Uid: uid, Gid: gid}
+	}
+	return &attr, nil
+}
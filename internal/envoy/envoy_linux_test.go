@@ -0,0 +1,60 @@
+// +build linux
+
+package envoy
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func Test_setPriority(t *testing.T) {
+	cmd := exec.Command("sleep", "10")
+	require.NoError(t, cmd.Start())
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+
+	// lowering the priority doesn't require any privileges
+	require.NoError(t, setPriority(cmd.Process, 10))
+	prio, err := unix.Getpriority(unix.PRIO_PROCESS, cmd.Process.Pid)
+	require.NoError(t, err)
+	// the kernel returns 20 - niceness
+	assert.Equal(t, 10, 20-prio)
+}
+
+func Test_setAffinity(t *testing.T) {
+	var available unix.CPUSet
+	require.NoError(t, unix.SchedGetaffinity(0, &available))
+	var first int
+	for !available.IsSet(first) {
+		first++
+	}
+
+	cmd := exec.Command("sleep", "10")
+	require.NoError(t, cmd.Start())
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+	affinity := func() unix.CPUSet {
+		var set unix.CPUSet
+		require.NoError(t, unix.SchedGetaffinity(cmd.Process.Pid, &set))
+		return set
+	}
+
+	require.NoError(t, setAffinity(cmd.Process, []int{first}))
+	set := affinity()
+	assert.Equal(t, 1, set.Count())
+	assert.True(t, set.IsSet(first))
+
+	// without cpus envoy may run on all the cpus pomerium may run on
+	require.NoError(t, setAffinity(cmd.Process, nil))
+	assert.Equal(t, available, affinity())
+
+	assert.Error(t, setAffinity(cmd.Process, []int{1023}), "cpus pomerium can't run on should be rejected")
+}
@@ -1,9 +1,57 @@
-// +build !linux
+// +build !linux,!windows
 
 package envoy
 
-import "syscall"
+import (
+	"os"
+	"syscall"
+)
 
 var sysProcAttr = &syscall.SysProcAttr{
 	Setpgid: true,
 }
+
+// reopenLogsSignal is the signal which makes envoy re-open its access logs.
+var reopenLogsSignal = syscall.SIGUSR1
+
+// setupProcess is called once the envoy process has started.
+func setupProcess(p *os.Process) error {
+	return nil
+}
+
+// setPriority sets the niceness of the envoy process. It's only supported on linux.
+func setPriority(p *os.Process, niceness int) error {
+	return nil
+}
+
+// setAffinity restricts the envoy process to the given cpus. It's only supported on linux.
+func setAffinity(p *os.Process, cpus []int) error {
+	return nil
+}
+
+// killProcess kills the envoy process.
+func killProcess(p *os.Process) error {
+	return p.Kill()
+}
+
+// terminateProcess asks the envoy process to exit.
+func terminateProcess(p *os.Process) error {
+	return p.Signal(syscall.SIGTERM)
+}
+
+// releaseProcess is called once the envoy process has exited.
+func releaseProcess(p *os.Process) {}
+
+// isNoExec returns true if path is on a filesystem mounted noexec. It's only supported on linux.
+func isNoExec(path string) (bool, error) {
+	return false, nil
+}
+
+// buildSysProcAttr returns the process attributes for envoy, running it as uid and gid if they're set.
+func buildSysProcAttr(uid, gid uint32) (*syscall.SysProcAttr, error) {
+	attr := *sysProcAttr
+	if uid != 0 {
+		attr.Credential = &syscall.Credential{Uid: uid, Gid: gid}
+	}
+	return &attr, nil
+}
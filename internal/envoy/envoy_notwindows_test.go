@@ -0,0 +1,41 @@
+// +build !windows
+
+package envoy
+
+import (
+	"os/exec"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_runCredentials(t *testing.T) {
+	attr, err := buildSysProcAttr(0, 0)
+	require.NoError(t, err)
+	assert.Nil(t, attr.Credential)
+
+	attr, err = buildSysProcAttr(1000, 1000)
+	require.NoError(t, err)
+	if assert.NotNil(t, attr.Credential) {
+		assert.Equal(t, uint32(1000), attr.Credential.Uid)
+		assert.Equal(t, uint32(1000), attr.Credential.Gid)
+	}
+	assert.Nil(t, sysProcAttr.Credential, "the shared process attributes should not be modified")
+}
+
+func Test_exitStatus(t *testing.T) {
+	cmd := exec.Command("sleep", "10")
+	require.NoError(t, cmd.Start())
+	require.NoError(t, cmd.Process.Signal(syscall.SIGKILL))
+	_ = cmd.Wait()
+
+	exitCode, signal := exitStatus(cmd.ProcessState)
+	assert.Equal(t, -1, exitCode)
+	assert.Equal(t, syscall.SIGKILL.String(), signal)
+
+	exitCode, signal = exitStatus(nil)
+	assert.Equal(t, -1, exitCode)
+	assert.Empty(t, signal)
+}
@@ -1,14 +1,37 @@
 package envoy
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	envoy_config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/stats/view"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
 
 	"github.com/pomerium/pomerium/config"
+	"github.com/pomerium/pomerium/internal/controlplane"
+	"github.com/pomerium/pomerium/internal/telemetry/metrics"
 	"github.com/pomerium/pomerium/internal/testutil"
 )
 
@@ -30,6 +53,1454 @@ func Test_buildStatsConfig(t *testing.T) {
 			testutil.AssertProtoJSONEqual(t, tt.want, statsCfg)
 		})
 	}
+
+	t.Run("cluster id and user-defined tags", func(t *testing.T) {
+		srv := &Server{options: serverOptions{
+			services:    config.ServiceAll,
+			nodeCluster: "us-east-1",
+			statsTags:   map[string]string{"region": "us-east", "env": "prod"},
+		}}
+		testutil.AssertProtoJSONEqual(t, `{"statsTags":[
+			{"tagName":"service","fixedValue":"pomerium"},
+			{"tagName":"cluster_id","fixedValue":"us-east-1"},
+			{"tagName":"env","fixedValue":"prod"},
+			{"tagName":"region","fixedValue":"us-east"}
+		]}`, srv.buildStatsConfig())
+	})
+	t.Run("histogram buckets", func(t *testing.T) {
+		srv := &Server{options: serverOptions{
+			services:     config.ServiceAll,
+			statsBuckets: []float64{1, 10, 100, 1000},
+		}}
+		testutil.AssertProtoJSONEqual(t, `{
+			"statsTags":[{"tagName":"service","fixedValue":"pomerium"}],
+			"histogramBucketSettings":[{
+				"match":{"safeRegex":{"googleRe2":{},"regex":".*"}},
+				"buckets":[1,10,100,1000]
+			}]
+		}`, srv.buildStatsConfig())
+	})
+	t.Run("tag extractors", func(t *testing.T) {
+		srv := &Server{options: serverOptions{
+			services: config.ServiceAll,
+			tagExtractors: []config.EnvoyStatsTagExtractor{
+				{Name: "route", Regex: `^cluster\.route-[0-9a-f]+\.((.+?)\.)`},
+				{Name: "upstream", Regex: `^cluster\.(upstream-(.+?)\.)`},
+			},
+		}}
+		testutil.AssertProtoJSONEqual(t, `{"statsTags":[
+			{"tagName":"service","fixedValue":"pomerium"},
+			{"tagName":"route","regex":"^cluster\\.route-[0-9a-f]+\\.((.+?)\\.)"},
+			{"tagName":"upstream","regex":"^cluster\\.(upstream-(.+?)\\.)"}
+		]}`, srv.buildStatsConfig())
+	})
+	t.Run("disabled", func(t *testing.T) {
+		srv := &Server{options: serverOptions{services: config.ServiceAll, statsDisabled: true}}
+		testutil.AssertProtoJSONEqual(t, `{"statsMatcher":{"rejectAll":true}}`, srv.buildStatsConfig())
+	})
+}
+
+func Test_buildControlPlaneTransportSocket(t *testing.T) {
+	srv := &Server{options: serverOptions{
+		controlPlaneTLS:           true,
+		controlPlaneTLSServerName: "control-plane.example.com",
+		controlPlaneCAFile:        "/etc/pomerium/ca.pem",
+		controlPlaneCertFile:      "/etc/pomerium/cert.pem",
+		controlPlaneKeyFile:       "/etc/pomerium/key.pem",
+	}}
+
+	ts, err := srv.buildControlPlaneTransportSocket()
+	require.NoError(t, err)
+	testutil.AssertProtoJSONEqual(t, `{
+		"name": "tls",
+		"typedConfig": {
+			"@type": "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.UpstreamTlsContext",
+			"commonTlsContext": {
+				"alpnProtocols": ["h2"],
+				"tlsCertificates": [{
+					"certificateChain": { "filename": "/etc/pomerium/cert.pem" },
+					"privateKey": { "filename": "/etc/pomerium/key.pem" }
+				}],
+				"validationContext": {
+					"matchSubjectAltNames": [{ "exact": "control-plane.example.com" }],
+					"trustedCa": { "filename": "/etc/pomerium/ca.pem" }
+				}
+			},
+			"sni": "control-plane.example.com"
+		}
+	}`, ts)
+}
+
+func TestServer_applyDNSResolvers(t *testing.T) {
+	srv := &Server{options: serverOptions{
+		dnsResolvers: []string{"8.8.8.8", "127.0.0.1:5353"},
+		dnsUseTCP:    true,
+	}}
+
+	static := &envoy_config_cluster_v3.Cluster{
+		ClusterDiscoveryType: &envoy_config_cluster_v3.Cluster_Type{Type: envoy_config_cluster_v3.Cluster_STATIC},
+	}
+	require.NoError(t, srv.applyDNSResolvers(static))
+	assert.Empty(t, static.DnsResolvers)
+
+	strictDNS := &envoy_config_cluster_v3.Cluster{
+		ClusterDiscoveryType: &envoy_config_cluster_v3.Cluster_Type{Type: envoy_config_cluster_v3.Cluster_STRICT_DNS},
+	}
+	require.NoError(t, srv.applyDNSResolvers(strictDNS))
+	testutil.AssertProtoJSONEqual(t, `{
+		"type": "STRICT_DNS",
+		"dnsResolvers": [
+			{ "socketAddress": { "address": "8.8.8.8", "portValue": 53 } },
+			{ "socketAddress": { "address": "127.0.0.1", "portValue": 5353 } }
+		],
+		"useTcpForDnsLookups": true
+	}`, strictDNS)
+}
+
+func TestServer_runEnvironment(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test requires a posix shell")
+	}
+
+	dir := t.TempDir()
+	envoyPath := writeFakeEnvoy(t, dir, "env > env.txt.tmp && mv env.txt.tmp env.txt")
+
+	srv := &Server{
+		wd:        dir,
+		envoyPath: envoyPath,
+		options: serverOptions{
+			environment: map[string]string{
+				"ENVOY_UID":         "0",
+				"POMERIUM_TEST_ENV": "override",
+			},
+		},
+	}
+	require.NoError(t, os.Setenv("POMERIUM_TEST_ENV", "inherited"))
+	defer os.Unsetenv("POMERIUM_TEST_ENV")
+	require.NoError(t, srv.run())
+	defer srv.Close()
+
+	pid, ok := srv.PID()
+	assert.True(t, ok)
+	assert.Equal(t, srv.cmd.Process.Pid, pid)
+
+	var env []byte
+	require.Eventually(t, func() bool {
+		var err error
+		env, err = ioutil.ReadFile(filepath.Join(dir, "env.txt"))
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	lines := strings.Split(string(env), "\n")
+	assert.Contains(t, lines, "ENVOY_UID=0")
+	assert.Contains(t, lines, "POMERIUM_TEST_ENV=override")
+	assert.NotContains(t, lines, "POMERIUM_TEST_ENV=inherited")
+}
+
+func TestServer_PIDExited(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test requires a posix shell")
+	}
+
+	dir := t.TempDir()
+	srv := &Server{
+		wd:        dir,
+		envoyPath: writeFakeEnvoy(t, dir, "exit 1"),
+	}
+	require.NoError(t, srv.run())
+	defer srv.Close()
+
+	select {
+	case <-srv.exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected envoy to exit")
+	}
+	_, ok := srv.PID()
+	assert.False(t, ok)
+}
+
+func TestServer_pidFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test requires a posix shell")
+	}
+
+	dir := t.TempDir()
+	pidFile := filepath.Join(dir, "envoy.pid")
+	srv := &Server{
+		wd:        dir,
+		envoyPath: writeFakeEnvoy(t, dir, "exec sleep 30"),
+		options:   serverOptions{pidFile: pidFile},
+	}
+
+	readPID := func() int {
+		bs, err := ioutil.ReadFile(pidFile)
+		require.NoError(t, err)
+		pid, err := strconv.Atoi(strings.TrimSpace(string(bs)))
+		require.NoError(t, err)
+		return pid
+	}
+
+	require.NoError(t, srv.run())
+	first := srv.cmd.Process.Pid
+	defer func() {
+		// the first process is left to drain on hot-reload, so it has to be killed separately
+		if p, err := os.FindProcess(first); err == nil {
+			_ = p.Kill()
+		}
+	}()
+	assert.Equal(t, first, readPID())
+
+	// hot-reload
+	require.NoError(t, srv.run())
+	second := srv.cmd.Process.Pid
+	assert.NotEqual(t, first, second)
+	assert.Equal(t, second, readPID())
+
+	require.NoError(t, srv.Close())
+	_, err := os.Stat(pidFile)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestServer_runWarmUp(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test requires a posix shell")
+	}
+
+	dir := t.TempDir()
+	srv := &Server{
+		wd:           dir,
+		envoyPath:    writeFakeEnvoy(t, dir, "exec sleep 30"),
+		warmUpPeriod: 100 * time.Millisecond,
+	}
+	// run releases srv.mu while the new process warms up
+	run := func() error {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		return srv.run()
+	}
+	require.NoError(t, run())
+	defer srv.Close()
+	previous := srv.cmd
+	restartEpoch := srv.restartEpoch
+
+	// the new envoy dies immediately, so the previous one should keep serving
+	srv.envoyPath = writeFakeEnvoy(t, dir, "exit 1")
+	assert.Error(t, run())
+	assert.Equal(t, previous, srv.cmd)
+	assert.Equal(t, restartEpoch, srv.restartEpoch)
+	assert.Nil(t, previous.ProcessState, "previous envoy should still be running")
+
+	// the running envoy can be queried while the new one warms up, and the warm-up period from the
+	// options takes precedence
+	srv.envoyPath = writeFakeEnvoy(t, dir, "exec sleep 30")
+	srv.options.warmUpPeriod = time.Second
+	done := make(chan error, 1)
+	start := time.Now()
+	go func() { done <- run() }()
+	time.Sleep(100 * time.Millisecond)
+	pid, ok := srv.PID()
+	assert.True(t, ok)
+	assert.Equal(t, previous.Process.Pid, pid)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second), "PID should not wait for the warm-up")
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("run did not complete after the warm-up period")
+	}
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(time.Second))
+	assert.NotEqual(t, previous, srv.cmd)
+
+	// a process warming up while the server is closed isn't kept
+	go func() { done <- run() }()
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, srv.Close())
+	select {
+	case err := <-done:
+		assert.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("run did not complete after the warm-up period")
+	}
+	assert.Nil(t, srv.cmd)
+}
+
+func TestServer_runDisableHotRestart(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test requires a posix shell")
+	}
+
+	dir := t.TempDir()
+	srv := &Server{
+		wd:        dir,
+		envoyPath: writeFakeEnvoy(t, dir, `echo "$@" > args.txt; exec sleep 30`),
+		options:   serverOptions{disableHotRestart: true},
+	}
+	require.NoError(t, srv.run())
+	defer srv.Close()
+	first := srv.cmd
+	firstExited := srv.exited
+
+	require.NoError(t, srv.run())
+	select {
+	case <-firstExited:
+	default:
+		t.Fatal("previous envoy process should have been stopped")
+	}
+	assert.NotNil(t, first.ProcessState)
+	assert.NotEqual(t, first, srv.cmd)
+
+	require.Eventually(t, func() bool {
+		bs, err := ioutil.ReadFile(filepath.Join(dir, "args.txt"))
+		return err == nil && strings.Contains(string(bs), "--disable-hot-restart") &&
+			!strings.Contains(string(bs), "--restart-epoch") && !strings.Contains(string(bs), "--base-id")
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestServer_runDrainArgs(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test requires a posix shell")
+	}
+
+	dir := t.TempDir()
+	srv := &Server{
+		wd:        dir,
+		envoyPath: writeFakeEnvoy(t, dir, `echo "$@" > args.txt`),
+		options:   serverOptions{drainStrategy: "immediate", drainTime: 1500 * time.Millisecond},
+	}
+	require.NoError(t, srv.run())
+	defer srv.Close()
+
+	require.Eventually(t, func() bool {
+		bs, err := ioutil.ReadFile(filepath.Join(dir, "args.txt"))
+		return err == nil && strings.Contains(string(bs), "--drain-strategy immediate --drain-time-s 2")
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestServer_runFileFlushInterval(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test requires a posix shell")
+	}
+
+	dir := t.TempDir()
+	srv := &Server{
+		wd:        dir,
+		envoyPath: writeFakeEnvoy(t, dir, `echo "$@" > args.txt`),
+		options:   serverOptions{fileFlushInterval: 2500 * time.Microsecond},
+	}
+	require.NoError(t, srv.run())
+	defer srv.Close()
+
+	require.Eventually(t, func() bool {
+		bs, err := ioutil.ReadFile(filepath.Join(dir, "args.txt"))
+		return err == nil && strings.Contains(string(bs), "--file-flush-interval-msec 3")
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestServer_runLogPath(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test requires a posix shell")
+	}
+
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "envoy.log")
+	srv := &Server{
+		wd:        dir,
+		envoyPath: writeFakeEnvoy(t, dir, `echo "$@" > args.txt`),
+		options:   serverOptions{logPath: logPath},
+	}
+	require.NoError(t, srv.run())
+	defer srv.Close()
+
+	require.Eventually(t, func() bool {
+		bs, err := ioutil.ReadFile(filepath.Join(dir, "args.txt"))
+		return err == nil && strings.Contains(string(bs), "--log-path "+logPath)
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, os.Stdout, srv.cmd.Stdout, "envoy's output should not be read by pomerium")
+}
+
+func TestServer_runConcurrentBaseIDs(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test requires a posix shell")
+	}
+
+	// the fake envoy records its arguments and writes its pid as the dynamic base id
+	const script = `echo "$@" >> args.txt
+while [ $# -gt 0 ]; do
+	if [ "$1" = "--base-id-path" ]; then printf %s $$ > "$2"; fi
+	shift
+done
+exec sleep 30`
+
+	servers := make([]*Server, 2)
+	for i := range servers {
+		dir := t.TempDir()
+		servers[i] = &Server{wd: dir, envoyPath: writeFakeEnvoy(t, dir, script)}
+	}
+
+	runAll := func() {
+		var wg sync.WaitGroup
+		for _, srv := range servers {
+			wg.Add(1)
+			go func(srv *Server) {
+				defer wg.Done()
+				assert.NoError(t, srv.run())
+			}(srv)
+		}
+		wg.Wait()
+	}
+
+	runAll()
+	baseIDs := make([]int, len(servers))
+	for i, srv := range servers {
+		srv := srv
+		require.Eventually(t, func() bool {
+			var ok bool
+			baseIDs[i], ok = readBaseID(srv.baseIDPath())
+			return ok
+		}, 5*time.Second, 10*time.Millisecond)
+		// the first process is left to drain on hot-reload, so it has to be killed separately
+		pid := baseIDs[i]
+		t.Cleanup(func() {
+			if p, err := os.FindProcess(pid); err == nil {
+				_ = p.Kill()
+			}
+		})
+		t.Cleanup(func() { _ = srv.Close() })
+	}
+	assert.NotEqual(t, baseIDs[0], baseIDs[1])
+
+	// hot-reload both, each should use its own base id
+	runAll()
+	for i, srv := range servers {
+		require.Eventually(t, func() bool {
+			bs, err := ioutil.ReadFile(filepath.Join(srv.wd, "args.txt"))
+			return err == nil && strings.Count(string(bs), "\n") == 2
+		}, 5*time.Second, 10*time.Millisecond)
+		bs, err := ioutil.ReadFile(filepath.Join(srv.wd, "args.txt"))
+		require.NoError(t, err)
+		lines := strings.Split(strings.TrimSpace(string(bs)), "\n")
+		assert.Contains(t, lines[0], "--use-dynamic-base-id --base-id-path "+srv.baseIDPath())
+		// the process started from scratch has epoch 0, so its hot restart has epoch 1
+		assert.Contains(t, lines[1], fmt.Sprintf("--base-id %d --restart-epoch 1", baseIDs[i]))
+
+		baseID, ok := readBaseID(srv.baseIDPath())
+		assert.True(t, ok)
+		assert.Equal(t, baseIDs[i], baseID, "base id should not be overwritten")
+	}
+}
+
+func TestServer_runRestartEpochLimits(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test requires a posix shell")
+	}
+
+	dir := t.TempDir()
+	srv := &Server{
+		wd: dir,
+		envoyPath: writeFakeEnvoy(t, dir, `echo "$@" >> args.txt
+echo $$ >> pids.txt
+while [ $# -gt 0 ]; do
+	if [ "$1" = "--base-id-path" ]; then printf %s $$ > "$2"; fi
+	shift
+done
+exec sleep 30`),
+		options: serverOptions{restartEpochStart: 5, restartEpochMax: 6},
+	}
+	t.Cleanup(func() {
+		_ = srv.Close()
+		// processes left to drain on hot-reload have to be killed separately
+		bs, _ := ioutil.ReadFile(filepath.Join(dir, "pids.txt"))
+		for _, pid := range strings.Fields(string(bs)) {
+			if pid, err := strconv.Atoi(pid); err == nil {
+				if p, err := os.FindProcess(pid); err == nil {
+					_ = p.Kill()
+				}
+			}
+		}
+	})
+
+	readArgs := func(n int) []string {
+		var lines []string
+		require.Eventually(t, func() bool {
+			bs, err := ioutil.ReadFile(filepath.Join(dir, "args.txt"))
+			lines = strings.Split(strings.TrimSpace(string(bs)), "\n")
+			return err == nil && len(lines) == n
+		}, 5*time.Second, 10*time.Millisecond)
+		return lines
+	}
+
+	epochOf := func(args string) int {
+		fields := strings.Fields(args)
+		for i, arg := range fields {
+			if arg == "--restart-epoch" && i+1 < len(fields) {
+				epoch, err := strconv.Atoi(fields[i+1])
+				require.NoError(t, err)
+				return epoch
+			}
+		}
+		return 0
+	}
+
+	// a non-zero starting epoch needs an explicit base id, which envoy doesn't accept a dynamic one for
+	assert.Error(t, srv.run())
+
+	// envoy is started from scratch at the starting epoch with the persisted base id
+	require.NoError(t, ioutil.WriteFile(srv.baseIDPath(), []byte("42"), 0o600))
+	require.NoError(t, srv.run())
+	args := readArgs(1)
+	assert.Contains(t, args[0], "--base-id 42 --restart-epoch 5")
+	assert.NotContains(t, args[0], "--use-dynamic-base-id")
+	assert.Equal(t, 5, epochOf(args[0]))
+	assert.Equal(t, 5, srv.epoch)
+
+	// each hot restart has the epoch after its parent's
+	require.NoError(t, srv.run())
+	args = readArgs(2)
+	assert.Contains(t, args[1], "--base-id ")
+	assert.Equal(t, epochOf(args[0])+1, epochOf(args[1]))
+	assert.Equal(t, 6, srv.epoch)
+
+	// the next epoch is beyond the max, so envoy is restarted from scratch at the starting epoch
+	previousExited := srv.exited
+	require.NoError(t, srv.run())
+	args = readArgs(3)
+	assert.Contains(t, args[2], "--base-id 42 --restart-epoch 5")
+	assert.NotContains(t, args[2], "--use-dynamic-base-id")
+	select {
+	case <-previousExited:
+	default:
+		t.Fatal("previous envoy process should have been stopped")
+	}
+	assert.Equal(t, 0, srv.restartEpoch)
+
+	require.NoError(t, srv.run())
+	args = readArgs(4)
+	assert.Equal(t, epochOf(args[2])+1, epochOf(args[3]))
+}
+
+func TestServer_runRestartOnBinaryChange(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test requires a posix shell")
+	}
+
+	dir := t.TempDir()
+	script := `echo "$@" >> args.txt
+echo $$ >> pids.txt
+while [ $# -gt 0 ]; do
+	if [ "$1" = "--base-id-path" ]; then printf %s $$ > "$2"; fi
+	shift
+done
+exec sleep 30`
+	srv := &Server{
+		wd:        dir,
+		envoyPath: writeFakeEnvoy(t, dir, script),
+		options:   serverOptions{restartOnBinaryChange: true},
+	}
+	t.Cleanup(func() {
+		_ = srv.Close()
+		// processes left to drain on hot-reload have to be killed separately
+		bs, _ := ioutil.ReadFile(filepath.Join(dir, "pids.txt"))
+		for _, pid := range strings.Fields(string(bs)) {
+			if pid, err := strconv.Atoi(pid); err == nil {
+				if p, err := os.FindProcess(pid); err == nil {
+					_ = p.Kill()
+				}
+			}
+		}
+	})
+
+	readArgs := func(n int) []string {
+		var lines []string
+		require.Eventually(t, func() bool {
+			bs, err := ioutil.ReadFile(filepath.Join(dir, "args.txt"))
+			lines = strings.Split(strings.TrimSpace(string(bs)), "\n")
+			return err == nil && len(lines) == n
+		}, 5*time.Second, 10*time.Millisecond)
+		return lines
+	}
+
+	require.NoError(t, srv.run())
+	readArgs(1)
+	require.Eventually(t, func() bool {
+		_, ok := readBaseID(srv.baseIDPath())
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// an unchanged binary is hot restarted
+	require.NoError(t, srv.run())
+	assert.Contains(t, readArgs(2)[1], "--restart-epoch 1")
+
+	// a replaced binary is started from scratch
+	writeFakeEnvoy(t, dir, "# updated\n"+script)
+	previousExited := srv.exited
+	require.NoError(t, srv.run())
+	assert.Contains(t, readArgs(3)[2], "--use-dynamic-base-id")
+	select {
+	case <-previousExited:
+	default:
+		t.Fatal("previous envoy process should have been stopped")
+	}
+
+	// a binary which doesn't match the verified checksum isn't started
+	srv.binaryChecksum = "0000"
+	previous := srv.cmd
+	assert.Error(t, srv.run())
+	assert.Equal(t, previous, srv.cmd)
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test requires a posix shell")
+	}
+
+	t.Run("drain", func(t *testing.T) {
+		admin, _, requests := newFakeAdmin(t)
+		dir := t.TempDir()
+		srv := &Server{
+			wd:        dir,
+			envoyPath: writeFakeEnvoy(t, dir, "exec sleep 30"),
+			options:   serverOptions{adminURL: admin.URL},
+		}
+		require.NoError(t, srv.run())
+		cmd := srv.cmd
+
+		require.NoError(t, srv.Shutdown(context.Background()))
+		assert.Nil(t, srv.cmd)
+		require.NotNil(t, cmd.ProcessState)
+		assert.Equal(t, "signal: terminated", cmd.ProcessState.String(), "envoy should be asked to exit")
+		assert.Equal(t, []string{"POST /healthcheck/fail", "POST /drain_listeners", "GET /stats"}, requests())
+	})
+	t.Run("timeout", func(t *testing.T) {
+		dir := t.TempDir()
+		srv := &Server{
+			wd:        dir,
+			envoyPath: writeFakeEnvoy(t, dir, `trap "" TERM; touch ready; while true; do sleep 0.1; done`),
+			options:   serverOptions{shutdownTimeout: 200 * time.Millisecond},
+		}
+		require.NoError(t, srv.run())
+		require.Eventually(t, func() bool {
+			_, err := os.Stat(filepath.Join(dir, "ready"))
+			return err == nil
+		}, 5*time.Second, 10*time.Millisecond)
+		cmd := srv.cmd
+		exited := srv.exited
+
+		start := time.Now()
+		require.NoError(t, srv.Shutdown(context.Background()))
+		assert.GreaterOrEqual(t, int64(time.Since(start)), int64(200*time.Millisecond))
+		select {
+		case <-exited:
+		case <-time.After(5 * time.Second):
+			t.Fatal("envoy should have been killed")
+		}
+		assert.Equal(t, "signal: killed", cmd.ProcessState.String())
+	})
+}
+
+func TestFindEnvoyBinary(t *testing.T) {
+	oldPath := os.Getenv("PATH")
+	defer func() { _ = os.Setenv("PATH", oldPath) }()
+	require.NoError(t, os.Setenv("PATH", t.TempDir()))
+
+	t.Run("no binary anywhere", func(t *testing.T) {
+		_, _, _, _, err := findEnvoyBinary(context.Background(), config.NewDefaultOptions(), t.TempDir())
+		var noBinaryErr *NoEnvoyBinaryError
+		require.True(t, errors.As(err, &noBinaryErr), "expected a NoEnvoyBinaryError, got: %v", err)
+		assert.Error(t, noBinaryErr.EmbeddedErr, "the test binary has no embedded envoy")
+		assert.Error(t, noBinaryErr.LookPathErr)
+		assert.NoError(t, noBinaryErr.DownloadErr, "no download should be attempted without a url")
+		assert.Contains(t, err.Error(), "embedded binary: ")
+		assert.Contains(t, err.Error(), "PATH lookup: ")
+	})
+	t.Run("configured binary missing", func(t *testing.T) {
+		options := config.NewDefaultOptions()
+		options.EnvoyBinaryPath = filepath.Join(t.TempDir(), "envoy")
+		_, _, _, _, err := findEnvoyBinary(context.Background(), options, t.TempDir())
+		var noBinaryErr *NoEnvoyBinaryError
+		require.True(t, errors.As(err, &noBinaryErr))
+		assert.Error(t, noBinaryErr.ConfiguredErr)
+		assert.NoError(t, noBinaryErr.EmbeddedErr, "nothing else should be tried")
+	})
+	t.Run("embedded binary disabled", func(t *testing.T) {
+		options := config.NewDefaultOptions()
+		options.EnvoyEmbeddedBinaryDisabled = true
+		_, _, _, _, err := findEnvoyBinary(context.Background(), options, t.TempDir())
+		var noBinaryErr *NoEnvoyBinaryError
+		require.True(t, errors.As(err, &noBinaryErr))
+		assert.NoError(t, noBinaryErr.EmbeddedErr, "no extraction should be attempted")
+		assert.Error(t, noBinaryErr.LookPathErr)
+	})
+	t.Run("system binary", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("test requires a posix shell")
+		}
+
+		dir := t.TempDir()
+		require.NoError(t, os.Setenv("PATH", dir))
+		writeFakeEnvoy(t, dir, "exit 0")
+
+		options := config.NewDefaultOptions()
+		options.EnvoyEmbeddedBinaryDisabled = true
+		envoyPath, fullEnvoyPath, _, downloaded, err := findEnvoyBinary(context.Background(), options, t.TempDir())
+		require.NoError(t, err)
+		assert.Equal(t, "envoy", envoyPath)
+		assert.Equal(t, filepath.Join(dir, "envoy"), fullEnvoyPath)
+		assert.False(t, downloaded)
+	})
+}
+
+func TestServer_CloseCleanup(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, configFileName)
+	otherPath := filepath.Join(dir, "other.txt")
+	require.NoError(t, ioutil.WriteFile(configPath, []byte("{}"), 0o600))
+	require.NoError(t, ioutil.WriteFile(otherPath, []byte("other"), 0o600))
+
+	srv := &Server{wd: dir}
+	require.NoError(t, srv.Close())
+	assert.FileExists(t, configPath, "files should be left in place by default")
+
+	srv.options.cleanupOnClose = true
+	require.NoError(t, srv.Close())
+	assert.NoFileExists(t, configPath)
+	assert.FileExists(t, otherPath)
+}
+
+func TestServer_OnError(t *testing.T) {
+	srv := &Server{
+		wd:       t.TempDir(),
+		grpcPort: "invalid",
+	}
+
+	var errs []error
+	srv.OnError(func(err error) {
+		errs = append(errs, err)
+	})
+
+	err := srv.ReloadConfig(&config.Config{Options: config.NewDefaultOptions()})
+	assert.Error(t, err)
+	if assert.Len(t, errs, 1) {
+		assert.Equal(t, err, errs[0])
+	}
+}
+
+func TestServer_writeConfigPermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes are not supported on windows")
+	}
+
+	wd := filepath.Join(t.TempDir(), workingDirectoryName)
+	require.NoError(t, os.MkdirAll(wd, 0o755))
+	require.NoError(t, ensureWorkingDirectory(wd))
+	fi, err := os.Stat(wd)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o700), fi.Mode().Perm())
+
+	cfgPath := filepath.Join(wd, configFileName)
+	require.NoError(t, ioutil.WriteFile(cfgPath, []byte("{}"), 0o644))
+
+	srv := &Server{wd: wd, grpcPort: "5443"}
+	require.NoError(t, srv.writeConfig(&config.Config{Options: config.NewDefaultOptions()}))
+	fi, err = os.Stat(cfgPath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+}
+
+func TestServer_writeConfigDump(t *testing.T) {
+	dir := t.TempDir()
+	dumpPath := filepath.Join(dir, "envoy-config-dump.yaml")
+
+	srv := &Server{wd: dir, grpcPort: "5443", options: serverOptions{configDumpPath: dumpPath}}
+	require.NoError(t, srv.writeConfig(&config.Config{Options: config.NewDefaultOptions()}))
+
+	expected, err := ioutil.ReadFile(filepath.Join(dir, configFileName))
+	require.NoError(t, err)
+	actual, err := ioutil.ReadFile(dumpPath)
+	require.NoError(t, err)
+	assert.Equal(t, expected, actual)
+
+	// failing to write the dump doesn't fail the reload
+	srv.options.configDumpPath = filepath.Join(dir, "missing", "envoy-config-dump.yaml")
+	assert.NoError(t, srv.writeConfig(&config.Config{Options: config.NewDefaultOptions()}))
+}
+
+func TestServer_writeConfigFailure(t *testing.T) {
+	dir := t.TempDir()
+	cfgPath := filepath.Join(dir, configFileName)
+	srv := &Server{wd: dir, grpcPort: "5443"}
+	require.NoError(t, srv.writeConfig(&config.Config{Options: config.NewDefaultOptions()}))
+	previous, err := ioutil.ReadFile(cfgPath)
+	require.NoError(t, err)
+
+	defer func(original func(string, []byte, os.FileMode) error) { writeFile = original }(writeFile)
+	for name, fn := range map[string]func(string, []byte, os.FileMode) error{
+		"error": func(string, []byte, os.FileMode) error {
+			return errors.New("no space left on device")
+		},
+		"incomplete": func(name string, data []byte, perm os.FileMode) error {
+			return ioutil.WriteFile(name, data[:len(data)/2], perm)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			writeFile = fn
+			srv.options.nodeID = "changed"
+			assert.Error(t, srv.writeConfig(&config.Config{Options: config.NewDefaultOptions()}))
+
+			actual, err := ioutil.ReadFile(cfgPath)
+			require.NoError(t, err)
+			assert.Equal(t, previous, actual, "the previous config should be left in place")
+			_, err = os.Stat(cfgPath + ".tmp")
+			assert.True(t, os.IsNotExist(err), "the temporary file should be removed")
+
+			srv.options.configHistory = 1
+			assert.Error(t, srv.writeConfig(&config.Config{Options: config.NewDefaultOptions()}))
+			srv.options.configHistory = 0
+			dirs, err := filepath.Glob(filepath.Join(dir, configHistoryDirectoryPrefix+"*"))
+			require.NoError(t, err)
+			assert.Empty(t, dirs, "the config history directory should be removed")
+			assert.Equal(t, configFileName, srv.configFile)
+		})
+	}
+}
+
+func TestServer_writeConfigHistory(t *testing.T) {
+	dir := t.TempDir()
+	srv := &Server{wd: dir, grpcPort: "5443"}
+	require.NoError(t, srv.writeConfig(&config.Config{Options: config.NewDefaultOptions()}))
+	assert.Equal(t, configFileName, srv.configFile)
+
+	srv.options.configHistory = 2
+	for i := 0; i < 3; i++ {
+		require.NoError(t, srv.writeConfig(&config.Config{Options: config.NewDefaultOptions()}))
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	dirs, err := filepath.Glob(filepath.Join(dir, configHistoryDirectoryPrefix+"*"))
+	require.NoError(t, err)
+	require.Len(t, dirs, 2, "only the newest configs should be kept")
+	assert.Equal(t, filepath.Join(filepath.Base(dirs[1]), configFileName), srv.configFile)
+	_, err = os.Stat(filepath.Join(dir, srv.configFile))
+	assert.NoError(t, err)
+}
+
+func TestServer_buildBootstrapInitialFetchTimeout(t *testing.T) {
+	srv := &Server{grpcPort: "5443"}
+	bcfg, err := srv.buildBootstrap(&config.Config{Options: config.NewDefaultOptions()})
+	require.NoError(t, err)
+	assert.Nil(t, bcfg.GetDynamicResources().GetLdsConfig().GetInitialFetchTimeout(), "envoy's default should be used")
+
+	srv.options.xdsInitialFetchTimeout = time.Minute
+	bcfg, err = srv.buildBootstrap(&config.Config{Options: config.NewDefaultOptions()})
+	require.NoError(t, err)
+	assert.Equal(t, time.Minute, bcfg.GetDynamicResources().GetLdsConfig().GetInitialFetchTimeout().AsDuration())
+	assert.Equal(t, time.Minute, bcfg.GetDynamicResources().GetCdsConfig().GetInitialFetchTimeout().AsDuration())
+}
+
+func TestServer_buildBootstrapXDSAPIType(t *testing.T) {
+	srv := &Server{grpcPort: "5443"}
+	bcfg, err := srv.buildBootstrap(&config.Config{Options: config.NewDefaultOptions()})
+	require.NoError(t, err)
+	assert.Equal(t, envoy_config_core_v3.ApiConfigSource_DELTA_GRPC, bcfg.GetDynamicResources().GetAdsConfig().GetApiType())
+
+	srv.options.xdsAPIType = config.XDSAPITypeGRPC
+	bcfg, err = srv.buildBootstrap(&config.Config{Options: config.NewDefaultOptions()})
+	require.NoError(t, err)
+	assert.Equal(t, envoy_config_core_v3.ApiConfigSource_GRPC, bcfg.GetDynamicResources().GetAdsConfig().GetApiType())
+}
+
+func TestServer_buildBootstrapControlPlaneCircuitBreakers(t *testing.T) {
+	srv := &Server{grpcPort: "5443"}
+	bcfg, err := srv.buildBootstrap(&config.Config{Options: config.NewDefaultOptions()})
+	require.NoError(t, err)
+	assert.Nil(t, bcfg.GetStaticResources().GetClusters()[0].GetCircuitBreakers(), "envoy's defaults should be used")
+
+	srv.options.controlPlaneMaxConnections = 10
+	srv.options.controlPlaneMaxRequests = 1000
+	bcfg, err = srv.buildBootstrap(&config.Config{Options: config.NewDefaultOptions()})
+	require.NoError(t, err)
+	testutil.AssertProtoJSONEqual(t, `{
+		"thresholds": [{ "maxConnections": 10, "maxRequests": 1000 }]
+	}`, bcfg.GetStaticResources().GetClusters()[0].GetCircuitBreakers())
+}
+
+func TestServer_buildBootstrapControlPlaneMatchesListener(t *testing.T) {
+	cp, err := controlplane.NewServer("test", nil)
+	require.NoError(t, err)
+	go func() { _ = cp.GRPCServer.Serve(cp.GRPCListener) }()
+	defer cp.GRPCServer.Stop()
+
+	opts := config.NewDefaultOptions()
+	opts.InsecureServer = true
+	require.NoError(t, opts.Validate())
+
+	_, port, err := net.SplitHostPort(cp.GRPCListener.Addr().String())
+	require.NoError(t, err)
+	srv := &Server{grpcPort: port}
+	srv.options, err = newServerOptions(&config.Config{Options: opts})
+	require.NoError(t, err)
+	bcfg, err := srv.buildBootstrap(&config.Config{Options: opts})
+	require.NoError(t, err)
+
+	cluster := bcfg.GetStaticResources().GetClusters()[0]
+	addr := cluster.GetLoadAssignment().GetEndpoints()[0].GetLbEndpoints()[0].GetEndpoint().GetAddress().GetSocketAddress()
+	assert.Equal(t, cp.GRPCListener.Addr().String(), net.JoinHostPort(addr.GetAddress(), strconv.Itoa(int(addr.GetPortValue()))))
+	assert.Nil(t, cluster.GetTransportSocket(), "envoy should connect to the control plane in plaintext")
+
+	// the listener speaks plaintext gRPC, so an unknown method is answered rather than the connection failing
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cc, err := grpc.DialContext(ctx, cp.GRPCListener.Addr().String(), grpc.WithInsecure(), grpc.WithBlock())
+	require.NoError(t, err)
+	defer cc.Close()
+	err = cc.Invoke(ctx, "/test.Service/Method", &emptypb.Empty{}, &emptypb.Empty{})
+	assert.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func TestServer_buildBootstrapClusterBufferLimit(t *testing.T) {
+	srv := &Server{grpcPort: "5443"}
+	bcfg, err := srv.buildBootstrap(&config.Config{Options: config.NewDefaultOptions()})
+	require.NoError(t, err)
+	assert.Nil(t, bcfg.GetStaticResources().GetClusters()[0].GetPerConnectionBufferLimitBytes(), "envoy's default should be used")
+
+	srv.options.clusterBufferLimitBytes = 4 << 20
+	srv.options.statsAddress = ":9903"
+	bcfg, err = srv.buildBootstrap(&config.Config{Options: config.NewDefaultOptions()})
+	require.NoError(t, err)
+	require.Len(t, bcfg.GetStaticResources().GetClusters(), 2)
+	for _, cluster := range bcfg.GetStaticResources().GetClusters() {
+		assert.Equal(t, uint32(4<<20), cluster.GetPerConnectionBufferLimitBytes().GetValue(), cluster.GetName())
+	}
+}
+
+func TestServer_buildBootstrapExtraClusters(t *testing.T) {
+	cluster := map[string]interface{}{
+		"name":            "ext-authz",
+		"connect_timeout": "1s",
+		"type":            "STRICT_DNS",
+		"load_assignment": map[interface{}]interface{}{"cluster_name": "ext-authz"},
+	}
+	srv := &Server{grpcPort: "5443", options: serverOptions{
+		bootstrapClusters:       []map[string]interface{}{cluster},
+		clusterBufferLimitBytes: 1 << 20,
+		dnsUseTCP:               true,
+	}}
+	bcfg, err := srv.buildBootstrap(&config.Config{Options: config.NewDefaultOptions()})
+	require.NoError(t, err)
+	clusters := bcfg.GetStaticResources().GetClusters()
+	require.Len(t, clusters, 2)
+	testutil.AssertProtoJSONEqual(t, `{
+		"name": "ext-authz",
+		"connectTimeout": "1s",
+		"type": "STRICT_DNS",
+		"loadAssignment": { "clusterName": "ext-authz" }
+	}`, clusters[1], "extra clusters should be added as-is")
+
+	srv.options.bootstrapClusters = []map[string]interface{}{{"name": statsAdminClusterName}}
+	srv.options.statsAddress = ":9903"
+	_, err = srv.buildBootstrap(&config.Config{Options: config.NewDefaultOptions()})
+	assert.Error(t, err, "extra clusters should not replace pomerium's clusters")
+}
+
+func TestServer_writeConfigYAML(t *testing.T) {
+	dir := t.TempDir()
+	srv := &Server{wd: dir, grpcPort: "5443", options: serverOptions{bootstrapFormat: config.BootstrapFormatYAML}}
+	require.NoError(t, srv.writeConfig(&config.Config{Options: config.NewDefaultOptions()}))
+
+	bs, err := ioutil.ReadFile(filepath.Join(dir, configFileName))
+	require.NoError(t, err)
+	assert.Contains(t, string(bs), "\nstaticResources:\n")
+
+	// the bootstrap exposed for debugging is always json
+	redacted, err := srv.Bootstrap()
+	require.NoError(t, err)
+	assert.True(t, json.Valid(redacted))
+}
+
+func TestServer_Bootstrap(t *testing.T) {
+	dir := t.TempDir()
+	srv := &Server{wd: dir, grpcPort: "5443"}
+	_, err := srv.Bootstrap()
+	assert.Error(t, err, "no config has been written yet")
+
+	require.NoError(t, srv.writeConfig(&config.Config{Options: config.NewDefaultOptions()}))
+	expected, err := ioutil.ReadFile(filepath.Join(dir, configFileName))
+	require.NoError(t, err)
+	actual, err := srv.Bootstrap()
+	require.NoError(t, err)
+	assert.JSONEq(t, string(expected), string(actual), "configs without secrets should be unchanged")
+}
+
+func TestServer_OnEvent(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test requires a posix shell")
+	}
+
+	dir := t.TempDir()
+	srv := &Server{
+		wd:        dir,
+		grpcPort:  "1234",
+		httpPort:  "1235",
+		envoyPath: writeFakeEnvoy(t, dir, "exit 3"),
+	}
+
+	var mu sync.Mutex
+	var events []Event
+	srv.OnEvent(func(evt Event) {
+		mu.Lock()
+		events = append(events, evt)
+		mu.Unlock()
+	})
+	eventTypes := func() []EventType {
+		mu.Lock()
+		defer mu.Unlock()
+
+		var types []EventType
+		for _, evt := range events {
+			types = append(types, evt.Type)
+		}
+		return types
+	}
+
+	require.NoError(t, srv.ReloadConfig(&config.Config{Options: config.NewDefaultOptions()}))
+	require.Eventually(t, func() bool {
+		return len(eventTypes()) == 4
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.ElementsMatch(t, []EventType{
+		EventConfigWritten, EventProcessStarted, EventReloadCompleted, EventProcessExited,
+	}, eventTypes())
+	assert.Equal(t, []EventType{EventConfigWritten, EventProcessStarted}, eventTypes()[:2])
+
+	mu.Lock()
+	for _, evt := range events {
+		assert.False(t, evt.Time.IsZero())
+		if evt.Type == EventProcessExited {
+			assert.Error(t, evt.Err)
+			assert.Equal(t, 3, evt.ExitCode)
+			assert.Empty(t, evt.Signal)
+		} else {
+			assert.NoError(t, evt.Err)
+		}
+	}
+	mu.Unlock()
+
+	// no changes, so no events
+	require.NoError(t, srv.ReloadConfig(&config.Config{Options: config.NewDefaultOptions()}))
+	assert.Len(t, eventTypes(), 4)
+
+	srv.grpcPort = "invalid"
+	opts := config.NewDefaultOptions()
+	opts.EnvoyLogQueueSize = 10
+	assert.Error(t, srv.ReloadConfig(&config.Config{Options: opts}))
+	assert.Equal(t, EventReloadFailed, eventTypes()[4])
+}
+
+func TestServer_OnReload(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test requires a posix shell")
+	}
+
+	dir := t.TempDir()
+	srv := &Server{
+		wd:        dir,
+		grpcPort:  "1234",
+		httpPort:  "1235",
+		envoyPath: writeFakeEnvoy(t, dir, "exit 3"),
+	}
+
+	var calls []string
+	srv.OnBeforeReload(func(cfg *config.Config) {
+		// listeners are called without locks held, so they can call back into the server
+		_, err := srv.ServerState(context.Background())
+		assert.Error(t, err, "nothing listens on the admin address")
+		calls = append(calls, fmt.Sprintf("before %d", cfg.Options.EnvoyLogQueueSize))
+	})
+	srv.OnAfterReload(func(cfg *config.Config, err error) {
+		calls = append(calls, fmt.Sprintf("after %d %v", cfg.Options.EnvoyLogQueueSize, err != nil))
+	})
+
+	require.NoError(t, srv.ReloadConfig(&config.Config{Options: config.NewDefaultOptions()}))
+	assert.Equal(t, []string{"before 0", "after 0 false"}, calls)
+
+	// no changes, so envoy isn't reloaded
+	require.NoError(t, srv.ReloadConfig(&config.Config{Options: config.NewDefaultOptions()}))
+	assert.Len(t, calls, 2)
+
+	srv.grpcPort = "invalid"
+	opts := config.NewDefaultOptions()
+	opts.EnvoyLogQueueSize = 10
+	assert.Error(t, srv.ReloadConfig(&config.Config{Options: opts}))
+	assert.Equal(t, []string{"before 0", "after 0 false", "before 10", "after 10 true"}, calls)
+}
+
+func TestServer_OnReloadConcurrent(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test requires a posix shell")
+	}
+
+	dir := t.TempDir()
+	srv := &Server{
+		wd:        dir,
+		grpcPort:  "1234",
+		httpPort:  "1235",
+		envoyPath: writeFakeEnvoy(t, dir, "exit 3"),
+	}
+
+	var mu sync.Mutex
+	var reloads, started int
+	srv.OnBeforeReload(func(cfg *config.Config) {
+		mu.Lock()
+		reloads++
+		mu.Unlock()
+	})
+	srv.OnEvent(func(evt Event) {
+		if evt.Type == EventProcessStarted {
+			mu.Lock()
+			started++
+			mu.Unlock()
+		}
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				opts := config.NewDefaultOptions()
+				opts.EnvoyLogQueueSize = i*10 + j + 1
+				assert.NoError(t, srv.ReloadConfig(&config.Config{Options: opts}))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// every restart was decided under the same lock it was applied with, so each has its reload hooks
+	assert.Equal(t, 10, started)
+	assert.Equal(t, started, reloads)
+}
+
+func TestServer_Restart(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test requires a posix shell")
+	}
+
+	dir := t.TempDir()
+	envoyPath := writeFakeEnvoy(t, dir, "exec sleep 10")
+	checksum, err := fileChecksum(envoyPath)
+	require.NoError(t, err)
+	srv := &Server{
+		wd:             dir,
+		grpcPort:       "1234",
+		httpPort:       "1235",
+		envoyPath:      envoyPath,
+		fullEnvoyPath:  envoyPath,
+		binaryChecksum: checksum,
+	}
+	t.Cleanup(func() { _ = srv.Close() })
+
+	var events []EventType
+	srv.OnEvent(func(evt Event) {
+		if evt.Type != EventProcessExited {
+			events = append(events, evt.Type)
+		}
+	})
+
+	assert.Error(t, srv.Restart(), "envoy can't be restarted before it's started")
+
+	require.NoError(t, srv.ReloadConfig(&config.Config{Options: config.NewDefaultOptions()}))
+	first, _ := srv.PID()
+	defer func() {
+		// the first process is left to drain, so it has to be killed separately
+		if p, err := os.FindProcess(first); err == nil {
+			_ = p.Kill()
+		}
+	}()
+
+	events = nil
+	require.NoError(t, srv.Restart())
+	second, _ := srv.PID()
+	assert.NotEqual(t, first, second)
+	assert.Equal(t, []EventType{EventConfigWritten, EventProcessStarted}, events)
+
+	// a swapped binary isn't started
+	writeFakeEnvoy(t, dir, "exec sleep 20")
+	assert.Error(t, srv.Restart())
+	pid, _ := srv.PID()
+	assert.Equal(t, second, pid)
+}
+
+func TestServer_recordUnchangedReload(t *testing.T) {
+	require.NoError(t, view.Register(metrics.EnvoyUnchangedReloadsView))
+	defer view.Unregister(metrics.EnvoyUnchangedReloadsView)
+
+	srv := &Server{options: serverOptions{unchangedReloadWarnThreshold: 2}}
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		srv.recordUnchangedReload(now)
+	}
+	assert.False(t, srv.unchangedReloadsWarned)
+	srv.recordUnchangedReload(now.Add(time.Second))
+	assert.True(t, srv.unchangedReloadsWarned, "exceeding the threshold should warn")
+
+	// the count starts over in the next window
+	srv.recordUnchangedReload(now.Add(unchangedReloadWindow))
+	assert.Equal(t, 1, srv.unchangedReloads)
+	assert.False(t, srv.unchangedReloadsWarned)
+
+	rows, err := view.RetrieveData(metrics.EnvoyUnchangedReloadsView.Name)
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	assert.Equal(t, float64(4), rows[0].Data.(*view.SumData).Value)
+}
+
+func Test_restartRequired(t *testing.T) {
+	previous := serverOptions{logLevel: "info", logQueueSize: 10, shutdownTimeout: time.Second}
+
+	live := previous
+	live.logLevel = "debug"
+	live.shutdownTimeout = time.Minute
+	live.cleanupOnClose = true
+	live.niceness = 10
+	live.cpus = []int{0}
+	live.unchangedReloadWarnThreshold = 5
+	assert.False(t, restartRequired(previous, live))
+
+	restart := live
+	restart.logQueueSize = 20
+	assert.True(t, restartRequired(previous, restart))
+}
+
+func TestServer_applyConfigLive(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test requires a posix shell")
+	}
+
+	// the admin interface is only reachable at the configured address over a unix socket
+	dir := t.TempDir()
+	sockPath := filepath.Join(dir, "admin.sock")
+	li, err := net.Listen("unix", sockPath)
+	require.NoError(t, err)
+	admin := httptest.NewUnstartedServer(nil)
+	admin.Listener = li
+	_, requests := startFakeAdmin(t, admin)
+
+	srv := &Server{
+		wd:        dir,
+		grpcPort:  "1234",
+		httpPort:  "1235",
+		envoyPath: writeFakeEnvoy(t, dir, "exec sleep 10"),
+	}
+	t.Cleanup(func() { _ = srv.Close() })
+
+	var events []EventType
+	srv.OnEvent(func(evt Event) {
+		if evt.Type != EventProcessExited {
+			events = append(events, evt.Type)
+		}
+	})
+
+	opts := config.NewDefaultOptions()
+	opts.EnvoyAdminAddress = "unix://" + sockPath
+	require.NoError(t, srv.ReloadConfig(&config.Config{Options: opts}))
+	pid, ok := srv.PID()
+	require.True(t, ok)
+
+	// the log level is changed via the admin interface without restarting envoy
+	events = nil
+	opts.ProxyLogLevel = "warn"
+	require.NoError(t, srv.ReloadConfig(&config.Config{Options: opts}))
+	assert.Equal(t, []EventType{EventAppliedLive, EventReloadCompleted}, events)
+	assert.Contains(t, requests(), "POST /logging")
+	livePID, _ := srv.PID()
+	assert.Equal(t, pid, livePID)
+	assert.Equal(t, "warn", srv.options.logLevel)
+
+	// other changes restart envoy
+	events = nil
+	opts.EnvoyLogQueueSize = 10
+	require.NoError(t, srv.ReloadConfig(&config.Config{Options: opts}))
+	assert.Equal(t, []EventType{EventConfigWritten, EventProcessStarted, EventReloadCompleted}, events)
+	restartedPID, _ := srv.PID()
+	assert.NotEqual(t, pid, restartedPID)
+}
+
+func TestServer_runWarmUpTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test requires a posix shell")
+	}
+
+	dir := t.TempDir()
+	sockPath := filepath.Join(dir, "admin.sock")
+	li, err := net.Listen("unix", sockPath)
+	require.NoError(t, err)
+	admin := httptest.NewUnstartedServer(nil)
+	admin.Listener = li
+	setState, _ := startFakeAdmin(t, admin)
+	setState(ServerStateInitializing)
+
+	srv := &Server{
+		wd:        dir,
+		grpcPort:  "1234",
+		httpPort:  "1235",
+		envoyPath: writeFakeEnvoy(t, dir, "exec sleep 10"),
+	}
+	t.Cleanup(func() { _ = srv.Close() })
+
+	opts := config.NewDefaultOptions()
+	opts.EnvoyAdminAddress = "unix://" + sockPath
+	opts.EnvoyWarmUpTimeout = 5 * time.Second
+
+	// the reload only completes once envoy is live
+	done := make(chan error, 1)
+	go func() { done <- srv.ReloadConfig(&config.Config{Options: opts}) }()
+	select {
+	case err := <-done:
+		t.Fatalf("reload completed before envoy was live: %v", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+	setState(ServerStateLive)
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("reload did not complete once envoy was live")
+	}
+
+	// envoy not becoming live before the timeout doesn't fail the reload
+	setState(ServerStateInitializing)
+	opts.EnvoyWarmUpTimeout = 200 * time.Millisecond
+	opts.EnvoyLogQueueSize = 10
+	assert.NoError(t, srv.ReloadConfig(&config.Config{Options: opts}))
+}
+
+func TestServer_onConfigChangeCoalesces(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test requires a posix shell")
+	}
+
+	dir := t.TempDir()
+	srv := &Server{
+		wd:        dir,
+		grpcPort:  "1234",
+		httpPort:  "1235",
+		envoyPath: writeFakeEnvoy(t, dir, "exit 0"),
+	}
+
+	cfgWithLogLevel := func(lvl string) *config.Config {
+		opts := config.NewDefaultOptions()
+		opts.ProxyLogLevel = lvl
+		return &config.Config{Options: opts}
+	}
+
+	reloads := 0
+	srv.OnEvent(func(evt Event) {
+		if evt.Type != EventReloadCompleted {
+			return
+		}
+		reloads++
+		if reloads == 1 {
+			// these arrive while the first reload is still in flight
+			srv.onConfigChange(cfgWithLogLevel("warn"))
+			srv.onConfigChange(cfgWithLogLevel("error"))
+			srv.onConfigChange(cfgWithLogLevel("trace"))
+		}
+	})
+
+	srv.onConfigChange(cfgWithLogLevel("debug"))
+	assert.Equal(t, 2, reloads)
+	assert.Equal(t, "trace", srv.options.logLevel)
+}
+
+func TestServer_PID(t *testing.T) {
+	srv := &Server{}
+	_, ok := srv.PID()
+	assert.False(t, ok)
+}
+
+func Test_checkNoExec(t *testing.T) {
+	// the other tests run fake envoy binaries from temporary directories, so they must allow executables
+	assert.NoError(t, checkNoExec(filepath.Join(t.TempDir(), "envoy")))
+
+	noexec, err := isNoExec(t.TempDir())
+	assert.NoError(t, err)
+	assert.False(t, noexec)
+}
+
+func Test_expandNodeTemplate(t *testing.T) {
+	defer func(f func() (string, error)) { osHostname = f }(osHostname)
+	osHostname = func() (string, error) { return "replica-1", nil }
+
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"proxy", "proxy"},
+		{"{hostname}", "replica-1"},
+		{"pomerium-{hostname}", "pomerium-replica-1"},
+	} {
+		got, err := expandNodeTemplate(tc.in)
+		require.NoError(t, err)
+		assert.Equal(t, tc.want, got)
+	}
+}
+
+func Test_newServerOptionsNode(t *testing.T) {
+	defer func(f func() (string, error)) { osHostname = f }(osHostname)
+	osHostname = func() (string, error) { return "replica-1", nil }
+
+	opts, err := newServerOptions(&config.Config{Options: &config.Options{}})
+	require.NoError(t, err)
+	assert.Equal(t, "proxy", opts.nodeID)
+	assert.Equal(t, "proxy", opts.nodeCluster)
+
+	opts, err = newServerOptions(&config.Config{Options: &config.Options{
+		EnvoyNodeID:      "pomerium-{hostname}",
+		EnvoyNodeCluster: "pomerium",
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, "pomerium-replica-1", opts.nodeID)
+	assert.Equal(t, "pomerium", opts.nodeCluster)
+}
+
+func Test_validateWritablePath(t *testing.T) {
+	dir := t.TempDir()
+
+	assert.NoError(t, validateWritablePath(""))
+	assert.NoError(t, validateWritablePath(os.DevNull))
+	assert.NoError(t, validateWritablePath(filepath.Join(dir, "access.log")))
+	assert.Error(t, validateWritablePath(filepath.Join(dir, "missing", "access.log")))
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, files, "should not leave the write check file behind")
+}
+
+func TestServer_ReopenLogs(t *testing.T) {
+	srv := &Server{}
+	assert.Error(t, srv.ReopenLogs(), "should return an error when envoy is not running")
+}
+
+func TestServer_runProcessCollectorStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	srv := &Server{}
+
+	done := make(chan struct{})
+	go func() {
+		srv.runProcessCollector(ctx)
+		close(done)
+	}()
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("process collector did not stop after the context was cancelled")
+	}
+}
+
+func Test_checkUnverifiedEnvoy(t *testing.T) {
+	assert.NoError(t, checkUnverifiedEnvoy(&config.Options{}))
+	assert.NoError(t, checkUnverifiedEnvoy(&config.Options{EnvoyAllowUnverifiedBinary: true}))
+	assert.Error(t, checkUnverifiedEnvoy(&config.Options{EnvoyRequireVerifiedBinary: true}))
 }
 
 func TestServer_handleLogs(t *testing.T) {
@@ -57,6 +1528,164 @@ func TestServer_handleLogs(t *testing.T) {
 	}
 }
 
+func TestServer_handleLogsSourceLocation(t *testing.T) {
+	rc := ioutil.NopCloser(strings.NewReader(strings.Join([]string{
+		`[LOG_FORMAT]debug--filter--[external/envoy/source/extensions/filters/listener/tls_inspector/tls_inspector.cc:78] tls inspector: new connection accepted`,
+		`[LOG_FORMAT]info--main--starting main dispatch loop`,
+		``,
+	}, "\n")))
+
+	var entries []logEntry
+	srv := &Server{}
+	srv.handleLogs(rc, logStreamStderr, defaultLogReadBufferSize, false, nil, func(entry logEntry) {
+		entries = append(entries, entry)
+	})
+
+	assert.Equal(t, []logEntry{
+		{
+			level:  zerolog.DebugLevel,
+			name:   "filter",
+			file:   "external/envoy/source/extensions/filters/listener/tls_inspector/tls_inspector.cc",
+			line:   78,
+			msg:    "tls inspector: new connection accepted",
+			stream: logStreamStderr,
+		},
+		{
+			level:  zerolog.InfoLevel,
+			name:   "main",
+			msg:    "starting main dispatch loop",
+			stream: logStreamStderr,
+		},
+	}, entries)
+}
+
+func TestServer_handleLogsRaw(t *testing.T) {
+	rc := ioutil.NopCloser(strings.NewReader("{\"level\":\"info\",\"msg\":\"starting main dispatch loop\"}\n\n"))
+
+	var entries []logEntry
+	srv := &Server{}
+	srv.handleLogs(rc, logStreamStdout, defaultLogReadBufferSize, true, nil, func(entry logEntry) {
+		entries = append(entries, entry)
+	})
+
+	assert.Equal(t, []logEntry{
+		{level: zerolog.NoLevel, name: "envoy", msg: `{"level":"info","msg":"starting main dispatch loop"}`, stream: logStreamStdout},
+	}, entries)
+}
+
+func TestServer_handleLogsTee(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "envoy.log")
+	tee, err := openLogFile(path, 0, 0)
+	require.NoError(t, err)
+
+	rc := ioutil.NopCloser(strings.NewReader("[LOG_FORMAT]info--main--authorization: Bearer TOKEN\n\n"))
+	srv := &Server{}
+	require.NoError(t, srv.handleLogs(rc, logStreamStderr, defaultLogReadBufferSize, false, tee, nil))
+	tee.close()
+
+	bs, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "[LOG_FORMAT]info--main--authorization: Bearer TOKEN\n", string(bs), "lines should be written as-is")
+}
+
+func TestServer_sharedLogFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "envoy.log")
+	opts := config.NewDefaultOptions()
+	opts.EnvoyLogFile = path
+	opts.EnvoyLogFileMaxSize = 16
+	options, err := newServerOptions(&config.Config{Options: opts})
+	require.NoError(t, err)
+	assert.Equal(t, 3, options.logFileMaxBackups)
+
+	// no backups is a valid setting, not a request for the default
+	opts.EnvoyLogFileMaxBackups = 0
+	options, err = newServerOptions(&config.Config{Options: opts})
+	require.NoError(t, err)
+	assert.Equal(t, 0, options.logFileMaxBackups)
+
+	// the processes of a hot restart write to the same file, so they share its size and rotation
+	srv := &Server{options: options}
+	parent, err := srv.sharedLogFile()
+	require.NoError(t, err)
+	child, err := srv.sharedLogFile()
+	require.NoError(t, err)
+	assert.Same(t, parent, child)
+
+	parent.writeLine("line-1")
+	child.writeLine("line-2")
+	parent.writeLine("line-3")
+	bs, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "line-3\n", string(bs))
+	assert.NoFileExists(t, path+".1", "no backups should be kept")
+
+	require.NoError(t, srv.Close())
+	assert.Nil(t, srv.logFile)
+	parent.writeLine("line-4")
+	bs, err = ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "line-3\n", string(bs), "lines written after close should be dropped")
+}
+
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
+
+func TestServer_handleLogsReadErrors(t *testing.T) {
+	readErr := errors.New("read failed")
+	srv := &Server{}
+	err := srv.handleLogs(ioutil.NopCloser(errReader{readErr}), logStreamStderr, defaultLogReadBufferSize, false, nil, func(logEntry) {
+		t.Error("no log entries should be written")
+	})
+	assert.ErrorIs(t, err, readErr)
+
+	err = srv.handleLogs(ioutil.NopCloser(strings.NewReader("[LOG_FORMAT]info--main--1\n")), logStreamStderr, defaultLogReadBufferSize, false, nil, func(logEntry) {})
+	assert.NoError(t, err, "reaching the end of the stream should not be an error")
+}
+
+func TestServer_handleLogsDelayed(t *testing.T) {
+	require.NoError(t, view.Register(metrics.EnvoyLogReadsDelayedView))
+	defer view.Unregister(metrics.EnvoyLogReadsDelayedView)
+
+	rc := ioutil.NopCloser(strings.NewReader("[LOG_FORMAT]info--main--1\n[LOG_FORMAT]info--main--2\n[LOG_FORMAT]info--main--3\n"))
+
+	srv := &Server{}
+	srv.handleLogs(rc, logStreamStderr, 16, false, nil, func(entry logEntry) {
+		if entry.msg == "2" {
+			time.Sleep(2 * logReadDelayThreshold)
+		}
+	})
+
+	rows, err := view.RetrieveData(metrics.EnvoyLogReadsDelayedView.Name)
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	assert.Equal(t, float64(1), rows[0].Data.(*view.SumData).Value)
+}
+
+func TestServer_handleLogsLevelMetric(t *testing.T) {
+	require.NoError(t, view.Register(metrics.EnvoyLogLinesView))
+	defer view.Unregister(metrics.EnvoyLogLinesView)
+
+	rc := ioutil.NopCloser(strings.NewReader(strings.Join([]string{
+		"[LOG_FORMAT]error--main--1",
+		"[LOG_FORMAT]error--main--2",
+		"[LOG_FORMAT]warning--main--3",
+		"[LOG_FORMAT]bogus--main--4",
+		"",
+	}, "\n")))
+	srv := &Server{}
+	srv.handleLogs(rc, logStreamStderr, defaultLogReadBufferSize, false, nil, func(logEntry) {})
+
+	rows, err := view.RetrieveData(metrics.EnvoyLogLinesView.Name)
+	require.NoError(t, err)
+	counts := map[string]float64{}
+	for _, row := range rows {
+		require.Len(t, row.Tags, 1)
+		counts[row.Tags[0].Value] = row.Data.(*view.SumData).Value
+	}
+	assert.Equal(t, map[string]float64{"error": 2, "warning": 1, "unknown": 1}, counts)
+}
+
 func Benchmark_handleLogs(b *testing.B) {
 	line := `[LOG_FORMAT]debug--http--[external/envoy/source/common/http/conn_manager_impl.cc:781] [C25][S14758077654018620250] request headers complete (end_stream=false):\\n\\':authority\\', \\'enabled-ws-echo.localhost.pomerium.io\\'\\n\\':path\\', \\'/\\'\\n\\':method\\', \\'GET\\'\\n\\'upgrade\\', \\'websocket\\'\\n\\'connection\\', \\'upgrade\\'\\n\\'x-request-id\\', \\'30ac7726e0b9e00a9c9ab2bf66d692ac\\'\\n\\'x-real-ip\\', \\'172.17.0.1\\'\\n\\'x-forwarded-for\\', \\'172.17.0.1\\'\\n\\'x-forwarded-host\\', \\'enabled-ws-echo.localhost.pomerium.io\\'\\n\\'x-forwarded-port\\', \\'443\\'\\n\\'x-forwarded-proto\\', \\'https\\'\\n\\'x-scheme\\', \\'https\\'\\n\\'user-agent\\', \\'Go-http-client/1.1\\'\\n\\'sec-websocket-key\\', \\'4bh7+YFVzrJiblaSu/CVfg==\\'\\n\\'sec-websocket-version\\', \\'13\\'`
 	rc := ioutil.NopCloser(strings.NewReader(line))
@@ -66,6 +1695,53 @@ func Benchmark_handleLogs(b *testing.B) {
 	b.ResetTimer()
 	b.ReportAllocs()
 	for i := 0; i < b.N; i++ {
-		srv.handleLogs(rc)
+		srv.handleLogs(rc, logStreamStderr, defaultLogReadBufferSize, false, nil, writeLogEntry)
+	}
+}
+
+// writeFakeEnvoy writes a shell script to dir which can be used in place of the envoy binary.
+func writeFakeEnvoy(t *testing.T, dir, script string) string {
+	t.Helper()
+
+	envoyPath := filepath.Join(dir, "envoy")
+	require.NoError(t, ioutil.WriteFile(envoyPath, []byte("#!/bin/sh\n"+script+"\n"), 0o755))
+	return envoyPath
+}
+
+func TestServer_ReportReload(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test requires a posix shell")
+	}
+
+	dir := t.TempDir()
+	src := config.NewStaticSource(nil)
+	srv := &Server{
+		wd:             dir,
+		grpcPort:       "1234",
+		httpPort:       "1235",
+		envoyPath:      writeFakeEnvoy(t, dir, "sleep 10"),
+		reloadReporter: src,
+	}
+	t.Cleanup(func() { _ = srv.Close() })
+
+	cfg := &config.Config{Options: config.NewDefaultOptions()}
+	require.NoError(t, srv.ReloadConfig(cfg))
+	version, ok := src.AppliedVersion(ReloadConsumerName)
+	assert.True(t, ok)
+	assert.Equal(t, cfg.Checksum(), version)
+
+	var statuses []config.ReloadStatus
+	src.OnReload(func(consumer string, status config.ReloadStatus) {
+		statuses = append(statuses, status)
+	})
+
+	srv.grpcPort = "invalid"
+	failed := &config.Config{Options: config.NewDefaultOptions()}
+	failed.Options.EnvoyLogQueueSize = 10
+	assert.Error(t, srv.ReloadConfig(failed))
+	if assert.Len(t, statuses, 1) {
+		assert.Equal(t, failed.Checksum(), statuses[0].Version)
+		assert.Error(t, statuses[0].Err)
 	}
+	assert.True(t, src.Committed(cfg.Checksum(), ReloadConsumerName))
 }
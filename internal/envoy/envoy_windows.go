@@ -0,0 +1,119 @@
+// +build windows
+
+package envoy
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var sysProcAttr = &syscall.SysProcAttr{
+	CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP,
+}
+
+// reopenLogsSignal is the signal which makes envoy re-open its access logs. Windows can't deliver it to
+// envoy, so re-opening logs isn't supported.
+var reopenLogsSignal = syscall.SIGHUP
+
+// jobs are the job objects envoy processes are assigned to, by process id. Closing the last handle to a
+// job kills its processes, so envoy and any processes it starts are killed if pomerium exits.
+var jobs = struct {
+	sync.Mutex
+	m map[int]windows.Handle
+}{m: make(map[int]windows.Handle)}
+
+// setupProcess is called once the envoy process has started. It assigns the process to a job object.
+func setupProcess(p *os.Process) error {
+	job, err := windows.CreateJobObject(nil, nil)
+	if err != nil {
+		return fmt.Errorf("error creating job object: %w", err)
+	}
+
+	info := windows.JOBOBJECT_EXTENDED_LIMIT_INFORMATION{
+		BasicLimitInformation: windows.JOBOBJECT_BASIC_LIMIT_INFORMATION{
+			LimitFlags: windows.JOB_OBJECT_LIMIT_KILL_ON_JOB_CLOSE,
+		},
+	}
+	_, err = windows.SetInformationJobObject(job, windows.JobObjectExtendedLimitInformation,
+		uintptr(unsafe.Pointer(&info)), uint32(unsafe.Sizeof(info)))
+	if err != nil {
+		_ = windows.CloseHandle(job)
+		return fmt.Errorf("error configuring job object: %w", err)
+	}
+
+	h, err := windows.OpenProcess(windows.PROCESS_SET_QUOTA|windows.PROCESS_TERMINATE, false, uint32(p.Pid))
+	if err != nil {
+		_ = windows.CloseHandle(job)
+		return fmt.Errorf("error opening envoy process: %w", err)
+	}
+	defer func() { _ = windows.CloseHandle(h) }()
+
+	err = windows.AssignProcessToJobObject(job, h)
+	if err != nil {
+		_ = windows.CloseHandle(job)
+		return fmt.Errorf("error assigning envoy process to job object: %w", err)
+	}
+
+	jobs.Lock()
+	jobs.m[p.Pid] = job
+	jobs.Unlock()
+	return nil
+}
+
+// setPriority sets the niceness of the envoy process. It's only supported on linux.
+func setPriority(p *os.Process, niceness int) error {
+	return nil
+}
+
+// setAffinity restricts the envoy process to the given cpus. It's only supported on linux.
+func setAffinity(p *os.Process, cpus []int) error {
+	return nil
+}
+
+// killProcess kills the envoy process and any processes it started.
+func killProcess(p *os.Process) error {
+	jobs.Lock()
+	job, ok := jobs.m[p.Pid]
+	jobs.Unlock()
+	if !ok {
+		return p.Kill()
+	}
+	return windows.TerminateJobObject(job, 1)
+}
+
+// terminateProcess asks the envoy process to exit. Windows has no equivalent of SIGTERM, so the process
+// is killed.
+func terminateProcess(p *os.Process) error {
+	return killProcess(p)
+}
+
+// releaseProcess is called once the envoy process has exited. It closes the process's job object.
+func releaseProcess(p *os.Process) {
+	jobs.Lock()
+	job, ok := jobs.m[p.Pid]
+	delete(jobs.m, p.Pid)
+	jobs.Unlock()
+	if ok {
+		_ = windows.CloseHandle(job)
+	}
+}
+
+// isNoExec returns true if path is on a filesystem mounted noexec. It's only supported on linux.
+func isNoExec(path string) (bool, error) {
+	return false, nil
+}
+
+// buildSysProcAttr returns the process attributes for envoy. Running envoy as a different user isn't
+// supported on windows.
+func buildSysProcAttr(uid, gid uint32) (*syscall.SysProcAttr, error) {
+	if uid != 0 {
+		return nil, fmt.Errorf("running envoy as a different user is not supported on windows")
+	}
+	attr := *sysProcAttr
+	return &attr, nil
+}
@@ -0,0 +1,123 @@
+package envoy
+
+import (
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pomerium/pomerium/internal/log"
+)
+
+// An EventType is the kind of envoy lifecycle transition an Event describes.
+type EventType string
+
+// envoy lifecycle event types
+const (
+	// EventConfigWritten is emitted when a new envoy bootstrap config has been written.
+	EventConfigWritten EventType = "config-written"
+	// EventProcessStarted is emitted when an envoy process has been started.
+	EventProcessStarted EventType = "process-started"
+	// EventProcessExited is emitted when an envoy process exits, with the exit error if any and its exit
+	// code or the signal which terminated it.
+	EventProcessExited EventType = "process-exited"
+	// EventReloadCompleted is emitted when a config change has been applied to envoy.
+	EventReloadCompleted EventType = "reload-completed"
+	// EventReloadFailed is emitted when applying a config change to envoy fails.
+	EventReloadFailed EventType = "reload-failed"
+	// EventAppliedLive is emitted when a config change has been applied to the running envoy without
+	// restarting it.
+	EventAppliedLive EventType = "applied-live"
+	// EventDraining is emitted when envoy starts draining without pomerium having initiated it.
+	EventDraining EventType = "draining"
+	// EventLogsFailed is emitted when an envoy process's output can no longer be read, with the read
+	// error. The process keeps running without its logs, so it should be restarted.
+	EventLogsFailed EventType = "logs-failed"
+)
+
+// An Event is an envoy lifecycle transition.
+type Event struct {
+	Type EventType
+	Time time.Time
+	// RestartEpoch is the restart epoch of the envoy process the event relates to. For config and
+	// reload events it's the epoch of the most recently started process.
+	RestartEpoch int
+	Err          error
+
+	// ExitCode is the exit code of the process for process exited events, or -1 if it was terminated
+	// by a signal.
+	ExitCode int
+	// Signal is the signal which terminated the process for process exited events, or empty if it
+	// exited by itself. A process killed by the kernel when it runs out of memory has the kill signal.
+	Signal string
+}
+
+// An EventListener is called for each envoy lifecycle event.
+type EventListener = func(Event)
+
+func newEvent(typ EventType, restartEpoch int, err error) Event {
+	return Event{
+		Type:         typ,
+		Time:         time.Now(),
+		RestartEpoch: restartEpoch,
+		Err:          err,
+	}
+}
+
+// OnEvent adds a listener which is called for each envoy lifecycle event. Listeners are called
+// synchronously, in the order the events occurred.
+func (srv *Server) OnEvent(li EventListener) {
+	srv.listenersMu.Lock()
+	defer srv.listenersMu.Unlock()
+
+	srv.eventListeners = append(srv.eventListeners, li)
+}
+
+func (srv *Server) notifyEvents(events ...Event) {
+	srv.listenersMu.Lock()
+	listeners := srv.eventListeners
+	srv.listenersMu.Unlock()
+
+	for _, evt := range events {
+		for _, li := range listeners {
+			li(evt)
+		}
+	}
+}
+
+// wait waits for the envoy process to exit, so that it's reaped even after a hot-reload replaces it.
+// cmd.Wait closes the process's output pipes, so it's only called once its logs have been read. exited
+// is closed once the process has exited.
+func (srv *Server) wait(cmd *exec.Cmd, logsWG *sync.WaitGroup, restartEpoch int, exited chan<- struct{}) {
+	logsWG.Wait()
+	err := cmd.Wait()
+	releaseProcess(cmd.Process)
+	close(exited)
+
+	evt := newEvent(EventProcessExited, restartEpoch, err)
+	evt.ExitCode, evt.Signal = exitStatus(cmd.ProcessState)
+
+	// processes which are replaced or shut down exit cleanly, anything else is worth a warning
+	logEvt := log.Debug()
+	if evt.ExitCode != 0 {
+		logEvt = log.Warn()
+	}
+	logEvt = logEvt.Err(err).Str("service", "envoy").Int("restart_epoch", restartEpoch).Int("exit_code", evt.ExitCode)
+	if evt.Signal != "" {
+		logEvt = logEvt.Str("signal", evt.Signal)
+	}
+	logEvt.Msg("envoy: process exited")
+	srv.notifyEvents(evt)
+}
+
+// exitStatus returns the exit code of an exited process, or -1 and the signal which terminated it.
+func exitStatus(state *os.ProcessState) (exitCode int, signal string) {
+	if state == nil {
+		return -1, ""
+	}
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return -1, ws.Signal().String()
+	}
+	return state.ExitCode(), ""
+}
@@ -0,0 +1,440 @@
+package envoy
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/pomerium/pomerium/internal/log"
+	"github.com/pomerium/pomerium/internal/telemetry/metrics"
+)
+
+// logReadDelayThreshold is how long writing a log line can hold up reading envoy's output before it's
+// counted as delayed.
+const logReadDelayThreshold = 10 * time.Millisecond
+
+// Failed reads of envoy's output are retried with a jittered exponential backoff, until maxLogReadErrors
+// consecutive reads have failed.
+const (
+	logReadRetryInitialInterval = 10 * time.Millisecond
+	logReadRetryMaxInterval     = time.Second
+	maxLogReadErrors            = 10
+)
+
+// envoy output streams
+const (
+	logStreamStdout = "stdout"
+	logStreamStderr = "stderr"
+)
+
+// envoyLogLevels are the level names envoy logs with. Lines with any other level are counted as
+// logLevelUnknown, so arbitrary text can't create new metric tags.
+var envoyLogLevels = map[string]bool{
+	"trace":    true,
+	"debug":    true,
+	"info":     true,
+	"warning":  true,
+	"error":    true,
+	"critical": true,
+	"off":      true,
+}
+
+const logLevelUnknown = "unknown"
+
+// recordLogLevel counts a log line with envoy's level name for the log lines metric.
+func recordLogLevel(logLevel string) {
+	if !envoyLogLevels[logLevel] {
+		logLevel = logLevelUnknown
+	}
+	metrics.RecordEnvoyLogLine(logLevel)
+}
+
+// A logEntry is a parsed envoy log line.
+type logEntry struct {
+	level zerolog.Level
+	name  string
+	file  string
+	line  int
+	msg   string
+	// stream is the output stream the entry was read from
+	stream string
+
+	traceID string
+}
+
+func writeLogEntry(entry logEntry) {
+	evt := log.WithLevel(entry.level).
+		Str("service", "envoy").
+		Str("name", entry.name)
+	if entry.stream != "" {
+		evt = evt.Str("stream", entry.stream)
+	}
+	if entry.file != "" {
+		evt = evt.Str("file", entry.file).Int("line", entry.line)
+	}
+	if entry.traceID != "" {
+		evt = evt.Str("trace_id", entry.traceID)
+	}
+	evt.Msg(entry.msg)
+}
+
+// A logQueue writes envoy log entries from a dedicated goroutine, so a slow log sink doesn't
+// back-pressure envoy's output. Entries are dropped when the queue is full.
+type logQueue struct {
+	entries chan logEntry
+	done    chan struct{}
+	sink    func(logEntry)
+}
+
+func newLogQueue(size int, sink func(logEntry)) *logQueue {
+	q := &logQueue{
+		entries: make(chan logEntry, size),
+		done:    make(chan struct{}),
+		sink:    sink,
+	}
+	go q.run()
+	return q
+}
+
+func (q *logQueue) run() {
+	defer close(q.done)
+
+	for entry := range q.entries {
+		q.sink(entry)
+	}
+}
+
+// write queues the entry, dropping it if the queue is full.
+func (q *logQueue) write(entry logEntry) {
+	select {
+	case q.entries <- entry:
+	default:
+		metrics.RecordEnvoyDroppedLogs(1)
+	}
+}
+
+// close stops accepting entries and waits for queued entries to be written.
+func (q *logQueue) close() {
+	close(q.entries)
+	<-q.done
+}
+
+// A logDeduplicator collapses consecutive identical log entries. The number of times an entry was
+// repeated is written periodically and when a different entry is written.
+type logDeduplicator struct {
+	sink func(logEntry)
+	stop chan struct{}
+	done chan struct{}
+
+	mu       sync.Mutex
+	last     *logEntry
+	repeated int
+}
+
+func newLogDeduplicator(interval time.Duration, sink func(logEntry)) *logDeduplicator {
+	d := &logDeduplicator{
+		sink: sink,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go d.run(interval)
+	return d
+}
+
+func (d *logDeduplicator) run(interval time.Duration) {
+	defer close(d.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+		}
+
+		d.mu.Lock()
+		d.flushLocked()
+		d.mu.Unlock()
+	}
+}
+
+func (d *logDeduplicator) write(entry logEntry) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.last != nil && *d.last == entry {
+		d.repeated++
+		return
+	}
+
+	d.flushLocked()
+	d.last = &entry
+	d.sink(entry)
+}
+
+// close stops the flush timer and writes any pending repeat count.
+func (d *logDeduplicator) close() {
+	close(d.stop)
+	<-d.done
+
+	d.mu.Lock()
+	d.flushLocked()
+	d.mu.Unlock()
+}
+
+func (d *logDeduplicator) flushLocked() {
+	if d.repeated == 0 {
+		return
+	}
+
+	d.sink(logEntry{
+		level:  d.last.level,
+		name:   d.last.name,
+		msg:    fmt.Sprintf("previous message repeated %d times", d.repeated),
+		stream: d.last.stream,
+	})
+	d.repeated = 0
+}
+
+// logTraceIDPatterns match the trace id in the propagation headers envoy logs for traced
+// requests. The first capture group is the trace id.
+var logTraceIDPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)x-b3-traceid'?[:,]?\s*'?([0-9a-f]{16,32})`),
+	regexp.MustCompile(`(?i)traceparent'?[:,]?\s*'?[0-9a-f]{2}-([0-9a-f]{32})-`),
+	regexp.MustCompile(`(?i)x-datadog-trace-id'?[:,]?\s*'?([0-9]+)`),
+	regexp.MustCompile(`(?i)uber-trace-id'?[:,]?\s*'?([0-9a-f]{1,32}):`),
+	regexp.MustCompile(`(?i)x-amzn-trace-id'?[:,]?\s*'?root=([0-9a-f-]+)`),
+}
+
+// parseTraceID returns the first trace id found in msg, or an empty string if there is none.
+func parseTraceID(msg string) string {
+	for _, re := range logTraceIDPatterns {
+		if m := re.FindStringSubmatch(msg); len(m) == 2 {
+			return m[1]
+		}
+	}
+	return ""
+}
+
+// withTraceIDs returns a sink which sets the trace id of entries before writing them to sink.
+func withTraceIDs(sink func(logEntry)) func(logEntry) {
+	return func(entry logEntry) {
+		entry.traceID = parseTraceID(entry.msg)
+		sink(entry)
+	}
+}
+
+// defaultLogRedactPatterns match bearer and pomerium tokens, cookies and pomerium's jwt assertion in
+// envoy's header logs, for example:
+//
+//	'authorization', 'Bearer TOKEN'
+//	authorization: Pomerium JWT
+//	'cookie', '_pomerium=SESSION'
+//	cookie: _pomerium=SESSION
+//	'x-pomerium-jwt-assertion', 'JWT'
+//
+// Cookie and jwt assertion patterns only match these header forms, so messages which merely mention
+// cookies are left intact.
+var defaultLogRedactPatterns = []string{
+	`(?i)authorization'?[:,]?\s*'?(?:bearer|pomerium)\s+([^'\s]+)`,
+	`(?i)'(?:(?:set-)?cookie|x-pomerium-jwt-assertion)', '([^'\n]*)'`,
+	`(?im)^\s*(?:(?:set-)?cookie|x-pomerium-jwt-assertion):[ \t]*([^\n]+)`,
+}
+
+const redactedValue = "***"
+
+// A logRedactor replaces sensitive values in log messages.
+type logRedactor struct {
+	patterns []*regexp.Regexp
+}
+
+func newLogRedactor(extraPatterns []string) (*logRedactor, error) {
+	r := &logRedactor{}
+	for _, pattern := range append(defaultLogRedactPatterns, extraPatterns...) {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid log redaction pattern %s: %w", pattern, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	return r, nil
+}
+
+// wrap returns a sink which redacts entries before writing them to sink.
+func (r *logRedactor) wrap(sink func(logEntry)) func(logEntry) {
+	return func(entry logEntry) {
+		entry.msg = r.redact(entry.msg)
+		sink(entry)
+	}
+}
+
+// redact replaces matches of each pattern with ***. If the pattern has a capture group only the
+// first group is replaced.
+func (r *logRedactor) redact(msg string) string {
+	for _, re := range r.patterns {
+		group := 0
+		if re.NumSubexp() > 0 {
+			group = 1
+		}
+
+		matches := re.FindAllStringSubmatchIndex(msg, -1)
+		if len(matches) == 0 {
+			continue
+		}
+
+		var b strings.Builder
+		last := 0
+		for _, m := range matches {
+			start, end := m[2*group], m[2*group+1]
+			if start < 0 {
+				continue
+			}
+			b.WriteString(msg[last:start])
+			b.WriteString(redactedValue)
+			last = end
+		}
+		b.WriteString(msg[last:])
+		msg = b.String()
+	}
+	return msg
+}
+
+// logFileMode is the mode of the file envoy's raw logs are written to.
+const logFileMode = 0o600
+
+// A logFile writes envoy's raw log lines to a file. It's shared by every envoy process, so that during a
+// hot restart the processes don't rotate the file from under each other. Once the file reaches its
+// maximum size it's rotated:
+// it's renamed with a .1 suffix, existing backups are shifted up and the oldest is removed.
+type logFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	failed bool
+	closed bool
+}
+
+func openLogFile(path string, maxSize int64, maxBackups int) (*logFile, error) {
+	lf := &logFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := lf.open(); err != nil {
+		return nil, err
+	}
+	return lf, nil
+}
+
+func (lf *logFile) open() error {
+	f, err := os.OpenFile(lf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, logFileMode)
+	if err != nil {
+		return fmt.Errorf("error opening envoy log file: %w", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("error opening envoy log file: %w", err)
+	}
+	lf.f = f
+	lf.size = fi.Size()
+	return nil
+}
+
+// writeLine appends a line to the file, rotating it first if the line would take it past its maximum
+// size. Errors are logged once, so a full disk doesn't flood pomerium's logs, and the line is dropped.
+func (lf *logFile) writeLine(ln string) {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+
+	err := lf.writeLineLocked(ln)
+	if err != nil && !lf.failed {
+		log.Error().Err(err).Str("service", "envoy").Str("path", lf.path).Msg("envoy: failed to write to log file")
+	}
+	lf.failed = err != nil
+}
+
+func (lf *logFile) writeLineLocked(ln string) error {
+	// lines from processes still draining when pomerium shuts down are dropped
+	if lf.closed {
+		return nil
+	}
+	if lf.f == nil {
+		if err := lf.open(); err != nil {
+			return err
+		}
+	}
+	if lf.maxSize > 0 && lf.size > 0 && lf.size+int64(len(ln))+1 > lf.maxSize {
+		if err := lf.rotateLocked(); err != nil {
+			return err
+		}
+	}
+
+	n, err := lf.f.WriteString(ln + "\n")
+	lf.size += int64(n)
+	return err
+}
+
+func (lf *logFile) rotateLocked() error {
+	if err := lf.f.Close(); err != nil {
+		log.Warn().Err(err).Str("service", "envoy").Str("path", lf.path).Msg("envoy: failed to close log file")
+	}
+	lf.f = nil
+
+	backup := func(i int) string { return lf.path + "." + strconv.Itoa(i) }
+	if lf.maxBackups > 0 {
+		_ = os.Remove(backup(lf.maxBackups))
+		for i := lf.maxBackups - 1; i > 0; i-- {
+			_ = os.Rename(backup(i), backup(i+1))
+		}
+		if err := os.Rename(lf.path, backup(1)); err != nil {
+			return fmt.Errorf("error rotating envoy log file: %w", err)
+		}
+	} else if err := os.Remove(lf.path); err != nil {
+		return fmt.Errorf("error rotating envoy log file: %w", err)
+	}
+	return lf.open()
+}
+
+// reconfigure changes the file's settings for the lines written from now on. When the path changes the
+// current file is closed and the new one is opened.
+func (lf *logFile) reconfigure(path string, maxSize int64, maxBackups int) error {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+
+	lf.maxSize, lf.maxBackups = maxSize, maxBackups
+	if path == lf.path {
+		return nil
+	}
+	if lf.f != nil {
+		if err := lf.f.Close(); err != nil {
+			log.Warn().Err(err).Str("service", "envoy").Str("path", lf.path).Msg("envoy: failed to close log file")
+		}
+		lf.f = nil
+	}
+	lf.path = path
+	return lf.open()
+}
+
+// close closes the file. Lines written afterwards are dropped.
+func (lf *logFile) close() {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+
+	lf.closed = true
+	if lf.f == nil {
+		return
+	}
+	if err := lf.f.Close(); err != nil {
+		log.Warn().Err(err).Str("service", "envoy").Str("path", lf.path).Msg("envoy: failed to close log file")
+	}
+	lf.f = nil
+}
@@ -0,0 +1,221 @@
+package envoy
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/stats/view"
+
+	"github.com/pomerium/pomerium/internal/telemetry/metrics"
+)
+
+func TestLogQueue(t *testing.T) {
+	require.NoError(t, view.Register(metrics.EnvoyDroppedLogsView))
+	defer view.Unregister(metrics.EnvoyDroppedLogsView)
+
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	var written []string
+	q := newLogQueue(1, func(entry logEntry) {
+		if len(written) == 0 {
+			close(started)
+			<-unblock
+		}
+		written = append(written, entry.msg)
+	})
+
+	q.write(logEntry{msg: "1"})
+	<-started
+	q.write(logEntry{msg: "2"})
+	q.write(logEntry{msg: "3"}) // dropped, the queue is full
+	close(unblock)
+	q.close()
+
+	assert.Equal(t, []string{"1", "2"}, written)
+
+	rows, err := view.RetrieveData(metrics.EnvoyDroppedLogsView.Name)
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	assert.Equal(t, float64(1), rows[0].Data.(*view.SumData).Value)
+}
+
+func TestLogDeduplicator(t *testing.T) {
+	var written []string
+	d := newLogDeduplicator(time.Hour, func(entry logEntry) {
+		written = append(written, entry.msg)
+	})
+
+	d.write(logEntry{msg: "a"})
+	d.write(logEntry{msg: "a"})
+	d.write(logEntry{msg: "a"})
+	d.write(logEntry{msg: "b"})
+	d.write(logEntry{msg: "b"})
+	d.close()
+
+	assert.Equal(t, []string{
+		"a",
+		"previous message repeated 2 times",
+		"b",
+		"previous message repeated 1 times",
+	}, written)
+}
+
+func TestLogDeduplicatorStreams(t *testing.T) {
+	var written []logEntry
+	d := newLogDeduplicator(time.Hour, func(entry logEntry) {
+		written = append(written, entry)
+	})
+
+	d.write(logEntry{msg: "a", stream: logStreamStderr})
+	d.write(logEntry{msg: "a", stream: logStreamStdout})
+	d.write(logEntry{msg: "a", stream: logStreamStdout})
+	d.close()
+
+	require.Len(t, written, 3)
+	assert.Equal(t, logStreamStderr, written[0].stream)
+	assert.Equal(t, logStreamStdout, written[1].stream, "the same message on another stream is not a repeat")
+	assert.Equal(t, "previous message repeated 1 times", written[2].msg)
+	assert.Equal(t, logStreamStdout, written[2].stream)
+}
+
+func TestLogDeduplicatorInterval(t *testing.T) {
+	written := make(chan string, 10)
+	d := newLogDeduplicator(time.Millisecond, func(entry logEntry) {
+		written <- entry.msg
+	})
+	defer d.close()
+
+	d.write(logEntry{msg: "a"})
+	d.write(logEntry{msg: "a"})
+
+	assert.Equal(t, "a", <-written)
+	select {
+	case msg := <-written:
+		assert.Equal(t, "previous message repeated 1 times", msg)
+	case <-time.After(5 * time.Second):
+		t.Fatal("repeat count was not written on the interval")
+	}
+}
+
+func TestParseTraceID(t *testing.T) {
+	for _, tc := range []struct {
+		name, in, want string
+	}{
+		{"none", "tls inspector: new connection accepted", ""},
+		{"b3", "':path', '/'\n'x-b3-traceid', '80f198ee56343ba864fe8b2a57d3eff7'\n'x-b3-spanid', 'e457b5a2e4d86bd1'", "80f198ee56343ba864fe8b2a57d3eff7"},
+		{"trace context", "'traceparent', '00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01'", "0af7651916cd43dd8448eb211c80319c"},
+		{"datadog", "'x-datadog-trace-id', '1234567890123456789'", "1234567890123456789"},
+		{"jaeger", "'uber-trace-id', '5e9f3c2d1a0b4c8d:4c8d5e9f3c2d1a0b:0:1'", "5e9f3c2d1a0b4c8d"},
+		{"xray", "'x-amzn-trace-id', 'Root=1-5759e988-bd862e3fe1be46a994272793;Sampled=1'", "1-5759e988-bd862e3fe1be46a994272793"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, parseTraceID(tc.in))
+		})
+	}
+}
+
+func TestLogRedactor(t *testing.T) {
+	r, err := newLogRedactor([]string{`api_key=[a-z0-9]+`})
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name, in, want string
+	}{
+		{
+			"no match",
+			"tls inspector: new connection accepted",
+			"tls inspector: new connection accepted",
+		},
+		{
+			"bearer token",
+			"request headers complete (end_stream=false):\n':authority', 'example.com'\n'authorization', 'Bearer abc.def.ghi'\n':path', '/'",
+			"request headers complete (end_stream=false):\n':authority', 'example.com'\n'authorization', 'Bearer ***'\n':path', '/'",
+		},
+		{
+			"pomerium token",
+			"'authorization', 'Pomerium eyJhbGciOiJFUzI1NiJ9.eyJzdWIiOiJ1c2VyIn0.c2ln'\n':path', '/'",
+			"'authorization', 'Pomerium ***'\n':path', '/'",
+		},
+		{
+			"pomerium token header line",
+			"request headers:\nauthorization: Pomerium eyJhbGciOiJFUzI1NiJ9.eyJzdWIiOiJ1c2VyIn0.c2ln\nhost: example.com",
+			"request headers:\nauthorization: Pomerium ***\nhost: example.com",
+		},
+		{
+			"jwt assertion",
+			"'x-pomerium-jwt-assertion', 'eyJhbGciOiJFUzI1NiJ9.eyJzdWIiOiJ1c2VyIn0.c2ln'\n'x-request-id', '30ac7726'",
+			"'x-pomerium-jwt-assertion', '***'\n'x-request-id', '30ac7726'",
+		},
+		{
+			"jwt assertion header line",
+			"request headers:\nX-Pomerium-Jwt-Assertion: eyJhbGciOiJFUzI1NiJ9.eyJzdWIiOiJ1c2VyIn0.c2ln\nhost: example.com",
+			"request headers:\nX-Pomerium-Jwt-Assertion: ***\nhost: example.com",
+		},
+		{
+			"cookies",
+			"'cookie', '_pomerium=SESSION; other=VALUE'\n'set-cookie', '_pomerium=NEW'\n'x-request-id', '30ac7726'",
+			"'cookie', '***'\n'set-cookie', '***'\n'x-request-id', '30ac7726'",
+		},
+		{
+			"cookie header lines",
+			"request headers:\ncookie: _pomerium=SESSION\nSet-Cookie: _pomerium=NEW; Secure\nhost: example.com",
+			"request headers:\ncookie: ***\nSet-Cookie: ***\nhost: example.com",
+		},
+		{
+			"cookie in prose",
+			"invalid cookie header in request, cookie: parsing failed for 'cookie' value",
+			"invalid cookie header in request, cookie: parsing failed for 'cookie' value",
+		},
+		{
+			"extra pattern",
+			"upstream request to /api?api_key=secret123&page=2",
+			"upstream request to /api?***&page=2",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, r.redact(tc.in))
+		})
+	}
+
+	_, err = newLogRedactor([]string{"("})
+	assert.Error(t, err)
+}
+
+func TestLogFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "envoy.log")
+	lf, err := openLogFile(path, 16, 2)
+	require.NoError(t, err)
+
+	for _, ln := range []string{"line-1", "line-2", "line-3", "line-4", "line-5", "line-6"} {
+		lf.writeLine(ln)
+	}
+	lf.close()
+
+	read := func(p string) string {
+		bs, err := ioutil.ReadFile(p)
+		require.NoError(t, err)
+		return string(bs)
+	}
+	assert.Equal(t, "line-5\nline-6\n", read(path))
+	assert.Equal(t, "line-3\nline-4\n", read(path+".1"))
+	assert.Equal(t, "line-1\nline-2\n", read(path+".2"))
+	assert.NoFileExists(t, path+".3")
+
+	// writes are appended to an existing file
+	lf, err = openLogFile(path, 0, 0)
+	require.NoError(t, err)
+	lf.writeLine("line-7")
+	assert.Equal(t, "line-5\nline-6\nline-7\n", read(path))
+
+	// lines are written to the new path once it's changed
+	newPath := filepath.Join(filepath.Dir(path), "envoy-new.log")
+	require.NoError(t, lf.reconfigure(newPath, 0, 0))
+	lf.writeLine("line-8")
+	lf.close()
+	assert.Equal(t, "line-5\nline-6\nline-7\n", read(path))
+	assert.Equal(t, "line-8\n", read(newPath))
+}
@@ -1,15 +1,34 @@
 package envoy
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"gopkg.in/yaml.v3"
+
+	"github.com/pomerium/pomerium/config"
+	"github.com/pomerium/pomerium/internal/log"
 )
 
-const baseIDPath = "/tmp/pomerium-envoy-base-id"
+const baseIDFileName = "envoy-base-id"
+
+func containsString(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
 
 func firstNonEmpty(args ...string) string {
 	for _, a := range args {
@@ -20,8 +39,147 @@ func firstNonEmpty(args ...string) string {
 	return ""
 }
 
-func readBaseID() (int, bool) {
-	bs, err := ioutil.ReadFile(baseIDPath)
+func firstNonZeroDuration(args ...time.Duration) time.Duration {
+	for _, a := range args {
+		if a != 0 {
+			return a
+		}
+	}
+	return 0
+}
+
+func firstNonZeroInt(args ...int) int {
+	for _, a := range args {
+		if a != 0 {
+			return a
+		}
+	}
+	return 0
+}
+
+func firstNonZeroInt64(args ...int64) int64 {
+	for _, a := range args {
+		if a != 0 {
+			return a
+		}
+	}
+	return 0
+}
+
+func firstNonZeroFloat(args ...float64) float64 {
+	for _, a := range args {
+		if a != 0 {
+			return a
+		}
+	}
+	return 0
+}
+
+// buildEnvironment merges the extra variables onto the base environment. Extra variables
+// replace any base variables with the same name.
+func buildEnvironment(base []string, extra map[string]string) []string {
+	env := make([]string, 0, len(base)+len(extra))
+	for _, kv := range base {
+		k := kv
+		if idx := strings.IndexByte(kv, '='); idx >= 0 {
+			k = kv[:idx]
+		}
+		if _, ok := extra[k]; ok {
+			continue
+		}
+		env = append(env, kv)
+	}
+
+	keys := make([]string, 0, len(extra))
+	for k := range extra {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		env = append(env, k+"="+extra[k])
+	}
+	return env
+}
+
+// ensureWorkingDirectory creates the working directory if it doesn't exist and restricts its
+// permissions to the current user.
+func ensureWorkingDirectory(wd string) error {
+	err := os.MkdirAll(wd, workingDirectoryMode)
+	if err != nil {
+		return err
+	}
+	// MkdirAll does not change the mode of an existing directory
+	return os.Chmod(wd, workingDirectoryMode)
+}
+
+// checkNoExec returns an error if the envoy binary is on a filesystem mounted noexec, as it can't be run.
+func checkNoExec(envoyPath string) error {
+	noexec, err := isNoExec(filepath.Dir(envoyPath))
+	if err != nil {
+		log.Debug().Err(err).Str("service", "envoy").Str("path", envoyPath).Msg("envoy: failed to check for noexec mount")
+		return nil
+	}
+	if noexec {
+		return fmt.Errorf("envoy binary %s is on a filesystem mounted noexec and can't be run, "+
+			"set TMPDIR to a writable directory which allows executables for pomerium to extract envoy to", envoyPath)
+	}
+	return nil
+}
+
+// hostnameTemplate is replaced with the machine's hostname in the node id and cluster.
+const hostnameTemplate = "{hostname}"
+
+var osHostname = os.Hostname
+
+// writeFile writes data to a file and syncs it to disk. It's a variable so tests can simulate failed
+// writes.
+var writeFile = func(name string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// expandNodeTemplate replaces {hostname} in s with the machine's hostname.
+func expandNodeTemplate(s string) (string, error) {
+	if !strings.Contains(s, hostnameTemplate) {
+		return s, nil
+	}
+
+	hostname, err := osHostname()
+	if err != nil {
+		return "", fmt.Errorf("error getting hostname: %w", err)
+	}
+	return strings.ReplaceAll(s, hostnameTemplate, hostname), nil
+}
+
+// validateWritablePath checks that a file can be created at the given path.
+func validateWritablePath(p string) error {
+	if p == "" || p == os.DevNull {
+		return nil
+	}
+
+	dir := filepath.Dir(p)
+	f, err := ioutil.TempFile(dir, ".pomerium-envoy-write-check")
+	if err != nil {
+		return fmt.Errorf("directory %s for %s is not writable: %w", dir, p, err)
+	}
+	_ = f.Close()
+	_ = os.Remove(f.Name())
+	return nil
+}
+
+func readBaseID(path string) (int, bool) {
+	bs, err := ioutil.ReadFile(path)
 	if err != nil {
 		return 0, false
 	}
@@ -34,21 +192,70 @@ func readBaseID() (int, bool) {
 	return baseID, true
 }
 
-// ParseAddress parses a string address into an envoy address.
+// parseAdminAddress parses the admin address, which may also be a unix socket (unix:///path).
+func parseAdminAddress(raw string) (*envoy_config_core_v3.Address, error) {
+	if path, ok := config.EnvoyAdminUnixSocketPath(raw); ok {
+		return &envoy_config_core_v3.Address{
+			Address: &envoy_config_core_v3.Address_Pipe{
+				Pipe: &envoy_config_core_v3.Pipe{
+					Path: path,
+				},
+			},
+		}, nil
+	}
+	return ParseAddress(raw)
+}
+
+// ParseAddress parses a host:port string address into an envoy address. The error describes which part
+// of the address couldn't be parsed.
 func ParseAddress(raw string) (*envoy_config_core_v3.Address, error) {
-	if host, portstr, err := net.SplitHostPort(raw); err == nil {
-		if port, err := strconv.Atoi(portstr); err == nil {
-			return &envoy_config_core_v3.Address{
-				Address: &envoy_config_core_v3.Address_SocketAddress{
-					SocketAddress: &envoy_config_core_v3.SocketAddress{
-						Address: host,
-						PortSpecifier: &envoy_config_core_v3.SocketAddress_PortValue{
-							PortValue: uint32(port),
-						},
-					},
+	if raw == "" {
+		return nil, fmt.Errorf("address is empty, expected host:port")
+	}
+	host, portstr, err := net.SplitHostPort(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q, expected host:port: %w", raw, err)
+	}
+	port, err := strconv.ParseUint(portstr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q in address %q, expected a number between 0 and 65535", portstr, raw)
+	}
+	return &envoy_config_core_v3.Address{
+		Address: &envoy_config_core_v3.Address_SocketAddress{
+			SocketAddress: &envoy_config_core_v3.SocketAddress{
+				Address: host,
+				PortSpecifier: &envoy_config_core_v3.SocketAddress_PortValue{
+					PortValue: uint32(port),
 				},
-			}, nil
+			},
+		},
+	}, nil
+}
+
+// jsonToYAML converts JSON to block style YAML. Keys keep their order and numbers their formatting.
+func jsonToYAML(bs []byte) ([]byte, error) {
+	// JSON is YAML in flow style, so it only has to be re-styled
+	var doc yaml.Node
+	if err := yaml.Unmarshal(bs, &doc); err != nil {
+		return nil, err
+	}
+	var restyle func(n *yaml.Node)
+	restyle = func(n *yaml.Node) {
+		n.Style = 0
+		for _, c := range n.Content {
+			restyle(c)
 		}
 	}
-	return nil, fmt.Errorf("unknown address format: %s", raw)
+	restyle(&doc)
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
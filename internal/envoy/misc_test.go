@@ -0,0 +1,52 @@
+package envoy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pomerium/pomerium/internal/testutil"
+)
+
+func TestParseAddress(t *testing.T) {
+	addr, err := ParseAddress("127.0.0.1:9901")
+	require.NoError(t, err)
+	testutil.AssertProtoJSONEqual(t, `{"socketAddress": {"address": "127.0.0.1", "portValue": 9901}}`, addr)
+
+	for _, tc := range []struct {
+		raw string
+		msg string
+	}{
+		{"", "address is empty"},
+		{"127.0.0.1", "expected host:port"},
+		{"127.0.0.1:admin", `invalid port "admin"`},
+		{"127.0.0.1:99011", `invalid port "99011"`},
+	} {
+		_, err := ParseAddress(tc.raw)
+		if assert.Error(t, err, tc.raw) {
+			assert.Contains(t, err.Error(), tc.msg)
+		}
+	}
+}
+
+func Test_jsonToYAML(t *testing.T) {
+	bs, err := jsonToYAML([]byte(`{"node":{"id":"proxy","metadata":{"enabled":"true"}},` +
+		`"statsFlushInterval":"1.5s","maxHeapSizeBytes":"1073741824","listeners":[{"port":443,"ratio":0.5,"on":true}],"empty":{}}`))
+	require.NoError(t, err)
+	assert.Equal(t, `node:
+  id: proxy
+  metadata:
+    enabled: "true"
+statsFlushInterval: 1.5s
+maxHeapSizeBytes: "1073741824"
+listeners:
+  - port: 443
+    ratio: 0.5
+    on: true
+empty: {}
+`, string(bs))
+
+	_, err = jsonToYAML([]byte(`{`))
+	assert.Error(t, err)
+}
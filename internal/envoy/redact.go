@@ -0,0 +1,65 @@
+package envoy
+
+import (
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// redactConfig removes secrets from an envoy config message in place, so it can be exposed for
+// debugging. Inline data sources, which hold keys and certificates, and gRPC initial metadata, which
+// holds tokens, are replaced with a placeholder. Typed configs are unpacked so their secrets are
+// redacted too.
+func redactConfig(msg proto.Message) error {
+	return redactMessage(msg.ProtoReflect())
+}
+
+func redactMessage(m protoreflect.Message) error {
+	switch v := m.Interface().(type) {
+	case *envoy_config_core_v3.DataSource:
+		switch v.GetSpecifier().(type) {
+		case *envoy_config_core_v3.DataSource_InlineBytes, *envoy_config_core_v3.DataSource_InlineString:
+			v.Specifier = &envoy_config_core_v3.DataSource_InlineString{InlineString: redactedValue}
+		}
+		return nil
+	case *envoy_config_core_v3.GrpcService:
+		for _, hdr := range v.GetInitialMetadata() {
+			hdr.Value = redactedValue
+		}
+	case *anypb.Any:
+		inner, err := v.UnmarshalNew()
+		if err != nil {
+			return err
+		}
+		if err := redactConfig(inner); err != nil {
+			return err
+		}
+		return anypb.MarshalFrom(v, inner, proto.MarshalOptions{})
+	}
+
+	var err error
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.IsMap():
+			if fd.MapValue().Message() == nil {
+				return true
+			}
+			v.Map().Range(func(_ protoreflect.MapKey, mv protoreflect.Value) bool {
+				err = redactMessage(mv.Message())
+				return err == nil
+			})
+		case fd.IsList():
+			if fd.Message() == nil {
+				return true
+			}
+			for i := 0; i < v.List().Len() && err == nil; i++ {
+				err = redactMessage(v.List().Get(i).Message())
+			}
+		case fd.Message() != nil:
+			err = redactMessage(v.Message())
+		}
+		return err == nil
+	})
+	return err
+}
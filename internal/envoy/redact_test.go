@@ -0,0 +1,54 @@
+package envoy
+
+import (
+	"testing"
+
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_extensions_transport_sockets_tls_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	"github.com/pomerium/pomerium/internal/testutil"
+)
+
+func Test_redactConfig(t *testing.T) {
+	tlsConfig, err := anypb.New(&envoy_extensions_transport_sockets_tls_v3.UpstreamTlsContext{
+		CommonTlsContext: &envoy_extensions_transport_sockets_tls_v3.CommonTlsContext{
+			TlsCertificates: []*envoy_extensions_transport_sockets_tls_v3.TlsCertificate{{
+				CertificateChain: &envoy_config_core_v3.DataSource{
+					Specifier: &envoy_config_core_v3.DataSource_Filename{Filename: "/etc/pomerium/cert.pem"},
+				},
+				PrivateKey: &envoy_config_core_v3.DataSource{
+					Specifier: &envoy_config_core_v3.DataSource_InlineBytes{InlineBytes: []byte("PRIVATE KEY")},
+				},
+			}},
+		},
+	})
+	require.NoError(t, err)
+	grpcService := &envoy_config_core_v3.GrpcService{
+		InitialMetadata: []*envoy_config_core_v3.HeaderValue{{Key: "x-api-key", Value: "TOKEN"}},
+	}
+	transportSocket := &envoy_config_core_v3.TransportSocket{
+		Name:       "tls",
+		ConfigType: &envoy_config_core_v3.TransportSocket_TypedConfig{TypedConfig: tlsConfig},
+	}
+
+	require.NoError(t, redactConfig(grpcService))
+	testutil.AssertProtoJSONEqual(t, `{
+		"initialMetadata": [{ "key": "x-api-key", "value": "***" }]
+	}`, grpcService)
+
+	require.NoError(t, redactConfig(transportSocket))
+	testutil.AssertProtoJSONEqual(t, `{
+		"name": "tls",
+		"typedConfig": {
+			"@type": "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.UpstreamTlsContext",
+			"commonTlsContext": {
+				"tlsCertificates": [{
+					"certificateChain": { "filename": "/etc/pomerium/cert.pem" },
+					"privateKey": { "inlineString": "***" }
+				}]
+			}
+		}
+	}`, transportSocket)
+}
@@ -0,0 +1,184 @@
+package envoy
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	envoy_config_bootstrap_v3 "github.com/envoyproxy/go-control-plane/envoy/config/bootstrap/v3"
+	envoy_extensions_filters_network_tcp_proxy_v3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/tcp_proxy/v3"
+
+	"github.com/pomerium/pomerium/internal/log"
+)
+
+// minimumEnvoyVersion is the oldest envoy version the generated configuration is known to work with.
+var minimumEnvoyVersion = envoyVersion{1, 17, 0}
+
+const versionCommandTimeout = 10 * time.Second
+
+// envoyVersionRE matches the output of envoy --version, for example:
+//
+//	envoy  version: d362e791eb9e4efa8d87f6d878740e72dc8330ac/1.17.1/clean-getenvoy-76c310e-envoy/RELEASE/BoringSSL
+//
+// Development builds have a suffix on the release version, such as 1.18.0-dev, which is ignored.
+var envoyVersionRE = regexp.MustCompile(`version:\s*(\S*/(\d+)\.(\d+)\.(\d+)\S*)`)
+
+// An envoyVersion is an envoy release version.
+type envoyVersion struct {
+	major, minor, patch int
+}
+
+func (v envoyVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.major, v.minor, v.patch)
+}
+
+func (v envoyVersion) less(other envoyVersion) bool {
+	if v.major != other.major {
+		return v.major < other.major
+	}
+	if v.minor != other.minor {
+		return v.minor < other.minor
+	}
+	return v.patch < other.patch
+}
+
+// parseEnvoyVersion parses the output of envoy --version. It returns the full version string, which
+// includes the commit and build type, and the release version.
+func parseEnvoyVersion(out string) (string, envoyVersion, error) {
+	m := envoyVersionRE.FindStringSubmatch(out)
+	if m == nil {
+		return "", envoyVersion{}, fmt.Errorf("unrecognized envoy version: %s", strings.TrimSpace(out))
+	}
+
+	var parts [3]int
+	for i := range parts {
+		n, err := strconv.Atoi(m[i+2])
+		if err != nil {
+			return "", envoyVersion{}, fmt.Errorf("unrecognized envoy version: %s", m[1])
+		}
+		parts[i] = n
+	}
+	return m[1], envoyVersion{parts[0], parts[1], parts[2]}, nil
+}
+
+// readEnvoyVersion runs envoy --version and parses its output.
+func readEnvoyVersion(ctx context.Context, envoyPath string) (string, envoyVersion, error) {
+	ctx, cancel := context.WithTimeout(ctx, versionCommandTimeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, envoyPath, "--version").CombinedOutput() // #nosec
+	if err != nil {
+		return "", envoyVersion{}, fmt.Errorf("error running envoy --version: %w", err)
+	}
+	return parseEnvoyVersion(string(out))
+}
+
+// checkEnvoyVersion returns an error if the envoy version is older than the minimum supported version.
+// If unsupported versions are allowed a warning is logged instead.
+func checkEnvoyVersion(version string, v envoyVersion, allowUnsupported bool) error {
+	if !v.less(minimumEnvoyVersion) {
+		log.Debug().Str("service", "envoy").Str("version", version).Msg("envoy: detected envoy version")
+		return nil
+	}
+
+	if !allowUnsupported {
+		return fmt.Errorf("envoy version %s is not supported, the minimum supported version is %s", v, minimumEnvoyVersion)
+	}
+	log.Warn().
+		Str("service", "envoy").
+		Str("version", version).
+		Str("minimum_version", minimumEnvoyVersion.String()).
+		Msg("envoy: envoy version is older than the minimum supported version")
+	return nil
+}
+
+// A bootstrapFeature is a feature of the generated bootstrap config which older envoy versions don't
+// support.
+type bootstrapFeature struct {
+	name           string
+	minimumVersion envoyVersion
+	used           func(*envoy_config_bootstrap_v3.Bootstrap) bool
+}
+
+// bootstrapFeatures are the known bootstrap features envoy versions may not support, with the envoy
+// version which introduced them. They're only checked for versions older than the minimum supported
+// version, which may be allowed with envoy_allow_unsupported_version.
+var bootstrapFeatures = []bootstrapFeature{
+	{
+		name:           "stats histogram bucket settings",
+		minimumVersion: envoyVersion{1, 17, 0},
+		used: func(bcfg *envoy_config_bootstrap_v3.Bootstrap) bool {
+			return len(bcfg.GetStatsConfig().GetHistogramBucketSettings()) > 0
+		},
+	},
+	{
+		name:           "tcp proxy tunneling over HTTP/1.1",
+		minimumVersion: envoyVersion{1, 17, 0},
+		used:           usesTCPProxyTunneling,
+	},
+}
+
+// usesTCPProxyTunneling returns true if a static listener has a tcp proxy filter which tunnels its
+// connections over HTTP CONNECT.
+func usesTCPProxyTunneling(bcfg *envoy_config_bootstrap_v3.Bootstrap) bool {
+	for _, li := range bcfg.GetStaticResources().GetListeners() {
+		for _, chain := range li.GetFilterChains() {
+			for _, filter := range chain.GetFilters() {
+				tcpProxy := new(envoy_extensions_filters_network_tcp_proxy_v3.TcpProxy)
+				if filter.GetTypedConfig().UnmarshalTo(tcpProxy) != nil {
+					continue
+				}
+				if tcpProxy.GetTunnelingConfig() != nil {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// unsupportedBootstrapFeatures returns the names of the features used by the bootstrap config which
+// the envoy version doesn't support.
+func unsupportedBootstrapFeatures(bcfg *envoy_config_bootstrap_v3.Bootstrap, v envoyVersion) []string {
+	var names []string
+	for _, feature := range bootstrapFeatures {
+		if v.less(feature.minimumVersion) && feature.used(bcfg) {
+			names = append(names, fmt.Sprintf("%s (requires %s)", feature.name, feature.minimumVersion))
+		}
+	}
+	return names
+}
+
+// checkBootstrapCompatibility logs a warning if the bootstrap config uses features the running envoy
+// version doesn't support, or returns an error in strict mode. Only versions older than the minimum
+// supported version are checked, every feature is supported by newer ones, and nothing is checked if
+// the envoy version couldn't be determined.
+func (srv *Server) checkBootstrapCompatibility(bcfg *envoy_config_bootstrap_v3.Bootstrap) error {
+	if srv.releaseVersion == (envoyVersion{}) || !srv.releaseVersion.less(minimumEnvoyVersion) {
+		return nil
+	}
+
+	features := unsupportedBootstrapFeatures(bcfg, srv.releaseVersion)
+	if len(features) == 0 {
+		return nil
+	}
+
+	if srv.options.strictCompatibility {
+		return fmt.Errorf("envoy version %s does not support %s", srv.releaseVersion, strings.Join(features, ", "))
+	}
+	log.Warn().
+		Str("service", "envoy").
+		Str("version", srv.version).
+		Strs("features", features).
+		Msg("envoy: the bootstrap config uses features the envoy version does not support")
+	return nil
+}
+
+// Version returns the version reported by envoy --version, or an empty string if it couldn't be determined.
+func (srv *Server) Version() string {
+	return srv.version
+}
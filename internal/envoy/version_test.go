@@ -0,0 +1,102 @@
+package envoy
+
+import (
+	"context"
+	"runtime"
+	"testing"
+
+	envoy_config_bootstrap_v3 "github.com/envoyproxy/go-control-plane/envoy/config/bootstrap/v3"
+	envoy_config_core_v3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	envoy_config_listener_v3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	envoy_config_metrics_v3 "github.com/envoyproxy/go-control-plane/envoy/config/metrics/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseEnvoyVersion(t *testing.T) {
+	version, v, err := parseEnvoyVersion("\nenvoy  version: d362e791eb9e4efa8d87f6d878740e72dc8330ac/1.17.1/clean-getenvoy-76c310e-envoy/RELEASE/BoringSSL\n\n")
+	require.NoError(t, err)
+	assert.Equal(t, "d362e791eb9e4efa8d87f6d878740e72dc8330ac/1.17.1/clean-getenvoy-76c310e-envoy/RELEASE/BoringSSL", version)
+	assert.Equal(t, envoyVersion{1, 17, 1}, v)
+	assert.False(t, v.less(minimumEnvoyVersion))
+	assert.True(t, envoyVersion{1, 16, 3}.less(minimumEnvoyVersion))
+
+	t.Run("development build", func(t *testing.T) {
+		version, v, err := parseEnvoyVersion("envoy  version: 0/1.18.0-dev/Modified/DEBUG/BoringSSL")
+		require.NoError(t, err)
+		assert.Equal(t, "0/1.18.0-dev/Modified/DEBUG/BoringSSL", version)
+		assert.Equal(t, envoyVersion{1, 18, 0}, v)
+	})
+	t.Run("custom build", func(t *testing.T) {
+		_, _, err := parseEnvoyVersion("envoy  version: custom/main/RELEASE")
+		assert.Error(t, err)
+	})
+	t.Run("not envoy", func(t *testing.T) {
+		_, _, err := parseEnvoyVersion("envoy: command not found")
+		assert.Error(t, err)
+	})
+}
+
+func Test_checkEnvoyVersion(t *testing.T) {
+	assert.NoError(t, checkEnvoyVersion("abc/1.17.0/Clean/RELEASE/BoringSSL", envoyVersion{1, 17, 0}, false))
+	assert.NoError(t, checkEnvoyVersion("abc/2.0.0/Clean/RELEASE/BoringSSL", envoyVersion{2, 0, 0}, false))
+	assert.Error(t, checkEnvoyVersion("abc/1.14.4/Clean/RELEASE/BoringSSL", envoyVersion{1, 14, 4}, false))
+	assert.NoError(t, checkEnvoyVersion("abc/1.14.4/Clean/RELEASE/BoringSSL", envoyVersion{1, 14, 4}, true))
+}
+
+func TestServer_checkBootstrapCompatibility(t *testing.T) {
+	bcfg := &envoy_config_bootstrap_v3.Bootstrap{
+		StatsConfig: &envoy_config_metrics_v3.StatsConfig{
+			HistogramBucketSettings: []*envoy_config_metrics_v3.HistogramBucketSettings{{Buckets: []float64{1, 10}}},
+		},
+	}
+	assert.Empty(t, unsupportedBootstrapFeatures(bcfg, envoyVersion{1, 17, 0}))
+	assert.Equal(t, []string{"stats histogram bucket settings (requires 1.17.0)"},
+		unsupportedBootstrapFeatures(bcfg, envoyVersion{1, 16, 2}))
+
+	srv := &Server{version: "abc/1.16.2/Clean/RELEASE/BoringSSL", releaseVersion: envoyVersion{1, 16, 2}}
+	assert.NoError(t, srv.checkBootstrapCompatibility(bcfg), "incompatibilities should only be logged")
+	srv.options.strictCompatibility = true
+	assert.Error(t, srv.checkBootstrapCompatibility(bcfg))
+	assert.NoError(t, srv.checkBootstrapCompatibility(&envoy_config_bootstrap_v3.Bootstrap{}))
+
+	// supported versions and custom builds aren't checked
+	srv.releaseVersion = minimumEnvoyVersion
+	assert.NoError(t, srv.checkBootstrapCompatibility(bcfg))
+	srv.releaseVersion = envoyVersion{}
+	assert.NoError(t, srv.checkBootstrapCompatibility(bcfg))
+}
+
+func Test_usesTCPProxyTunneling(t *testing.T) {
+	srv := &Server{wd: t.TempDir(), options: serverOptions{tracingProxyAddress: "proxy.example.com:3128"}}
+	listener, _, err := srv.buildTracingProxy(&envoy_config_core_v3.SocketAddress{
+		Address:       "datadog-agent",
+		PortSpecifier: &envoy_config_core_v3.SocketAddress_PortValue{PortValue: 8126},
+	})
+	require.NoError(t, err)
+	assert.True(t, usesTCPProxyTunneling(&envoy_config_bootstrap_v3.Bootstrap{
+		StaticResources: &envoy_config_bootstrap_v3.Bootstrap_StaticResources{
+			Listeners: []*envoy_config_listener_v3.Listener{listener},
+		},
+	}))
+
+	// the listener name alone isn't the feature
+	assert.False(t, usesTCPProxyTunneling(&envoy_config_bootstrap_v3.Bootstrap{
+		StaticResources: &envoy_config_bootstrap_v3.Bootstrap_StaticResources{
+			Listeners: []*envoy_config_listener_v3.Listener{{Name: tracingProxyListenerName}},
+		},
+	}))
+}
+
+func Test_readEnvoyVersion(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test requires a posix shell")
+	}
+
+	dir := t.TempDir()
+	envoyPath := writeFakeEnvoy(t, dir, `echo "envoy  version: abc123/1.18.2/Clean/RELEASE/BoringSSL"`)
+	version, v, err := readEnvoyVersion(context.Background(), envoyPath)
+	require.NoError(t, err)
+	assert.Equal(t, "abc123/1.18.2/Clean/RELEASE/BoringSSL", version)
+	assert.Equal(t, "1.18.2", v.String())
+}
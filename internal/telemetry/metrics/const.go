@@ -18,6 +18,8 @@ var (
 	TagKeyStorageOperation = tag.MustNewKey("operation")
 	TagKeyStorageResult    = tag.MustNewKey("result")
 	TagKeyStorageBackend   = tag.MustNewKey("backend")
+
+	TagKeyLogLevel = tag.MustNewKey("level")
 )
 
 // Default distributions used by views in this package.
@@ -38,6 +40,7 @@ var (
 // DefaultViews are a set of default views to view HTTP and GRPC metrics.
 var (
 	DefaultViews = [][]*view.View{
+		EnvoyViews,
 		GRPCClientViews,
 		GRPCServerViews,
 		HTTPClientViews,
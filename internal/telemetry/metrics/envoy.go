@@ -0,0 +1,168 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+
+	"github.com/pomerium/pomerium/internal/log"
+	"github.com/pomerium/pomerium/pkg/metrics"
+)
+
+var (
+	// EnvoyViews contains opencensus views for metrics about the envoy process managed by pomerium.
+	EnvoyViews = []*view.View{
+		EnvoyDroppedLogsView,
+		EnvoyLogReadsDelayedView,
+		EnvoyLogLinesView,
+		EnvoyUnchangedReloadsView,
+		EnvoyMemoryAllocatedView,
+		EnvoyMemoryHeapSizeView,
+		EnvoyMemoryTotalThreadCacheView,
+	}
+
+	envoyDroppedLogs = stats.Int64(
+		metrics.EnvoyDroppedLogsTotal,
+		"Total number of envoy log lines dropped because the log queue was full",
+		"1")
+
+	// EnvoyDroppedLogsView contains the number of envoy log lines which were dropped.
+	EnvoyDroppedLogsView = &view.View{
+		Name:        envoyDroppedLogs.Name(),
+		Description: envoyDroppedLogs.Description(),
+		Measure:     envoyDroppedLogs,
+		Aggregation: view.Sum(),
+	}
+
+	envoyLogReadsDelayed = stats.Int64(
+		metrics.EnvoyLogReadsDelayedTotal,
+		"Total number of envoy log lines whose writing held up reading envoy's output",
+		"1")
+
+	// EnvoyLogReadsDelayedView contains the number of envoy log lines whose writing held up reading
+	// envoy's output.
+	EnvoyLogReadsDelayedView = &view.View{
+		Name:        envoyLogReadsDelayed.Name(),
+		Description: envoyLogReadsDelayed.Description(),
+		Measure:     envoyLogReadsDelayed,
+		Aggregation: view.Sum(),
+	}
+
+	envoyLogLines = stats.Int64(
+		metrics.EnvoyLogLinesTotal,
+		"Total number of envoy log lines written, by level",
+		"1")
+
+	// EnvoyLogLinesView contains the number of envoy log lines written, tagged with their level.
+	EnvoyLogLinesView = &view.View{
+		Name:        envoyLogLines.Name(),
+		Description: envoyLogLines.Description(),
+		TagKeys:     []tag.Key{TagKeyLogLevel},
+		Measure:     envoyLogLines,
+		Aggregation: view.Sum(),
+	}
+
+	envoyUnchangedReloads = stats.Int64(
+		metrics.EnvoyUnchangedReloadsTotal,
+		"Total number of envoy config reloads which had no changes to apply",
+		"1")
+
+	// EnvoyUnchangedReloadsView contains the number of envoy config reloads which had no changes to apply.
+	EnvoyUnchangedReloadsView = &view.View{
+		Name:        envoyUnchangedReloads.Name(),
+		Description: envoyUnchangedReloads.Description(),
+		Measure:     envoyUnchangedReloads,
+		Aggregation: view.Sum(),
+	}
+
+	envoyMemoryAllocated = stats.Int64(
+		metrics.EnvoyMemoryAllocatedBytes,
+		"Memory allocated by envoy",
+		stats.UnitBytes)
+
+	// EnvoyMemoryAllocatedView contains the memory allocated by envoy, labeled by service.
+	EnvoyMemoryAllocatedView = &view.View{
+		Name:        envoyMemoryAllocated.Name(),
+		Description: envoyMemoryAllocated.Description(),
+		Measure:     envoyMemoryAllocated,
+		TagKeys:     []tag.Key{TagKeyService},
+		Aggregation: view.LastValue(),
+	}
+
+	envoyMemoryHeapSize = stats.Int64(
+		metrics.EnvoyMemoryHeapSizeBytes,
+		"Size of envoy's heap",
+		stats.UnitBytes)
+
+	// EnvoyMemoryHeapSizeView contains the size of envoy's heap, labeled by service.
+	EnvoyMemoryHeapSizeView = &view.View{
+		Name:        envoyMemoryHeapSize.Name(),
+		Description: envoyMemoryHeapSize.Description(),
+		Measure:     envoyMemoryHeapSize,
+		TagKeys:     []tag.Key{TagKeyService},
+		Aggregation: view.LastValue(),
+	}
+
+	envoyMemoryTotalThreadCache = stats.Int64(
+		metrics.EnvoyMemoryTotalThreadCacheBytes,
+		"Size of envoy's thread caches",
+		stats.UnitBytes)
+
+	// EnvoyMemoryTotalThreadCacheView contains the size of envoy's thread caches, labeled by service.
+	EnvoyMemoryTotalThreadCacheView = &view.View{
+		Name:        envoyMemoryTotalThreadCache.Name(),
+		Description: envoyMemoryTotalThreadCache.Description(),
+		Measure:     envoyMemoryTotalThreadCache,
+		TagKeys:     []tag.Key{TagKeyService},
+		Aggregation: view.LastValue(),
+	}
+
+	// envoyLogLevelContexts caches a context tagged with each log level, so recording a log line
+	// doesn't allocate
+	envoyLogLevelContexts sync.Map
+)
+
+// RecordEnvoyDroppedLogs records that envoy log lines were dropped.
+func RecordEnvoyDroppedLogs(n int64) {
+	stats.Record(context.Background(), envoyDroppedLogs.M(n))
+}
+
+// RecordEnvoyLogReadDelayed records that writing envoy log lines held up reading envoy's output.
+func RecordEnvoyLogReadDelayed(n int64) {
+	stats.Record(context.Background(), envoyLogReadsDelayed.M(n))
+}
+
+// RecordEnvoyUnchangedReload records that an envoy config reload had no changes to apply.
+func RecordEnvoyUnchangedReload() {
+	stats.Record(context.Background(), envoyUnchangedReloads.M(1))
+}
+
+// RecordEnvoyMemory records envoy's memory usage, as reported by its admin interface.
+func RecordEnvoyMemory(service string, allocated, heapSize, totalThreadCache int64) {
+	err := stats.RecordWithTags(context.Background(),
+		[]tag.Mutator{tag.Upsert(TagKeyService, service)},
+		envoyMemoryAllocated.M(allocated),
+		envoyMemoryHeapSize.M(heapSize),
+		envoyMemoryTotalThreadCache.M(totalThreadCache),
+	)
+	if err != nil {
+		log.Warn().Err(err).Msg("internal/telemetry/metrics: failed to record")
+	}
+}
+
+// RecordEnvoyLogLine records that an envoy log line with the given level was written.
+func RecordEnvoyLogLine(level string) {
+	ctx, ok := envoyLogLevelContexts.Load(level)
+	if !ok {
+		tagged, err := tag.New(context.Background(), tag.Upsert(TagKeyLogLevel, level))
+		if err != nil {
+			log.Warn().Err(err).Msg("internal/telemetry/metrics: failed to record")
+			return
+		}
+		ctx, _ = envoyLogLevelContexts.LoadOrStore(level, tagged)
+	}
+	stats.Record(ctx.(context.Context), envoyLogLines.M(1))
+}
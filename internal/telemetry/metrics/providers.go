@@ -1,6 +1,7 @@
 package metrics
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -12,24 +13,38 @@ import (
 	"go.opencensus.io/stats/view"
 
 	log "github.com/pomerium/pomerium/internal/log"
+	"github.com/pomerium/pomerium/internal/tripper"
 )
 
 // PrometheusHandler creates an exporter that exports stats to Prometheus
-// and returns a handler suitable for exporting metrics.
-func PrometheusHandler(envoyURL *url.URL) (http.Handler, error) {
+// and returns a handler suitable for exporting metrics. If envoyURL is nil
+// envoy metrics are not included. An envoyURL with a unix scheme connects
+// to envoy over the unix socket at its path. If envoyPrefix is set it's
+// prepended to the names of envoy metrics.
+func PrometheusHandler(envoyURL *url.URL, envoyPrefix string) (http.Handler, error) {
 	exporter, err := getGlobalExporter()
 	if err != nil {
 		return nil, err
 	}
 
 	mux := http.NewServeMux()
+	if envoyURL == nil {
+		mux.Handle("/metrics", exporter)
+		return mux, nil
+	}
+
+	client := http.DefaultClient
+	if envoyURL.Scheme == "unix" {
+		client = &http.Client{Transport: tripper.NewUnixSocketTransport(envoyURL.Path)}
+		envoyURL = &url.URL{Scheme: "http", Host: "envoy"}
+	}
 
 	envoyMetricsURL, err := envoyURL.Parse("/stats/prometheus")
 	if err != nil {
 		return nil, fmt.Errorf("telemetry/metrics: invalid proxy URL: %w", err)
 	}
 
-	mux.Handle("/metrics", newProxyMetricsHandler(exporter, *envoyMetricsURL))
+	mux.Handle("/metrics", newProxyMetricsHandler(exporter, client, *envoyMetricsURL, envoyPrefix))
 	return mux, nil
 }
 
@@ -73,7 +88,7 @@ func registerDefaultViews() error {
 
 // newProxyMetricsHandler creates a subrequest to the envoy control plane for metrics and
 // combines them with our own
-func newProxyMetricsHandler(promHandler http.Handler, envoyURL url.URL) http.HandlerFunc {
+func newProxyMetricsHandler(promHandler http.Handler, client *http.Client, envoyURL url.URL, envoyPrefix string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer promHandler.ServeHTTP(w, r)
 
@@ -86,7 +101,7 @@ func newProxyMetricsHandler(promHandler http.Handler, envoyURL url.URL) http.Han
 			return
 		}
 
-		resp, err := http.DefaultClient.Do(r)
+		resp, err := client.Do(r)
 		if err != nil {
 			log.Error().Err(err).Msg("telemetry/metrics: fail to fetch proxy metrics")
 			return
@@ -99,6 +114,31 @@ func newProxyMetricsHandler(promHandler http.Handler, envoyURL url.URL) http.Han
 			return
 		}
 
+		if envoyPrefix != "" {
+			envoyBody = prefixMetricNames(envoyBody, envoyPrefix)
+		}
 		w.Write(envoyBody)
 	}
 }
+
+// prefixMetricNames prepends prefix to the metric names in prometheus text exposition format. The
+// labels, including the ones from envoy stats tags, are left as-is.
+func prefixMetricNames(body []byte, prefix string) []byte {
+	prefix += "_"
+	var buf bytes.Buffer
+	buf.Grow(len(body))
+	for _, line := range bytes.SplitAfter(body, []byte("\n")) {
+		switch {
+		case bytes.HasPrefix(line, []byte("# HELP ")), bytes.HasPrefix(line, []byte("# TYPE ")):
+			buf.Write(line[:7])
+			buf.WriteString(prefix)
+			buf.Write(line[7:])
+		case len(bytes.TrimSpace(line)) == 0, line[0] == '#':
+			buf.Write(line)
+		default:
+			buf.WriteString(prefix)
+			buf.Write(line)
+		}
+	}
+	return buf.Bytes()
+}
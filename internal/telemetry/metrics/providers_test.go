@@ -2,9 +2,11 @@ package metrics
 
 import (
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"path/filepath"
 	"regexp"
 	"testing"
 )
@@ -28,7 +30,11 @@ envoy_server_initialization_time_ms_bucket{le="1000"} 1
 }
 
 func getMetrics(t *testing.T, envoyURL *url.URL) []byte {
-	h, err := PrometheusHandler(envoyURL)
+	return getMetricsWithPrefix(t, envoyURL, "")
+}
+
+func getMetricsWithPrefix(t *testing.T, envoyURL *url.URL, envoyPrefix string) []byte {
+	h, err := PrometheusHandler(envoyURL, envoyPrefix)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -54,6 +60,14 @@ func Test_PrometheusHandler(t *testing.T) {
 		}
 	})
 
+	t.Run("envoy disabled", func(t *testing.T) {
+		b := getMetrics(t, nil)
+
+		if m, _ := regexp.Match(`(?m)^go_.*`, b); !m {
+			t.Errorf("Metrics endpoint did not contain internal metrics: %s", b)
+		}
+	})
+
 	t.Run("with envoy", func(t *testing.T) {
 		fakeEnvoyMetricsServer := httptest.NewServer(newEnvoyMetricsHandler())
 		envoyURL, _ := url.Parse(fakeEnvoyMetricsServer.URL)
@@ -66,4 +80,39 @@ func Test_PrometheusHandler(t *testing.T) {
 			t.Errorf("Metrics endpoint did not contain envoy metrics: %s", b)
 		}
 	})
+
+	t.Run("with envoy prefix", func(t *testing.T) {
+		fakeEnvoyMetricsServer := httptest.NewServer(newEnvoyMetricsHandler())
+		defer fakeEnvoyMetricsServer.Close()
+		envoyURL, _ := url.Parse(fakeEnvoyMetricsServer.URL)
+		b := getMetricsWithPrefix(t, envoyURL, "edge")
+
+		if m, _ := regexp.Match(`(?m)^# TYPE edge_envoy_server_initialization_time_ms histogram$`, b); !m {
+			t.Errorf("Metrics endpoint did not contain prefixed envoy metric types: %s", b)
+		}
+		if m, _ := regexp.Match(`(?m)^edge_envoy_server_initialization_time_ms_bucket\{le="0.5"\} 0$`, b); !m {
+			t.Errorf("Metrics endpoint did not contain prefixed envoy metrics: %s", b)
+		}
+		if m, _ := regexp.Match(`(?m)^envoy_.*`, b); m {
+			t.Errorf("Metrics endpoint contained unprefixed envoy metrics: %s", b)
+		}
+	})
+
+	t.Run("with envoy over unix socket", func(t *testing.T) {
+		sock := filepath.Join(t.TempDir(), "envoy-admin.sock")
+		li, err := net.Listen("unix", sock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fakeEnvoyMetricsServer := httptest.NewUnstartedServer(newEnvoyMetricsHandler())
+		fakeEnvoyMetricsServer.Listener = li
+		fakeEnvoyMetricsServer.Start()
+		defer fakeEnvoyMetricsServer.Close()
+
+		b := getMetrics(t, &url.URL{Scheme: "unix", Path: sock})
+
+		if m, _ := regexp.Match(`(?m)^# TYPE envoy_.*`, b); !m {
+			t.Errorf("Metrics endpoint did not contain envoy metrics: %s", b)
+		}
+	})
 }
@@ -20,6 +20,10 @@ const (
 	DatadogTracingProviderName = "datadog"
 	// JaegerTracingProviderName is the name of the tracing provider Jaeger.
 	JaegerTracingProviderName = "jaeger"
+	// LightstepTracingProviderName is the name of the tracing provider Lightstep.
+	LightstepTracingProviderName = "lightstep"
+	// XRayTracingProviderName is the name of the tracing provider AWS X-Ray.
+	XRayTracingProviderName = "xray"
 	// ZipkinTracingProviderName is the name of the tracing provider Zipkin.
 	ZipkinTracingProviderName = "zipkin"
 )
@@ -49,6 +53,20 @@ type TracingOptions struct {
 	// Example: http://zipkin:9411/api/v2/spans
 	ZipkinEndpoint *url.URL
 
+	// Lightstep
+
+	// LightstepCollectorURL is the url of the Lightstep collector.
+	// For example, https://ingest.lightstep.com:443
+	LightstepCollectorURL *url.URL
+
+	// X-Ray
+
+	// XRayDaemonAddress is the host:port of the X-Ray daemon's UDP endpoint.
+	// For example, 127.0.0.1:2000
+	XRayDaemonAddress string
+	// XRaySegmentName is the name of the X-Ray segment.
+	XRaySegmentName string
+
 	// SampleRate is percentage of requests which are sampled
 	SampleRate float64
 }
@@ -67,6 +85,10 @@ func RegisterTracing(opts *TracingOptions) (trace.Exporter, error) {
 		exporter, err = registerDatadog(opts)
 	case JaegerTracingProviderName:
 		exporter, err = registerJaeger(opts)
+	case LightstepTracingProviderName, XRayTracingProviderName:
+		// these spans are only exported by envoy
+		log.Warn().Msgf("telemetry/trace: %s tracing is only supported by the proxy", opts.Provider)
+		return nil, nil
 	case ZipkinTracingProviderName:
 		exporter, err = registerZipkin(opts)
 	default:
@@ -0,0 +1,19 @@
+package tripper
+
+import (
+	"context"
+	"net"
+	"net/http"
+)
+
+// NewUnixSocketTransport returns a transport which sends every request to the unix socket at path,
+// whatever the request's host. Proxies aren't used.
+func NewUnixSocketTransport(path string) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", path)
+	}
+	return transport
+}
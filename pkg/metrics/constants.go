@@ -14,6 +14,20 @@ const (
 	BuildInfo = "build_info"
 	// PolicyCountTotal is total amount of routes currently configured
 	PolicyCountTotal = "policy_count_total"
+	// EnvoyDroppedLogsTotal is the number of envoy log lines dropped because the log queue was full
+	EnvoyDroppedLogsTotal = "envoy_dropped_logs_total"
+	// EnvoyLogReadsDelayedTotal is the number of envoy log lines whose writing held up reading envoy's output
+	EnvoyLogReadsDelayedTotal = "envoy_log_reads_delayed_total"
+	// EnvoyLogLinesTotal is the number of envoy log lines written, by level
+	EnvoyLogLinesTotal = "envoy_log_lines_total"
+	// EnvoyUnchangedReloadsTotal is the number of envoy config reloads which had no changes to apply
+	EnvoyUnchangedReloadsTotal = "envoy_unchanged_reloads_total"
+	// EnvoyMemoryAllocatedBytes is the memory allocated by envoy, as reported by its admin interface
+	EnvoyMemoryAllocatedBytes = "envoy_memory_allocated_bytes"
+	// EnvoyMemoryHeapSizeBytes is the size of envoy's heap, as reported by its admin interface
+	EnvoyMemoryHeapSizeBytes = "envoy_memory_heap_size_bytes"
+	// EnvoyMemoryTotalThreadCacheBytes is the size of envoy's thread caches, as reported by its admin interface
+	EnvoyMemoryTotalThreadCacheBytes = "envoy_memory_total_thread_cache_bytes"
 	// ConfigChecksumDecimal should only be used to compare config on a single node, it will be different in multi-node environment
 	ConfigChecksumDecimal = "config_checksum_decimal"
 )
@@ -4,9 +4,31 @@ set -euo pipefail
 BINARY=$1
 DIR=$(dirname "${BINARY}")
 
+# ENVOY_COMPRESSION may be set to gzip or zstd to compress the embedded envoy binary.
+# The compression is detected and the binary decompressed when it is extracted at startup.
+ENVOY_COMPRESSION=${ENVOY_COMPRESSION:-}
+
 (
   cd "$DIR"
-  zip envoy.zip envoy
+  DIR=$(pwd)
+  case "$ENVOY_COMPRESSION" in
+  gzip)
+    mkdir -p compressed
+    gzip -9 -c envoy >compressed/envoy
+    cd compressed
+    ;;
+  zstd)
+    mkdir -p compressed
+    zstd -19 -q -f -o compressed/envoy envoy
+    cd compressed
+    ;;
+  "") ;;
+  *)
+    echo "unknown ENVOY_COMPRESSION: $ENVOY_COMPRESSION" >&2
+    exit 1
+    ;;
+  esac
+  zip "$DIR/envoy.zip" envoy
 )
 
 echo "appending $DIR/envoy.zip to ${BINARY}"